@@ -0,0 +1,195 @@
+// Package admission 控制modbus和nb的Server接受哪些连接
+package admission
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 地址不在Allow中或者在Deny中
+	Denied = errors.New("address denied")
+	// 连接总数已达到MaxConns
+	TooManyConns = errors.New("too many connections")
+	// 同一IP的连接数已达到MaxConnsPerIP
+	TooManyConnsPerIP = errors.New("too many connections from same ip")
+	// 接受新连接的速率超过AcceptRate
+	RateLimited = errors.New("accept rate limited")
+)
+
+// Policy 连接的准入策略，字段需要在使用之前设置，之后不能修改
+type Policy struct {
+	// 允许的网段，如"10.0.0.0/8"，也可以是单个IP，为空时允许所有地址
+	Allow []string
+	// 拒绝的网段，优先于Allow
+	Deny []string
+
+	// 最大连接总数，为0时不限制
+	MaxConns int
+	// 每个IP的最大连接数，为0时不限制
+	MaxConnsPerIP int
+
+	// 每秒允许接受的新连接数量，为0时不限制
+	AcceptRate float64
+	// 允许突发接受的新连接数量，默认为1
+	AcceptBurst int
+
+	// 新连接必须在此时间内完成注册（调用SetID），否则会被关闭，为0时不限制
+	RegisterTimeout time.Duration
+
+	once     sync.Once
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	parseErr error
+
+	mu     sync.Mutex
+	total  int
+	perIP  map[string]int
+	tokens float64
+	last   time.Time
+}
+
+// Validate 检查Allow和Deny的格式
+func (p *Policy) Validate() error {
+	p.once.Do(p.parse)
+	return p.parseErr
+}
+
+// Admit 判断是否接受来自remote的连接，接受时返回的release必须在连接关闭时调用
+func (p *Policy) Admit(remote net.Addr) (release func(), err error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	host := hostOf(remote)
+	ip := net.ParseIP(host)
+	if !p.allowed(ip) {
+		return nil, Denied
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxConns > 0 && p.total >= p.MaxConns {
+		return nil, TooManyConns
+	}
+	if p.MaxConnsPerIP > 0 && p.perIP[host] >= p.MaxConnsPerIP {
+		return nil, TooManyConnsPerIP
+	}
+	if !p.take(time.Now()) {
+		return nil, RateLimited
+	}
+	if p.perIP == nil {
+		p.perIP = make(map[string]int)
+	}
+	p.total++
+	p.perIP[host]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			p.total--
+			if p.perIP[host]--; p.perIP[host] <= 0 {
+				delete(p.perIP, host)
+			}
+			p.mu.Unlock()
+		})
+	}, nil
+}
+
+// Conns 获取当前的连接总数以及来自ip的连接数
+func (p *Policy) Conns(ip string) (total, perIP int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total, p.perIP[ip]
+}
+
+func (p *Policy) allowed(ip net.IP) bool {
+	if ip == nil {
+		// UDP会话、平台推送等没有IP的地址只受数量限制
+		return len(p.allow) == 0
+	}
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 以令牌桶限制接受新连接的速率，调用方需持有锁
+func (p *Policy) take(now time.Time) bool {
+	if p.AcceptRate <= 0 {
+		return true
+	}
+	burst := float64(p.AcceptBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	if p.last.IsZero() {
+		p.tokens = burst
+	} else {
+		p.tokens += now.Sub(p.last).Seconds() * p.AcceptRate
+		if p.tokens > burst {
+			p.tokens = burst
+		}
+	}
+	p.last = now
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+func (p *Policy) parse() {
+	if p.allow, p.parseErr = parseNets(p.Allow); p.parseErr != nil {
+		return
+	}
+	p.deny, p.parseErr = parseNets(p.Deny)
+}
+
+func parseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			s = fmt.Sprintf("%v/%v", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,75 @@
+package admission
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func addr(s string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", s)
+	return a
+}
+
+func TestPolicy_Admit(t *testing.T) {
+	p := &Policy{
+		Allow:         []string{"10.0.0.0/8", "192.168.1.10"},
+		Deny:          []string{"10.0.1.0/24"},
+		MaxConns:      3,
+		MaxConnsPerIP: 2,
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr string
+		err  error
+	}{
+		{"10.0.0.1:1000", nil},
+		{"10.0.0.1:1001", nil},
+		{"10.0.0.1:1002", TooManyConnsPerIP},
+		{"10.0.1.1:1000", Denied},
+		{"172.16.0.1:1000", Denied},
+		{"192.168.1.10:1000", nil},
+		{"10.0.0.2:1000", TooManyConns},
+	} {
+		if _, err := p.Admit(addr(c.addr)); err != c.err {
+			t.Fatalf("Admit(%v) = %v, want %v", c.addr, err, c.err)
+		}
+	}
+
+	p = &Policy{MaxConnsPerIP: 1}
+	release, err := p.Admit(addr("10.0.0.1:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	release()
+	if total, perIP := p.Conns("10.0.0.1"); total != 0 || perIP != 0 {
+		t.Fatalf("conns = %v/%v after release, want 0/0", total, perIP)
+	}
+}
+
+func TestPolicy_AcceptRate(t *testing.T) {
+	p := &Policy{AcceptRate: 10, AcceptBurst: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := p.Admit(addr("10.0.0.1:1000")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.Admit(addr("10.0.0.1:1000")); err != RateLimited {
+		t.Fatalf("err = %v, want %v", err, RateLimited)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if _, err := p.Admit(addr("10.0.0.1:1000")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	p := &Policy{Allow: []string{"not-an-ip"}}
+	if p.Validate() == nil {
+		t.Fatal("invalid address should fail validation")
+	}
+}
@@ -0,0 +1,140 @@
+// Package auth 校验设备注册报文中的凭据，防止任意连接冒充其他设备
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxSkew = 5 * time.Minute
+
+var (
+	// 凭据校验失败
+	Unauthorized = errors.New("unauthorized")
+	// 凭据库中没有该设备
+	UnknownDevice = errors.New("unknown device")
+	// 凭据中的时间戳超出允许的偏差
+	Expired = errors.New("credential expired")
+	// 凭据的时间戳不晚于该设备上一次通过认证的时间戳，可能是重放的凭据
+	Replayed = errors.New("credential replayed")
+)
+
+type (
+	// Authenticator 校验设备注册时提供的凭据，方法会被多个协程并发调用
+	Authenticator interface {
+		Authenticate(id string, payload []byte) error
+	}
+
+	// AuthenticatorFunc 将函数转换为Authenticator
+	AuthenticatorFunc func(id string, payload []byte) error
+
+	// CredentialStore 保存设备的密钥
+	CredentialStore interface {
+		Secret(id string) ([]byte, error)
+	}
+
+	// MapStore 以map保存设备编号到密钥的对应关系
+	MapStore map[string]string
+
+	// Token 设备以预共享的令牌作为凭据
+	Token struct {
+		Store CredentialStore
+	}
+
+	// HMAC 设备以"时间戳:签名"作为凭据，时间戳为十进制的Unix秒数，
+	// 签名为以密钥对"设备编号:时间戳"计算的HMAC-SHA256的十六进制字符串。
+	// 同一设备的时间戳必须大于上一次通过认证的时间戳，因此同一秒内只能认证一次
+	HMAC struct {
+		Store CredentialStore
+		// 允许的时间偏差，默认5分钟
+		MaxSkew time.Duration
+
+		mu sync.Mutex
+		// 每个设备上一次通过认证的时间戳
+		last map[string]int64
+	}
+)
+
+func (f AuthenticatorFunc) Authenticate(id string, payload []byte) error {
+	return f(id, payload)
+}
+
+func (m MapStore) Secret(id string) ([]byte, error) {
+	s, ok := m[id]
+	if !ok {
+		return nil, UnknownDevice
+	}
+	return []byte(s), nil
+}
+
+func (a *Token) Authenticate(id string, payload []byte) error {
+	secret, err := a.Store.Secret(id)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(secret, payload) != 1 {
+		return Unauthorized
+	}
+	return nil
+}
+
+func (a *HMAC) Authenticate(id string, payload []byte) error {
+	parts := strings.SplitN(string(payload), ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%w: malformed credential", Unauthorized)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", Unauthorized)
+	}
+	skew := a.MaxSkew
+	if skew <= 0 {
+		skew = defaultMaxSkew
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > skew || d < -skew {
+		return Expired
+	}
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", Unauthorized)
+	}
+
+	secret, err := a.Store.Secret(id)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, sign(secret, id, parts[0])) {
+		return Unauthorized
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ts <= a.last[id] {
+		return Replayed
+	}
+	if a.last == nil {
+		a.last = make(map[string]int64)
+	}
+	a.last[id] = ts
+	return nil
+}
+
+// SignHMAC 生成HMAC凭据，供设备端或测试使用
+func SignHMAC(secret []byte, id string, t time.Time) []byte {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return []byte(ts + ":" + hex.EncodeToString(sign(secret, id, ts)))
+}
+
+func sign(secret []byte, id, ts string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + ":" + ts))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	a := &Token{Store: MapStore{"dev1": "secret"}}
+	if err := a.Authenticate("dev1", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate("dev1", []byte("wrong")); err != Unauthorized {
+		t.Fatalf("err = %v, want %v", err, Unauthorized)
+	}
+	if err := a.Authenticate("dev2", []byte("secret")); err != UnknownDevice {
+		t.Fatalf("err = %v, want %v", err, UnknownDevice)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	a := &HMAC{Store: MapStore{"dev1": "secret"}}
+	now := time.Now()
+	credential := SignHMAC([]byte("secret"), "dev1", now)
+	if err := a.Authenticate("dev1", credential); err != nil {
+		t.Fatal(err)
+	}
+	// 截获的凭据不能重放，更早的时间戳同样被拒绝
+	if err := a.Authenticate("dev1", credential); err != Replayed {
+		t.Fatalf("err = %v, want %v", err, Replayed)
+	}
+	if err := a.Authenticate("dev1", SignHMAC([]byte("secret"), "dev1", now.Add(-time.Minute))); err != Replayed {
+		t.Fatalf("err = %v, want %v", err, Replayed)
+	}
+	if err := a.Authenticate("dev1", SignHMAC([]byte("secret"), "dev1", now.Add(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	// 签名与设备编号绑定
+	if err := a.Authenticate("dev1", SignHMAC([]byte("secret"), "dev2", time.Now())); err != Unauthorized {
+		t.Fatalf("err = %v, want %v", err, Unauthorized)
+	}
+	if err := a.Authenticate("dev1", SignHMAC([]byte("secret"), "dev1", time.Now().Add(-time.Hour))); err != Expired {
+		t.Fatalf("err = %v, want %v", err, Expired)
+	}
+	if err := a.Authenticate("dev1", []byte("garbage")); !errors.Is(err, Unauthorized) {
+		t.Fatalf("err = %v, want %v", err, Unauthorized)
+	}
+}
@@ -0,0 +1,123 @@
+package cjt188
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/transporttest"
+)
+
+// 模拟仪表，按请求返回预置的应答
+func newMeter(respond func(req *Frame) *Frame) *transporttest.Meter {
+	return transporttest.New(func(buf []byte) ([][]byte, error) {
+		req, err := NewFrame(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := respond(req)
+		if resp == nil {
+			return nil, nil
+		}
+		b, _ := resp.Bytes()
+		return [][]byte{b}, nil
+	})
+}
+
+// 水表计量数据：当前累计流量1234.56m³，结算日累计流量1200.00m³，2019-05-14 11:23:45，关阀且电池欠压
+var waterData = []byte{
+	0x56, 0x34, 0x12, 0x00, 0x2C,
+	0x00, 0x00, 0x12, 0x00, 0x2C,
+	0x45, 0x23, 0x11, 0x14, 0x05, 0x19, 0x20,
+	0x05, 0x00,
+}
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Type: ColdWater, Address: WildcardAddress, Control: ReadData, DI: MeterData}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x68, 0x10, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0x01, 0x03, 0x90, 0x1F, 0x00, 0x00, 0x16}
+	want[14] = checksum(want[:14])
+	if !bytes.Equal(b, want) {
+		t.Fatalf("bytes = % x, want % x", b, want)
+	}
+	got, err := NewFrame(append([]byte{0xfe, 0xfe}, b...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != ColdWater || got.Address != WildcardAddress || got.DI != MeterData || len(got.Data) != 0 {
+		t.Fatalf("frame = %+v", got)
+	}
+	b[14]++
+	if _, err := NewFrame(b); err != ChecksumError {
+		t.Fatalf("err = %v, want ChecksumError", err)
+	}
+}
+
+func TestDecodeReading(t *testing.T) {
+	r, err := DecodeReading(ColdWater, waterData, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Flow != (Value{1234.56, M3}) || r.SettlementFlow != (Value{1200, M3}) {
+		t.Fatalf("flow = %+v %+v", r.Flow, r.SettlementFlow)
+	}
+	if !r.Time.Equal(time.Date(2019, 5, 14, 11, 23, 45, 0, time.UTC)) || r.Valve != ValveClosed || !r.LowBattery {
+		t.Fatalf("reading = %+v", r)
+	}
+
+	heat := []byte{
+		0x00, 0x10, 0x00, 0x00, 0x05, // 结算日热量10.00kWh
+		0x00, 0x20, 0x00, 0x00, 0x05, // 当前热量20.00kWh
+		0x50, 0x01, 0x00, 0x00, 0x17, // 热功率1.50kW
+		0x00, 0x25, 0x01, 0x00, 0x35, // 流量1.2500m³/h
+		0x00, 0x00, 0x03, 0x00, 0x2C, // 累计流量300.00m³
+		0x50, 0x55, 0x00, // 供水温度55.50℃
+		0x25, 0x40, 0x00, // 回水温度40.25℃
+		0x00, 0x10, 0x00, // 累计工作时间1000小时
+		0x45, 0x23, 0x11, 0x14, 0x05, 0x19, 0x20,
+		0x00, 0x00,
+	}
+	r, err = DecodeReading(Heat, heat, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Heat != (Value{20, KWh}) || r.Power != (Value{1.5, KW}) || r.FlowRate != (Value{1.25, M3PerH}) ||
+		r.Flow != (Value{300, M3}) || r.SupplyTemp != 55.5 || r.ReturnTemp != 40.25 || r.WorkingHours != 1000 {
+		t.Fatalf("reading = %+v", r)
+	}
+	if _, err := DecodeReading(Heat, waterData, nil); err != ShortData {
+		t.Fatalf("err = %v, want ShortData", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	m := newMeter(func(req *Frame) *Frame {
+		resp := &Frame{Type: req.Type, Address: "00000012345678", Control: req.Control | directionBit, DI: req.DI, SER: req.SER}
+		switch {
+		case req.DI == MeterData:
+			resp.Data = waterData
+		case req.DI == ValveControl && req.Data[0] == CloseValve:
+			resp.Control |= abnormalBit
+		}
+		return resp
+	})
+	c := NewClient(m, ColdWater, "00000012345678")
+	c.Location = time.UTC
+
+	r, err := c.Read()
+	if err != nil || r.Flow.Value != 1234.56 {
+		t.Fatalf("reading = %+v, %v", r, err)
+	}
+	if err := c.SetValve(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetValve(false); err != Abnormal {
+		t.Fatalf("err = %v, want Abnormal", err)
+	}
+	if addr, err := c.ReadAddress(); err != nil || addr != "00000012345678" {
+		t.Fatalf("address = %v, %v", addr, err)
+	}
+}
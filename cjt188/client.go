@@ -0,0 +1,148 @@
+package cjt188
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 应答的地址、控制码或者数据标识与请求不一致
+	UnexpectedResponse = errors.New("unexpected cjt188 response")
+	// 仪表报告通信异常
+	Abnormal = errors.New("cjt188 meter abnormal")
+)
+
+type (
+	// Transport 与仪表通信的连接，*modbus.Conn（DTU、M-Bus转换器）和*nb.Conn都实现了该接口。
+	// Server.Handler需要将仪表的应答通过Conn.Send交给Client；
+	// NB表主动上报的计量数据可以直接以NewFrame和DecodeReading解析
+	Transport interface {
+		Write(buf []byte) (int, error)
+		Receive() ([]byte, error)
+		Lock()
+		Unlock()
+	}
+
+	// Client 与一个仪表通信
+	Client struct {
+		Transport Transport
+
+		Type MeterType
+
+		// 14位地址
+		Address string
+
+		// 是否不发送前导字节，默认发送
+		NoPreamble bool
+
+		// 时区，为nil时使用time.Local
+		Location *time.Location
+
+		ser uint32
+	}
+)
+
+func NewClient(t Transport, typ MeterType, address string) *Client {
+	return &Client{Transport: t, Type: typ, Address: address}
+}
+
+// Exchange 发送请求并等待应答，仪表报告通信异常时返回Abnormal
+func (c *Client) Exchange(req *Frame) (*Frame, error) {
+	b, err := req.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if !c.NoPreamble {
+		b = append(append([]byte{}, Preamble...), b...)
+	}
+	c.Transport.Lock()
+	defer c.Transport.Unlock()
+	if _, err := c.Transport.Write(b); err != nil {
+		return nil, err
+	}
+	out, err := c.Transport.Receive()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := NewFrame(out)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsResponse() || resp.Function() != req.Function() {
+		return nil, UnexpectedResponse
+	}
+	if !strings.ContainsAny(req.Address, "Aa") && resp.Address != req.Address {
+		return nil, UnexpectedResponse
+	}
+	if resp.IsAbnormal() {
+		return nil, Abnormal
+	}
+	if resp.DI != req.DI {
+		return nil, UnexpectedResponse
+	}
+	return resp, nil
+}
+
+func (c *Client) request(control uint8, di uint16, data []byte) *Frame {
+	return &Frame{
+		Type:    c.Type,
+		Address: c.Address,
+		Control: control,
+		DI:      di,
+		SER:     uint8(atomic.AddUint32(&c.ser, 1)),
+		Data:    data,
+	}
+}
+
+// Read 读取计量数据
+func (c *Client) Read() (*Reading, error) {
+	return c.readData(MeterData)
+}
+
+// ReadHistory 读取上n个结算日（1到12）的历史计量数据
+func (c *Client) ReadHistory(n int) (*Reading, error) {
+	if n < 1 || n > 12 {
+		return nil, errors.New("history index must be between 1 and 12")
+	}
+	return c.readData(HistoryData + uint16(n-1))
+}
+
+func (c *Client) readData(di uint16) (*Reading, error) {
+	resp, err := c.Exchange(c.request(ReadData, di, nil))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReading(resp.Type, resp.Data, c.Location)
+}
+
+// SetValve 开阀或者关阀
+func (c *Client) SetValve(open bool) error {
+	v := CloseValve
+	if open {
+		v = OpenValve
+	}
+	_, err := c.Exchange(c.request(WriteData, ValveControl, []byte{v}))
+	return err
+}
+
+// SetTime 写标准时间
+func (c *Client) SetTime(t time.Time) error {
+	if c.Location != nil {
+		t = t.In(c.Location)
+	}
+	_, err := c.Exchange(c.request(WriteData, WriteTime, EncodeTime(t)))
+	return err
+}
+
+// ReadAddress 以通配地址读取仪表的地址，总线上只能有一个仪表
+func (c *Client) ReadAddress() (string, error) {
+	req := c.request(ReadAddress, ReadAddressDI, nil)
+	req.Address = WildcardAddress
+	resp, err := c.Exchange(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Address, nil
+}
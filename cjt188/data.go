@@ -0,0 +1,223 @@
+package cjt188
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Unit 计量单位代号
+type Unit uint8
+
+const (
+	Wh     Unit = 0x02
+	KWh    Unit = 0x05
+	MWh    Unit = 0x08
+	MWh100 Unit = 0x0A
+	J      Unit = 0x01
+	KJ     Unit = 0x0B
+	MJ     Unit = 0x0E
+	GJ     Unit = 0x11
+	GJ100  Unit = 0x13
+	W      Unit = 0x14
+	KW     Unit = 0x17
+	MW     Unit = 0x1A
+	L      Unit = 0x29
+	M3     Unit = 0x2C
+	LPerH  Unit = 0x32
+	M3PerH Unit = 0x35
+)
+
+var unitNames = map[Unit]string{
+	Wh: "Wh", KWh: "kWh", MWh: "MWh", MWh100: "MWh×100",
+	J: "J", KJ: "kJ", MJ: "MJ", GJ: "GJ", GJ100: "GJ×100",
+	W: "W", KW: "kW", MW: "MW",
+	L: "L", M3: "m³", LPerH: "L/h", M3PerH: "m³/h",
+}
+
+func (u Unit) String() string {
+	if name, ok := unitNames[u]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ValveState 阀门状态
+type ValveState uint8
+
+const (
+	ValveOpen     ValveState = 0
+	ValveClosed   ValveState = 1
+	ValveAbnormal ValveState = 3
+)
+
+// 阀门控制的数据
+const (
+	OpenValve  = byte(0x55)
+	CloseValve = byte(0x99)
+)
+
+var (
+	InvalidBCD = errors.New("invalid bcd")
+	// 数据长度与仪表类型不符
+	ShortData = errors.New("cjt188 data too short")
+)
+
+type (
+	// Value 带单位的数值
+	Value struct {
+		Value float64
+		Unit  Unit
+	}
+
+	// Reading 计量数据，热量表才有热量、功率、流速、温度和累计工作时间
+	Reading struct {
+		Type MeterType
+
+		// 当前累计流量
+		Flow Value
+		// 结算日累计流量，水表和燃气表才有
+		SettlementFlow Value
+
+		// 结算日热量和当前热量
+		SettlementHeat Value
+		Heat           Value
+		// 热功率
+		Power Value
+		// 流量（流速）
+		FlowRate Value
+		// 供水温度和回水温度，单位℃
+		SupplyTemp float64
+		ReturnTemp float64
+		// 累计工作时间，单位小时
+		WorkingHours int
+
+		// 仪表的实时时间
+		Time time.Time
+
+		Valve      ValveState
+		LowBattery bool
+		// 状态ST，ST0为第一个字节
+		Status [2]byte
+	}
+)
+
+// DecodeBCD 将低字节在前的BCD码转换为数值，decimals为小数位数
+func DecodeBCD(b []byte, decimals int) (float64, error) {
+	var v float64
+	for i := len(b) - 1; i >= 0; i-- {
+		hi, lo := b[i]>>4, b[i]&0x0f
+		if hi > 9 || lo > 9 {
+			return 0, InvalidBCD
+		}
+		v = v*100 + float64(hi*10+lo)
+	}
+	return v / math.Pow10(decimals), nil
+}
+
+func fromBCD(b byte) int {
+	return int(b>>4)*10 + int(b&0x0f)
+}
+
+func bcdByte(v int) byte {
+	return byte(v/10)<<4 | byte(v%10)
+}
+
+// EncodeTime 将时间编码为ssmmhhDDMMYYYY，低字节在前
+func EncodeTime(t time.Time) []byte {
+	year := t.Year()
+	return []byte{
+		bcdByte(t.Second()), bcdByte(t.Minute()), bcdByte(t.Hour()),
+		bcdByte(t.Day()), bcdByte(int(t.Month())),
+		bcdByte(year % 100), bcdByte(year / 100),
+	}
+}
+
+// DecodeTime 解析7字节的实时时间，loc为nil时使用time.Local
+func DecodeTime(b []byte, loc *time.Location) (time.Time, error) {
+	if len(b) < 7 {
+		return time.Time{}, ShortData
+	}
+	for _, v := range b[:7] {
+		if v>>4 > 9 || v&0x0f > 9 {
+			return time.Time{}, InvalidBCD
+		}
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return time.Date(fromBCD(b[6])*100+fromBCD(b[5]), time.Month(fromBCD(b[4])), fromBCD(b[3]),
+		fromBCD(b[2]), fromBCD(b[1]), fromBCD(b[0]), 0, loc), nil
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = ShortData
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) bcd(n, decimals int) float64 {
+	b := r.next(n)
+	if r.err != nil {
+		return 0
+	}
+	v, err := DecodeBCD(b, decimals)
+	if err != nil {
+		r.err = err
+	}
+	return v
+}
+
+// 4字节BCD数值和1字节单位
+func (r *reader) value(decimals int) Value {
+	v := r.bcd(4, decimals)
+	u := r.next(1)
+	if r.err != nil {
+		return Value{}
+	}
+	return Value{Value: v, Unit: Unit(u[0])}
+}
+
+// DecodeReading 解析读计量数据（MeterData、HistoryData）应答中序号之后的数据，loc为nil时使用time.Local
+func DecodeReading(t MeterType, data []byte, loc *time.Location) (*Reading, error) {
+	r := &reader{b: data}
+	rd := &Reading{Type: t}
+	if t.IsHeat() {
+		rd.SettlementHeat = r.value(2)
+		rd.Heat = r.value(2)
+		rd.Power = r.value(2)
+		rd.FlowRate = r.value(4)
+		rd.Flow = r.value(2)
+		rd.SupplyTemp = r.bcd(3, 2)
+		rd.ReturnTemp = r.bcd(3, 2)
+		rd.WorkingHours = int(r.bcd(3, 0))
+	} else {
+		rd.Flow = r.value(2)
+		rd.SettlementFlow = r.value(2)
+	}
+	tm := r.next(7)
+	st := r.next(2)
+	if r.err != nil {
+		return nil, r.err
+	}
+	var err error
+	if rd.Time, err = DecodeTime(tm, loc); err != nil {
+		return nil, err
+	}
+	copy(rd.Status[:], st)
+	rd.Valve = ValveState(st[0] & 0x03)
+	rd.LowBattery = st[0]&0x04 != 0
+	return rd, nil
+}
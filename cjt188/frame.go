@@ -0,0 +1,215 @@
+package cjt188
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	startByte = 0x68
+	endByte   = 0x16
+	preamble  = 0xFE
+)
+
+// MeterType 仪表类型
+type MeterType uint8
+
+const (
+	ColdWater    MeterType = 0x10
+	HotWater     MeterType = 0x11
+	DrinkWater   MeterType = 0x12
+	ReclaimWater MeterType = 0x13
+	// 热量表（计热量）
+	Heat MeterType = 0x20
+	// 热量表（计冷量）
+	Cooling MeterType = 0x21
+	Gas     MeterType = 0x30
+	// 通配仪表类型，用于读地址
+	AnyType MeterType = 0xAA
+)
+
+// IsHeat 是否是热量表
+func (t MeterType) IsHeat() bool {
+	return t == Heat || t == Cooling
+}
+
+// 控制码的功能部分
+const (
+	ReadData       = uint8(0x01)
+	ReadAddress    = uint8(0x03)
+	WriteData      = uint8(0x04)
+	ReadKeyVersion = uint8(0x09)
+	WriteAddress   = uint8(0x15)
+	WriteMotorSync = uint8(0x16)
+)
+
+// 控制码的标志位
+const (
+	// 仪表发出的应答
+	directionBit = 0x80
+	// 通信异常
+	abnormalBit = 0x40
+)
+
+// 常用的数据标识，帧中DI0在前，例如0x901F编码为90 1F
+const (
+	// 计量数据
+	MeterData = uint16(0x901F)
+	// 上1到12个结算日的历史计量数据为0xD120到0xD12B
+	HistoryData = uint16(0xD120)
+	// 写标准时间
+	WriteTime = uint16(0xA015)
+	// 阀门控制
+	ValveControl = uint16(0xA017)
+	// 读地址
+	ReadAddressDI = uint16(0x810A)
+	// 写地址
+	WriteAddressDI = uint16(0xA018)
+)
+
+var (
+	// 通配地址，总线上只有一个仪表时用于读地址
+	WildcardAddress = "AAAAAAAAAAAAAA"
+
+	// 默认的前导字节
+	Preamble = []byte{preamble, preamble}
+
+	InvalidFrame  = errors.New("invalid cjt188 frame")
+	ChecksumError = errors.New("cjt188 checksum error")
+)
+
+// Frame CJ/T 188帧
+type Frame struct {
+	Type MeterType
+	// 14位地址，高位在前
+	Address string
+	Control uint8
+	// 数据标识
+	DI uint16
+	// 序号
+	SER uint8
+	// 数据标识和序号之后的数据
+	Data []byte
+}
+
+// Function 去掉标志位的控制码
+func (f *Frame) Function() uint8 {
+	return f.Control & 0x3f
+}
+
+// IsResponse 是否是仪表发出的帧
+func (f *Frame) IsResponse() bool {
+	return f.Control&directionBit != 0
+}
+
+// IsAbnormal 仪表是否报告通信异常
+func (f *Frame) IsAbnormal() bool {
+	return f.Control&abnormalBit != 0
+}
+
+// Bytes 编码为帧，不包含前导字节
+func (f *Frame) Bytes() ([]byte, error) {
+	addr, err := encodeAddress(f.Address)
+	if err != nil {
+		return nil, err
+	}
+	l := 3 + len(f.Data)
+	if l > 0xff {
+		return nil, fmt.Errorf("%w: data too long", InvalidFrame)
+	}
+	b := make([]byte, 0, 13+l)
+	b = append(b, startByte, byte(f.Type))
+	b = append(b, addr...)
+	b = append(b, f.Control, byte(l), byte(f.DI>>8), byte(f.DI), f.SER)
+	b = append(b, f.Data...)
+	return append(b, checksum(b), endByte), nil
+}
+
+// NewFrame 解析帧，会忽略开头的前导字节
+func NewFrame(packet []byte) (*Frame, error) {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	if len(packet) < 13 || packet[0] != startByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	l := int(packet[10])
+	if len(packet) < 13+l || packet[12+l] != endByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	if checksum(packet[:11+l]) != packet[11+l] {
+		return nil, ChecksumError
+	}
+	f := &Frame{
+		Type:    MeterType(packet[1]),
+		Address: decodeAddress(packet[2:9]),
+		Control: packet[9],
+	}
+	// 异常应答可能只有数据标识和序号，甚至没有数据
+	data := packet[11 : 11+l]
+	if len(data) >= 2 {
+		f.DI = uint16(data[0])<<8 | uint16(data[1])
+	}
+	if len(data) >= 3 {
+		f.SER = data[2]
+		f.Data = append([]byte(nil), data[3:]...)
+	}
+	return f, nil
+}
+
+// IsFrame 判断报文是否可能是CJ/T 188帧，用于在Handler中区分不同协议的报文
+func IsFrame(packet []byte) bool {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	if len(packet) < 13 || packet[0] != startByte {
+		return false
+	}
+	l := int(packet[10])
+	return len(packet) >= 13+l && packet[12+l] == endByte
+}
+
+func checksum(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return sum
+}
+
+// 地址为7字节BCD，低字节在前
+func encodeAddress(address string) ([]byte, error) {
+	if len(address) != 14 {
+		return nil, fmt.Errorf("%w: address %q must be 14 digits", InvalidFrame, address)
+	}
+	b := make([]byte, 7)
+	for i := 0; i < 7; i++ {
+		hi, ok1 := hexDigit(address[2*i])
+		lo, ok2 := hexDigit(address[2*i+1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: invalid address %q", InvalidFrame, address)
+		}
+		b[6-i] = hi<<4 | lo
+	}
+	return b, nil
+}
+
+func decodeAddress(b []byte) string {
+	const digits = "0123456789ABCDEF"
+	s := make([]byte, 0, 14)
+	for i := len(b) - 1; i >= 0; i-- {
+		s = append(s, digits[b[i]>>4], digits[b[i]&0x0f])
+	}
+	return string(s)
+}
+
+// 地址中允许出现通配符A
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c == 'A' || c == 'a':
+		return 0x0a, true
+	}
+	return 0, false
+}
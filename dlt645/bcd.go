@@ -0,0 +1,74 @@
+package dlt645
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+var InvalidBCD = errors.New("invalid bcd")
+
+// DecodeBCD 将低字节在前的BCD码转换为数值，decimals为小数位数，
+// signed为true时最高字节的最高位为符号位
+func DecodeBCD(b []byte, decimals int, signed bool) (float64, error) {
+	var v float64
+	negative := false
+	for i := len(b) - 1; i >= 0; i-- {
+		d := b[i]
+		if signed && i == len(b)-1 {
+			negative = d&0x80 != 0
+			d &= 0x7f
+		}
+		hi, lo := d>>4, d&0x0f
+		if hi > 9 || lo > 9 {
+			return 0, InvalidBCD
+		}
+		v = v*100 + float64(hi*10+lo)
+	}
+	v /= math.Pow10(decimals)
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// EncodeBCD 将数值转换为size字节、低字节在前的BCD码
+func EncodeBCD(v float64, size, decimals int, signed bool) ([]byte, error) {
+	negative := v < 0
+	if negative && !signed {
+		return nil, InvalidBCD
+	}
+	n := uint64(math.Round(math.Abs(v) * math.Pow10(decimals)))
+	b := make([]byte, size)
+	for i := 0; i < size; i++ {
+		b[i] = byte(n%10) | byte(n/10%10)<<4
+		n /= 100
+	}
+	if n != 0 || (signed && b[size-1]&0x80 != 0) {
+		return nil, InvalidBCD
+	}
+	if negative {
+		b[size-1] |= 0x80
+	}
+	return b, nil
+}
+
+func bcdByte(v int) byte {
+	return byte(v/10)<<4 | byte(v%10)
+}
+
+func fromBCD(b byte) int {
+	return int(b>>4)*10 + int(b&0x0f)
+}
+
+// 日期时间编码为ssmmhhDDMMYY，低字节在前
+func encodeTime(t time.Time) []byte {
+	return []byte{
+		bcdByte(t.Second()),
+		bcdByte(t.Minute()),
+		bcdByte(t.Hour()),
+		bcdByte(t.Day()),
+		bcdByte(int(t.Month())),
+		bcdByte(t.Year() % 100),
+	}
+}
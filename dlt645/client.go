@@ -0,0 +1,272 @@
+package dlt645
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// 应答的地址或控制码与请求不一致
+	UnexpectedResponse = errors.New("unexpected dlt645 response")
+	// Items中没有该数据标识的格式
+	UnknownItem = errors.New("unknown data identifier")
+)
+
+type (
+	// Transport 与电表通信的连接，*modbus.Conn和*nb.Conn都实现了该接口。
+	// 与modbus相同，Server.Handler需要将电表的应答通过Conn.Send交给Client
+	Transport interface {
+		Write(buf []byte) (int, error)
+		Receive() ([]byte, error)
+		Lock()
+		Unlock()
+	}
+
+	// MeterError 电表异常应答的错误信息字
+	MeterError uint8
+
+	// Client 通过DTU与一个电表通信
+	Client struct {
+		Transport Transport
+
+		// 12位表地址
+		Address string
+
+		// 写数据时的密码，第一个字节为权限
+		Password [4]byte
+
+		// 写数据时的操作者代码
+		Operator [4]byte
+
+		// 是否不发送前导字节，默认发送
+		NoPreamble bool
+
+		// 电表的协议版本，为VersionUnknown时在首次通信时检测
+		Version Version
+	}
+)
+
+func (e MeterError) Error() string {
+	var reasons []string
+	names := []string{"其他错误", "无请求数据", "密码错/未授权", "通信速率不能更改", "年时区数超", "日时段数超", "费率数超"}
+	for i, name := range names {
+		if e&(1<<uint(i)) != 0 {
+			reasons = append(reasons, name)
+		}
+	}
+	if len(reasons) == 0 {
+		return fmt.Sprintf("dlt645 meter error 0x%02x", uint8(e))
+	}
+	return fmt.Sprintf("dlt645 meter error 0x%02x: %v", uint8(e), strings.Join(reasons, ","))
+}
+
+func NewClient(t Transport, address string) *Client {
+	return &Client{Transport: t, Address: address}
+}
+
+// Exchange 发送请求并等待应答，电表的异常应答以MeterError返回
+func (c *Client) Exchange(req *Frame) (*Frame, error) {
+	buf, err := c.encode(req)
+	if err != nil {
+		return nil, err
+	}
+	c.Transport.Lock()
+	defer c.Transport.Unlock()
+	if _, err := c.Transport.Write(buf); err != nil {
+		return nil, err
+	}
+	out, err := c.Transport.Receive()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := NewFrame(out)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsResponse() || resp.Function() != req.Function() {
+		return nil, UnexpectedResponse
+	}
+	if !strings.ContainsRune(req.Address, 'A') && !strings.ContainsRune(req.Address, 'a') && resp.Address != req.Address {
+		return nil, UnexpectedResponse
+	}
+	if resp.IsAbnormal() {
+		if len(resp.Data) == 0 {
+			return nil, UnexpectedResponse
+		}
+		return nil, MeterError(resp.Data[0])
+	}
+	return resp, nil
+}
+
+func (c *Client) encode(f *Frame) ([]byte, error) {
+	b, err := f.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if c.NoPreamble {
+		return b, nil
+	}
+	return append(append([]byte{}, Preamble...), b...), nil
+}
+
+// DetectVersion 先以2007再以1997读取通信地址，以电表能够应答（包括异常应答）的版本作为Client.Version
+func (c *Client) DetectVersion() (Version, error) {
+	var err error
+	for _, v := range []Version{V2007, V1997} {
+		_, err = c.read(v, CommAddress)
+		var e MeterError
+		if err == nil || errors.As(err, &e) {
+			c.Version = v
+			return v, nil
+		}
+	}
+	return VersionUnknown, err
+}
+
+func (c *Client) version() (Version, error) {
+	if c.Version != VersionUnknown {
+		return c.Version, nil
+	}
+	return c.DetectVersion()
+}
+
+// Read 读取数据标识对应的数据，返回去掉数据标识之后的数据。
+// di为2007的数据标识，电表为1997版本时按Items1997转换，不在其中的di直接作为1997的数据标识
+func (c *Client) Read(di DI) ([]byte, error) {
+	v, err := c.version()
+	if err != nil {
+		return nil, err
+	}
+	return c.read(v, di)
+}
+
+func (c *Client) read(v Version, di DI) ([]byte, error) {
+	req := &Frame{Address: c.Address, Control: Read, Data: di.Bytes()}
+	n := 4
+	if v == V1997 {
+		di = di1997(di)
+		req.Control = Read1997
+		req.Data = di.Bytes()[:2]
+		n = 2
+	}
+	resp, err := c.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if got, ok := resp.DI(); !ok || got != di {
+		return nil, UnexpectedResponse
+	}
+	return resp.Data[n:], nil
+}
+
+func di1997(di DI) DI {
+	if item, ok := Items1997[di]; ok {
+		return item.DI
+	}
+	return di
+}
+
+// ReadValue 读取数据标识对应的数值，格式由Items或者Items1997决定
+func (c *Client) ReadValue(di DI) (float64, error) {
+	v, err := c.version()
+	if err != nil {
+		return 0, err
+	}
+	item, ok := Catalogue(v, di)
+	if !ok {
+		return 0, fmt.Errorf("%w: %08x", UnknownItem, uint32(di))
+	}
+	data, err := c.read(v, di)
+	if err != nil {
+		return 0, err
+	}
+	return item.Decode(data)
+}
+
+// ReadTime 读取电表的日期和时间，loc为nil时使用time.Local
+func (c *Client) ReadTime(loc *time.Location) (time.Time, error) {
+	date, err := c.Read(Date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	clock, err := c.Read(Time)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(date) < 4 || len(clock) < 3 {
+		return time.Time{}, UnexpectedResponse
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	// 日期为WWDDMMYY，时间为ssmmhh，低字节在前
+	return time.Date(2000+fromBCD(date[3]), time.Month(fromBCD(date[2])), fromBCD(date[1]),
+		fromBCD(clock[2]), fromBCD(clock[1]), fromBCD(clock[0]), 0, loc), nil
+}
+
+// Write 写入数据标识对应的数据，使用Client的密码和操作者代码，1997版本没有操作者代码
+func (c *Client) Write(di DI, data []byte) error {
+	v, err := c.version()
+	if err != nil {
+		return err
+	}
+	req := &Frame{Address: c.Address, Control: Write}
+	payload := make([]byte, 0, 12+len(data))
+	if v == V1997 {
+		req.Control = Write1997
+		payload = append(payload, di1997(di).Bytes()[:2]...)
+		payload = append(payload, c.Password[:]...)
+	} else {
+		payload = append(payload, di.Bytes()...)
+		payload = append(payload, c.Password[:]...)
+		payload = append(payload, c.Operator[:]...)
+	}
+	req.Data = append(payload, data...)
+	_, err = c.Exchange(req)
+	return err
+}
+
+// ReadAddress 以通配地址读取电表的通信地址，总线上只能有一个电表
+func (c *Client) ReadAddress() (string, error) {
+	v, err := c.version()
+	if err != nil {
+		return "", err
+	}
+	req := &Frame{Address: WildcardAddress, Control: ReadAddress}
+	if v == V1997 {
+		// 1997没有读通信地址命令，以通配地址读取表号
+		req.Control = Read1997
+		req.Data = di1997(CommAddress).Bytes()[:2]
+	}
+	resp, err := c.Exchange(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Address, nil
+}
+
+// BroadcastTimeTo 通过连接t广播校时，电表不应答
+func BroadcastTimeTo(t Transport, tm time.Time) error {
+	return broadcastTime(t, tm, Preamble)
+}
+
+func broadcastTime(t Transport, tm time.Time, preamble []byte) error {
+	b, err := (&Frame{Address: BroadcastAddress, Control: BroadcastTime, Data: encodeTime(tm)}).Bytes()
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	_, err = t.Write(append(append([]byte{}, preamble...), b...))
+	return err
+}
+
+// BroadcastTime 通过Client的连接广播校时
+func (c *Client) BroadcastTime(tm time.Time) error {
+	if c.NoPreamble {
+		return broadcastTime(c.Transport, tm, nil)
+	}
+	return broadcastTime(c.Transport, tm, Preamble)
+}
@@ -0,0 +1,101 @@
+package dlt645
+
+import "encoding/binary"
+
+// DI 数据标识，例如0x02010100为A相电压
+type DI uint32
+
+// 常用的数据标识
+const (
+	// 组合有功总电能
+	CombinedActiveEnergy DI = 0x00000000
+	// 正向有功总电能
+	ForwardActiveEnergy DI = 0x00010000
+	// 反向有功总电能
+	ReverseActiveEnergy DI = 0x00020000
+	// 组合无功1总电能
+	CombinedReactiveEnergy1 DI = 0x00030000
+	// 组合无功2总电能
+	CombinedReactiveEnergy2 DI = 0x00040000
+
+	VoltageA DI = 0x02010100
+	VoltageB DI = 0x02010200
+	VoltageC DI = 0x02010300
+
+	CurrentA DI = 0x02020100
+	CurrentB DI = 0x02020200
+	CurrentC DI = 0x02020300
+
+	// 总有功功率
+	ActivePower  DI = 0x02030000
+	ActivePowerA DI = 0x02030100
+	ActivePowerB DI = 0x02030200
+	ActivePowerC DI = 0x02030300
+
+	// 总无功功率
+	ReactivePower DI = 0x02040000
+
+	// 总功率因数
+	PowerFactor DI = 0x02060000
+
+	// 电网频率
+	Frequency DI = 0x02800002
+
+	// 日期及星期，YYMMDDWW
+	Date DI = 0x04000101
+	// 时间，hhmmss
+	Time DI = 0x04000102
+
+	// 通信地址
+	CommAddress DI = 0x04000401
+)
+
+// Item 数据标识对应数据的格式
+type Item struct {
+	DI   DI
+	Name string
+	// 数据的字节数
+	Size int
+	// 小数位数
+	Decimals int
+	// 最高位是否为符号位
+	Signed bool
+	Unit   string
+}
+
+// Items 常用数据标识的格式，ReadValue根据它转换数值，可以添加其他数据标识
+var Items = map[DI]Item{
+	CombinedActiveEnergy:    {CombinedActiveEnergy, "组合有功总电能", 4, 2, false, "kWh"},
+	ForwardActiveEnergy:     {ForwardActiveEnergy, "正向有功总电能", 4, 2, false, "kWh"},
+	ReverseActiveEnergy:     {ReverseActiveEnergy, "反向有功总电能", 4, 2, false, "kWh"},
+	CombinedReactiveEnergy1: {CombinedReactiveEnergy1, "组合无功1总电能", 4, 2, true, "kvarh"},
+	CombinedReactiveEnergy2: {CombinedReactiveEnergy2, "组合无功2总电能", 4, 2, true, "kvarh"},
+	VoltageA:                {VoltageA, "A相电压", 2, 1, false, "V"},
+	VoltageB:                {VoltageB, "B相电压", 2, 1, false, "V"},
+	VoltageC:                {VoltageC, "C相电压", 2, 1, false, "V"},
+	CurrentA:                {CurrentA, "A相电流", 3, 3, true, "A"},
+	CurrentB:                {CurrentB, "B相电流", 3, 3, true, "A"},
+	CurrentC:                {CurrentC, "C相电流", 3, 3, true, "A"},
+	ActivePower:             {ActivePower, "总有功功率", 3, 4, true, "kW"},
+	ActivePowerA:            {ActivePowerA, "A相有功功率", 3, 4, true, "kW"},
+	ActivePowerB:            {ActivePowerB, "B相有功功率", 3, 4, true, "kW"},
+	ActivePowerC:            {ActivePowerC, "C相有功功率", 3, 4, true, "kW"},
+	ReactivePower:           {ReactivePower, "总无功功率", 3, 4, true, "kvar"},
+	PowerFactor:             {PowerFactor, "总功率因数", 2, 3, true, ""},
+	Frequency:               {Frequency, "电网频率", 2, 2, false, "Hz"},
+}
+
+// Bytes 数据标识按DI0到DI3的顺序编码
+func (di DI) Bytes() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(di))
+	return b
+}
+
+// Decode 将数据转换为数值
+func (item Item) Decode(b []byte) (float64, error) {
+	if len(b) < item.Size {
+		return 0, InvalidBCD
+	}
+	return DecodeBCD(b[:item.Size], item.Decimals, item.Signed)
+}
@@ -0,0 +1,149 @@
+package dlt645
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/transporttest"
+)
+
+// 模拟电表，按请求返回预置的应答
+func newMeter(respond func(req *Frame) *Frame) *transporttest.Meter {
+	return transporttest.New(func(buf []byte) ([][]byte, error) {
+		req, err := NewFrame(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := respond(req)
+		if resp == nil {
+			return nil, nil
+		}
+		b, _ := resp.Bytes()
+		return [][]byte{append([]byte{0xfe, 0xfe}, b...)}, nil
+	})
+}
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Address: "000012345678", Control: Read, Data: VoltageA.Bytes()}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x68, 0x78, 0x56, 0x34, 0x12, 0x00, 0x00, 0x68, 0x11, 0x04, 0x33, 0x34, 0x34, 0x35, 0x00, 0x16}
+	want[14] = checksum(want[:14])
+	if !bytes.Equal(b, want) {
+		t.Fatalf("bytes = % x, want % x", b, want)
+	}
+	got, err := NewFrame(append([]byte{0xfe, 0xfe, 0xfe, 0xfe}, b...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != f.Address || got.Control != Read || !bytes.Equal(got.Data, f.Data) {
+		t.Fatalf("frame = %+v", got)
+	}
+	b[14]++
+	if _, err := NewFrame(b); err != ChecksumError {
+		t.Fatalf("err = %v, want ChecksumError", err)
+	}
+}
+
+func TestBCD(t *testing.T) {
+	v, err := DecodeBCD([]byte{0x56, 0x34, 0x92}, 3, true)
+	if err != nil || v != -123.456 {
+		t.Fatalf("decoded = %v, %v", v, err)
+	}
+	b, err := EncodeBCD(-123.456, 3, 3, true)
+	if err != nil || !bytes.Equal(b, []byte{0x56, 0x34, 0x92}) {
+		t.Fatalf("encoded = % x, %v", b, err)
+	}
+	if _, err := EncodeBCD(1000, 1, 0, false); err != InvalidBCD {
+		t.Fatalf("err = %v, want InvalidBCD", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	m := newMeter(func(req *Frame) *Frame {
+		resp := &Frame{Address: "000012345678", Control: req.Control | directionBit}
+		switch req.Function() {
+		case Read:
+			if bytes.Equal(req.Data, VoltageA.Bytes()) {
+				resp.Data = append(VoltageA.Bytes(), 0x05, 0x22)
+			} else {
+				resp.Control |= abnormalBit
+				resp.Data = []byte{0x02}
+			}
+		case Write, ReadAddress:
+		default:
+			return nil
+		}
+		return resp
+	})
+	c := NewClient(m, "000012345678")
+
+	v, err := c.ReadValue(VoltageA)
+	if err != nil || v != 220.5 {
+		t.Fatalf("voltage = %v, %v", v, err)
+	}
+	if _, err := c.ReadValue(CurrentA); err != MeterError(0x02) {
+		t.Fatalf("err = %v, want MeterError(0x02)", err)
+	}
+	if err := c.Write(CommAddress, []byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := c.ReadAddress(); err != nil || addr != "000012345678" {
+		t.Fatalf("address = %v, %v", addr, err)
+	}
+	tm := time.Date(2020, 3, 12, 17, 19, 5, 0, time.Local)
+	if err := c.BroadcastTime(tm); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := NewFrame(m.Last())
+	if f.Address != BroadcastAddress || !bytes.Equal(f.Data, []byte{0x05, 0x19, 0x17, 0x12, 0x03, 0x20}) {
+		t.Fatalf("broadcast = %+v", f)
+	}
+}
+
+func TestClient_V1997(t *testing.T) {
+	m := newMeter(func(req *Frame) *Frame {
+		if req.Version() != V1997 {
+			return nil
+		}
+		resp := &Frame{Address: "000000000042", Control: req.Control | directionBit}
+		switch di, _ := req.DI(); di {
+		case 0xC032:
+			resp.Data = append(DI(0xC032).Bytes()[:2], 0x42, 0, 0, 0, 0, 0)
+		case 0x9010:
+			resp.Data = append(DI(0x9010).Bytes()[:2], 0x78, 0x56, 0x34, 0x12)
+		case 0xB611:
+			resp.Data = append(DI(0xB611).Bytes()[:2], 0x20, 0x02)
+		default:
+			resp.Control |= abnormalBit
+			resp.Data = []byte{0x02}
+		}
+		return resp
+	})
+	c := NewClient(m, "000000000042")
+
+	v, err := c.ReadValue(ForwardActiveEnergy)
+	if err != nil || v != 123456.78 {
+		t.Fatalf("energy = %v, %v", v, err)
+	}
+	if c.Version != V1997 {
+		t.Fatalf("version = %v, want V1997", c.Version)
+	}
+	if v, err := c.ReadValue(VoltageA); err != nil || v != 220 {
+		t.Fatalf("voltage = %v, %v", v, err)
+	}
+	if _, err := c.ReadValue(Frequency); !errors.Is(err, UnknownItem) {
+		t.Fatalf("err = %v, want UnknownItem", err)
+	}
+	if err := c.Write(Date, []byte{0x01}); err != MeterError(0x02) {
+		t.Fatalf("err = %v, want MeterError(0x02)", err)
+	}
+	f, _ := NewFrame(m.Last())
+	if f.Control != Write1997 || !bytes.Equal(f.Data[:2], []byte{0x10, 0xC0}) || len(f.Data) != 7 {
+		t.Fatalf("write = %+v", f)
+	}
+}
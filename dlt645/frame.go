@@ -0,0 +1,174 @@
+package dlt645
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	startByte = 0x68
+	endByte   = 0x16
+	// 唤醒前导字节
+	preamble = 0xFE
+	// 数据域发送时每个字节加0x33，接收时减0x33
+	offset = 0x33
+)
+
+// 控制码的功能部分
+const (
+	BroadcastTime = uint8(0x08)
+	Read          = uint8(0x11)
+	ReadFollow    = uint8(0x12)
+	ReadAddress   = uint8(0x13)
+	Write         = uint8(0x14)
+)
+
+// 控制码的标志位
+const (
+	// 从站发出的应答
+	directionBit = 0x80
+	// 从站异常应答
+	abnormalBit = 0x40
+	// 有后续数据帧
+	followBit = 0x20
+)
+
+var (
+	// 广播地址，用于广播校时
+	BroadcastAddress = "999999999999"
+	// 通配地址，用于点对点通信时不知道表地址的情况
+	WildcardAddress = "AAAAAAAAAAAA"
+
+	// 默认的前导字节
+	Preamble = []byte{preamble, preamble, preamble, preamble}
+
+	InvalidFrame  = errors.New("invalid dlt645 frame")
+	ChecksumError = errors.New("dlt645 checksum error")
+)
+
+// Frame DL/T 645帧，Data为减去0x33之后的数据域
+type Frame struct {
+	// 12位表地址，高位在前，例如"000012345678"
+	Address string
+	Control uint8
+	Data    []byte
+}
+
+// Function 去掉标志位的控制码
+func (f *Frame) Function() uint8 {
+	return f.Control & 0x1f
+}
+
+// IsResponse 是否是从站发出的应答
+func (f *Frame) IsResponse() bool {
+	return f.Control&directionBit != 0
+}
+
+// IsAbnormal 是否是从站的异常应答，此时Data[0]为错误信息字
+func (f *Frame) IsAbnormal() bool {
+	return f.Control&abnormalBit != 0
+}
+
+// HasFollow 是否有后续数据帧
+func (f *Frame) HasFollow() bool {
+	return f.Control&followBit != 0
+}
+
+// Bytes 编码为帧，不包含前导字节
+func (f *Frame) Bytes() ([]byte, error) {
+	addr, err := encodeAddress(f.Address)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Data) > 0xff {
+		return nil, fmt.Errorf("%w: data too long", InvalidFrame)
+	}
+	b := make([]byte, 0, 12+len(f.Data))
+	b = append(b, startByte)
+	b = append(b, addr...)
+	b = append(b, startByte, f.Control, byte(len(f.Data)))
+	for _, d := range f.Data {
+		b = append(b, d+offset)
+	}
+	b = append(b, checksum(b), endByte)
+	return b, nil
+}
+
+// NewFrame 解析帧，会忽略开头的前导字节
+func NewFrame(packet []byte) (*Frame, error) {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	if len(packet) < 12 || packet[0] != startByte || packet[7] != startByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	l := int(packet[9])
+	if len(packet) < 12+l || packet[11+l] != endByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	if checksum(packet[:10+l]) != packet[10+l] {
+		return nil, ChecksumError
+	}
+	data := make([]byte, l)
+	for i := range data {
+		data[i] = packet[10+i] - offset
+	}
+	return &Frame{
+		Address: decodeAddress(packet[1:7]),
+		Control: packet[8],
+		Data:    data,
+	}, nil
+}
+
+// IsFrame 判断报文是否可能是DL/T 645帧，用于在Handler中区分不同协议的报文
+func IsFrame(packet []byte) bool {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	return len(packet) >= 12 && packet[0] == startByte && packet[7] == startByte
+}
+
+func checksum(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return sum
+}
+
+// 地址为6字节BCD，低字节在前
+func encodeAddress(address string) ([]byte, error) {
+	if len(address) != 12 {
+		return nil, fmt.Errorf("%w: address %q must be 12 digits", InvalidFrame, address)
+	}
+	b := make([]byte, 6)
+	for i := 0; i < 6; i++ {
+		hi, ok1 := hexDigit(address[2*i])
+		lo, ok2 := hexDigit(address[2*i+1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: invalid address %q", InvalidFrame, address)
+		}
+		b[5-i] = hi<<4 | lo
+	}
+	return b, nil
+}
+
+func decodeAddress(b []byte) string {
+	const digits = "0123456789ABCDEF"
+	s := make([]byte, 0, 12)
+	for i := len(b) - 1; i >= 0; i-- {
+		s = append(s, digits[b[i]>>4], digits[b[i]&0x0f])
+	}
+	return string(s)
+}
+
+// 地址中允许出现通配符A
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c == 'A' || c == 'a':
+		return 0x0a, true
+	}
+	return 0, false
+}
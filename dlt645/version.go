@@ -0,0 +1,93 @@
+package dlt645
+
+import "encoding/binary"
+
+// Version 协议版本
+type Version int
+
+const (
+	// 未知版本，Client首次通信时自动检测
+	VersionUnknown Version = 0
+	V1997          Version = 1997
+	V2007          Version = 2007
+)
+
+// DL/T 645-1997的控制码功能部分，广播校时与2007相同
+const (
+	Read1997         = uint8(0x01)
+	ReadFollow1997   = uint8(0x02)
+	Reread1997       = uint8(0x03)
+	Write1997        = uint8(0x04)
+	WriteAddress1997 = uint8(0x0A)
+)
+
+// Items1997 DL/T 645-1997的数据格式，以对应的2007数据标识为键，Item.DI为1997的2字节数据标识，
+// 调用方始终使用2007的数据标识，Client根据电表的版本选择
+var Items1997 = map[DI]Item{
+	ForwardActiveEnergy: {0x9010, "正向有功总电能", 4, 2, false, "kWh"},
+	ReverseActiveEnergy: {0x9020, "反向有功总电能", 4, 2, false, "kWh"},
+	VoltageA:            {0xB611, "A相电压", 2, 0, false, "V"},
+	VoltageB:            {0xB612, "B相电压", 2, 0, false, "V"},
+	VoltageC:            {0xB613, "C相电压", 2, 0, false, "V"},
+	CurrentA:            {0xB621, "A相电流", 2, 2, false, "A"},
+	CurrentB:            {0xB622, "B相电流", 2, 2, false, "A"},
+	CurrentC:            {0xB623, "C相电流", 2, 2, false, "A"},
+	ActivePower:         {0xB630, "总有功功率", 3, 4, true, "kW"},
+	ActivePowerA:        {0xB631, "A相有功功率", 3, 4, true, "kW"},
+	ActivePowerB:        {0xB632, "B相有功功率", 3, 4, true, "kW"},
+	ActivePowerC:        {0xB633, "C相有功功率", 3, 4, true, "kW"},
+	ReactivePower:       {0xB640, "总无功功率", 2, 2, true, "kvar"},
+	PowerFactor:         {0xB650, "总功率因数", 2, 3, true, ""},
+	Date:                {0xC010, "日期及星期", 4, 0, false, ""},
+	Time:                {0xC011, "时间", 3, 0, false, ""},
+	CommAddress:         {0xC032, "表号", 6, 0, false, ""},
+}
+
+// Catalogue 返回数据标识在指定版本中的格式，di为2007的数据标识
+func Catalogue(v Version, di DI) (Item, bool) {
+	if v == V1997 {
+		item, ok := Items1997[di]
+		return item, ok
+	}
+	item, ok := Items[di]
+	return item, ok
+}
+
+// Version 根据控制码和数据长度判断帧的版本，广播校时两个版本相同，返回VersionUnknown
+func (f *Frame) Version() Version {
+	switch f.Function() {
+	case Read1997, ReadFollow1997, Write1997, WriteAddress1997:
+		return V1997
+	case Reread1997:
+		// 2007中0x03为安全认证，1997的重读请求没有数据，应答以2字节数据标识开头
+		if len(f.Data) == 0 || (f.IsResponse() && len(f.Data) < 8) {
+			return V1997
+		}
+		return V2007
+	case BroadcastTime:
+		return VersionUnknown
+	case Read, ReadFollow, ReadAddress, Write:
+		return V2007
+	}
+	if f.Function() > 0x10 {
+		return V2007
+	}
+	return V1997
+}
+
+// DI 返回帧中的数据标识，1997为2字节，2007为4字节
+func (f *Frame) DI() (DI, bool) {
+	switch f.Version() {
+	case V1997:
+		if len(f.Data) < 2 {
+			return 0, false
+		}
+		return DI(binary.LittleEndian.Uint16(f.Data)), true
+	case V2007:
+		if len(f.Data) < 4 {
+			return 0, false
+		}
+		return DI(binary.LittleEndian.Uint32(f.Data)), true
+	}
+	return 0, false
+}
@@ -0,0 +1,469 @@
+package dlt698
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 应用层服务
+const (
+	LinkRequest   = uint8(1)
+	GetRequest    = uint8(5)
+	SetRequest    = uint8(6)
+	ActionRequest = uint8(7)
+	// 客户机对上报通知的应答
+	ReportResponse = uint8(8)
+
+	LinkResponse       = uint8(129)
+	GetResponse        = uint8(133)
+	SetResponse        = uint8(134)
+	ActionResponse     = uint8(135)
+	ReportNotification = uint8(136)
+)
+
+// 服务的类型
+const (
+	Normal     = uint8(1)
+	NormalList = uint8(2)
+	Record     = uint8(3)
+
+	// 上报通知的类型
+	ReportList       = uint8(1)
+	ReportRecordList = uint8(2)
+)
+
+// 链路请求的类型
+const (
+	LinkLogin     = uint8(0)
+	LinkHeartbeat = uint8(1)
+	LinkLogout    = uint8(2)
+)
+
+var (
+	InvalidAPDU = errors.New("invalid dlt698 apdu")
+	// 应答与请求的服务或者服务序号不一致
+	UnexpectedResponse = errors.New("unexpected dlt698 response")
+)
+
+// DAR 数据访问结果
+type DAR uint8
+
+var darNames = map[DAR]string{
+	0:   "成功",
+	1:   "硬件失效",
+	2:   "暂时失效",
+	3:   "拒绝读写",
+	4:   "对象未定义",
+	5:   "对象接口类不符合",
+	6:   "对象不存在",
+	7:   "类型不匹配",
+	8:   "越界",
+	9:   "数据块不可用",
+	15:  "密码错/未授权",
+	16:  "通信速率不能更改",
+	20:  "安全认证不匹配",
+	22:  "ESAM验证失败",
+	23:  "安全认证失败",
+	32:  "时间标签无效",
+	33:  "请求超时",
+	255: "其它",
+}
+
+func (e DAR) Error() string {
+	if name, ok := darNames[e]; ok {
+		return fmt.Sprintf("dlt698 dar %d: %v", uint8(e), name)
+	}
+	return fmt.Sprintf("dlt698 dar %d", uint8(e))
+}
+
+type (
+	// RSD 记录选择描述符，支持方法0、1、2、9
+	RSD struct {
+		Selector uint8
+		// 方法1、2的对象属性描述符，例如数据冻结时间0x20210200
+		OAD OAD
+		// 方法1：指定值
+		Value Data
+		// 方法2：起始值、结束值和数据间隔
+		From, To, Interval Data
+		// 方法9：上第n次记录
+		Last uint8
+	}
+
+	// Result 一个对象属性的读取结果，DAR为0时Data有效
+	Result struct {
+		OAD  OAD
+		DAR  DAR
+		Data Data
+	}
+
+	// RecordResult 记录型对象属性的读取结果，每行的列与RCSD一一对应
+	RecordResult struct {
+		OAD  OAD
+		RCSD []CSD
+		DAR  DAR
+		Rows [][]Data
+	}
+
+	// APDU 解析之后的应用层数据单元，按Service和Type使用对应的字段
+	APDU struct {
+		Service uint8
+		Type    uint8
+		// 服务序号及优先级，应答中bit6为请求访问标志
+		PIID uint8
+
+		// GetRequestNormal、GetRequestRecord、SetRequest的对象属性描述符
+		OAD OAD
+		// GetRequestRecord的记录选择描述符和记录列选择描述符
+		RSD  RSD
+		RCSD []CSD
+		// SetRequest的数据
+		Data Data
+		// ActionRequest、ActionResponse的对象方法描述符
+		OMD OMD
+
+		// GetResponseNormal、SetResponse、ActionResponse、ReportNotificationList的结果，
+		// SetResponse和ActionResponse只有一个结果，ActionResponse的OAD为OMD
+		Results []Result
+		// GetResponseRecord、ReportNotificationRecordList的结果
+		Records []RecordResult
+
+		// LinkRequest
+		LinkType    uint8
+		Heartbeat   uint16
+		RequestTime time.Time
+	}
+)
+
+// PIID 生成服务序号，序号只保留低6位
+func PIID(seq uint8, high bool) uint8 {
+	piid := seq & 0x3f
+	if high {
+		piid |= 0x80
+	}
+	return piid
+}
+
+func appendRSD(b []byte, rsd RSD) ([]byte, error) {
+	b = append(b, rsd.Selector)
+	var err error
+	switch rsd.Selector {
+	case 0:
+	case 1:
+		b = appendUint32(b, uint32(rsd.OAD))
+		b, err = appendData(b, rsd.Value)
+	case 2:
+		b = appendUint32(b, uint32(rsd.OAD))
+		for _, d := range []Data{rsd.From, rsd.To, rsd.Interval} {
+			if b, err = appendData(b, d); err != nil {
+				return nil, err
+			}
+		}
+	case 9:
+		b = append(b, rsd.Last)
+	default:
+		return nil, fmt.Errorf("%w: rsd selector %v", UnsupportedType, rsd.Selector)
+	}
+	return b, err
+}
+
+func (d *decoder) rsd() (RSD, error) {
+	var rsd RSD
+	var err error
+	if rsd.Selector, err = d.byte(); err != nil {
+		return rsd, err
+	}
+	switch rsd.Selector {
+	case 0:
+	case 1:
+		if rsd.OAD, err = d.oad(); err != nil {
+			return rsd, err
+		}
+		rsd.Value, err = d.data()
+	case 2:
+		if rsd.OAD, err = d.oad(); err != nil {
+			return rsd, err
+		}
+		for _, p := range []*Data{&rsd.From, &rsd.To, &rsd.Interval} {
+			if *p, err = d.data(); err != nil {
+				return rsd, err
+			}
+		}
+	case 9:
+		rsd.Last, err = d.byte()
+	default:
+		err = fmt.Errorf("%w: rsd selector %v", UnsupportedType, rsd.Selector)
+	}
+	return rsd, err
+}
+
+// NewGetRequestNormal 读取一个对象属性
+func NewGetRequestNormal(piid uint8, oad OAD) []byte {
+	b := []byte{GetRequest, Normal, piid}
+	b = appendUint32(b, uint32(oad))
+	// 没有时间标签
+	return append(b, 0)
+}
+
+// NewGetRequestRecord 读取记录型对象属性，例如冻结数据
+func NewGetRequestRecord(piid uint8, oad OAD, rsd RSD, rcsd []CSD) ([]byte, error) {
+	b := []byte{GetRequest, Record, piid}
+	b = appendUint32(b, uint32(oad))
+	b, err := appendRSD(b, rsd)
+	if err != nil {
+		return nil, err
+	}
+	b = appendRCSD(b, rcsd)
+	return append(b, 0), nil
+}
+
+// NewSetRequestNormal 设置一个对象属性
+func NewSetRequestNormal(piid uint8, oad OAD, data Data) ([]byte, error) {
+	b := []byte{SetRequest, Normal, piid}
+	b = appendUint32(b, uint32(oad))
+	b, err := appendData(b, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, 0), nil
+}
+
+// NewActionRequest 操作一个对象方法
+func NewActionRequest(piid uint8, omd OMD, data Data) ([]byte, error) {
+	b := []byte{ActionRequest, Normal, piid}
+	b = appendUint32(b, uint32(omd))
+	b, err := appendData(b, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, 0), nil
+}
+
+// NewReportResponse 确认上报通知，typ为ReportList或ReportRecordList
+func NewReportResponse(typ, piid uint8, oads []OAD) []byte {
+	b := []byte{ReportResponse, typ, piid}
+	b = appendLength(b, len(oads))
+	for _, oad := range oads {
+		b = appendUint32(b, uint32(oad))
+	}
+	return b
+}
+
+// NewLinkResponse 应答电表的登录、心跳和退出登录，received为收到请求的时间
+func NewLinkResponse(piid uint8, requested, received, now time.Time) []byte {
+	// 结果：bit7时钟可信，低3位为0表示成功
+	b := []byte{LinkResponse, piid, 0x80}
+	b = appendDateTime(b, requested, true, true)
+	b = appendDateTime(b, received, true, true)
+	return appendDateTime(b, now, true, true)
+}
+
+// ParseAPDU 解析LinkRequest、GetRequest（Normal、Record）、SetRequest、ActionRequest，
+// 以及GetResponse（Normal、Record）、SetResponse、ActionResponse和ReportNotification
+func ParseAPDU(b []byte) (*APDU, error) {
+	d := &decoder{b: b}
+	a := &APDU{}
+	var err error
+	if a.Service, err = d.byte(); err != nil {
+		return nil, err
+	}
+	if a.Service == LinkRequest {
+		err = d.linkRequest(a)
+	} else {
+		if a.Type, err = d.byte(); err != nil {
+			return nil, err
+		}
+		if a.PIID, err = d.byte(); err != nil {
+			return nil, err
+		}
+		err = d.service(a)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (d *decoder) linkRequest(a *APDU) error {
+	var err error
+	if a.PIID, err = d.byte(); err != nil {
+		return err
+	}
+	if a.LinkType, err = d.byte(); err != nil {
+		return err
+	}
+	if a.Heartbeat, err = d.uint16(); err != nil {
+		return err
+	}
+	a.RequestTime, err = d.dateTime(true, true)
+	return err
+}
+
+func (d *decoder) service(a *APDU) error {
+	var err error
+	switch {
+	case a.Service == GetRequest && a.Type == Normal:
+		a.OAD, err = d.oad()
+	case a.Service == GetRequest && a.Type == Record:
+		if a.OAD, err = d.oad(); err != nil {
+			return err
+		}
+		if a.RSD, err = d.rsd(); err != nil {
+			return err
+		}
+		a.RCSD, err = d.rcsd()
+	case a.Service == SetRequest && a.Type == Normal:
+		if a.OAD, err = d.oad(); err != nil {
+			return err
+		}
+		a.Data, err = d.data()
+	case a.Service == ActionRequest && a.Type == Normal:
+		var v uint32
+		if v, err = d.uint32(); err != nil {
+			return err
+		}
+		a.OMD = OMD(v)
+		a.Data, err = d.data()
+	case a.Service == GetResponse && a.Type == Normal:
+		var r Result
+		if r, err = d.resultNormal(); err == nil {
+			a.Results = []Result{r}
+		}
+	case a.Service == GetResponse && a.Type == Record:
+		var r RecordResult
+		if r, err = d.resultRecord(); err == nil {
+			a.Records = []RecordResult{r}
+		}
+	case a.Service == SetResponse && a.Type == Normal:
+		var r Result
+		if r.OAD, err = d.oad(); err != nil {
+			return err
+		}
+		var dar byte
+		dar, err = d.byte()
+		r.DAR = DAR(dar)
+		a.OAD = r.OAD
+		a.Results = []Result{r}
+	case a.Service == ActionResponse && a.Type == Normal:
+		err = d.actionResult(a)
+	case a.Service == ReportNotification && a.Type == ReportList:
+		var n int
+		if n, err = d.length(); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			r, err := d.resultNormal()
+			if err != nil {
+				return err
+			}
+			a.Results = append(a.Results, r)
+		}
+	case a.Service == ReportNotification && a.Type == ReportRecordList:
+		var n int
+		if n, err = d.length(); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			r, err := d.resultRecord()
+			if err != nil {
+				return err
+			}
+			a.Records = append(a.Records, r)
+		}
+	default:
+		return fmt.Errorf("%w: service %v type %v", InvalidAPDU, a.Service, a.Type)
+	}
+	// 忽略之后的跟随上报信息域和时间标签
+	return err
+}
+
+// A-ResultNormal：OAD和Get-Result，Get-Result为0时是DAR，为1时是Data
+func (d *decoder) resultNormal() (Result, error) {
+	var r Result
+	var err error
+	if r.OAD, err = d.oad(); err != nil {
+		return r, err
+	}
+	choice, err := d.byte()
+	if err != nil {
+		return r, err
+	}
+	switch choice {
+	case 0:
+		var dar byte
+		dar, err = d.byte()
+		r.DAR = DAR(dar)
+	case 1:
+		r.Data, err = d.data()
+	default:
+		err = fmt.Errorf("%w: get result choice %v", InvalidAPDU, choice)
+	}
+	return r, err
+}
+
+// A-ResultRecord：OAD、RCSD和记录，记录为0时是DAR，为1时是若干行
+func (d *decoder) resultRecord() (RecordResult, error) {
+	var r RecordResult
+	var err error
+	if r.OAD, err = d.oad(); err != nil {
+		return r, err
+	}
+	if r.RCSD, err = d.rcsd(); err != nil {
+		return r, err
+	}
+	choice, err := d.byte()
+	if err != nil {
+		return r, err
+	}
+	switch choice {
+	case 0:
+		var dar byte
+		dar, err = d.byte()
+		r.DAR = DAR(dar)
+	case 1:
+		var n int
+		if n, err = d.length(); err != nil {
+			return r, err
+		}
+		for i := 0; i < n; i++ {
+			row := make([]Data, 0, len(r.RCSD))
+			for j := 0; j < len(r.RCSD); j++ {
+				v, err := d.data()
+				if err != nil {
+					return r, err
+				}
+				row = append(row, v)
+			}
+			r.Rows = append(r.Rows, row)
+		}
+	default:
+		err = fmt.Errorf("%w: record result choice %v", InvalidAPDU, choice)
+	}
+	return r, err
+}
+
+// ActionResponseNormal：OMD、DAR和可选的返回数据
+func (d *decoder) actionResult(a *APDU) error {
+	v, err := d.uint32()
+	if err != nil {
+		return err
+	}
+	a.OMD = OMD(v)
+	dar, err := d.byte()
+	if err != nil {
+		return err
+	}
+	r := Result{OAD: OAD(v), DAR: DAR(dar)}
+	optional, err := d.byte()
+	if err != nil {
+		return err
+	}
+	if optional != 0 {
+		if r.Data, err = d.data(); err != nil {
+			return err
+		}
+	}
+	a.Results = []Result{r}
+	return nil
+}
@@ -0,0 +1,217 @@
+package dlt698
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 客户机发起的用户数据帧，服务器的应答为0xC3
+const requestControl = ControlPRM | FunctionData
+
+type (
+	// Transport 与电表通信的连接，*modbus.Conn和*nb.Conn都实现了该接口。
+	// 与modbus相同，Server.Handler需要将电表的应答通过Conn.Send交给Client，
+	// 电表主动发出的登录、心跳和上报通知可以通过Respond生成应答
+	Transport interface {
+		Write(buf []byte) (int, error)
+		Receive() ([]byte, error)
+		Lock()
+		Unlock()
+	}
+
+	// Client 与一个电表通信
+	Client struct {
+		Transport Transport
+
+		// 服务器地址
+		Address string
+
+		// 客户机地址
+		ClientAddress uint8
+
+		// 是否不发送前导字节，默认发送
+		NoPreamble bool
+
+		// 服务序号
+		seq uint32
+	}
+)
+
+func NewClient(t Transport, address string) *Client {
+	return &Client{Transport: t, Address: address}
+}
+
+func (c *Client) piid() uint8 {
+	return PIID(uint8(atomic.AddUint32(&c.seq, 1)), false)
+}
+
+// Exchange 发送请求并等待应答，应答的服务和服务序号必须与请求一致
+func (c *Client) Exchange(apdu []byte) (*APDU, error) {
+	b, err := (&Frame{Control: requestControl, Address: c.Address, ClientAddress: c.ClientAddress, APDU: apdu}).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if !c.NoPreamble {
+		b = append(append([]byte{}, Preamble...), b...)
+	}
+	c.Transport.Lock()
+	defer c.Transport.Unlock()
+	if _, err := c.Transport.Write(b); err != nil {
+		return nil, err
+	}
+	out, err := c.Transport.Receive()
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewFrame(out)
+	if err != nil {
+		return nil, err
+	}
+	if !f.FromServer() {
+		return nil, UnexpectedResponse
+	}
+	resp, err := ParseAPDU(f.APDU)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Service != apdu[0]|0x80 || resp.Type != apdu[1] || resp.PIID&0x3f != apdu[2]&0x3f {
+		return nil, UnexpectedResponse
+	}
+	return resp, nil
+}
+
+func firstResult(resp *APDU) (Result, error) {
+	if len(resp.Results) != 1 {
+		return Result{}, UnexpectedResponse
+	}
+	r := resp.Results[0]
+	if r.DAR != 0 {
+		return r, r.DAR
+	}
+	return r, nil
+}
+
+// Get 读取一个对象属性，数据访问失败时返回DAR
+func (c *Client) Get(oad OAD) (Data, error) {
+	resp, err := c.Exchange(NewGetRequestNormal(c.piid(), oad))
+	if err != nil {
+		return Data{}, err
+	}
+	r, err := firstResult(resp)
+	if err != nil {
+		return Data{}, err
+	}
+	if r.OAD != oad {
+		return Data{}, UnexpectedResponse
+	}
+	return r.Data, nil
+}
+
+// GetValues 读取对象属性并按Items中的换算转换为实际值，数组依次转换每个元素，其他数值只有一个元素
+func (c *Client) GetValues(oad OAD) ([]float64, error) {
+	item, ok := Lookup(oad)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown oad %v", UnsupportedType, oad)
+	}
+	d, err := c.Get(oad)
+	if err != nil {
+		return nil, err
+	}
+	items := []Data{d}
+	if d.Type == TypeArray {
+		items = d.Items()
+	}
+	values := make([]float64, 0, len(items))
+	for _, v := range items {
+		f, ok := v.Scaled(item.Scaler)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v is not a number", UnsupportedType, v.Type)
+		}
+		values = append(values, f)
+	}
+	return values, nil
+}
+
+// GetRecord 读取记录型对象属性，例如以RSD{Selector: 9, Last: 1}读取上一次日冻结
+func (c *Client) GetRecord(oad OAD, rsd RSD, rcsd []CSD) (*RecordResult, error) {
+	apdu, err := NewGetRequestRecord(c.piid(), oad, rsd, rcsd)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Exchange(apdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Records) != 1 || resp.Records[0].OAD != oad {
+		return nil, UnexpectedResponse
+	}
+	r := resp.Records[0]
+	if r.DAR != 0 {
+		return nil, r.DAR
+	}
+	return &r, nil
+}
+
+// Set 设置一个对象属性
+func (c *Client) Set(oad OAD, data Data) error {
+	apdu, err := NewSetRequestNormal(c.piid(), oad, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Exchange(apdu)
+	if err != nil {
+		return err
+	}
+	_, err = firstResult(resp)
+	return err
+}
+
+// Action 操作一个对象方法，返回电表的返回数据
+func (c *Client) Action(omd OMD, data Data) (Data, error) {
+	apdu, err := NewActionRequest(c.piid(), omd, data)
+	if err != nil {
+		return Data{}, err
+	}
+	resp, err := c.Exchange(apdu)
+	if err != nil {
+		return Data{}, err
+	}
+	r, err := firstResult(resp)
+	return r.Data, err
+}
+
+// SetTime 设置电表的日期时间
+func (c *Client) SetTime(t time.Time) error {
+	return c.Set(DateTime, Data{Type: TypeDateTimeS, Value: t})
+}
+
+// Respond 为电表主动发出的登录、心跳、退出登录和上报通知生成应答帧，其他帧返回nil
+func Respond(f *Frame, now time.Time) (*Frame, error) {
+	if !f.FromServer() || len(f.APDU) == 0 {
+		return nil, nil
+	}
+	a, err := ParseAPDU(f.APDU)
+	if err != nil {
+		return nil, err
+	}
+	resp := &Frame{AddressType: f.AddressType, Logical: f.Logical, Address: f.Address, ClientAddress: f.ClientAddress}
+	switch a.Service {
+	case LinkRequest:
+		resp.Control = FunctionLink
+		resp.APDU = NewLinkResponse(a.PIID, a.RequestTime, now, now)
+	case ReportNotification:
+		resp.Control = FunctionData
+		var oads []OAD
+		for _, r := range a.Results {
+			oads = append(oads, r.OAD)
+		}
+		for _, r := range a.Records {
+			oads = append(oads, r.OAD)
+		}
+		resp.APDU = NewReportResponse(a.Type, a.PIID, oads)
+	default:
+		return nil, nil
+	}
+	return resp, nil
+}
@@ -0,0 +1,27 @@
+package dlt698
+
+// CRC-16/X.25，多项式0x1021（反序0x8408），初值和结果异或值均为0xFFFF
+var crcTable [256]uint16
+
+func init() {
+	for i := range crcTable {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+		crcTable[i] = crc
+	}
+}
+
+// CRC16 计算帧头校验HCS和帧校验FCS
+func CRC16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, v := range b {
+		crc = crc>>8 ^ crcTable[byte(crc)^v]
+	}
+	return ^crc
+}
@@ -0,0 +1,709 @@
+package dlt698
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// 数据类型
+const (
+	TypeNull               = uint8(0)
+	TypeArray              = uint8(1)
+	TypeStructure          = uint8(2)
+	TypeBool               = uint8(3)
+	TypeBitString          = uint8(4)
+	TypeDoubleLong         = uint8(5)
+	TypeDoubleLongUnsigned = uint8(6)
+	TypeOctetString        = uint8(9)
+	TypeVisibleString      = uint8(10)
+	TypeUTF8String         = uint8(12)
+	TypeInteger            = uint8(15)
+	TypeLong               = uint8(16)
+	TypeUnsigned           = uint8(17)
+	TypeLongUnsigned       = uint8(18)
+	TypeLong64             = uint8(20)
+	TypeLong64Unsigned     = uint8(21)
+	TypeEnum               = uint8(22)
+	TypeFloat32            = uint8(23)
+	TypeFloat64            = uint8(24)
+	TypeDateTime           = uint8(25)
+	TypeDate               = uint8(26)
+	TypeTime               = uint8(27)
+	TypeDateTimeS          = uint8(28)
+	TypeOI                 = uint8(80)
+	TypeOAD                = uint8(81)
+	TypeROAD               = uint8(82)
+	TypeOMD                = uint8(83)
+	TypeTI                 = uint8(84)
+	TypeTSA                = uint8(85)
+	TypeScalerUnit         = uint8(89)
+	TypeCSD                = uint8(91)
+	TypeRCSD               = uint8(96)
+)
+
+var (
+	// 数据不完整
+	ShortData = errors.New("dlt698 data too short")
+	// 不支持的数据类型
+	UnsupportedType = errors.New("unsupported dlt698 data type")
+)
+
+type (
+	// Data 带类型的数据，Value的类型：
+	//  Null：nil
+	//  Array、Structure：[]Data
+	//  Bool：bool
+	//  BitString：BitString
+	//  DoubleLong：int32，DoubleLongUnsigned：uint32
+	//  OctetString、TSA：[]byte，VisibleString、UTF8String：string
+	//  Integer：int8，Long：int16，Unsigned、Enum：uint8，LongUnsigned：uint16
+	//  Long64：int64，Long64Unsigned：uint64，Float32：float32，Float64：float64
+	//  DateTime、Date、DateTimeS：time.Time（time.Local），Time：time.Duration（距零点）
+	//  OI：OI，OAD：OAD，ROAD：ROAD，OMD：OMD，TI：TI，ScalerUnit：ScalerUnit，CSD：CSD，RCSD：[]CSD
+	Data struct {
+		Type  uint8
+		Value interface{}
+	}
+
+	// OI 对象标识
+	OI uint16
+
+	// OAD 对象属性描述符，由对象标识、属性特征与属性标识、属性内元素索引组成，例如0x00100200
+	OAD uint32
+
+	// OMD 对象方法描述符，由对象标识、方法标识、操作模式组成
+	OMD uint32
+
+	// ROAD 记录型对象属性描述符
+	ROAD struct {
+		OAD     OAD
+		Related []OAD
+	}
+
+	// CSD 列选择描述符，ROAD不为nil时为记录型对象属性描述符，否则为OAD
+	CSD struct {
+		OAD  OAD
+		ROAD *ROAD
+	}
+
+	BitString struct {
+		// 位数
+		Len   int
+		Bytes []byte
+	}
+
+	// TI 时间间隔，Unit：0秒、1分、2时、3日、4月、5年
+	TI struct {
+		Unit     uint8
+		Interval uint16
+	}
+
+	// ScalerUnit 换算及单位
+	ScalerUnit struct {
+		Scaler int8
+		Unit   uint8
+	}
+
+	decoder struct {
+		b   []byte
+		off int
+	}
+)
+
+// OI 对象标识
+func (oad OAD) OI() OI {
+	return OI(oad >> 16)
+}
+
+// Attribute 属性标识，不含属性特征
+func (oad OAD) Attribute() uint8 {
+	return uint8(oad>>8) & 0x1f
+}
+
+// Index 属性内元素索引，0表示整个属性
+func (oad OAD) Index() uint8 {
+	return uint8(oad)
+}
+
+func (oad OAD) String() string {
+	return fmt.Sprintf("%08X", uint32(oad))
+}
+
+func (omd OMD) String() string {
+	return fmt.Sprintf("%08X", uint32(omd))
+}
+
+// Float 将数值类型转换为float64
+func (d Data) Float() (float64, bool) {
+	switch v := d.Value.(type) {
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Scaled 按换算转换为实际值，例如scaler为-2时除以100
+func (d Data) Scaled(scaler int8) (float64, bool) {
+	v, ok := d.Float()
+	if !ok {
+		return 0, false
+	}
+	// 除以10的幂可以避免220.10000000000002这样的误差
+	if scaler < 0 {
+		return v / math.Pow10(-int(scaler)), true
+	}
+	return v * math.Pow10(int(scaler)), true
+}
+
+// Items 数组或者结构体的元素
+func (d Data) Items() []Data {
+	items, _ := d.Value.([]Data)
+	return items
+}
+
+// DecodeData 解析一个数据，返回数据和占用的字节数
+func DecodeData(b []byte) (Data, int, error) {
+	d := &decoder{b: b}
+	data, err := d.data()
+	return data, d.off, err
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || d.off+n > len(d.b) {
+		return nil, ShortData
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// 可变长度：小于0x80时为一个字节，否则低7位为后续长度字节数
+func (d *decoder) length() (int, error) {
+	l, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	if l&0x80 == 0 {
+		return int(l), nil
+	}
+	b, err := d.next(int(l & 0x7f))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, v := range b {
+		n = n<<8 | int(v)
+		if n > len(d.b) {
+			return 0, ShortData
+		}
+	}
+	return n, nil
+}
+
+func (d *decoder) oad() (OAD, error) {
+	v, err := d.uint32()
+	return OAD(v), err
+}
+
+func (d *decoder) road() (ROAD, error) {
+	var r ROAD
+	var err error
+	if r.OAD, err = d.oad(); err != nil {
+		return r, err
+	}
+	n, err := d.length()
+	if err != nil {
+		return r, err
+	}
+	for i := 0; i < n; i++ {
+		oad, err := d.oad()
+		if err != nil {
+			return r, err
+		}
+		r.Related = append(r.Related, oad)
+	}
+	return r, nil
+}
+
+func (d *decoder) csd() (CSD, error) {
+	choice, err := d.byte()
+	if err != nil {
+		return CSD{}, err
+	}
+	switch choice {
+	case 0:
+		oad, err := d.oad()
+		return CSD{OAD: oad}, err
+	case 1:
+		r, err := d.road()
+		return CSD{OAD: r.OAD, ROAD: &r}, err
+	}
+	return CSD{}, fmt.Errorf("%w: csd choice %v", UnsupportedType, choice)
+}
+
+func (d *decoder) rcsd() ([]CSD, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	csds := make([]CSD, 0, n)
+	for i := 0; i < n; i++ {
+		csd, err := d.csd()
+		if err != nil {
+			return nil, err
+		}
+		csds = append(csds, csd)
+	}
+	return csds, nil
+}
+
+func (d *decoder) dateTime(withMillis, withWeek bool) (time.Time, error) {
+	year, err := d.uint16()
+	if err != nil {
+		return time.Time{}, err
+	}
+	n := 5
+	if withWeek {
+		n++
+	}
+	if withMillis {
+		n += 2
+	}
+	b, err := d.next(n)
+	if err != nil {
+		return time.Time{}, err
+	}
+	month, day := b[0], b[1]
+	if withWeek {
+		b = b[1:]
+	}
+	hour, minute, second := b[2], b[3], b[4]
+	var ms int
+	if withMillis {
+		ms = int(binary.BigEndian.Uint16(b[5:]))
+	}
+	return time.Date(int(year), time.Month(month), int(day), int(hour), int(minute), int(second), ms*int(time.Millisecond), time.Local), nil
+}
+
+func (d *decoder) data() (Data, error) {
+	t, err := d.byte()
+	if err != nil {
+		return Data{}, err
+	}
+	data := Data{Type: t}
+	switch t {
+	case TypeNull:
+	case TypeArray, TypeStructure:
+		n, err := d.length()
+		if err != nil {
+			return data, err
+		}
+		items := make([]Data, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := d.data()
+			if err != nil {
+				return data, err
+			}
+			items = append(items, item)
+		}
+		data.Value = items
+	case TypeBool:
+		v, err := d.byte()
+		data.Value = v != 0
+		return data, err
+	case TypeBitString:
+		n, err := d.length()
+		if err != nil {
+			return data, err
+		}
+		b, err := d.next((n + 7) / 8)
+		data.Value = BitString{Len: n, Bytes: append([]byte(nil), b...)}
+		return data, err
+	case TypeDoubleLong:
+		v, err := d.uint32()
+		data.Value = int32(v)
+		return data, err
+	case TypeDoubleLongUnsigned:
+		v, err := d.uint32()
+		data.Value = v
+		return data, err
+	case TypeOctetString, TypeVisibleString, TypeUTF8String, TypeTSA:
+		n, err := d.length()
+		if err != nil {
+			return data, err
+		}
+		b, err := d.next(n)
+		if t == TypeVisibleString || t == TypeUTF8String {
+			data.Value = string(b)
+		} else {
+			data.Value = append([]byte(nil), b...)
+		}
+		return data, err
+	case TypeInteger:
+		v, err := d.byte()
+		data.Value = int8(v)
+		return data, err
+	case TypeLong:
+		v, err := d.uint16()
+		data.Value = int16(v)
+		return data, err
+	case TypeUnsigned, TypeEnum:
+		v, err := d.byte()
+		data.Value = v
+		return data, err
+	case TypeLongUnsigned:
+		v, err := d.uint16()
+		data.Value = v
+		return data, err
+	case TypeLong64, TypeLong64Unsigned, TypeFloat64:
+		b, err := d.next(8)
+		if err != nil {
+			return data, err
+		}
+		v := binary.BigEndian.Uint64(b)
+		switch t {
+		case TypeLong64:
+			data.Value = int64(v)
+		case TypeLong64Unsigned:
+			data.Value = v
+		default:
+			data.Value = math.Float64frombits(v)
+		}
+	case TypeFloat32:
+		v, err := d.uint32()
+		data.Value = math.Float32frombits(v)
+		return data, err
+	case TypeDateTime:
+		v, err := d.dateTime(true, true)
+		data.Value = v
+		return data, err
+	case TypeDateTimeS:
+		v, err := d.dateTime(false, false)
+		data.Value = v
+		return data, err
+	case TypeDate:
+		year, err := d.uint16()
+		if err != nil {
+			return data, err
+		}
+		b, err := d.next(3)
+		if err != nil {
+			return data, err
+		}
+		data.Value = time.Date(int(year), time.Month(b[0]), int(b[1]), 0, 0, 0, 0, time.Local)
+	case TypeTime:
+		b, err := d.next(3)
+		if err != nil {
+			return data, err
+		}
+		data.Value = time.Duration(b[0])*time.Hour + time.Duration(b[1])*time.Minute + time.Duration(b[2])*time.Second
+	case TypeOI:
+		v, err := d.uint16()
+		data.Value = OI(v)
+		return data, err
+	case TypeOAD:
+		v, err := d.oad()
+		data.Value = v
+		return data, err
+	case TypeOMD:
+		v, err := d.uint32()
+		data.Value = OMD(v)
+		return data, err
+	case TypeROAD:
+		v, err := d.road()
+		data.Value = v
+		return data, err
+	case TypeTI:
+		b, err := d.next(3)
+		if err != nil {
+			return data, err
+		}
+		data.Value = TI{Unit: b[0], Interval: binary.BigEndian.Uint16(b[1:])}
+	case TypeScalerUnit:
+		b, err := d.next(2)
+		if err != nil {
+			return data, err
+		}
+		data.Value = ScalerUnit{Scaler: int8(b[0]), Unit: b[1]}
+	case TypeCSD:
+		v, err := d.csd()
+		data.Value = v
+		return data, err
+	case TypeRCSD:
+		v, err := d.rcsd()
+		data.Value = v
+		return data, err
+	default:
+		return data, fmt.Errorf("%w: %v", UnsupportedType, t)
+	}
+	return data, nil
+}
+
+// Bytes 编码为A-XDR
+func (d Data) Bytes() ([]byte, error) {
+	return appendData(nil, d)
+}
+
+func appendLength(b []byte, n int) []byte {
+	switch {
+	case n < 0x80:
+		return append(b, byte(n))
+	case n <= 0xff:
+		return append(b, 0x81, byte(n))
+	default:
+		return append(b, 0x82, byte(n>>8), byte(n))
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendROAD(b []byte, r ROAD) []byte {
+	b = appendUint32(b, uint32(r.OAD))
+	b = appendLength(b, len(r.Related))
+	for _, oad := range r.Related {
+		b = appendUint32(b, uint32(oad))
+	}
+	return b
+}
+
+func appendCSD(b []byte, csd CSD) []byte {
+	if csd.ROAD != nil {
+		return appendROAD(append(b, 1), *csd.ROAD)
+	}
+	return appendUint32(append(b, 0), uint32(csd.OAD))
+}
+
+func appendRCSD(b []byte, rcsd []CSD) []byte {
+	b = appendLength(b, len(rcsd))
+	for _, csd := range rcsd {
+		b = appendCSD(b, csd)
+	}
+	return b
+}
+
+func appendDateTime(b []byte, t time.Time, withMillis, withWeek bool) []byte {
+	b = appendUint16(b, uint16(t.Year()))
+	b = append(b, byte(t.Month()), byte(t.Day()))
+	if withWeek {
+		b = append(b, byte(t.Weekday()))
+	}
+	b = append(b, byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+	if withMillis {
+		b = appendUint16(b, uint16(t.Nanosecond()/int(time.Millisecond)))
+	}
+	return b
+}
+
+func typeError(d Data) error {
+	return fmt.Errorf("%w: type %v with value %T", UnsupportedType, d.Type, d.Value)
+}
+
+func appendData(b []byte, d Data) ([]byte, error) {
+	b = append(b, d.Type)
+	var ok bool
+	switch d.Type {
+	case TypeNull:
+		return b, nil
+	case TypeArray, TypeStructure:
+		var items []Data
+		if items, ok = d.Value.([]Data); ok {
+			b = appendLength(b, len(items))
+			for _, item := range items {
+				var err error
+				if b, err = appendData(b, item); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case TypeBool:
+		var v bool
+		if v, ok = d.Value.(bool); ok {
+			if v {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		}
+	case TypeBitString:
+		var v BitString
+		if v, ok = d.Value.(BitString); ok {
+			b = append(appendLength(b, v.Len), v.Bytes...)
+		}
+	case TypeDoubleLong:
+		var v int32
+		if v, ok = d.Value.(int32); ok {
+			b = appendUint32(b, uint32(v))
+		}
+	case TypeDoubleLongUnsigned:
+		var v uint32
+		if v, ok = d.Value.(uint32); ok {
+			b = appendUint32(b, v)
+		}
+	case TypeOctetString, TypeTSA:
+		var v []byte
+		if v, ok = d.Value.([]byte); ok {
+			b = append(appendLength(b, len(v)), v...)
+		}
+	case TypeVisibleString, TypeUTF8String:
+		var v string
+		if v, ok = d.Value.(string); ok {
+			b = append(appendLength(b, len(v)), v...)
+		}
+	case TypeInteger:
+		var v int8
+		if v, ok = d.Value.(int8); ok {
+			b = append(b, byte(v))
+		}
+	case TypeLong:
+		var v int16
+		if v, ok = d.Value.(int16); ok {
+			b = appendUint16(b, uint16(v))
+		}
+	case TypeUnsigned, TypeEnum:
+		var v uint8
+		if v, ok = d.Value.(uint8); ok {
+			b = append(b, v)
+		}
+	case TypeLongUnsigned:
+		var v uint16
+		if v, ok = d.Value.(uint16); ok {
+			b = appendUint16(b, v)
+		}
+	case TypeLong64:
+		var v int64
+		if v, ok = d.Value.(int64); ok {
+			b = appendUint64(b, uint64(v))
+		}
+	case TypeLong64Unsigned:
+		var v uint64
+		if v, ok = d.Value.(uint64); ok {
+			b = appendUint64(b, v)
+		}
+	case TypeFloat32:
+		var v float32
+		if v, ok = d.Value.(float32); ok {
+			b = appendUint32(b, math.Float32bits(v))
+		}
+	case TypeFloat64:
+		var v float64
+		if v, ok = d.Value.(float64); ok {
+			b = appendUint64(b, math.Float64bits(v))
+		}
+	case TypeDateTime, TypeDateTimeS, TypeDate:
+		var v time.Time
+		if v, ok = d.Value.(time.Time); ok {
+			switch d.Type {
+			case TypeDateTime:
+				b = appendDateTime(b, v, true, true)
+			case TypeDateTimeS:
+				b = appendDateTime(b, v, false, false)
+			default:
+				b = append(appendUint16(b, uint16(v.Year())), byte(v.Month()), byte(v.Day()), byte(v.Weekday()))
+			}
+		}
+	case TypeTime:
+		var v time.Duration
+		if v, ok = d.Value.(time.Duration); ok {
+			b = append(b, byte(v/time.Hour), byte(v%time.Hour/time.Minute), byte(v%time.Minute/time.Second))
+		}
+	case TypeOI:
+		var v OI
+		if v, ok = d.Value.(OI); ok {
+			b = appendUint16(b, uint16(v))
+		}
+	case TypeOAD:
+		var v OAD
+		if v, ok = d.Value.(OAD); ok {
+			b = appendUint32(b, uint32(v))
+		}
+	case TypeOMD:
+		var v OMD
+		if v, ok = d.Value.(OMD); ok {
+			b = appendUint32(b, uint32(v))
+		}
+	case TypeROAD:
+		var v ROAD
+		if v, ok = d.Value.(ROAD); ok {
+			b = appendROAD(b, v)
+		}
+	case TypeTI:
+		var v TI
+		if v, ok = d.Value.(TI); ok {
+			b = appendUint16(append(b, v.Unit), v.Interval)
+		}
+	case TypeScalerUnit:
+		var v ScalerUnit
+		if v, ok = d.Value.(ScalerUnit); ok {
+			b = append(b, byte(v.Scaler), v.Unit)
+		}
+	case TypeCSD:
+		var v CSD
+		if v, ok = d.Value.(CSD); ok {
+			b = appendCSD(b, v)
+		}
+	case TypeRCSD:
+		var v []CSD
+		if v, ok = d.Value.([]CSD); ok {
+			b = appendRCSD(b, v)
+		}
+	}
+	if !ok {
+		return nil, typeError(d)
+	}
+	return b, nil
+}
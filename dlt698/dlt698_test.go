@@ -0,0 +1,171 @@
+package dlt698
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/transporttest"
+)
+
+// 模拟电表，按请求返回预置的应答APDU
+func newMeter(respond func(req *APDU) []byte) *transporttest.Meter {
+	return transporttest.New(func(buf []byte) ([][]byte, error) {
+		f, err := NewFrame(buf)
+		if err != nil {
+			return nil, err
+		}
+		req, err := ParseAPDU(f.APDU)
+		if err != nil {
+			return nil, err
+		}
+		apdu := respond(req)
+		if apdu == nil {
+			return nil, nil
+		}
+		b, _ := (&Frame{Control: ControlDIR | requestControl, Address: f.Address, APDU: apdu}).Bytes()
+		return [][]byte{b}, nil
+	})
+}
+
+func TestCRC16(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0x906E {
+		t.Fatalf("crc = %04x, want 906e", crc)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Control: requestControl, Address: "000012345678", ClientAddress: 0x10, APDU: NewGetRequestNormal(1, CommAddress)}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsFrame(b) {
+		t.Fatal("IsFrame = false")
+	}
+	got, err := NewFrame(append([]byte{0xfe, 0xfe}, b...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Fatalf("frame = %+v, want %+v", got, f)
+	}
+	b[len(b)-3]++
+	if _, err := NewFrame(b); err != ChecksumError {
+		t.Fatalf("err = %v, want ChecksumError", err)
+	}
+}
+
+func TestData(t *testing.T) {
+	now := time.Date(2020, 3, 12, 17, 19, 5, 0, time.Local)
+	d := Data{Type: TypeStructure, Value: []Data{
+		{Type: TypeNull},
+		{Type: TypeArray, Value: []Data{{Type: TypeLongUnsigned, Value: uint16(2201)}, {Type: TypeLongUnsigned, Value: uint16(2199)}}},
+		{Type: TypeDoubleLong, Value: int32(-1500)},
+		{Type: TypeVisibleString, Value: "meter"},
+		{Type: TypeOctetString, Value: make([]byte, 200)},
+		{Type: TypeDateTimeS, Value: now},
+		{Type: TypeDateTime, Value: now.Add(123 * time.Millisecond)},
+		{Type: TypeOAD, Value: Voltage},
+		{Type: TypeScalerUnit, Value: ScalerUnit{Scaler: -1, Unit: 35}},
+		{Type: TypeRCSD, Value: []CSD{{OAD: FreezeTime}, {OAD: ForwardActiveEnergy, ROAD: &ROAD{OAD: ForwardActiveEnergy, Related: []OAD{Voltage}}}}},
+		{Type: TypeFloat64, Value: 1.5},
+	}}
+	b, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, n, err := DecodeData(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || !reflect.DeepEqual(got, d) {
+		t.Fatalf("data = %+v, want %+v", got, d)
+	}
+	if _, _, err := DecodeData(b[:len(b)-1]); err != ShortData {
+		t.Fatalf("err = %v, want ShortData", err)
+	}
+	if _, err := (Data{Type: TypeLong, Value: 1}).Bytes(); !errors.Is(err, UnsupportedType) {
+		t.Fatalf("err = %v, want UnsupportedType", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	freeze := time.Date(2020, 3, 12, 0, 0, 0, 0, time.Local)
+	m := newMeter(func(req *APDU) []byte {
+		b := []byte{req.Service | 0x80, req.Type, req.PIID}
+		b = appendUint32(b, uint32(req.OAD))
+		switch {
+		case req.Service == GetRequest && req.OAD == Voltage:
+			b, _ = appendData(append(b, 1), Data{Type: TypeArray, Value: []Data{
+				{Type: TypeLongUnsigned, Value: uint16(2201)},
+				{Type: TypeLongUnsigned, Value: uint16(2199)},
+				{Type: TypeLongUnsigned, Value: uint16(2200)},
+			}})
+		case req.Service == GetRequest && req.OAD == DayFreeze:
+			if req.RSD.Selector != 9 || req.RSD.Last != 1 || len(req.RCSD) != 2 {
+				return nil
+			}
+			b = appendRCSD(b, req.RCSD)
+			b = append(b, 1, 1)
+			b, _ = appendData(b, Data{Type: TypeDateTimeS, Value: freeze})
+			b, _ = appendData(b, Data{Type: TypeArray, Value: []Data{{Type: TypeDoubleLongUnsigned, Value: uint32(12345)}}})
+		case req.Service == GetRequest:
+			b = append(b, 0, 6)
+		case req.Service == SetRequest:
+			b = append(b, 0)
+		default:
+			return nil
+		}
+		return append(b, 0, 0)
+	})
+	c := NewClient(m, "000012345678")
+
+	v, err := c.GetValues(Voltage)
+	if err != nil || !reflect.DeepEqual(v, []float64{220.1, 219.9, 220}) {
+		t.Fatalf("voltage = %v, %v", v, err)
+	}
+	if _, err := c.Get(CommAddress); err != DAR(6) {
+		t.Fatalf("err = %v, want DAR(6)", err)
+	}
+	r, err := c.GetRecord(DayFreeze, RSD{Selector: 9, Last: 1}, []CSD{{OAD: FreezeTime}, {OAD: ForwardActiveEnergy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Rows) != 1 || !r.Rows[0][0].Value.(time.Time).Equal(freeze) {
+		t.Fatalf("record = %+v", r)
+	}
+	if e, _ := r.Rows[0][1].Items()[0].Scaled(-2); e != 123.45 {
+		t.Fatalf("energy = %v", e)
+	}
+	if err := c.SetTime(freeze); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	now := time.Date(2020, 3, 12, 17, 19, 5, 0, time.Local)
+	login := appendDateTime([]byte{LinkRequest, 0x01, LinkLogin, 0x00, 0x3c}, now, true, true)
+	f := &Frame{Control: ControlDIR | FunctionLink, Address: "000012345678", APDU: login}
+	resp, err := Respond(f, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Control != FunctionLink || resp.Address != f.Address || resp.APDU[0] != LinkResponse || resp.APDU[1] != 0x01 {
+		t.Fatalf("link response = %+v", resp)
+	}
+
+	report := []byte{ReportNotification, ReportList, 0x02, 0x01}
+	report = appendUint32(report, uint32(Voltage))
+	report, _ = appendData(append(report, 1), Data{Type: TypeLongUnsigned, Value: uint16(2200)})
+	f = &Frame{Control: ControlDIR | FunctionData, Address: "000012345678", APDU: append(report, 0, 0)}
+	resp, err = Respond(f, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := appendUint32([]byte{ReportResponse, ReportList, 0x02, 0x01}, uint32(Voltage))
+	if !reflect.DeepEqual(resp.APDU, want) {
+		t.Fatalf("report response = % x, want % x", resp.APDU, want)
+	}
+}
@@ -0,0 +1,201 @@
+package dlt698
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	startByte = 0x68
+	endByte   = 0x16
+	preamble  = 0xFE
+)
+
+// 控制域的标志位
+const (
+	// 传输方向，1为服务器（电表）发出
+	ControlDIR = 0x80
+	// 启动标志，1为客户机发起
+	ControlPRM = 0x40
+	// 分帧标志
+	ControlFragment = 0x20
+	// 扰码标志
+	ControlScramble = 0x08
+)
+
+// 控制域的功能码
+const (
+	// 链路管理，登录、心跳和退出登录
+	FunctionLink = uint8(1)
+	// 用户数据
+	FunctionData = uint8(3)
+)
+
+// 服务器地址的类型
+const (
+	AddressSingle    = uint8(0)
+	AddressWildcard  = uint8(1)
+	AddressGroup     = uint8(2)
+	AddressBroadcast = uint8(3)
+)
+
+var (
+	InvalidFrame = errors.New("invalid dlt698 frame")
+	// 帧头校验或者帧校验错误
+	ChecksumError = errors.New("dlt698 checksum error")
+	// 不支持分帧和扰码
+	Unsupported = errors.New("unsupported dlt698 frame")
+
+	// 默认的前导字节
+	Preamble = []byte{preamble, preamble, preamble, preamble}
+)
+
+// Frame DL/T 698.45帧
+type Frame struct {
+	Control uint8
+
+	// 服务器地址的类型和逻辑地址
+	AddressType uint8
+	Logical     uint8
+	// 服务器地址，BCD码高位在前，长度为偶数，例如"000012345678"
+	Address string
+
+	// 客户机地址
+	ClientAddress uint8
+
+	// 应用层数据单元
+	APDU []byte
+}
+
+// Function 控制域的功能码
+func (f *Frame) Function() uint8 {
+	return f.Control & 0x07
+}
+
+// FromServer 是否是服务器（电表）发出的帧
+func (f *Frame) FromServer() bool {
+	return f.Control&ControlDIR != 0
+}
+
+// Bytes 编码为帧，不包含前导字节
+func (f *Frame) Bytes() ([]byte, error) {
+	sa, err := encodeAddress(f.Address)
+	if err != nil {
+		return nil, err
+	}
+	length := 9 + len(sa) + len(f.APDU)
+	if length > 0x3fff {
+		return nil, fmt.Errorf("%w: apdu too long", InvalidFrame)
+	}
+	b := make([]byte, 0, length+2)
+	b = append(b, startByte, byte(length), byte(length>>8), f.Control)
+	b = append(b, f.AddressType<<6|(f.Logical&0x03)<<4|byte(len(sa)-1))
+	b = append(b, sa...)
+	b = append(b, f.ClientAddress)
+	b = appendCRC(b, CRC16(b[1:]))
+	b = append(b, f.APDU...)
+	b = appendCRC(b, CRC16(b[1:]))
+	return append(b, endByte), nil
+}
+
+func appendCRC(b []byte, crc uint16) []byte {
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+// NewFrame 解析帧，会忽略开头的前导字节
+func NewFrame(packet []byte) (*Frame, error) {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	if len(packet) < 12 || packet[0] != startByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	lf := binary.LittleEndian.Uint16(packet[1:3])
+	// 长度单位为千字节的帧不会出现在电表通信中
+	if lf&0x4000 != 0 {
+		return nil, Unsupported
+	}
+	length := int(lf & 0x3fff)
+	if len(packet) < length+2 || packet[length+1] != endByte {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	c := packet[3]
+	if c&(ControlFragment|ControlScramble) != 0 {
+		return nil, Unsupported
+	}
+	af := packet[4]
+	n := int(af&0x0f) + 1
+	// 帧头：长度、控制域、地址域
+	header := 6 + n
+	if length < header+2 {
+		return nil, fmt.Errorf("%w: 0x% x", InvalidFrame, packet)
+	}
+	if CRC16(packet[1:header]) != binary.LittleEndian.Uint16(packet[header:]) {
+		return nil, ChecksumError
+	}
+	if CRC16(packet[1:length-1]) != binary.LittleEndian.Uint16(packet[length-1:]) {
+		return nil, ChecksumError
+	}
+	f := &Frame{
+		Control:       c,
+		AddressType:   af >> 6,
+		Logical:       af >> 4 & 0x03,
+		Address:       decodeAddress(packet[5 : 5+n]),
+		ClientAddress: packet[5+n],
+	}
+	if length-1 > header+2 {
+		f.APDU = append([]byte(nil), packet[header+2:length-1]...)
+	}
+	return f, nil
+}
+
+// IsFrame 判断报文是否可能是DL/T 698.45帧，用于在Handler中区分不同协议的报文
+func IsFrame(packet []byte) bool {
+	for len(packet) > 0 && packet[0] == preamble {
+		packet = packet[1:]
+	}
+	if len(packet) < 12 || packet[0] != startByte {
+		return false
+	}
+	length := int(binary.LittleEndian.Uint16(packet[1:3]) & 0x3fff)
+	return len(packet) >= length+2 && packet[length+1] == endByte
+}
+
+// 地址为BCD码，低字节在前
+func encodeAddress(address string) ([]byte, error) {
+	if len(address) == 0 || len(address)%2 != 0 || len(address) > 32 {
+		return nil, fmt.Errorf("%w: invalid address %q", InvalidFrame, address)
+	}
+	n := len(address) / 2
+	b := make([]byte, n)
+	for i := 0; i < n; i++ {
+		hi, ok1 := hexDigit(address[2*i])
+		lo, ok2 := hexDigit(address[2*i+1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: invalid address %q", InvalidFrame, address)
+		}
+		b[n-1-i] = hi<<4 | lo
+	}
+	return b, nil
+}
+
+func decodeAddress(b []byte) string {
+	const digits = "0123456789ABCDEF"
+	s := make([]byte, 0, 2*len(b))
+	for i := len(b) - 1; i >= 0; i-- {
+		s = append(s, digits[b[i]>>4], digits[b[i]&0x0f])
+	}
+	return string(s)
+}
+
+// 通配地址中允许出现A
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c == 'A' || c == 'a':
+		return 0x0a, true
+	}
+	return 0, false
+}
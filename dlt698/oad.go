@@ -0,0 +1,66 @@
+package dlt698
+
+// 常用的对象属性描述符
+const (
+	// 组合有功电能，总及各费率
+	CombinedActiveEnergy OAD = 0x00000200
+	// 正向有功电能，总及各费率
+	ForwardActiveEnergy OAD = 0x00100200
+	// 反向有功电能，总及各费率
+	ReverseActiveEnergy OAD = 0x00200200
+	// 电压，A、B、C相
+	Voltage OAD = 0x20000200
+	// 电流，A、B、C相
+	Current OAD = 0x20010200
+	// 有功功率，总及A、B、C相
+	ActivePower OAD = 0x20040200
+	// 无功功率，总及A、B、C相
+	ReactivePower OAD = 0x20050200
+	// 功率因数，总及A、B、C相
+	PowerFactor OAD = 0x200A0200
+	// 电网频率
+	Frequency OAD = 0x200F0200
+	// 数据冻结时间，用作冻结记录的选择条件
+	FreezeTime OAD = 0x20210200
+	// 日期时间
+	DateTime OAD = 0x40000200
+	// 通信地址
+	CommAddress OAD = 0x40010200
+	// 分钟冻结
+	MinuteFreeze OAD = 0x50020200
+	// 日冻结
+	DayFreeze OAD = 0x50040200
+	// 月冻结
+	MonthFreeze OAD = 0x50060200
+)
+
+// Item 对象属性的换算和单位
+type Item struct {
+	Name   string
+	Scaler int8
+	Unit   string
+}
+
+// Items 常用对象属性的换算和单位，以元素索引为0的OAD为键，可以添加其他对象属性
+var Items = map[OAD]Item{
+	CombinedActiveEnergy: {"组合有功电能", -2, "kWh"},
+	ForwardActiveEnergy:  {"正向有功电能", -2, "kWh"},
+	ReverseActiveEnergy:  {"反向有功电能", -2, "kWh"},
+	Voltage:              {"电压", -1, "V"},
+	Current:              {"电流", -3, "A"},
+	ActivePower:          {"有功功率", -1, "W"},
+	ReactivePower:        {"无功功率", -1, "var"},
+	PowerFactor:          {"功率因数", -3, ""},
+	Frequency:            {"电网频率", -2, "Hz"},
+}
+
+// Element 属性内第index个元素，从1开始
+func (oad OAD) Element(index uint8) OAD {
+	return oad&^0xff | OAD(index)
+}
+
+// Lookup 查找对象属性的换算和单位，忽略元素索引
+func Lookup(oad OAD) (Item, bool) {
+	item, ok := Items[oad.Element(0)]
+	return item, ok
+}
@@ -0,0 +1,153 @@
+package hj212
+
+import "fmt"
+
+// 系统编码ST
+const (
+	SurfaceWater   = "21"
+	AirQuality     = "22"
+	AirPollution   = "31"
+	WaterPollution = "32"
+	// 系统交互，用于应答
+	SystemInteraction = "91"
+)
+
+// 命令编码CN
+const (
+	// 设置超时时间及重发次数
+	SetTimeoutRetry = "1000"
+	// 提取现场机时间
+	GetTime = "1011"
+	// 设置现场机时间
+	SetTime = "1012"
+	// 现场机时间校准请求
+	TimeCalibrationRequest = "1013"
+	// 提取实时数据间隔
+	GetRtdInterval = "1061"
+	// 设置实时数据间隔
+	SetRtdInterval = "1062"
+	// 提取分钟数据间隔
+	GetMinuteInterval = "1063"
+	// 设置分钟数据间隔
+	SetMinuteInterval = "1064"
+	// 设置现场机访问密码
+	SetPassword = "1072"
+	// 实时数据
+	RealtimeData = "2011"
+	// 停止察看实时数据
+	StopRealtimeData = "2012"
+	// 设备运行状态
+	RunningStatus = "2021"
+	// 停止察看设备运行状态
+	StopRunningStatus = "2022"
+	// 日历史数据
+	DayData = "2031"
+	// 设备运行时间日历史数据
+	DayRunningTime = "2041"
+	// 分钟数据
+	MinuteData = "2051"
+	// 小时数据
+	HourData = "2061"
+	// 数采仪开机时间
+	StartupTime = "2081"
+	// 零点校准量程校准
+	Calibrate = "3011"
+	// 即时采样
+	InstantSample = "3012"
+	// 启动清洗/反吹
+	StartCleaning = "3013"
+	// 比对采样
+	CompareSample = "3014"
+	// 提取现场机信息
+	GetInfo = "3020"
+	// 设置现场机参数
+	SetParam = "3021"
+	// 请求应答
+	RequestResponse = "9011"
+	// 执行结果
+	ExecutionResult = "9012"
+	// 通知应答
+	NotifyResponse = "9013"
+	// 数据应答
+	DataResponse = "9014"
+)
+
+// Commands 命令编码的名称
+var Commands = map[string]string{
+	SetTimeoutRetry:        "设置超时时间及重发次数",
+	GetTime:                "提取现场机时间",
+	SetTime:                "设置现场机时间",
+	TimeCalibrationRequest: "现场机时间校准请求",
+	GetRtdInterval:         "提取实时数据间隔",
+	SetRtdInterval:         "设置实时数据间隔",
+	GetMinuteInterval:      "提取分钟数据间隔",
+	SetMinuteInterval:      "设置分钟数据间隔",
+	SetPassword:            "设置现场机访问密码",
+	RealtimeData:           "实时数据",
+	StopRealtimeData:       "停止察看实时数据",
+	RunningStatus:          "设备运行状态",
+	StopRunningStatus:      "停止察看设备运行状态",
+	DayData:                "日历史数据",
+	DayRunningTime:         "设备运行时间日历史数据",
+	MinuteData:             "分钟数据",
+	HourData:               "小时数据",
+	StartupTime:            "数采仪开机时间",
+	Calibrate:              "零点校准量程校准",
+	InstantSample:          "即时采样",
+	StartCleaning:          "启动清洗/反吹",
+	CompareSample:          "比对采样",
+	GetInfo:                "提取现场机信息",
+	SetParam:               "设置现场机参数",
+	RequestResponse:        "请求应答",
+	ExecutionResult:        "执行结果",
+	NotifyResponse:         "通知应答",
+	DataResponse:           "数据应答",
+}
+
+// IsUpload 是否为现场机主动上传的数据，需要应答时以数据应答回复
+func IsUpload(cn string) bool {
+	switch cn {
+	case RealtimeData, RunningStatus, DayData, DayRunningTime, MinuteData, HourData, StartupTime:
+		return true
+	}
+	return false
+}
+
+// 请求应答的QnRtn
+var qnRtn = map[string]string{
+	"1":   "准备执行请求",
+	"2":   "请求被拒绝",
+	"3":   "PW错误",
+	"4":   "MN错误",
+	"5":   "ST错误",
+	"6":   "Flag错误",
+	"7":   "QN错误",
+	"8":   "CN错误",
+	"9":   "CRC校验错误",
+	"100": "未知错误",
+}
+
+// 执行结果的ExeRtn
+var exeRtn = map[string]string{
+	"1":   "执行成功",
+	"2":   "执行失败，但不知道原因",
+	"3":   "命令请求条件错误",
+	"4":   "通讯超时",
+	"5":   "系统繁忙不能执行",
+	"6":   "系统故障",
+	"100": "没有数据",
+}
+
+// ReturnError 现场机拒绝请求（QnRtn）或者执行失败（ExeRtn）
+type ReturnError struct {
+	// RequestResponse或者ExecutionResult
+	CN   string
+	Code string
+}
+
+func (e *ReturnError) Error() string {
+	if e.CN == RequestResponse {
+		return fmt.Sprintf("hj212 request rejected: QnRtn=%v(%v)", e.Code, qnRtn[e.Code])
+	}
+	return fmt.Sprintf("hj212 execution failed: ExeRtn=%v(%v)", e.Code, exeRtn[e.Code])
+}
@@ -0,0 +1,17 @@
+package hj212
+
+// CRC16 HJ 212的校验，与CRCModbus不同：每个字节与寄存器的高字节异或，结果为4位十六进制
+func CRC16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc = crc>>8 ^ uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
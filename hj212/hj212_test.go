@@ -0,0 +1,199 @@
+package hj212
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const example = "##0101QN=20160801085857223;ST=32;CN=1062;PW=100000;MN=010000A8900016F000169DC0;Flag=5;CP=&&RtdInterval=30&&1C80\r\n"
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.QN != "20160801085857223" || p.ST != WaterPollution || p.CN != SetRtdInterval || p.PW != "100000" ||
+		p.MN != "010000A8900016F000169DC0" || !p.Flag.NeedAck() || p.Flag.Version() != 1 {
+		t.Fatalf("unexpected packet %+v", p)
+	}
+	if v, _ := p.CP.Get("RtdInterval"); v != "30" {
+		t.Errorf("RtdInterval = %v", v)
+	}
+	b, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != example {
+		t.Errorf("Bytes() = %q", b)
+	}
+
+	bad := []byte(example)
+	bad[len(bad)-4] = '1'
+	if _, err := Parse(bad); !errors.Is(err, CRCError) {
+		t.Errorf("err = %v, want CRCError", err)
+	}
+
+	// CP=&&之后没有结尾的&&
+	for _, data := range []string{"CN=2011;CP=&&", "CN=2011;CP=&&&", "CN=2011;CP=&&a=1&"} {
+		if _, err := ParseData(data); !errors.Is(err, InvalidPacket) {
+			t.Errorf("ParseData(%q) err = %v, want InvalidPacket", data, err)
+		}
+	}
+	if p, err := ParseData("CN=2011;CP=&&&&"); err != nil || len(p.CP) != 0 {
+		t.Errorf("empty CP = %+v, %v", p, err)
+	}
+
+	// 截断的数据包和数据段只返回错误
+	for i := 0; i < len(example); i++ {
+		if _, err := Parse([]byte(example[:i])); err == nil {
+			t.Errorf("Parse(%q) should fail", example[:i])
+		}
+	}
+	data := example[6 : len(example)-6]
+	for i := 0; i < len(data); i++ {
+		ParseData(data[:i])
+		ParseData(data[i:])
+	}
+}
+
+func TestCP(t *testing.T) {
+	cp := ParseCP("DataTime=20160801084000;w01018-Rtd=166.6,w01018-Flag=N;w21003-Rtd=1.01,w21003-Flag=N")
+	dt, err := cp.DataTime(time.UTC)
+	if err != nil || !dt.Equal(time.Date(2016, 8, 1, 8, 40, 0, 0, time.UTC)) {
+		t.Fatalf("DataTime = %v, %v", dt, err)
+	}
+	m := cp.Pollutants()
+	if m["w01018"]["Rtd"] != "166.6" || m["w21003"]["Flag"] != "N" || len(m) != 2 {
+		t.Errorf("Pollutants = %v", m)
+	}
+	if v, err := cp.Float("w21003-Rtd"); err != nil || v != 1.01 {
+		t.Errorf("Float = %v, %v", v, err)
+	}
+	cp.Set("w01018-Flag", "D")
+	if cp.String() != "DataTime=20160801084000;w01018-Rtd=166.6,w01018-Flag=D;w21003-Rtd=1.01,w21003-Flag=N" {
+		t.Errorf("String() = %v", cp.String())
+	}
+}
+
+// 模拟数采仪
+type station struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *station) send(p *Packet) {
+	b, err := p.Bytes()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *station) read() *Packet {
+	s.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := s.r.ReadBytes('\n')
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	p, err := Parse(line)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return p
+}
+
+func TestServer(t *testing.T) {
+	const mn = "010000A8900016F000169DC0"
+	srv := NewServer()
+	srv.RequestTimeout = 2 * time.Second
+	registered := make(chan *Conn, 1)
+	srv.OnRegister = func(c *Conn) {
+		registered <- c
+	}
+	received := make(chan *Packet, 1)
+	srv.Handler = func(c *Conn, p *Packet) {
+		received <- p
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Shutdown()
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := &station{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// 异常的数据包被丢弃，不影响之后的数据包
+	bad := "CN=2011;CP=&&"
+	fmt.Fprintf(conn, "##%04d%s%04X\r\n", len(bad), bad, CRC16([]byte(bad)))
+
+	// 上传实时数据，需要数据应答
+	s.send(&Packet{
+		QN:   "20160801085857223",
+		ST:   WaterPollution,
+		CN:   RealtimeData,
+		PW:   "123456",
+		MN:   mn,
+		Flag: Version2017 | FlagAck,
+		CP:   ParseCP("DataTime=20160801085857;w01018-Rtd=166.6,w01018-Flag=N"),
+	})
+	ack := s.read()
+	if ack.CN != DataResponse || ack.QN != "20160801085857223" || ack.ST != SystemInteraction || ack.Flag.NeedAck() {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	select {
+	case p := <-received:
+		if p.CN != RealtimeData {
+			t.Fatalf("handler received %v", p.CN)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not called")
+	}
+	<-registered
+	c, err := srv.FindConn(mn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 提取现场机时间：请求应答、数据、执行结果
+	go func() {
+		req := s.read()
+		s.send(req.Response(RequestResponse, CP{{{Key: "QnRtn", Value: "1"}}}))
+		data := &Packet{QN: req.QN, ST: WaterPollution, CN: GetTime, PW: req.PW, MN: mn, Flag: Version2017,
+			CP: CP{{{Key: "SystemTime", Value: "20160801085857"}}}}
+		s.send(data)
+		s.send(req.Response(ExecutionResult, CP{{{Key: "ExeRtn", Value: "1"}}}))
+
+		req = s.read()
+		s.send(req.Response(RequestResponse, CP{{{Key: "QnRtn", Value: "3"}}}))
+	}()
+	data, err := c.Request(&Packet{ST: WaterPollution, CN: GetTime, PW: "123456", Flag: Version2017})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 {
+		t.Fatalf("got %d packets", len(data))
+	}
+	if v, _ := data[0].CP.Get("SystemTime"); v != "20160801085857" {
+		t.Errorf("SystemTime = %v", v)
+	}
+
+	_, err = c.Request(&Packet{ST: WaterPollution, CN: SetTime, PW: "000000", Flag: Version2017})
+	var re *ReturnError
+	if !errors.As(err, &re) || re.CN != RequestResponse || re.Code != "3" {
+		t.Fatalf("err = %v, want QnRtn=3", err)
+	}
+}
@@ -0,0 +1,308 @@
+package hj212
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	header  = "##"
+	trailer = "\r\n"
+	// 数据段长度为4位十进制数
+	maxDataLength = 9999
+	// 包头、长度、CRC和包尾
+	overhead = len(header) + 4 + 4 + len(trailer)
+
+	qnLayout       = "20060102150405"
+	DataTimeLayout = "20060102150405"
+)
+
+var (
+	InvalidPacket = errors.New("invalid hj212 packet")
+	CRCError      = errors.New("hj212 crc error")
+)
+
+// Flag 拆分包及应答标志，V5~V0为标准版本号，D为是否拆分包，A为是否需要应答
+type Flag uint8
+
+const (
+	// 需要应答
+	FlagAck Flag = 0x01
+	// 拆分包，数据段包含PNUM和PNO
+	FlagSplit Flag = 0x02
+	// HJ 212-2017的版本号
+	Version2017 Flag = 0x04
+)
+
+func (f Flag) NeedAck() bool {
+	return f&FlagAck != 0
+}
+
+func (f Flag) Split() bool {
+	return f&FlagSplit != 0
+}
+
+// Version 标准版本号，0为HJ/T 212-2005，1为HJ 212-2017
+func (f Flag) Version() uint8 {
+	return uint8(f >> 2)
+}
+
+type (
+	// Packet 通讯包的数据段
+	Packet struct {
+		// 请求编码，yyyyMMddHHmmssSSS
+		QN string
+		// 系统编码
+		ST string
+		// 命令编码
+		CN string
+		// 访问密码
+		PW string
+		// 设备唯一标识
+		MN   string
+		Flag Flag
+		// 拆分包的总包数和包号，Flag包含FlagSplit时有效
+		PNUM int
+		PNO  int
+		CP   CP
+	}
+
+	// Field 指令参数中的一个字段
+	Field struct {
+		Key   string
+		Value string
+	}
+
+	// CP 指令参数，分号分隔为组，组内逗号分隔为字段，例如同一污染物的Rtd和Flag为一组
+	CP [][]Field
+)
+
+// NewQN 根据时间生成请求编码
+func NewQN(t time.Time) string {
+	return t.Format(qnLayout) + fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond))
+}
+
+// Parse 解析一个完整的通讯包，校验包头、长度、CRC和包尾
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < overhead || !bytes.HasPrefix(b, []byte(header)) || !bytes.HasSuffix(b, []byte(trailer)) {
+		return nil, InvalidPacket
+	}
+	n, err := strconv.Atoi(string(b[2:6]))
+	if err != nil || n != len(b)-overhead {
+		return nil, fmt.Errorf("%w: length %q", InvalidPacket, b[2:6])
+	}
+	data := b[6 : 6+n]
+	crc, err := strconv.ParseUint(string(b[6+n:10+n]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: crc %q", InvalidPacket, b[6+n:10+n])
+	}
+	if uint16(crc) != CRC16(data) {
+		return nil, fmt.Errorf("%w: got %04X, want %04X", CRCError, crc, CRC16(data))
+	}
+	return ParseData(string(data))
+}
+
+// ParseData 解析数据段
+func ParseData(data string) (*Packet, error) {
+	i := strings.Index(data, "CP=&&")
+	j := strings.LastIndex(data, "&&")
+	// 结尾的&&必须在CP=&&之后
+	if i < 0 || j < i+len("CP=&&") {
+		return nil, fmt.Errorf("%w: missing CP", InvalidPacket)
+	}
+	p := new(Packet)
+	for _, kv := range strings.Split(data[:i], ";") {
+		if kv == "" {
+			continue
+		}
+		k, v := splitKV(kv)
+		var err error
+		switch k {
+		case "QN":
+			p.QN = v
+		case "ST":
+			p.ST = v
+		case "CN":
+			p.CN = v
+		case "PW":
+			p.PW = v
+		case "MN":
+			p.MN = v
+		case "Flag":
+			var f int
+			f, err = strconv.Atoi(v)
+			p.Flag = Flag(f)
+		case "PNUM":
+			p.PNUM, err = strconv.Atoi(v)
+		case "PNO":
+			p.PNO, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", InvalidPacket, kv)
+		}
+	}
+	if p.CN == "" {
+		return nil, fmt.Errorf("%w: missing CN", InvalidPacket)
+	}
+	p.CP = ParseCP(data[i+len("CP=&&") : j])
+	return p, nil
+}
+
+func splitKV(s string) (string, string) {
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// Data 编码数据段
+func (p *Packet) Data() string {
+	var b strings.Builder
+	write := func(k, v string) {
+		if v != "" {
+			b.WriteString(k + "=" + v + ";")
+		}
+	}
+	write("QN", p.QN)
+	write("ST", p.ST)
+	write("CN", p.CN)
+	write("PW", p.PW)
+	write("MN", p.MN)
+	// HJ/T 212-2005没有Flag
+	if p.Flag != 0 {
+		write("Flag", strconv.Itoa(int(p.Flag)))
+	}
+	if p.Flag.Split() {
+		write("PNUM", strconv.Itoa(p.PNUM))
+		write("PNO", strconv.Itoa(p.PNO))
+	}
+	b.WriteString("CP=&&" + p.CP.String() + "&&")
+	return b.String()
+}
+
+// Bytes 编码为完整的通讯包
+func (p *Packet) Bytes() ([]byte, error) {
+	data := p.Data()
+	if len(data) > maxDataLength {
+		return nil, fmt.Errorf("%w: data length %d", InvalidPacket, len(data))
+	}
+	return []byte(fmt.Sprintf("%s%04d%s%04X%s", header, len(data), data, CRC16([]byte(data)), trailer)), nil
+}
+
+func (p *Packet) String() string {
+	return p.Data()
+}
+
+// Response 生成对p的应答，例如请求应答、执行结果、通知应答和数据应答
+func (p *Packet) Response(cn string, cp CP) *Packet {
+	return &Packet{
+		QN:   p.QN,
+		ST:   SystemInteraction,
+		CN:   cn,
+		PW:   p.PW,
+		MN:   p.MN,
+		Flag: p.Flag &^ (FlagAck | FlagSplit),
+		CP:   cp,
+	}
+}
+
+// ParseCP 解析指令参数，不含首尾的&&
+func ParseCP(s string) CP {
+	if s == "" {
+		return nil
+	}
+	var cp CP
+	for _, group := range strings.Split(s, ";") {
+		if group == "" {
+			continue
+		}
+		var fields []Field
+		for _, kv := range strings.Split(group, ",") {
+			k, v := splitKV(kv)
+			fields = append(fields, Field{Key: k, Value: v})
+		}
+		cp = append(cp, fields)
+	}
+	return cp
+}
+
+func (cp CP) String() string {
+	groups := make([]string, 0, len(cp))
+	for _, group := range cp {
+		fields := make([]string, 0, len(group))
+		for _, f := range group {
+			fields = append(fields, f.Key+"="+f.Value)
+		}
+		groups = append(groups, strings.Join(fields, ","))
+	}
+	return strings.Join(groups, ";")
+}
+
+// Get 返回第一个键为key的字段
+func (cp CP) Get(key string) (string, bool) {
+	for _, group := range cp {
+		for _, f := range group {
+			if f.Key == key {
+				return f.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Set 修改键为key的字段，不存在时新增一组
+func (cp *CP) Set(key, value string) {
+	for _, group := range *cp {
+		for i := range group {
+			if group[i].Key == key {
+				group[i].Value = value
+				return
+			}
+		}
+	}
+	*cp = append(*cp, []Field{{Key: key, Value: value}})
+}
+
+// DataTime 数据时间，loc为nil时使用time.Local
+func (cp CP) DataTime(loc *time.Location) (time.Time, error) {
+	v, ok := cp.Get("DataTime")
+	if !ok {
+		return time.Time{}, fmt.Errorf("%w: missing DataTime", InvalidPacket)
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return time.ParseInLocation(DataTimeLayout, v, loc)
+}
+
+// Pollutants 按污染物编码归类的字段，例如w01018-Rtd=1.1,w01018-Flag=N归为w01018的Rtd和Flag
+func (cp CP) Pollutants() map[string]map[string]string {
+	m := make(map[string]map[string]string)
+	for _, group := range cp {
+		for _, f := range group {
+			i := strings.IndexByte(f.Key, '-')
+			if i < 0 {
+				continue
+			}
+			code := f.Key[:i]
+			if m[code] == nil {
+				m[code] = make(map[string]string)
+			}
+			m[code][f.Key[i+1:]] = f.Value
+		}
+	}
+	return m
+}
+
+// Float 将键为key的字段解析为浮点数，例如w01018-Rtd
+func (cp CP) Float(key string) (float64, error) {
+	v, ok := cp.Get(key)
+	if !ok {
+		return 0, fmt.Errorf("%w: missing %v", InvalidPacket, key)
+	}
+	return strconv.ParseFloat(v, 64)
+}
@@ -0,0 +1,499 @@
+package hj212
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/presence"
+)
+
+const (
+	defaultTimeout        = 3 * time.Minute
+	defaultRequestTimeout = 10 * time.Second
+)
+
+var (
+	DeviceOffline       = errors.New("device offline")
+	WaitResponseTimeout = errors.New("wait response timeout")
+	// 调用方指定的QN与正在等待应答的请求重复
+	DuplicateQN = errors.New("duplicate hj212 qn")
+)
+
+// CloseReason 连接关闭的原因
+type CloseReason string
+
+const (
+	// 调用方主动关闭
+	CloseByCaller CloseReason = "closed"
+	// 读取超时
+	CloseReadTimeout CloseReason = "read_timeout"
+	// 设备断开了连接
+	CloseEOF CloseReason = "eof"
+	// 其他读取错误
+	CloseReadError CloseReason = "read_error"
+	// 同一MN建立了新的连接
+	CloseReplaced CloseReason = "replaced"
+	// 服务关闭
+	CloseShutdown CloseReason = "shutdown"
+)
+
+type (
+	// Server 接受数采仪的连接，以数据段中的MN作为连接的编号
+	Server struct {
+		// 读取超时，默认3分钟
+		Timeout time.Duration
+
+		// 等待请求应答和执行结果的超时，默认10秒
+		RequestTimeout time.Duration
+
+		// 处理现场机上传的数据包，不包括Request等待的应答
+		Handler func(c *Conn, p *Packet)
+
+		// 不自动回复数据应答，默认对需要应答的上传数据回复9014
+		NoAutoAck bool
+
+		// 保存所有活动连接
+		activeConn sync.Map
+
+		// 用于调用方执行收尾工作
+		AfterConnClose func(id string)
+
+		// 是否打印报文
+		debug bool
+
+		// 记录设备的在线状态，为nil时不记录
+		Presence *presence.Tracker
+
+		// 开始监听时调用
+		OnStart func(addr net.Addr)
+
+		// 接受新连接时调用，返回error时拒绝该连接
+		OnAccept func(remote net.Addr) error
+
+		// 连接收到第一个带MN的数据包并完成注册之后调用
+		OnRegister func(c *Conn)
+
+		// 连接关闭时调用，在AfterConnClose之前
+		OnClose func(c *Conn, reason CloseReason)
+	}
+
+	Conn struct {
+		// 数采仪的MN
+		id string
+
+		server *Server
+
+		rwc net.Conn
+		r   *bufio.Reader
+
+		CloseNotifier chan struct{}
+
+		inShutdown int32 // accessed atomically (non-zero means we're in Shutdown)
+
+		// 可供调用方存储一些键值
+		sync.Map
+
+		// 同一时间只允许一个协程写入
+		writeMu sync.Mutex
+
+		// 等待应答的请求，key为QN
+		pending sync.Map
+
+		// 最近一次读取失败对应的关闭原因
+		readErr atomic.Value
+
+		// 是否已根据MN注册
+		registered int32
+	}
+)
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (srv *Server) Debug(debug bool) {
+	srv.debug = debug
+}
+
+func (srv *Server) timeout() time.Duration {
+	if srv.Timeout > 0 {
+		return srv.Timeout
+	}
+	return defaultTimeout
+}
+
+func (srv *Server) requestTimeout() time.Duration {
+	if srv.RequestTimeout > 0 {
+		return srv.RequestTimeout
+	}
+	return defaultRequestTimeout
+}
+
+func (srv *Server) StartServer(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	return srv.Serve(l)
+}
+
+// Serve 在调用方提供的Listener上接受连接，返回时关闭l
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if srv.OnStart != nil {
+		srv.OnStart(l.Addr())
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if srv.OnAccept != nil {
+			if err := srv.OnAccept(rwc.RemoteAddr()); err != nil {
+				log.Printf("reject connection from %v,reason: %v\n", rwc.RemoteAddr(), err)
+				rwc.Close()
+				continue
+			}
+		}
+		c := &Conn{
+			server:        srv,
+			rwc:           rwc,
+			r:             bufio.NewReader(rwc),
+			CloseNotifier: make(chan struct{}),
+		}
+		srv.activeConn.Store(c, true)
+		go c.serve()
+	}
+}
+
+func (srv *Server) Shutdown() {
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		key.(*Conn).close(CloseShutdown)
+		return true
+	})
+}
+
+// FindConn 根据MN查找连接
+func (srv *Server) FindConn(mn string) (*Conn, error) {
+	var c1 *Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if atomic.LoadInt32(&c.registered) == 1 && c.id == mn {
+			c1 = c
+			return false
+		}
+		return true
+	})
+	if c1 == nil {
+		return nil, DeviceOffline
+	}
+	return c1, nil
+}
+
+// Conns 返回所有已注册MN的活动连接
+func (srv *Server) Conns() []*Conn {
+	var conns []*Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if atomic.LoadInt32(&c.registered) == 1 {
+			conns = append(conns, c)
+		}
+		return true
+	})
+	return conns
+}
+
+func (srv *Server) handle(c *Conn, p *Packet) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("handler panic on connection %v,reason: %v\n%s", c.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	if srv.Handler != nil {
+		srv.Handler(c, p)
+	}
+}
+
+func (c *Conn) serve() {
+	for {
+		b, err := c.read()
+		if err != nil {
+			if !c.ShuttingDown() {
+				log.Printf("failed to read from connection %v,reason: %v\n", c.RemoteAddr(), err)
+			}
+			c.Close()
+			return
+		}
+		p, err := Parse(b)
+		if err != nil {
+			log.Printf("failed to parse packet from %v,reason: %v\n", c.RemoteAddr(), err)
+			continue
+		}
+		if p.MN != "" && atomic.LoadInt32(&c.registered) == 0 {
+			c.register(p.MN)
+		}
+		if t := c.server.Presence; t != nil && c.id != "" {
+			t.Uplink(c.id, len(b))
+		}
+		if ch, ok := c.pending.Load(p.QN); ok {
+			select {
+			case ch.(chan *Packet) <- p:
+			default:
+				log.Printf("drop packet from %v,reason: too many responses for %v\n", c.RemoteAddr(), p.QN)
+			}
+			continue
+		}
+		if !c.server.NoAutoAck && p.Flag.NeedAck() && IsUpload(p.CN) {
+			if err := c.Send(p.Response(DataResponse, nil)); err != nil {
+				log.Printf("failed to ack packet from %v,reason: %v\n", c.RemoteAddr(), err)
+			}
+		}
+		// 必须用协程，否则Handler中的Request会因为无法读取应答而超时
+		go c.server.handle(c, p)
+	}
+}
+
+// 读取一个完整的数据包，丢弃包头之前的字节
+func (c *Conn) read() ([]byte, error) {
+	for {
+		c.rwc.SetReadDeadline(time.Now().Add(c.server.timeout()))
+		if _, err := c.r.ReadSlice('#'); err != nil {
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			c.readErr.Store(readErrReason(err))
+			return nil, err
+		}
+		head, err := c.r.Peek(5)
+		if err != nil {
+			c.readErr.Store(readErrReason(err))
+			return nil, err
+		}
+		if head[0] != '#' {
+			continue
+		}
+		n, err := strconv.Atoi(string(head[1:]))
+		if err != nil || n > maxDataLength {
+			continue
+		}
+		b := make([]byte, overhead+n)
+		b[0] = '#'
+		if _, err := io.ReadFull(c.r, b[1:]); err != nil {
+			c.readErr.Store(readErrReason(err))
+			return nil, err
+		}
+		if c.server.debug {
+			log.Printf("read:%s", b)
+		}
+		return b, nil
+	}
+}
+
+// 以MN注册连接，关闭同一MN之前的连接
+func (c *Conn) register(mn string) {
+	if p := c.server.Presence; p != nil {
+		p.Connect(mn, c.RemoteAddr())
+	}
+	c.server.activeConn.Range(func(key, value interface{}) bool {
+		prev := key.(*Conn)
+		if prev != c && prev.id == mn {
+			prev.close(CloseReplaced)
+		}
+		return true
+	})
+	c.id = mn
+	atomic.StoreInt32(&c.registered, 1)
+	if c.server.OnRegister != nil {
+		c.server.OnRegister(c)
+	}
+}
+
+// ID 数采仪的MN，收到第一个带MN的数据包之前为空
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Send 发送数据包，不等待应答
+func (c *Conn) Send(p *Packet) error {
+	b, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.ShuttingDown() {
+		return DeviceOffline
+	}
+	if c.server.debug {
+		log.Printf("write:%s", b)
+	}
+	c.rwc.SetWriteDeadline(time.Now().Add(c.server.timeout()))
+	if _, err := c.rwc.Write(b); err != nil {
+		return err
+	}
+	if t := c.server.Presence; t != nil && c.id != "" {
+		t.Downlink(c.id, len(b))
+	}
+	return nil
+}
+
+// 补全请求的QN、MN和应答标志，并登记等待应答
+func (c *Conn) prepare(p *Packet) (chan *Packet, error) {
+	if p.MN == "" {
+		p.MN = c.id
+	}
+	p.Flag |= FlagAck
+	ch := make(chan *Packet, 16)
+	if p.QN != "" {
+		if _, loaded := c.pending.LoadOrStore(p.QN, ch); loaded {
+			return nil, DuplicateQN
+		}
+		return ch, nil
+	}
+	// 同一毫秒内的多个请求依次顺延
+	for t := time.Now(); ; t = t.Add(time.Millisecond) {
+		if _, loaded := c.pending.LoadOrStore(NewQN(t), ch); !loaded {
+			p.QN = NewQN(t)
+			return ch, nil
+		}
+	}
+}
+
+// Request 向现场机发送命令，等待请求应答（9011）和执行结果（9012），
+// 返回两者之间现场机上传的QN相同的数据包，例如提取现场机时间的1011。
+// 现场机拒绝请求或者执行失败时返回*ReturnError
+func (c *Conn) Request(p *Packet) ([]*Packet, error) {
+	ch, err := c.prepare(p)
+	if err != nil {
+		return nil, err
+	}
+	defer c.pending.Delete(p.QN)
+	if err := c.Send(p); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.server.requestTimeout())
+	defer timer.Stop()
+	var data []*Packet
+	for {
+		select {
+		case <-c.CloseNotifier:
+			return data, DeviceOffline
+		case <-timer.C:
+			return data, WaitResponseTimeout
+		case r := <-ch:
+			switch r.CN {
+			case RequestResponse:
+				if code, _ := r.CP.Get("QnRtn"); code != "1" {
+					return data, &ReturnError{CN: RequestResponse, Code: code}
+				}
+			case ExecutionResult:
+				if code, _ := r.CP.Get("ExeRtn"); code != "1" {
+					return data, &ReturnError{CN: ExecutionResult, Code: code}
+				}
+				return data, nil
+			default:
+				if r.Flag.NeedAck() {
+					c.Send(r.Response(DataResponse, nil))
+				}
+				data = append(data, r)
+			}
+		}
+	}
+}
+
+// Notify 发送通知命令，例如停止察看实时数据，等待通知应答（9013）
+func (c *Conn) Notify(p *Packet) error {
+	ch, err := c.prepare(p)
+	if err != nil {
+		return err
+	}
+	defer c.pending.Delete(p.QN)
+	if err := c.Send(p); err != nil {
+		return err
+	}
+	timer := time.NewTimer(c.server.requestTimeout())
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.CloseNotifier:
+			return DeviceOffline
+		case <-timer.C:
+			return WaitResponseTimeout
+		case r := <-ch:
+			if r.CN == NotifyResponse {
+				return nil
+			}
+		}
+	}
+}
+
+func (c *Conn) Close() {
+	c.close("")
+}
+
+// 以指定的原因关闭连接，reason为空时根据最近一次读取失败的原因判断
+func (c *Conn) close(reason CloseReason) {
+	if atomic.CompareAndSwapInt32(&c.inShutdown, 0, 1) {
+		if reason == "" {
+			reason = CloseByCaller
+			if r, ok := c.readErr.Load().(CloseReason); ok {
+				reason = r
+			}
+		}
+		c.server.activeConn.Delete(c)
+		close(c.CloseNotifier)
+		c.rwc.Close()
+		if p := c.server.Presence; p != nil && c.id != "" {
+			p.Disconnect(c.id)
+		}
+		if c.server.OnClose != nil {
+			c.server.OnClose(c, reason)
+		}
+		if c.server.AfterConnClose != nil {
+			c.server.AfterConnClose(c.id)
+		}
+	}
+}
+
+// 根据读取错误判断连接关闭的原因
+func readErrReason(err error) CloseReason {
+	if err == io.EOF {
+		return CloseEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseReadTimeout
+	}
+	return CloseReadError
+}
+
+func (c *Conn) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.inShutdown) != 0
+}
+
+// 获取客户端地址
+func (c *Conn) RemoteAddr() string {
+	return c.rwc.RemoteAddr().String()
+}
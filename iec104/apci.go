@@ -0,0 +1,131 @@
+package iec104
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	startByte = 0x68
+	// APDU的最大长度，不含启动字符和长度
+	maxAPDULength = 253
+	// ASDU的最大长度
+	maxASDULength = maxAPDULength - 4
+	// 序号的模
+	seqModulo = 32768
+)
+
+// U格式的功能
+const (
+	StartDTAct = uint8(0x07)
+	StartDTCon = uint8(0x0B)
+	StopDTAct  = uint8(0x13)
+	StopDTCon  = uint8(0x23)
+	TestFRAct  = uint8(0x43)
+	TestFRCon  = uint8(0x83)
+)
+
+// FrameType APCI的格式
+type FrameType uint8
+
+const (
+	IFrame FrameType = iota
+	SFrame
+	UFrame
+)
+
+var InvalidAPDU = errors.New("invalid iec104 apdu")
+
+// APCI 应用规约控制信息
+type APCI struct {
+	Type FrameType
+	// I格式的发送序号
+	SendSeq uint16
+	// I格式和S格式的接收序号
+	RecvSeq uint16
+	// U格式的功能
+	Function uint8
+}
+
+func (a APCI) String() string {
+	switch a.Type {
+	case IFrame:
+		return fmt.Sprintf("I(%d,%d)", a.SendSeq, a.RecvSeq)
+	case SFrame:
+		return fmt.Sprintf("S(%d)", a.RecvSeq)
+	}
+	return fmt.Sprintf("U(0x%02x)", a.Function)
+}
+
+// encodeAPDU 编码为APDU，asdu只用于I格式
+func encodeAPDU(a APCI, asdu []byte) []byte {
+	b := make([]byte, 6, 6+len(asdu))
+	b[0] = startByte
+	b[1] = byte(4 + len(asdu))
+	switch a.Type {
+	case IFrame:
+		b[2] = byte(a.SendSeq << 1)
+		b[3] = byte(a.SendSeq >> 7)
+		b[4] = byte(a.RecvSeq << 1)
+		b[5] = byte(a.RecvSeq >> 7)
+		b = append(b, asdu...)
+	case SFrame:
+		b[2] = 0x01
+		b[4] = byte(a.RecvSeq << 1)
+		b[5] = byte(a.RecvSeq >> 7)
+	case UFrame:
+		b[2] = a.Function
+	}
+	return b
+}
+
+// readAPDU 读取一个APDU，返回APCI和I格式的ASDU
+func readAPDU(r io.Reader) (APCI, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return APCI{}, nil, err
+	}
+	if header[0] != startByte || header[1] < 4 || header[1] > maxAPDULength {
+		return APCI{}, nil, fmt.Errorf("%w: header 0x% x", InvalidAPDU, header)
+	}
+	body := make([]byte, header[1])
+	if _, err := io.ReadFull(r, body); err != nil {
+		return APCI{}, nil, err
+	}
+	return parseAPCI(body)
+}
+
+func parseAPCI(body []byte) (APCI, []byte, error) {
+	switch {
+	case body[0]&0x01 == 0:
+		a := APCI{
+			Type:    IFrame,
+			SendSeq: uint16(body[0])>>1 | uint16(body[1])<<7,
+			RecvSeq: uint16(body[2])>>1 | uint16(body[3])<<7,
+		}
+		if len(body) == 4 {
+			return a, nil, fmt.Errorf("%w: empty i frame", InvalidAPDU)
+		}
+		return a, body[4:], nil
+	case body[0]&0x03 == 0x01:
+		if len(body) != 4 {
+			return APCI{}, nil, fmt.Errorf("%w: s frame with asdu", InvalidAPDU)
+		}
+		return APCI{Type: SFrame, RecvSeq: uint16(body[2])>>1 | uint16(body[3])<<7}, nil, nil
+	default:
+		if len(body) != 4 {
+			return APCI{}, nil, fmt.Errorf("%w: u frame with asdu", InvalidAPDU)
+		}
+		switch body[0] {
+		case StartDTAct, StartDTCon, StopDTAct, StopDTCon, TestFRAct, TestFRCon:
+			return APCI{Type: UFrame, Function: body[0]}, nil, nil
+		}
+		return APCI{}, nil, fmt.Errorf("%w: u function 0x%02x", InvalidAPDU, body[0])
+	}
+}
+
+// 序号差，考虑回绕
+func seqDiff(a, b uint16) uint16 {
+	return (a - b + seqModulo) % seqModulo
+}
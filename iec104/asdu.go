@@ -0,0 +1,362 @@
+package iec104
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TypeID 类型标识
+type TypeID uint8
+
+const (
+	// 单点信息
+	M_SP_NA_1 TypeID = 1
+	// 双点信息
+	M_DP_NA_1 TypeID = 3
+	// 测量值，归一化值
+	M_ME_NA_1 TypeID = 9
+	// 测量值，标度化值
+	M_ME_NB_1 TypeID = 11
+	// 测量值，短浮点数
+	M_ME_NC_1 TypeID = 13
+	// 带CP56Time2a时标的单点信息
+	M_SP_TB_1 TypeID = 30
+	// 带CP56Time2a时标的双点信息
+	M_DP_TB_1 TypeID = 31
+	// 带CP56Time2a时标的测量值，归一化值
+	M_ME_TD_1 TypeID = 34
+	// 带CP56Time2a时标的测量值，标度化值
+	M_ME_TE_1 TypeID = 35
+	// 带CP56Time2a时标的测量值，短浮点数
+	M_ME_TF_1 TypeID = 36
+	// 单点命令
+	C_SC_NA_1 TypeID = 45
+	// 初始化结束
+	M_EI_NA_1 TypeID = 70
+	// 总召唤命令
+	C_IC_NA_1 TypeID = 100
+	// 时钟同步命令
+	C_CS_NA_1 TypeID = 103
+)
+
+// Cause 传送原因
+type Cause uint8
+
+const (
+	Periodic              Cause = 1
+	Background            Cause = 2
+	Spontaneous           Cause = 3
+	Initialized           Cause = 4
+	Request               Cause = 5
+	Activation            Cause = 6
+	ActivationCon         Cause = 7
+	Deactivation          Cause = 8
+	DeactivationCon       Cause = 9
+	ActivationTerm        Cause = 10
+	InterrogatedByStation Cause = 20
+	UnknownType           Cause = 44
+	UnknownCause          Cause = 45
+	UnknownCommonAddr     Cause = 46
+	UnknownIOA            Cause = 47
+)
+
+// Quality 品质描述词，单点和双点信息只使用高4位
+type Quality uint8
+
+const (
+	// 溢出，只用于测量值
+	QualityOV Quality = 0x01
+	// 被闭锁
+	QualityBL Quality = 0x10
+	// 被取代
+	QualitySB Quality = 0x20
+	// 非当前值
+	QualityNT Quality = 0x40
+	// 无效
+	QualityIV Quality = 0x80
+)
+
+// 总召唤的召唤限定词
+const QOIStation = uint8(20)
+
+// 单点命令的选择/执行位
+const SelectCommand = uint8(0x80)
+
+var (
+	// ASDU不完整
+	ShortASDU = errors.New("iec104 asdu too short")
+	// 不支持的类型标识
+	UnsupportedType = errors.New("unsupported iec104 type")
+)
+
+type (
+	// ASDU 应用服务数据单元，传送原因2字节，公共地址2字节，信息对象地址3字节
+	ASDU struct {
+		Type TypeID
+		// 信息对象地址是否连续，连续时只编码第一个信息对象地址
+		Sequence bool
+		Cause    Cause
+		// 否定确认
+		Negative bool
+		// 试验
+		Test bool
+		// 源发站地址
+		Originator uint8
+		CommonAddr uint16
+		Objects    []InfoObject
+	}
+
+	// InfoObject 信息对象
+	InfoObject struct {
+		IOA uint32
+		// 单点信息和单点命令为0或1，双点信息为0到3，归一化值在-1到1之间，标度化值为整数，短浮点数为实际值
+		Value   float64
+		Quality Quality
+		// 带时标的类型和时钟同步命令的时间
+		Time time.Time
+		// 单点命令的选择/执行位和命令限定词，总召唤的召唤限定词，初始化结束的初始化原因
+		Qualifier uint8
+	}
+)
+
+// Reply 生成以cause应答的ASDU，信息对象与a相同
+func (a *ASDU) Reply(cause Cause) *ASDU {
+	r := *a
+	r.Cause = cause
+	r.Negative = false
+	r.Objects = append([]InfoObject(nil), a.Objects...)
+	return &r
+}
+
+// 信息元素的长度，不含信息对象地址
+func elementSize(t TypeID) (int, error) {
+	switch t {
+	case M_SP_NA_1, M_DP_NA_1, C_SC_NA_1, C_IC_NA_1, M_EI_NA_1:
+		return 1, nil
+	case M_ME_NA_1, M_ME_NB_1:
+		return 3, nil
+	case M_ME_NC_1:
+		return 5, nil
+	case M_SP_TB_1, M_DP_TB_1:
+		return 8, nil
+	case M_ME_TD_1, M_ME_TE_1:
+		return 10, nil
+	case M_ME_TF_1:
+		return 12, nil
+	case C_CS_NA_1:
+		return 7, nil
+	}
+	return 0, fmt.Errorf("%w: %v", UnsupportedType, t)
+}
+
+// Bytes 编码ASDU
+func (a *ASDU) Bytes() ([]byte, error) {
+	if _, err := elementSize(a.Type); err != nil {
+		return nil, err
+	}
+	n := len(a.Objects)
+	if n == 0 || n > 127 {
+		return nil, fmt.Errorf("%w: %v objects", ShortASDU, n)
+	}
+	vsq := byte(n)
+	if a.Sequence {
+		vsq |= 0x80
+	}
+	cot := byte(a.Cause & 0x3f)
+	if a.Negative {
+		cot |= 0x40
+	}
+	if a.Test {
+		cot |= 0x80
+	}
+	b := []byte{byte(a.Type), vsq, cot, a.Originator, byte(a.CommonAddr), byte(a.CommonAddr >> 8)}
+	for i, obj := range a.Objects {
+		if i == 0 || !a.Sequence {
+			b = append(b, byte(obj.IOA), byte(obj.IOA>>8), byte(obj.IOA>>16))
+		}
+		b = appendElement(b, a.Type, obj)
+	}
+	if len(b) > maxASDULength {
+		return nil, fmt.Errorf("asdu too long: %v bytes, max %v", len(b), maxASDULength)
+	}
+	return b, nil
+}
+
+func appendElement(b []byte, t TypeID, obj InfoObject) []byte {
+	switch t {
+	case M_SP_NA_1, M_SP_TB_1:
+		b = append(b, byte(obj.Quality&0xf0)|byte(obj.Value)&0x01)
+	case M_DP_NA_1, M_DP_TB_1:
+		b = append(b, byte(obj.Quality&0xf0)|byte(obj.Value)&0x03)
+	case M_ME_NA_1, M_ME_TD_1:
+		v := math.Round(obj.Value * 32768)
+		v = math.Max(math.Min(v, math.MaxInt16), math.MinInt16)
+		b = append(b, byte(int16(v)), byte(uint16(int16(v))>>8), byte(obj.Quality))
+	case M_ME_NB_1, M_ME_TE_1:
+		v := int16(math.Round(obj.Value))
+		b = append(b, byte(v), byte(uint16(v)>>8), byte(obj.Quality))
+	case M_ME_NC_1, M_ME_TF_1:
+		var f [4]byte
+		binary.LittleEndian.PutUint32(f[:], math.Float32bits(float32(obj.Value)))
+		b = append(append(b, f[:]...), byte(obj.Quality))
+	case C_SC_NA_1:
+		b = append(b, obj.Qualifier&0xfe|byte(obj.Value)&0x01)
+	case C_IC_NA_1, M_EI_NA_1:
+		b = append(b, obj.Qualifier)
+	case C_CS_NA_1:
+		b = append(b, CP56Time2a(obj.Time)...)
+	}
+	switch t {
+	case M_SP_TB_1, M_DP_TB_1, M_ME_TD_1, M_ME_TE_1, M_ME_TF_1:
+		b = append(b, CP56Time2a(obj.Time)...)
+	}
+	return b
+}
+
+// ParseASDU 解析ASDU，loc为时标的时区，为nil时使用time.Local
+func ParseASDU(b []byte, loc *time.Location) (*ASDU, error) {
+	if len(b) < 6 {
+		return nil, ShortASDU
+	}
+	a := &ASDU{
+		Type:       TypeID(b[0]),
+		Sequence:   b[1]&0x80 != 0,
+		Cause:      Cause(b[2] & 0x3f),
+		Negative:   b[2]&0x40 != 0,
+		Test:       b[2]&0x80 != 0,
+		Originator: b[3],
+		CommonAddr: binary.LittleEndian.Uint16(b[4:]),
+	}
+	size, err := elementSize(a.Type)
+	if err != nil {
+		return a, err
+	}
+	n := int(b[1] & 0x7f)
+	b = b[6:]
+	var ioa uint32
+	for i := 0; i < n; i++ {
+		if i == 0 || !a.Sequence {
+			if len(b) < 3 {
+				return nil, ShortASDU
+			}
+			ioa = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+			b = b[3:]
+		} else {
+			ioa++
+		}
+		if len(b) < size {
+			return nil, ShortASDU
+		}
+		obj, err := parseElement(a.Type, b[:size], loc)
+		if err != nil {
+			return nil, err
+		}
+		obj.IOA = ioa
+		a.Objects = append(a.Objects, obj)
+		b = b[size:]
+	}
+	return a, nil
+}
+
+func parseElement(t TypeID, b []byte, loc *time.Location) (InfoObject, error) {
+	var obj InfoObject
+	switch t {
+	case M_SP_NA_1, M_SP_TB_1:
+		obj.Value = float64(b[0] & 0x01)
+		obj.Quality = Quality(b[0] & 0xf0)
+	case M_DP_NA_1, M_DP_TB_1:
+		obj.Value = float64(b[0] & 0x03)
+		obj.Quality = Quality(b[0] & 0xf0)
+	case M_ME_NA_1, M_ME_TD_1:
+		obj.Value = float64(int16(binary.LittleEndian.Uint16(b))) / 32768
+		obj.Quality = Quality(b[2])
+	case M_ME_NB_1, M_ME_TE_1:
+		obj.Value = float64(int16(binary.LittleEndian.Uint16(b)))
+		obj.Quality = Quality(b[2])
+	case M_ME_NC_1, M_ME_TF_1:
+		obj.Value = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		obj.Quality = Quality(b[4])
+	case C_SC_NA_1:
+		obj.Value = float64(b[0] & 0x01)
+		obj.Qualifier = b[0] & 0xfe
+	case C_IC_NA_1, M_EI_NA_1:
+		obj.Qualifier = b[0]
+	case C_CS_NA_1:
+		obj.Time = ParseCP56Time2a(b, loc)
+	}
+	switch t {
+	case M_SP_TB_1, M_DP_TB_1, M_ME_TD_1, M_ME_TE_1, M_ME_TF_1:
+		obj.Time = ParseCP56Time2a(b[len(b)-7:], loc)
+	}
+	return obj, nil
+}
+
+// CP56Time2a 将时间编码为7字节的CP56Time2a
+func CP56Time2a(t time.Time) []byte {
+	ms := t.Second()*1000 + t.Nanosecond()/int(time.Millisecond)
+	weekday := int(t.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	return []byte{
+		byte(ms), byte(ms >> 8),
+		byte(t.Minute()),
+		byte(t.Hour()),
+		byte(weekday<<5 | t.Day()),
+		byte(t.Month()),
+		byte(t.Year() % 100),
+	}
+}
+
+// ParseCP56Time2a 解析7字节的CP56Time2a，年份按21世纪处理，loc为nil时使用time.Local
+func ParseCP56Time2a(b []byte, loc *time.Location) time.Time {
+	if len(b) < 7 {
+		return time.Time{}
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	ms := int(binary.LittleEndian.Uint16(b))
+	return time.Date(2000+int(b[6]&0x7f), time.Month(b[5]&0x0f), int(b[4]&0x1f),
+		int(b[3]&0x1f), int(b[2]&0x3f), ms/1000, ms%1000*int(time.Millisecond), loc)
+}
+
+// NewInterrogation 总召唤命令
+func NewInterrogation(commonAddr uint16) *ASDU {
+	return &ASDU{
+		Type:       C_IC_NA_1,
+		Cause:      Activation,
+		CommonAddr: commonAddr,
+		Objects:    []InfoObject{{Qualifier: QOIStation}},
+	}
+}
+
+// NewClockSync 时钟同步命令
+func NewClockSync(commonAddr uint16, t time.Time) *ASDU {
+	return &ASDU{
+		Type:       C_CS_NA_1,
+		Cause:      Activation,
+		CommonAddr: commonAddr,
+		Objects:    []InfoObject{{Time: t}},
+	}
+}
+
+// NewSingleCommand 单点命令，selectFirst为true时为选择命令，否则为执行命令
+func NewSingleCommand(commonAddr uint16, ioa uint32, on, selectFirst bool) *ASDU {
+	obj := InfoObject{IOA: ioa}
+	if on {
+		obj.Value = 1
+	}
+	if selectFirst {
+		obj.Qualifier = SelectCommand
+	}
+	return &ASDU{
+		Type:       C_SC_NA_1,
+		Cause:      Activation,
+		CommonAddr: commonAddr,
+		Objects:    []InfoObject{obj},
+	}
+}
@@ -0,0 +1,22 @@
+package iec104
+
+import (
+	"fmt"
+	"net"
+)
+
+// Dial 作为客户端（主站）连接到服务端并启动数据传输，handler处理收到的ASDU
+func Dial(address string, cfg Config, handler HandlerFunc) (*Conn, error) {
+	cfg = cfg.withDefaults()
+	rwc, err := net.DialTimeout("tcp", address, cfg.T0)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to dial %v , reason: %v`, address, err)
+	}
+	c := newConn(rwc, cfg, handler, nil)
+	c.run()
+	if err := c.StartDT(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
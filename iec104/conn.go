@@ -0,0 +1,506 @@
+package iec104
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultK  = 12
+	defaultW  = 8
+	defaultT0 = 30 * time.Second
+	defaultT1 = 15 * time.Second
+	defaultT2 = 10 * time.Second
+	defaultT3 = 20 * time.Second
+)
+
+var (
+	// 未启动数据传输（STARTDT）
+	NotStarted = errors.New("iec104 data transfer not started")
+	ConnClosed = errors.New("iec104 connection closed")
+	// 未被确认的APDU已达到k
+	WindowFull = errors.New("iec104 send window full")
+)
+
+// CloseReason 连接关闭的原因
+type CloseReason string
+
+const (
+	// 调用方主动关闭
+	CloseByCaller CloseReason = "closed"
+	// 对端关闭连接
+	CloseEOF CloseReason = "eof"
+	// 读写失败或者报文格式错误
+	CloseReadError  CloseReason = "read_error"
+	CloseWriteError CloseReason = "write_error"
+	// t1内没有收到I格式报文、STARTDT或TESTFR的确认
+	CloseT1Timeout CloseReason = "t1_timeout"
+	// 发送序号或接收序号错误
+	CloseSequenceError CloseReason = "sequence_error"
+	// 服务关闭
+	CloseShutdown CloseReason = "shutdown"
+)
+
+type (
+	// Config k、w和t0到t3参数，零值使用标准的默认值
+	Config struct {
+		// 未被确认的I格式APDU的最大数目，默认12
+		K uint16
+		// 最迟在接收到W个I格式APDU之后确认，默认8
+		W uint16
+		// 建立连接的超时，只用于Dial，默认30秒
+		T0 time.Duration
+		// 发送I格式APDU、STARTDT或TESTFR之后等待确认的超时，默认15秒
+		T1 time.Duration
+		// 没有数据报文时确认I格式APDU的超时，默认10秒，必须小于T1
+		T2 time.Duration
+		// 长时间空闲时发送TESTFR的超时，默认20秒
+		T3 time.Duration
+		// 时标的时区，为nil时使用time.Local
+		Location *time.Location
+	}
+
+	// HandlerFunc 处理收到的ASDU
+	HandlerFunc func(c *Conn, a *ASDU)
+
+	// Conn 一个IEC 104连接，服务端和客户端共用
+	Conn struct {
+		// 用于标示连接的唯一编号，默认为对端地址
+		id string
+
+		// 服务端的连接不为nil
+		server *Server
+
+		rwc     net.Conn
+		cfg     Config
+		handler HandlerFunc
+
+		CloseNotifier chan struct{}
+
+		inShutdown int32 // accessed atomically (non-zero means we're in Shutdown)
+
+		// 可供调用方存储一些键值
+		sync.Map
+
+		// 保护以下的链路状态，写入也在锁内进行，保证序号的顺序
+		mu   sync.Mutex
+		cond *sync.Cond
+		// 是否已启动数据传输
+		started bool
+		sendSeq uint16
+		recvSeq uint16
+		// pending中第一个I格式APDU的发送序号
+		ackSeq uint16
+		// 已发送未被确认的I格式APDU的发送时间
+		pending []time.Time
+		// 已接收未确认的I格式APDU的数量，以及其中第一个的接收时间
+		recvUnacked uint16
+		recvFirst   time.Time
+		lastRecv    time.Time
+		// 等待确认的TESTFR和STARTDT的发送时间
+		testSent  time.Time
+		startSent time.Time
+		startCon  chan struct{}
+
+		// 按顺序交给handler处理
+		inboxMu   sync.Mutex
+		inboxCond *sync.Cond
+		inbox     []*ASDU
+
+		closeReason atomic.Value
+	}
+)
+
+func (cfg Config) withDefaults() Config {
+	if cfg.K == 0 {
+		cfg.K = defaultK
+	}
+	if cfg.W == 0 {
+		cfg.W = defaultW
+	}
+	if cfg.T0 <= 0 {
+		cfg.T0 = defaultT0
+	}
+	if cfg.T1 <= 0 {
+		cfg.T1 = defaultT1
+	}
+	if cfg.T2 <= 0 {
+		cfg.T2 = defaultT2
+	}
+	if cfg.T3 <= 0 {
+		cfg.T3 = defaultT3
+	}
+	return cfg
+}
+
+func newConn(rwc net.Conn, cfg Config, handler HandlerFunc, server *Server) *Conn {
+	c := &Conn{
+		id:            rwc.RemoteAddr().String(),
+		server:        server,
+		rwc:           rwc,
+		cfg:           cfg.withDefaults(),
+		handler:       handler,
+		CloseNotifier: make(chan struct{}),
+		startCon:      make(chan struct{}, 1),
+		lastRecv:      time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.inboxCond = sync.NewCond(&c.inboxMu)
+	return c
+}
+
+// 启动读取、定时器和处理三个协程
+func (c *Conn) run() {
+	go c.readLoop()
+	go c.timerLoop()
+	go c.dispatch()
+}
+
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// SetID 设置连接的编号，用于FindConn
+func (c *Conn) SetID(id string) {
+	c.id = id
+}
+
+func (c *Conn) RemoteAddr() string {
+	return c.rwc.RemoteAddr().String()
+}
+
+// Started 是否已启动数据传输
+func (c *Conn) Started() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started
+}
+
+func (c *Conn) debug() bool {
+	return c.server != nil && c.server.debug
+}
+
+// 调用方需持有c.mu
+func (c *Conn) write(a APCI, asdu []byte) error {
+	b := encodeAPDU(a, asdu)
+	if c.debug() {
+		log.Printf("write %v:0x% x\n", a, b)
+	}
+	c.rwc.SetWriteDeadline(time.Now().Add(c.cfg.T1))
+	if _, err := c.rwc.Write(b); err != nil {
+		log.Printf("failed to write to connection %v,reason: %v\n", c.RemoteAddr(), err)
+		// close会等待其他协程，不能在持有锁时同步调用
+		go c.close(CloseWriteError)
+		return err
+	}
+	return nil
+}
+
+// 确认已接收的I格式APDU，调用方需持有c.mu
+func (c *Conn) sendS() error {
+	c.recvUnacked = 0
+	return c.write(APCI{Type: SFrame, RecvSeq: c.recvSeq}, nil)
+}
+
+// Send 以I格式发送ASDU，未被确认的APDU达到k时阻塞直到收到确认或者连接关闭
+func (c *Conn) Send(a *ASDU) error {
+	return c.send(a, true)
+}
+
+// TrySend 与Send相同，但未被确认的APDU达到k时不等待，返回WindowFull
+func (c *Conn) TrySend(a *ASDU) error {
+	return c.send(a, false)
+}
+
+func (c *Conn) send(a *ASDU, wait bool) error {
+	b, err := a.Bytes()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.ShuttingDown() {
+			return ConnClosed
+		}
+		if !c.started {
+			return NotStarted
+		}
+		if len(c.pending) < int(c.cfg.K) {
+			break
+		}
+		if !wait {
+			return WindowFull
+		}
+		c.cond.Wait()
+	}
+	if err := c.write(APCI{Type: IFrame, SendSeq: c.sendSeq, RecvSeq: c.recvSeq}, b); err != nil {
+		return err
+	}
+	if len(c.pending) == 0 {
+		c.ackSeq = c.sendSeq
+	}
+	c.pending = append(c.pending, time.Now())
+	c.sendSeq = (c.sendSeq + 1) % seqModulo
+	// I格式APDU同时确认了已接收的APDU
+	c.recvUnacked = 0
+	return nil
+}
+
+// StartDT 客户端启动数据传输，等待对端确认
+func (c *Conn) StartDT() error {
+	c.mu.Lock()
+	err := c.write(APCI{Type: UFrame, Function: StartDTAct}, nil)
+	if err == nil {
+		c.startSent = time.Now()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.startCon:
+		return nil
+	case <-c.CloseNotifier:
+		return ConnClosed
+	}
+}
+
+// StopDT 客户端停止数据传输
+func (c *Conn) StopDT() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = false
+	return c.write(APCI{Type: UFrame, Function: StopDTAct}, nil)
+}
+
+// 处理对端的确认，调用方需持有c.mu
+func (c *Conn) ack(nr uint16) bool {
+	n := seqDiff(nr, c.ackSeq)
+	if len(c.pending) == 0 {
+		// 没有待确认的APDU时，确认序号必须等于发送序号
+		return nr == c.sendSeq
+	}
+	if int(n) > len(c.pending) {
+		return false
+	}
+	c.pending = c.pending[n:]
+	c.ackSeq = nr
+	if n > 0 {
+		c.cond.Broadcast()
+	}
+	return true
+}
+
+func (c *Conn) readLoop() {
+	for {
+		a, asdu, err := readAPDU(c.rwc)
+		if err != nil {
+			if c.ShuttingDown() {
+				return
+			}
+			if err == io.EOF {
+				c.close(CloseEOF)
+				return
+			}
+			log.Printf("failed to read from connection %v,reason: %v\n", c.RemoteAddr(), err)
+			c.close(CloseReadError)
+			return
+		}
+		if c.debug() {
+			log.Printf("read %v:0x% x\n", a, asdu)
+		}
+		if reason, ok := c.receive(a, asdu); !ok {
+			log.Printf("protocol error on connection %v,reason: %v\n", c.RemoteAddr(), reason)
+			c.close(reason)
+			return
+		}
+	}
+}
+
+// 更新链路状态，返回false时关闭连接
+func (c *Conn) receive(a APCI, asdu []byte) (CloseReason, bool) {
+	c.mu.Lock()
+	c.lastRecv = time.Now()
+	switch a.Type {
+	case IFrame:
+		if a.SendSeq != c.recvSeq || !c.ack(a.RecvSeq) {
+			c.mu.Unlock()
+			return CloseSequenceError, false
+		}
+		c.recvSeq = (c.recvSeq + 1) % seqModulo
+		if c.recvUnacked == 0 {
+			c.recvFirst = c.lastRecv
+		}
+		c.recvUnacked++
+		if c.recvUnacked >= c.cfg.W {
+			c.sendS()
+		}
+		started := c.started
+		c.mu.Unlock()
+		if !started {
+			log.Printf("drop i frame before startdt from %v\n", c.RemoteAddr())
+			return "", true
+		}
+		parsed, err := ParseASDU(asdu, c.cfg.Location)
+		if err != nil {
+			log.Printf("invalid asdu from %v,reason: %v\n", c.RemoteAddr(), err)
+			return "", true
+		}
+		c.enqueue(parsed)
+		return "", true
+	case SFrame:
+		ok := c.ack(a.RecvSeq)
+		c.mu.Unlock()
+		if !ok {
+			return CloseSequenceError, false
+		}
+		return "", true
+	}
+	defer c.mu.Unlock()
+	switch a.Function {
+	case StartDTAct:
+		c.started = true
+		c.write(APCI{Type: UFrame, Function: StartDTCon}, nil)
+	case StopDTAct:
+		if c.recvUnacked > 0 {
+			c.sendS()
+		}
+		c.started = false
+		c.write(APCI{Type: UFrame, Function: StopDTCon}, nil)
+	case StartDTCon:
+		c.started = true
+		c.startSent = time.Time{}
+		select {
+		case c.startCon <- struct{}{}:
+		default:
+		}
+	case StopDTCon:
+		c.started = false
+	case TestFRAct:
+		c.write(APCI{Type: UFrame, Function: TestFRCon}, nil)
+	case TestFRCon:
+		c.testSent = time.Time{}
+	}
+	return "", true
+}
+
+// 检查t1、t2、t3
+func (c *Conn) timerLoop() {
+	tick := c.cfg.T2 / 4
+	if c.cfg.T3/4 < tick {
+		tick = c.cfg.T3 / 4
+	}
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.CloseNotifier:
+			return
+		case now := <-ticker.C:
+			if !c.checkTimers(now) {
+				log.Printf("t1 timeout on connection %v\n", c.RemoteAddr())
+				c.close(CloseT1Timeout)
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) checkTimers(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t1 := c.cfg.T1
+	if len(c.pending) > 0 && now.Sub(c.pending[0]) >= t1 ||
+		!c.testSent.IsZero() && now.Sub(c.testSent) >= t1 ||
+		!c.startSent.IsZero() && now.Sub(c.startSent) >= t1 {
+		return false
+	}
+	if c.recvUnacked > 0 && now.Sub(c.recvFirst) >= c.cfg.T2 {
+		c.sendS()
+	}
+	if c.testSent.IsZero() && now.Sub(c.lastRecv) >= c.cfg.T3 {
+		if c.write(APCI{Type: UFrame, Function: TestFRAct}, nil) == nil {
+			c.testSent = now
+		}
+	}
+	return true
+}
+
+func (c *Conn) enqueue(a *ASDU) {
+	c.inboxMu.Lock()
+	c.inbox = append(c.inbox, a)
+	c.inboxMu.Unlock()
+	c.inboxCond.Signal()
+}
+
+// 按接收顺序处理ASDU，handler可以调用Send而不会阻塞确认的处理
+func (c *Conn) dispatch() {
+	for {
+		c.inboxMu.Lock()
+		for len(c.inbox) == 0 && !c.ShuttingDown() {
+			c.inboxCond.Wait()
+		}
+		if c.ShuttingDown() {
+			c.inboxMu.Unlock()
+			return
+		}
+		a := c.inbox[0]
+		c.inbox = c.inbox[1:]
+		c.inboxMu.Unlock()
+		c.handle(a)
+	}
+}
+
+func (c *Conn) handle(a *ASDU) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("handler panic on connection %v,reason: %v\n%s", c.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	if c.handler != nil {
+		c.handler(c, a)
+	}
+}
+
+func (c *Conn) Close() {
+	c.close(CloseByCaller)
+}
+
+func (c *Conn) close(reason CloseReason) {
+	if !atomic.CompareAndSwapInt32(&c.inShutdown, 0, 1) {
+		return
+	}
+	c.closeReason.Store(reason)
+	close(c.CloseNotifier)
+	c.rwc.Close()
+	// 唤醒等待窗口和等待处理的协程
+	c.mu.Lock()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.inboxMu.Lock()
+	c.inboxCond.Broadcast()
+	c.inboxMu.Unlock()
+	if c.server != nil {
+		c.server.onClose(c, reason)
+	}
+}
+
+// CloseReason 连接关闭的原因，连接未关闭时为空
+func (c *Conn) CloseReason() CloseReason {
+	reason, _ := c.closeReason.Load().(CloseReason)
+	return reason
+}
+
+func (c *Conn) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.inShutdown) != 0
+}
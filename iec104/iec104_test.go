@@ -0,0 +1,329 @@
+package iec104
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		srv.Shutdown()
+	})
+	return l.Addr().String()
+}
+
+func TestASDU_RoundTrip(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 10, 20, 30, 456*int(time.Millisecond), time.UTC)
+	a := &ASDU{
+		Type:       M_ME_TF_1,
+		Cause:      Spontaneous,
+		CommonAddr: 1,
+		Objects: []InfoObject{
+			{IOA: 16385, Value: 220.5, Time: ts},
+			{IOA: 16386, Value: -1.25, Quality: QualityIV, Time: ts},
+		},
+	}
+	b, err := a.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseASDU(b, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != a.Type || got.Cause != a.Cause || got.CommonAddr != 1 || len(got.Objects) != 2 {
+		t.Fatalf("unexpected asdu %+v", got)
+	}
+	for i, obj := range got.Objects {
+		if obj.IOA != a.Objects[i].IOA || obj.Value != a.Objects[i].Value ||
+			obj.Quality != a.Objects[i].Quality || !obj.Time.Equal(ts) {
+			t.Errorf("object %d = %+v", i, obj)
+		}
+	}
+
+	// 连续的归一化值
+	n := &ASDU{
+		Type:       M_ME_NA_1,
+		Sequence:   true,
+		Cause:      InterrogatedByStation,
+		CommonAddr: 1,
+		Objects:    []InfoObject{{IOA: 100, Value: 0.5}, {IOA: 101, Value: -0.25}},
+	}
+	b, err = n.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ParseASDU(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Objects[1].IOA != 101 || math.Abs(got.Objects[0].Value-0.5) > 1e-4 || math.Abs(got.Objects[1].Value+0.25) > 1e-4 {
+		t.Errorf("unexpected objects %+v", got.Objects)
+	}
+}
+
+func TestInterrogation(t *testing.T) {
+	srv := NewServer()
+	srv.Handler = func(c *Conn, a *ASDU) {
+		if a.Type != C_IC_NA_1 || a.Cause != Activation {
+			c.Send(&ASDU{Type: a.Type, Cause: UnknownType, Negative: true, CommonAddr: a.CommonAddr, Objects: a.Objects})
+			return
+		}
+		c.Send(a.Reply(ActivationCon))
+		c.Send(&ASDU{
+			Type:       M_ME_NC_1,
+			Cause:      InterrogatedByStation,
+			CommonAddr: a.CommonAddr,
+			Objects:    []InfoObject{{IOA: 16385, Value: 230.1}},
+		})
+		c.Send(&ASDU{
+			Type:       M_SP_NA_1,
+			Cause:      InterrogatedByStation,
+			CommonAddr: a.CommonAddr,
+			Objects:    []InfoObject{{IOA: 1, Value: 1}},
+		})
+		c.Send(a.Reply(ActivationTerm))
+	}
+	addr := startServer(t, srv)
+
+	received := make(chan *ASDU, 8)
+	c, err := Dial(addr, Config{}, func(c *Conn, a *ASDU) {
+		received <- a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send(NewInterrogation(1)); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		typ   TypeID
+		cause Cause
+	}{
+		{C_IC_NA_1, ActivationCon},
+		{M_ME_NC_1, InterrogatedByStation},
+		{M_SP_NA_1, InterrogatedByStation},
+		{C_IC_NA_1, ActivationTerm},
+	}
+	for i, w := range want {
+		select {
+		case a := <-received:
+			if a.Type != w.typ || a.Cause != w.cause {
+				t.Fatalf("asdu %d = %v/%v, want %v/%v", i, a.Type, a.Cause, w.typ, w.cause)
+			}
+			if a.Type == M_ME_NC_1 && math.Abs(a.Objects[0].Value-230.1) > 1e-4 {
+				t.Errorf("value = %v", a.Objects[0].Value)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("asdu %d not received", i)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	const total = 20
+	srv := NewServer()
+	srv.K = 2
+	sent := make(chan error, 1)
+	srv.Handler = func(c *Conn, a *ASDU) {
+		for i := 0; i < total; i++ {
+			if err := c.Send(&ASDU{
+				Type:       M_SP_NA_1,
+				Cause:      Spontaneous,
+				CommonAddr: 1,
+				Objects:    []InfoObject{{IOA: uint32(i)}},
+			}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}
+	addr := startServer(t, srv)
+
+	received := make(chan *ASDU, total)
+	// w大于k，客户端只能依靠t2确认
+	c, err := Dial(addr, Config{W: 8, T1: time.Second, T2: 20 * time.Millisecond}, func(c *Conn, a *ASDU) {
+		received <- a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send(NewInterrogation(1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("window never acknowledged")
+	}
+	for i := 0; i < total; i++ {
+		a := <-received
+		if a.Objects[0].IOA != uint32(i) {
+			t.Fatalf("asdu %d has ioa %d", i, a.Objects[0].IOA)
+		}
+	}
+}
+
+func TestBroadcastSkipsFullWindow(t *testing.T) {
+	srv := NewServer()
+	srv.K = 2
+	addr := startServer(t, srv)
+
+	// 启动数据传输之后不再确认的主站
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.Write([]byte{startByte, 0x04, StartDTAct, 0x00, 0x00, 0x00})
+	go io.Copy(ioutil.Discard, stalled)
+
+	// 每收到一个APDU立即确认的主站
+	received := make(chan *ASDU, 8)
+	c, err := Dial(addr, Config{W: 1}, func(c *Conn, a *ASDU) {
+		received <- a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		started := 0
+		for _, conn := range srv.Conns() {
+			if conn.Started() {
+				started++
+			}
+		}
+		if started == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections started, want 2", started)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var healthy *Conn
+	for _, conn := range srv.Conns() {
+		if conn.RemoteAddr() == c.rwc.LocalAddr().String() {
+			healthy = conn
+		}
+	}
+	acked := func() bool {
+		healthy.mu.Lock()
+		defer healthy.mu.Unlock()
+		return len(healthy.pending) == 0
+	}
+
+	// 停滞的主站的窗口满了之后，广播仍然立即返回并送达其他主站
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		srv.Broadcast(&ASDU{Type: M_SP_NA_1, Cause: Spontaneous, CommonAddr: 1, Objects: []InfoObject{{IOA: uint32(i)}}})
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("broadcast %d blocked for %v", i, d)
+		}
+		select {
+		case a := <-received:
+			if a.Objects[0].IOA != uint32(i) {
+				t.Fatalf("asdu %d has ioa %d", i, a.Objects[0].IOA)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("asdu %d not received", i)
+		}
+		for deadline := time.Now().Add(time.Second); !acked(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("asdu %d not acknowledged", i)
+			}
+		}
+	}
+}
+
+func TestSendBeforeStart(t *testing.T) {
+	srv := NewServer()
+	conns := make(chan *Conn, 1)
+	srv.OnAccept = func(c *Conn) error {
+		conns <- c
+		return nil
+	}
+	addr := startServer(t, srv)
+	rwc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	c := <-conns
+	if err := c.Send(NewInterrogation(1)); err != NotStarted {
+		t.Fatalf("err = %v, want NotStarted", err)
+	}
+}
+
+func TestTestFrame(t *testing.T) {
+	srv := NewServer()
+	addr := startServer(t, srv)
+
+	c, err := Dial(addr, Config{T1: 200 * time.Millisecond, T2: 20 * time.Millisecond, T3: 40 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 空闲期间发送TESTFR，服务端确认后连接保持
+	select {
+	case <-c.CloseNotifier:
+		t.Fatalf("connection closed: %v", c.CloseReason())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestT1Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		rwc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer rwc.Close()
+		// 只确认STARTDT，不响应TESTFR
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(rwc, buf); err != nil {
+			return
+		}
+		rwc.Write([]byte{startByte, 0x04, StartDTCon, 0x00, 0x00, 0x00})
+		io.Copy(ioutil.Discard, rwc)
+	}()
+
+	c, err := Dial(l.Addr().String(), Config{T1: 100 * time.Millisecond, T2: 20 * time.Millisecond, T3: 40 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.CloseNotifier:
+		if c.CloseReason() != CloseT1Timeout {
+			t.Fatalf("reason = %v", c.CloseReason())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("t1 timeout not detected")
+	}
+}
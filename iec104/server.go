@@ -0,0 +1,141 @@
+package iec104
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var DeviceOffline = errors.New("device offline")
+
+// Server 作为被控站（从站）接受主站的连接
+type Server struct {
+	// k、w和t1到t3参数
+	Config
+
+	// 处理收到的ASDU，同一连接上的ASDU按接收顺序依次处理
+	Handler HandlerFunc
+
+	activeConn sync.Map
+
+	debug bool
+
+	// 开始监听时调用
+	OnStart func(addr net.Addr)
+
+	// 接受新连接时调用，返回error时拒绝该连接
+	OnAccept func(c *Conn) error
+
+	// 连接关闭时调用
+	OnClose func(c *Conn, reason CloseReason)
+}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (srv *Server) Debug(debug bool) {
+	srv.debug = debug
+}
+
+func (srv *Server) StartServer(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	return srv.Serve(l)
+}
+
+// Serve 在调用方提供的Listener上接受连接，返回时关闭l
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if srv.OnStart != nil {
+		srv.OnStart(l.Addr())
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		c := newConn(rwc, srv.Config, srv.Handler, srv)
+		if srv.OnAccept != nil {
+			if err := srv.OnAccept(c); err != nil {
+				log.Printf("reject connection from %v,reason: %v\n", rwc.RemoteAddr(), err)
+				rwc.Close()
+				continue
+			}
+		}
+		srv.activeConn.Store(c, true)
+		c.run()
+	}
+}
+
+func (srv *Server) onClose(c *Conn, reason CloseReason) {
+	srv.activeConn.Delete(c)
+	if srv.OnClose != nil {
+		srv.OnClose(c, reason)
+	}
+}
+
+func (srv *Server) Shutdown() {
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		key.(*Conn).close(CloseShutdown)
+		return true
+	})
+}
+
+func (srv *Server) FindConn(id string) (*Conn, error) {
+	var c1 *Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if c.id == id {
+			c1 = c
+			return false
+		}
+		return true
+	})
+	if c1 == nil {
+		return nil, DeviceOffline
+	}
+	return c1, nil
+}
+
+// Conns 返回所有活动连接
+func (srv *Server) Conns() []*Conn {
+	var conns []*Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		conns = append(conns, key.(*Conn))
+		return true
+	})
+	return conns
+}
+
+// Broadcast 向所有已启动数据传输的连接发送ASDU，用于突发（自发）上送。
+// 不等待对端确认，未被确认的APDU已达到k的连接丢弃该ASDU，避免一个停滞的主站阻塞其他连接
+func (srv *Server) Broadcast(a *ASDU) {
+	for _, c := range srv.Conns() {
+		if !c.Started() {
+			continue
+		}
+		if err := c.TrySend(a); err != nil {
+			log.Printf("failed to send asdu to %v,reason: %v\n", c.RemoteAddr(), err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package iec62056
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// 识别报文和数据报文的最大长度
+const maxMessageLength = 64 * 1024
+
+var UnexpectedResponse = errors.New("unexpected iec62056-21 response")
+
+type (
+	// Transport 与电表通信的连接，*modbus.Conn和*nb.Conn都实现了该接口。
+	// 与modbus相同，Server.Handler需要将电表的应答通过Conn.Send交给Client，
+	// 报文可能被透传网关分成多次读取，读取期间该连接的所有数据都应交给Client
+	Transport interface {
+		Write(buf []byte) (int, error)
+		Receive() ([]byte, error)
+		Lock()
+		Unlock()
+	}
+
+	// Client 以模式C读取一个电表
+	Client struct {
+		Transport Transport
+
+		// 设备地址，为空时发送/?!
+		Address string
+
+		// 确认报文中选择的波特率字符，为0时使用识别报文中的最高波特率
+		BaudChar byte
+
+		// 协商的波特率，TCP透传时不切换，仅用于记录
+		BaudRate int
+
+		buf []byte
+	}
+)
+
+func NewClient(t Transport, address string) *Client {
+	return &Client{Transport: t, Address: address}
+}
+
+// Read 发送请求报文，解析识别报文，以数据读出方式确认后读取数据报文
+func (c *Client) Read() (*Readout, error) {
+	c.Transport.Lock()
+	defer c.Transport.Unlock()
+	c.buf = c.buf[:0]
+	if _, err := c.Transport.Write([]byte("/?" + c.Address + "!\r\n")); err != nil {
+		return nil, err
+	}
+	line, err := c.readUntil(func(b []byte) int {
+		if i := bytes.Index(b, []byte("\r\n")); i >= 0 {
+			return i + 2
+		}
+		return -1
+	})
+	if err != nil {
+		return nil, err
+	}
+	id, err := ParseIdentification(line)
+	if err != nil {
+		return nil, err
+	}
+	z := c.BaudChar
+	if z == 0 {
+		z = id.BaudChar
+	}
+	rate, ok := baudRates[z]
+	if !ok {
+		return nil, fmt.Errorf("%w: baud rate character %q", UnsupportedMode, z)
+	}
+	// 确认及选项选择报文：ACK 0 Z 0 CR LF，V=0正常协议，Y=0数据读出
+	if _, err := c.Transport.Write([]byte{ACK, '0', z, '0', '\r', '\n'}); err != nil {
+		return nil, err
+	}
+	c.BaudRate = rate
+	msg, err := c.readUntil(func(b []byte) int {
+		if len(b) > 0 && b[0] != STX {
+			return 0
+		}
+		if i := bytes.IndexByte(b, ETX); i >= 0 && i+1 < len(b) {
+			return i + 2
+		}
+		return -1
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("%w: data message must start with STX", UnexpectedResponse)
+	}
+	sets, err := ParseDataMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Readout{Identification: id, DataSets: sets}, nil
+}
+
+// readUntil 累积读取的数据，直到complete返回报文的长度，返回0时为无效数据
+func (c *Client) readUntil(complete func(b []byte) int) ([]byte, error) {
+	for {
+		if n := complete(c.buf); n >= 0 {
+			msg := append([]byte(nil), c.buf[:n]...)
+			c.buf = c.buf[n:]
+			return msg, nil
+		}
+		if len(c.buf) > maxMessageLength {
+			return nil, fmt.Errorf("%w: message too long", UnexpectedResponse)
+		}
+		b, err := c.Transport.Receive()
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b...)
+	}
+}
+
+// Values 按names（OBIS编码到名称）转换为与modbus.Registers.Decode相同的名称到实际值，
+// 值为float64，单位见DataSet.Unit。names为nil时以OBIS编码为名称，无法解析为数值的数据集被忽略
+func (r *Readout) Values(names map[string]string) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, ds := range r.DataSets {
+		name := ds.Address
+		if names != nil {
+			var ok bool
+			if name, ok = names[ds.Address]; !ok {
+				if name, ok = names[shortOBIS(ds.Address)]; !ok {
+					continue
+				}
+			}
+		}
+		v, err := ds.Float()
+		if err != nil {
+			continue
+		}
+		values[name] = v
+	}
+	return values
+}
+
+// IsFrame 是否为识别报文或者数据报文的开始，用于在Handler中区分不同协议的报文
+func IsFrame(packet []byte) bool {
+	return len(packet) > 0 && (packet[0] == '/' || packet[0] == STX)
+}
@@ -0,0 +1,104 @@
+package iec62056
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ricnsmart/iot-protocol/internal/transporttest"
+)
+
+// 模拟透传网关后的电表，应答被分成多次读取
+func newMeter(data []byte) *transporttest.Meter {
+	return transporttest.New(func(req []byte) ([][]byte, error) {
+		var parts [][]byte
+		switch {
+		case bytes.HasPrefix(req, []byte("/?")):
+			parts = append(parts, []byte("/ISk5\\2MT382-10"), []byte("00\r\n"))
+		case req[0] == ACK:
+			for i := 0; i < len(data); i += 16 {
+				end := i + 16
+				if end > len(data) {
+					end = len(data)
+				}
+				parts = append(parts, data[i:end])
+			}
+		}
+		return parts, nil
+	})
+}
+
+func dataMessage(block string) []byte {
+	b := append([]byte{STX}, block...)
+	b = append(b, ETX)
+	return append(b, BCC(b[1:]))
+}
+
+const block = "0.0.0(12345678)\r\n" +
+	"1-0:1.8.0*255(001234.567*kWh)\r\n" +
+	"1.8.1(000800.000*kWh)1.8.2(000434.567*kWh)\r\n" +
+	"1.6.0(00.512*kW)(2401151230)\r\n" +
+	"32.7.0(230.1*V)\r\n" +
+	"C.1.0(MT382)\r\n" +
+	"!\r\n"
+
+func TestParseIdentification(t *testing.T) {
+	id, err := ParseIdentification([]byte("/ISk5\\2MT382-1000\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Manufacturer != "ISk" || id.BaudRate != 9600 || id.Enhanced != "\\2" || id.Identifier != "MT382-1000" {
+		t.Fatalf("unexpected identification %+v", id)
+	}
+	if _, err := ParseIdentification([]byte("/ABCE123\r\n")); !errors.Is(err, UnsupportedMode) {
+		t.Errorf("err = %v, want UnsupportedMode", err)
+	}
+}
+
+func TestParseDataMessage(t *testing.T) {
+	sets, err := ParseDataMessage(dataMessage(block))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 7 {
+		t.Fatalf("got %d data sets: %+v", len(sets), sets)
+	}
+	r := &Readout{DataSets: sets}
+	ds, ok := r.Get("1.8.0")
+	if !ok || ds.Value != "001234.567" || ds.Unit != "kWh" {
+		t.Errorf("1.8.0 = %+v", ds)
+	}
+	ds, _ = r.Get("1.6.0")
+	if len(ds.Extra) != 1 || ds.Extra[0] != "2401151230" {
+		t.Errorf("1.6.0 = %+v", ds)
+	}
+
+	bad := dataMessage(block)
+	bad[len(bad)-1] ^= 0xFF
+	if _, err := ParseDataMessage(bad); !errors.Is(err, BCCError) {
+		t.Errorf("err = %v, want BCCError", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	m := newMeter(dataMessage(block))
+	c := NewClient(m, "")
+	r, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := m.Requests()
+	if string(requests[0]) != "/?!\r\n" || !bytes.Equal(requests[1], []byte{ACK, '0', '5', '0', '\r', '\n'}) {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+	if c.BaudRate != 9600 || r.Identification.Identifier != "MT382-1000" {
+		t.Errorf("BaudRate = %v, identification = %+v", c.BaudRate, r.Identification)
+	}
+	values := r.Values(map[string]string{"1.8.0": "energy", "32.7.0": "voltage", "C.1.0": "model"})
+	if len(values) != 2 || values["energy"] != 1234.567 || values["voltage"] != 230.1 {
+		t.Errorf("Values = %+v", values)
+	}
+	if all := r.Values(nil); len(all) != 6 {
+		t.Errorf("Values(nil) = %+v", all)
+	}
+}
@@ -0,0 +1,174 @@
+package iec62056
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	STX = byte(0x02)
+	ETX = byte(0x03)
+	ACK = byte(0x06)
+	NAK = byte(0x15)
+)
+
+var (
+	InvalidMessage = errors.New("invalid iec62056-21 message")
+	BCCError       = errors.New("iec62056-21 bcc error")
+	// 识别报文中的波特率字符不属于模式C
+	UnsupportedMode = errors.New("unsupported iec62056-21 mode")
+)
+
+// 模式C的波特率字符
+var baudRates = map[byte]int{
+	'0': 300, '1': 600, '2': 1200, '3': 2400, '4': 4800, '5': 9600, '6': 19200,
+}
+
+type (
+	// Identification 识别报文：/XXXZ\W标识\r\n
+	Identification struct {
+		// 3个字母的制造商代码，第三个字母小写时表示最短反应时间为20毫秒
+		Manufacturer string
+		// 电表支持的最高波特率字符和对应的波特率
+		BaudChar byte
+		BaudRate int
+		// 增强型识别码，例如\2表示支持HDLC
+		Enhanced   string
+		Identifier string
+	}
+
+	// DataSet 数据块中的一个数据集：地址(值*单位)，负荷曲线等可能包含多组括号
+	DataSet struct {
+		// OBIS编码，例如1.8.0或者1-0:1.8.0*255
+		Address string
+		Value   string
+		Unit    string
+		// 其余括号中的内容，例如最大需量的发生时间
+		Extra []string
+	}
+
+	// Readout 一次读取的结果
+	Readout struct {
+		Identification *Identification
+		DataSets       []DataSet
+	}
+)
+
+// ParseIdentification 解析识别报文，包括结尾的\r\n
+func ParseIdentification(line []byte) (*Identification, error) {
+	s := strings.TrimRight(string(line), "\r\n")
+	if len(s) < 5 || s[0] != '/' {
+		return nil, fmt.Errorf("%w: identification %q", InvalidMessage, line)
+	}
+	id := &Identification{Manufacturer: s[1:4], BaudChar: s[4]}
+	rate, ok := baudRates[id.BaudChar]
+	if !ok {
+		return nil, fmt.Errorf("%w: baud rate character %q", UnsupportedMode, id.BaudChar)
+	}
+	id.BaudRate = rate
+	s = s[5:]
+	if len(s) >= 2 && s[0] == '\\' {
+		id.Enhanced = s[:2]
+		s = s[2:]
+	}
+	id.Identifier = s
+	return id, nil
+}
+
+// BCC 从STX之后到ETX（含）所有字节的异或
+func BCC(b []byte) byte {
+	var bcc byte
+	for _, v := range b {
+		bcc ^= v
+	}
+	return bcc
+}
+
+// ParseDataMessage 解析数据报文：STX 数据块 ! CR LF ETX BCC
+func ParseDataMessage(b []byte) ([]DataSet, error) {
+	if len(b) < 3 || b[0] != STX || b[len(b)-2] != ETX {
+		return nil, fmt.Errorf("%w: data message", InvalidMessage)
+	}
+	if bcc := BCC(b[1 : len(b)-1]); bcc != b[len(b)-1] {
+		return nil, fmt.Errorf("%w: got 0x%02x, want 0x%02x", BCCError, b[len(b)-1], bcc)
+	}
+	block := b[1 : len(b)-2]
+	if i := bytes.LastIndexByte(block, '!'); i >= 0 {
+		block = block[:i]
+	}
+	return ParseDataBlock(string(block))
+}
+
+// ParseDataBlock 解析数据块，没有地址的括号归入上一个数据集
+func ParseDataBlock(block string) ([]DataSet, error) {
+	var sets []DataSet
+	s := block
+	for {
+		s = strings.TrimLeft(s, "\r\n")
+		if s == "" {
+			return sets, nil
+		}
+		open := strings.IndexByte(s, '(')
+		if open < 0 {
+			return nil, fmt.Errorf("%w: data set %q", InvalidMessage, s)
+		}
+		address := s[:open]
+		s = s[open:]
+		var values []string
+		for len(s) > 0 && s[0] == '(' {
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated data set %q", InvalidMessage, address)
+			}
+			values = append(values, s[1:end])
+			s = s[end+1:]
+		}
+		if address == "" {
+			if len(sets) == 0 {
+				return nil, fmt.Errorf("%w: data set without address", InvalidMessage)
+			}
+			sets[len(sets)-1].Extra = append(sets[len(sets)-1].Extra, values...)
+			continue
+		}
+		ds := DataSet{Address: address}
+		ds.Value, ds.Unit = splitUnit(values[0])
+		ds.Extra = values[1:]
+		sets = append(sets, ds)
+	}
+}
+
+func splitUnit(v string) (string, string) {
+	if i := strings.IndexByte(v, '*'); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// Float 将值解析为浮点数
+func (ds DataSet) Float() (float64, error) {
+	return strconv.ParseFloat(ds.Value, 64)
+}
+
+// Get 返回地址为obis的数据集，简写的地址（1.8.0）与完整的地址（1-0:1.8.0*255）视为相同
+func (r *Readout) Get(obis string) (DataSet, bool) {
+	for _, ds := range r.DataSets {
+		if ds.Address == obis || shortOBIS(ds.Address) == shortOBIS(obis) {
+			return ds, true
+		}
+	}
+	return DataSet{}, false
+}
+
+// 去掉OBIS编码中的A-B:和*F
+func shortOBIS(s string) string {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.IndexByte(s, '*'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
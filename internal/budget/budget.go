@@ -0,0 +1,139 @@
+// Package budget 提供modbus和nb的Server共用的错误计数和黑名单
+package budget
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// 按地址保存的记录至少间隔多久清理一次过期的条目，
+// 避免端口扫描或者不断更换地址的攻击者使map无限增长
+const sweepInterval = time.Minute
+
+// Window 统计时间窗口内发生的次数，零值可用
+type Window struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// Add 记录一次，返回window内的次数是否超过max
+func (w *Window) Add(now time.Time, max int, window time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	since := now.Add(-window)
+	i := 0
+	for i < len(w.times) && !w.times[i].After(since) {
+		i++
+	}
+	w.times = append(w.times[i:], now)
+	// 只需判断是否超过max，最多保留max+1条记录
+	if n := len(w.times) - (max + 1); n > 0 {
+		w.times = w.times[n:]
+	}
+	return len(w.times) > max
+}
+
+// 判断window内是否没有任何记录
+func (w *Window) idle(now time.Time, window time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.times) == 0 || !w.times[len(w.times)-1].After(now.Add(-window))
+}
+
+// BanList 在一段时间内拒绝指定的地址，零值可用
+type BanList struct {
+	mu        sync.Mutex
+	until     map[string]time.Time
+	lastSweep time.Time
+}
+
+// Ban 在until之前拒绝key
+func (b *BanList) Ban(key string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until == nil {
+		b.until = make(map[string]time.Time)
+	}
+	b.until[key] = until
+	b.sweep(time.Now())
+}
+
+// Banned 判断key是否仍被拒绝，过期的记录会被删除
+func (b *BanList) Banned(key string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+	until, ok := b.until[key]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(b.until, key)
+		return false
+	}
+	return true
+}
+
+// 删除所有过期的记录，调用方需持有锁
+func (b *BanList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < sweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for key, until := range b.until {
+		if now.After(until) {
+			delete(b.until, key)
+		}
+	}
+}
+
+// Host 获取地址中的IP，无法解析时返回完整的地址
+func Host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Counter 按key分别统计时间窗口内发生的次数，零值可用。
+// window内没有记录的key会在之后的Add中被删除
+type Counter struct {
+	mu        sync.Mutex
+	windows   map[string]*Window
+	lastSweep time.Time
+}
+
+// Add 为key记录一次，返回window内的次数是否超过max
+func (c *Counter) Add(key string, now time.Time, max int, window time.Duration) bool {
+	c.mu.Lock()
+	if c.windows == nil {
+		c.windows = make(map[string]*Window)
+	}
+	if now.Sub(c.lastSweep) >= sweepInterval {
+		c.lastSweep = now
+		for k, w := range c.windows {
+			if w.idle(now, window) {
+				delete(c.windows, k)
+			}
+		}
+	}
+	w, ok := c.windows[key]
+	if !ok {
+		w = new(Window)
+		c.windows[key] = w
+	}
+	c.mu.Unlock()
+	return w.Add(now, max, window)
+}
+
+// Reset 清除key的记录
+func (c *Counter) Reset(key string) {
+	c.mu.Lock()
+	delete(c.windows, key)
+	c.mu.Unlock()
+}
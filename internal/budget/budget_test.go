@@ -0,0 +1,68 @@
+package budget
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	var w Window
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if w.Add(now.Add(time.Duration(i)*time.Second), 3, 10*time.Second) {
+			t.Fatalf("exceeded after %v errors", i+1)
+		}
+	}
+	if !w.Add(now.Add(3*time.Second), 3, 10*time.Second) {
+		t.Fatal("4 errors within window should exceed budget of 3")
+	}
+	// 窗口之外的错误不再计入
+	if w.Add(now.Add(12*time.Second), 3, 10*time.Second) {
+		t.Fatal("errors outside window should be dropped")
+	}
+}
+
+func TestBanList(t *testing.T) {
+	var b BanList
+	now := time.Now()
+	b.Ban("10.0.0.1", now.Add(time.Minute))
+	if !b.Banned("10.0.0.1", now) {
+		t.Fatal("10.0.0.1 should be banned")
+	}
+	if b.Banned("10.0.0.2", now) {
+		t.Fatal("10.0.0.2 should not be banned")
+	}
+	if b.Banned("10.0.0.1", now.Add(2*time.Minute)) {
+		t.Fatal("ban should expire")
+	}
+}
+
+func TestExpireIdleEntries(t *testing.T) {
+	var c Counter
+	var b BanList
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		host := "10.0.0." + strconv.Itoa(i)
+		c.Add(host, now, 3, 10*time.Second)
+		b.Ban(host, now.Add(time.Second))
+	}
+	later := now.Add(2 * sweepInterval)
+	c.Add("10.0.1.1", later, 3, 10*time.Second)
+	if n := len(c.windows); n != 1 {
+		t.Fatalf("counter keeps %d keys, want 1", n)
+	}
+	b.Banned("10.0.1.1", later)
+	if n := len(b.until); n != 0 {
+		t.Fatalf("ban list keeps %d keys, want 0", n)
+	}
+
+	// 同一窗口内的记录数量有上限
+	var w Window
+	for i := 0; i < 1000; i++ {
+		w.Add(now, 3, time.Minute)
+	}
+	if len(w.times) != 4 {
+		t.Fatalf("window keeps %d records, want 4", len(w.times))
+	}
+}
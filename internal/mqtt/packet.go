@@ -0,0 +1,573 @@
+// Package mqtt 提供MQTT客户端和服务端共用的报文编解码
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 报文类型
+const (
+	CONNECT     = byte(1)
+	CONNACK     = byte(2)
+	PUBLISH     = byte(3)
+	PUBACK      = byte(4)
+	SUBSCRIBE   = byte(8)
+	SUBACK      = byte(9)
+	UNSUBSCRIBE = byte(10)
+	UNSUBACK    = byte(11)
+	PINGREQ     = byte(12)
+	PINGRESP    = byte(13)
+	DISCONNECT  = byte(14)
+)
+
+// 协议级别
+const (
+	Version311 = byte(4)
+	Version5   = byte(5)
+)
+
+// CONNACK的返回码
+const (
+	Accepted              = byte(0)
+	UnacceptableVersion   = byte(1)
+	IdentifierRejected    = byte(2)
+	ServerUnavailable     = byte(3)
+	BadUsernameOrPassword = byte(4)
+	NotAuthorized         = byte(5)
+)
+
+// SUBACK中订阅失败的返回码
+const SubscribeFailure = byte(0x80)
+
+const (
+	defaultMaxPacketSize    = 1 << 20
+	maxRemainingLengthBytes = 4
+)
+
+var (
+	MalformedPacket = errors.New("malformed mqtt packet")
+	// 报文超过MaxPacketSize
+	PacketTooLarge = errors.New("mqtt packet too large")
+)
+
+type (
+	// Packet MQTT报文
+	Packet interface {
+		Type() byte
+		encode(version byte) (flags byte, body []byte)
+	}
+
+	Connect struct {
+		ProtocolName  string
+		ProtocolLevel byte
+		CleanSession  bool
+		KeepAlive     uint16
+		ClientID      string
+		WillTopic     string
+		WillMessage   []byte
+		WillQoS       byte
+		WillRetain    bool
+		// 为nil时没有用户名或密码
+		Username *string
+		Password []byte
+	}
+
+	ConnAck struct {
+		SessionPresent bool
+		ReturnCode     byte
+	}
+
+	Publish struct {
+		Topic   string
+		ID      uint16
+		QoS     byte
+		Retain  bool
+		Dup     bool
+		Payload []byte
+		// MQTT 5的主题别名，为0时没有
+		TopicAlias uint16
+	}
+
+	PubAck struct {
+		ID uint16
+	}
+
+	Subscription struct {
+		Filter string
+		QoS    byte
+	}
+
+	Subscribe struct {
+		ID            uint16
+		Subscriptions []Subscription
+	}
+
+	SubAck struct {
+		ID uint16
+		// 每个订阅授予的QoS，失败为SubscribeFailure
+		Codes []byte
+	}
+
+	Unsubscribe struct {
+		ID      uint16
+		Filters []string
+	}
+
+	UnsubAck struct {
+		ID uint16
+		// MQTT 5每个过滤器的原因码
+		Codes []byte
+	}
+
+	PingReq    struct{}
+	PingResp   struct{}
+	Disconnect struct {
+		// MQTT 5的原因码，0为正常断开
+		ReasonCode byte
+	}
+)
+
+func (*Connect) Type() byte     { return CONNECT }
+func (*ConnAck) Type() byte     { return CONNACK }
+func (*Publish) Type() byte     { return PUBLISH }
+func (*PubAck) Type() byte      { return PUBACK }
+func (*Subscribe) Type() byte   { return SUBSCRIBE }
+func (*SubAck) Type() byte      { return SUBACK }
+func (*Unsubscribe) Type() byte { return UNSUBSCRIBE }
+func (*UnsubAck) Type() byte    { return UNSUBACK }
+func (*PingReq) Type() byte     { return PINGREQ }
+func (*PingResp) Type() byte    { return PINGRESP }
+func (*Disconnect) Type() byte  { return DISCONNECT }
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = append(b, byte(len(v)>>8), byte(len(v)))
+	return append(b, v...)
+}
+
+func appendID(b []byte, id uint16) []byte {
+	return append(b, byte(id>>8), byte(id))
+}
+
+func (p *Connect) encode(v byte) (byte, []byte) {
+	name, level := p.ProtocolName, p.ProtocolLevel
+	if name == "" {
+		name = "MQTT"
+	}
+	if level == 0 {
+		level = Version311
+	}
+	b := appendString(nil, name)
+	var flags byte
+	if p.CleanSession {
+		flags |= 0x02
+	}
+	if p.WillTopic != "" {
+		flags |= 0x04 | p.WillQoS&0x03<<3
+		if p.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if p.Password != nil {
+		flags |= 0x40
+	}
+	if p.Username != nil {
+		flags |= 0x80
+	}
+	b = append(b, level, flags, byte(p.KeepAlive>>8), byte(p.KeepAlive))
+	if level == Version5 {
+		b = append(b, 0)
+	}
+	b = appendString(b, p.ClientID)
+	if p.WillTopic != "" {
+		if level == Version5 {
+			b = append(b, 0)
+		}
+		b = appendString(b, p.WillTopic)
+		b = appendBytes(b, p.WillMessage)
+	}
+	if p.Username != nil {
+		b = appendString(b, *p.Username)
+	}
+	if p.Password != nil {
+		b = appendBytes(b, p.Password)
+	}
+	return 0, b
+}
+
+func (p *ConnAck) encode(v byte) (byte, []byte) {
+	var sp byte
+	if p.SessionPresent {
+		sp = 1
+	}
+	if v == Version5 {
+		return 0, []byte{sp, p.ReturnCode, 0}
+	}
+	return 0, []byte{sp, p.ReturnCode}
+}
+
+func (p *Publish) encode(v byte) (byte, []byte) {
+	flags := p.QoS & 0x03 << 1
+	if p.Retain {
+		flags |= 0x01
+	}
+	if p.Dup {
+		flags |= 0x08
+	}
+	b := appendString(nil, p.Topic)
+	if p.QoS > 0 {
+		b = appendID(b, p.ID)
+	}
+	if v == Version5 {
+		if p.TopicAlias != 0 {
+			b = append(b, 3, propTopicAlias, byte(p.TopicAlias>>8), byte(p.TopicAlias))
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return flags, append(b, p.Payload...)
+}
+
+func (p *PubAck) encode(v byte) (byte, []byte) {
+	return 0, appendID(nil, p.ID)
+}
+
+func (p *Subscribe) encode(v byte) (byte, []byte) {
+	b := appendID(nil, p.ID)
+	if v == Version5 {
+		b = append(b, 0)
+	}
+	for _, s := range p.Subscriptions {
+		b = appendString(b, s.Filter)
+		b = append(b, s.QoS)
+	}
+	return 0x02, b
+}
+
+func (p *SubAck) encode(v byte) (byte, []byte) {
+	b := appendID(nil, p.ID)
+	if v == Version5 {
+		b = append(b, 0)
+	}
+	return 0, append(b, p.Codes...)
+}
+
+func (p *Unsubscribe) encode(v byte) (byte, []byte) {
+	b := appendID(nil, p.ID)
+	if v == Version5 {
+		b = append(b, 0)
+	}
+	for _, f := range p.Filters {
+		b = appendString(b, f)
+	}
+	return 0x02, b
+}
+
+func (p *UnsubAck) encode(v byte) (byte, []byte) {
+	b := appendID(nil, p.ID)
+	if v == Version5 {
+		b = append(append(b, 0), p.Codes...)
+	}
+	return 0, b
+}
+
+func (*PingReq) encode(v byte) (byte, []byte)  { return 0, nil }
+func (*PingResp) encode(v byte) (byte, []byte) { return 0, nil }
+
+func (p *Disconnect) encode(v byte) (byte, []byte) {
+	if v == Version5 && p.ReasonCode != 0 {
+		return 0, []byte{p.ReasonCode, 0}
+	}
+	return 0, nil
+}
+
+// Encode 以MQTT 3.1.1编码为完整的报文
+func Encode(p Packet) []byte {
+	return EncodeVersion(p, Version311)
+}
+
+// EncodeVersion 以指定的协议级别编码，MQTT 5的属性只编码主题别名
+func EncodeVersion(p Packet, version byte) []byte {
+	flags, body := p.encode(version)
+	b := []byte{p.Type()<<4 | flags}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// WritePacket 以MQTT 3.1.1编码并写入w
+func WritePacket(w io.Writer, p Packet) error {
+	_, err := w.Write(Encode(p))
+	return err
+}
+
+// ReadPacket 读取一个MQTT 3.1.1的报文，maxSize为0时限制为1MB
+func ReadPacket(r *bufio.Reader, maxSize int) (Packet, error) {
+	return ReadPacketVersion(r, maxSize, Version311)
+}
+
+// ReadPacketVersion 以指定的协议级别读取一个报文，CONNECT的协议级别以报文中的为准，
+// MQTT 5的属性只解析主题别名，其余属性被忽略
+func ReadPacketVersion(r *bufio.Reader, maxSize int, version byte) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var n, shift int
+	for i := 0; ; i++ {
+		if i == maxRemainingLengthBytes {
+			return nil, fmt.Errorf("%w: remaining length", MalformedPacket)
+		}
+		d, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n |= int(d&0x7F) << shift
+		shift += 7
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxPacketSize
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", PacketTooLarge, n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return decode(header, body, version)
+}
+
+// 按顺序读取报文的各个字段，出错后的读取均返回零值
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = MalformedPacket
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	return d.next(1)[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) bytes() []byte {
+	return append([]byte(nil), d.next(int(d.uint16()))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+func (d *decoder) varint() int {
+	var n, shift int
+	for i := 0; i < maxRemainingLengthBytes; i++ {
+		v := d.byte()
+		n |= int(v&0x7F) << shift
+		shift += 7
+		if v&0x80 == 0 {
+			return n
+		}
+	}
+	d.err = MalformedPacket
+	return 0
+}
+
+// MQTT 5的属性标识符
+const propTopicAlias = byte(0x23)
+
+// 每种属性值的长度，-1为变长整数，-2为字符串或二进制，-3为字符串对
+var propLengths = map[byte]int{
+	0x01: 1, 0x17: 1, 0x19: 1, 0x24: 1, 0x25: 1, 0x28: 1, 0x29: 1, 0x2A: 1,
+	0x13: 2, 0x21: 2, 0x22: 2, 0x23: 2,
+	0x02: 4, 0x11: 4, 0x18: 4, 0x27: 4,
+	0x0B: -1,
+	0x03: -2, 0x08: -2, 0x09: -2, 0x12: -2, 0x15: -2, 0x16: -2, 0x1A: -2, 0x1C: -2, 0x1F: -2,
+	0x26: -3,
+}
+
+// 读取MQTT 5的属性，返回主题别名
+func (d *decoder) properties() (topicAlias uint16) {
+	props := &decoder{b: d.next(d.varint())}
+	for props.err == nil && len(props.b) > 0 {
+		id := props.byte()
+		n, ok := propLengths[id]
+		if !ok {
+			d.err = MalformedPacket
+			return 0
+		}
+		switch {
+		case id == propTopicAlias:
+			topicAlias = props.uint16()
+		case n > 0:
+			props.next(n)
+		case n == -1:
+			props.varint()
+		case n == -2:
+			props.bytes()
+		case n == -3:
+			props.bytes()
+			props.bytes()
+		}
+	}
+	if props.err != nil {
+		d.err = props.err
+	}
+	return topicAlias
+}
+
+func decode(header byte, body []byte, version byte) (Packet, error) {
+	d := &decoder{b: body}
+	v5 := version == Version5
+	flags := header & 0x0F
+	var p Packet
+	switch header >> 4 {
+	case CONNECT:
+		c := &Connect{ProtocolName: d.string(), ProtocolLevel: d.byte()}
+		v5 = c.ProtocolLevel == Version5
+		f := d.byte()
+		c.CleanSession = f&0x02 != 0
+		c.KeepAlive = d.uint16()
+		if v5 {
+			d.properties()
+		}
+		c.ClientID = d.string()
+		if f&0x04 != 0 {
+			c.WillQoS = f >> 3 & 0x03
+			c.WillRetain = f&0x20 != 0
+			if v5 {
+				d.properties()
+			}
+			c.WillTopic = d.string()
+			c.WillMessage = d.bytes()
+		}
+		if f&0x80 != 0 {
+			u := d.string()
+			c.Username = &u
+		}
+		if f&0x40 != 0 {
+			c.Password = d.bytes()
+		}
+		p = c
+	case CONNACK:
+		ack := &ConnAck{SessionPresent: d.byte()&0x01 != 0, ReturnCode: d.byte()}
+		if v5 && len(d.b) > 0 {
+			d.properties()
+		}
+		p = ack
+	case PUBLISH:
+		pub := &Publish{
+			QoS:    flags >> 1 & 0x03,
+			Retain: flags&0x01 != 0,
+			Dup:    flags&0x08 != 0,
+			Topic:  d.string(),
+		}
+		if pub.QoS > 1 {
+			return nil, fmt.Errorf("%w: unsupported qos %d", MalformedPacket, pub.QoS)
+		}
+		if pub.QoS > 0 {
+			pub.ID = d.uint16()
+		}
+		if v5 {
+			pub.TopicAlias = d.properties()
+		}
+		if d.err == nil {
+			pub.Payload = append([]byte(nil), d.b...)
+			d.b = nil
+		}
+		p = pub
+	case PUBACK:
+		// MQTT 5的原因码和属性可以省略
+		p = &PubAck{ID: d.uint16()}
+		d.b = nil
+	case SUBSCRIBE:
+		s := &Subscribe{ID: d.uint16()}
+		if v5 {
+			d.properties()
+		}
+		for d.err == nil && len(d.b) > 0 {
+			s.Subscriptions = append(s.Subscriptions, Subscription{Filter: d.string(), QoS: d.byte() & 0x03})
+		}
+		if len(s.Subscriptions) == 0 {
+			d.err = MalformedPacket
+		}
+		p = s
+	case SUBACK:
+		s := &SubAck{ID: d.uint16()}
+		if v5 {
+			d.properties()
+		}
+		if d.err == nil {
+			s.Codes = append([]byte(nil), d.b...)
+			d.b = nil
+		}
+		p = s
+	case UNSUBSCRIBE:
+		u := &Unsubscribe{ID: d.uint16()}
+		if v5 {
+			d.properties()
+		}
+		for d.err == nil && len(d.b) > 0 {
+			u.Filters = append(u.Filters, d.string())
+		}
+		p = u
+	case UNSUBACK:
+		u := &UnsubAck{ID: d.uint16()}
+		if v5 {
+			d.properties()
+			if d.err == nil {
+				u.Codes = append([]byte(nil), d.b...)
+				d.b = nil
+			}
+		}
+		p = u
+	case PINGREQ:
+		p = &PingReq{}
+	case PINGRESP:
+		p = &PingResp{}
+	case DISCONNECT:
+		dis := &Disconnect{}
+		if v5 && len(d.b) > 0 {
+			dis.ReasonCode = d.byte()
+			d.b = nil
+		}
+		p = dis
+	default:
+		return nil, fmt.Errorf("%w: type %d", MalformedPacket, header>>4)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: type %d", MalformedPacket, header>>4)
+	}
+	return p, nil
+}
@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	user := "user"
+	packets := []Packet{
+		&Connect{ProtocolName: "MQTT", ProtocolLevel: Version311, CleanSession: true, KeepAlive: 60, ClientID: "c1",
+			WillTopic: "w", WillMessage: []byte("bye"), WillQoS: 1, Username: &user, Password: []byte("pw")},
+		&ConnAck{ReturnCode: NotAuthorized},
+		&Publish{Topic: "devices/1/telemetry", ID: 7, QoS: 1, Retain: true, Payload: bytes.Repeat([]byte{'x'}, 300)},
+		&Publish{Topic: "a"},
+		&PubAck{ID: 7},
+		&Subscribe{ID: 1, Subscriptions: []Subscription{{Filter: "devices/+/commands", QoS: 1}}},
+		&SubAck{ID: 1, Codes: []byte{1}},
+		&Unsubscribe{ID: 2, Filters: []string{"a/#"}},
+		&UnsubAck{ID: 2},
+		&PingReq{},
+		&PingResp{},
+		&Disconnect{},
+	}
+	var buf bytes.Buffer
+	for _, p := range packets {
+		if err := WritePacket(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range packets {
+		got, err := ReadPacket(r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"devices/+/commands", "devices/1/commands", true},
+		{"devices/+/commands", "devices/1/2/commands", false},
+		{"devices/#", "devices", true},
+		{"devices/#", "devices/1/telemetry", true},
+		{"#", "$SYS/uptime", false},
+		{"a/b", "a/b/c", false},
+	}
+	for _, c := range cases {
+		if Match(c.filter, c.topic) != c.match {
+			t.Errorf("Match(%q, %q) = %v", c.filter, c.topic, !c.match)
+		}
+	}
+	if ValidFilter("a/#/b") || ValidFilter("a+") || !ValidFilter("+/b/#") {
+		t.Error("ValidFilter")
+	}
+}
+
+func TestEncodeDecodeV5(t *testing.T) {
+	user := "user"
+	packets := []Packet{
+		&Connect{ProtocolName: "MQTT", ProtocolLevel: Version5, KeepAlive: 30, ClientID: "gw-1",
+			WillTopic: "w", WillMessage: []byte("bye"), Username: &user, Password: []byte("pw")},
+		&ConnAck{ReturnCode: 0x86},
+		&Publish{Topic: "devices/1/up", ID: 3, QoS: 1, Payload: []byte("v"), TopicAlias: 2},
+		&PubAck{ID: 3},
+		&Subscribe{ID: 4, Subscriptions: []Subscription{{Filter: "devices/1/down", QoS: 1}}},
+		&SubAck{ID: 4, Codes: []byte{1}},
+		&Unsubscribe{ID: 5, Filters: []string{"devices/1/down"}},
+		&UnsubAck{ID: 5, Codes: []byte{0}},
+		&Disconnect{ReasonCode: 0x8E},
+	}
+	var buf bytes.Buffer
+	for _, p := range packets {
+		buf.Write(EncodeVersion(p, Version5))
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range packets {
+		got, err := ReadPacketVersion(r, 0, Version5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// 忽略消息过期间隔和用户属性
+	raw := []byte{PUBLISH << 4, 0, 0, 1, 'a',
+		17, 0x02, 0, 0, 0, 60, 0x26, 0, 1, 'k', 0, 1, 'v', propTopicAlias, 0, 9, 0x01, 1,
+		'x'}
+	raw[1] = byte(len(raw) - 2)
+	got, err := ReadPacketVersion(bufio.NewReader(bytes.NewReader(raw)), 0, Version5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := got.(*Publish); pub.Topic != "a" || pub.TopicAlias != 9 || string(pub.Payload) != "x" {
+		t.Errorf("got %+v", pub)
+	}
+}
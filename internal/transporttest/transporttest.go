@@ -0,0 +1,83 @@
+// Package transporttest 提供仪表协议测试共用的Transport，模拟透传网关后的仪表
+package transporttest
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Receive等待应答的默认时间
+const defaultTimeout = 100 * time.Millisecond
+
+// Timeout 等待应答超时
+var Timeout = errors.New("timeout")
+
+// Meter 模拟仪表，实现各协议包的Transport。
+// 记录写入的请求，Respond返回的各段应答依次作为之后Receive的结果，用于模拟被分成多次读取的应答
+type Meter struct {
+	sync.Mutex
+
+	// 返回请求的应答，返回nil时不应答，返回错误时Write失败
+	Respond func(req []byte) ([][]byte, error)
+
+	// Receive等待应答的时间，默认100ms
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	requests [][]byte
+	resp     chan []byte
+}
+
+func New(respond func(req []byte) ([][]byte, error)) *Meter {
+	return &Meter{
+		Respond: respond,
+		Timeout: defaultTimeout,
+		resp:    make(chan []byte, 64),
+	}
+}
+
+func (m *Meter) Write(buf []byte) (int, error) {
+	req := append([]byte(nil), buf...)
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	m.mu.Unlock()
+	parts, err := m.Respond(req)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range parts {
+		m.resp <- p
+	}
+	return len(buf), nil
+}
+
+func (m *Meter) Receive() ([]byte, error) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	select {
+	case b := <-m.resp:
+		return b, nil
+	case <-time.After(timeout):
+		return nil, Timeout
+	}
+}
+
+// Requests 返回已经写入的请求
+func (m *Meter) Requests() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.requests...)
+}
+
+// Last 返回最后写入的请求，没有请求时返回nil
+func (m *Meter) Last() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.requests) == 0 {
+		return nil
+	}
+	return m.requests[len(m.requests)-1]
+}
@@ -0,0 +1,46 @@
+// Package metrics 收集modbus和nb的Server运行指标，
+// 内置的Registry以Prometheus文本格式输出，也可以实现Recorder对接其他监控系统
+package metrics
+
+import "time"
+
+// Recorder 接收单个Server产生的指标，方法会被多个协程并发调用
+type Recorder interface {
+	// 接受新连接
+	ConnAccepted()
+	// 连接关闭及其原因
+	ConnClosed(reason string)
+	// 收发的字节数
+	BytesIn(n int)
+	BytesOut(n int)
+	// 收发的报文数
+	FrameIn()
+	FrameOut()
+	// 报文CRC校验失败，modbus只在Conn.NewRTUFrame以及ValidateCRC、Metrics中间件中记录
+	CRCFailure()
+	// 设备返回的异常码
+	Exception(function uint8, code uint8)
+	// Send、Receive等操作超时
+	Timeout(op string)
+	// 一次写入从排队到完成的耗时
+	WriteLatency(d time.Duration)
+	// 写入在连接的队列中排队的时长，priority为low、normal或high
+	QueueWait(priority string, d time.Duration)
+}
+
+// Nop 不记录任何指标
+var Nop Recorder = nop{}
+
+type nop struct{}
+
+func (nop) ConnAccepted()                   {}
+func (nop) ConnClosed(string)               {}
+func (nop) BytesIn(int)                     {}
+func (nop) BytesOut(int)                    {}
+func (nop) FrameIn()                        {}
+func (nop) FrameOut()                       {}
+func (nop) CRCFailure()                     {}
+func (nop) Exception(uint8, uint8)          {}
+func (nop) Timeout(string)                  {}
+func (nop) WriteLatency(time.Duration)      {}
+func (nop) QueueWait(string, time.Duration) {}
@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// 写入耗时的分桶，单位秒
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10}
+
+type (
+	// Registry 保存所有Server的指标，并以Prometheus文本格式输出，实现了http.Handler
+	Registry struct {
+		mu       sync.Mutex
+		families map[string]*family
+		// 按注册顺序输出
+		names []string
+	}
+
+	family struct {
+		name       string
+		help       string
+		kind       string
+		labelNames []string
+		series     map[string]*series
+	}
+
+	series struct {
+		labels []string
+		value  float64
+		// 仅histogram使用
+		buckets []uint64
+		count   uint64
+	}
+
+	// 绑定了server标签的Recorder
+	serverRecorder struct {
+		r      *Registry
+		server string
+	}
+)
+
+func NewRegistry() *Registry {
+	r := &Registry{families: make(map[string]*family)}
+	r.register("iot_connections_active", "Number of active connections.", gauge, "server")
+	r.register("iot_connections_accepted_total", "Total number of accepted connections.", counter, "server")
+	r.register("iot_connections_closed_total", "Total number of closed connections by reason.", counter, "server", "reason")
+	r.register("iot_received_bytes_total", "Total number of bytes received from devices.", counter, "server")
+	r.register("iot_sent_bytes_total", "Total number of bytes sent to devices.", counter, "server")
+	r.register("iot_received_frames_total", "Total number of frames received from devices.", counter, "server")
+	r.register("iot_sent_frames_total", "Total number of frames sent to devices.", counter, "server")
+	r.register("iot_crc_failures_total", "Total number of frames failing CRC check.", counter, "server")
+	r.register("iot_exceptions_total", "Total number of exception responses by function and code.", counter, "server", "function", "code")
+	r.register("iot_timeouts_total", "Total number of timed out operations.", counter, "server", "op")
+	r.register("iot_write_latency_seconds", "Latency of writes to devices, including queueing and pacing.", histogram, "server")
+	r.register("iot_queue_wait_seconds", "Time writes spent waiting in the per-connection queue by priority.", histogram, "server", "priority")
+	return r
+}
+
+// For 获取指定Server的Recorder，server作为标签区分不同的Server
+func (r *Registry) For(server string) Recorder {
+	return &serverRecorder{r: r, server: server}
+}
+
+func (r *Registry) register(name, help, kind string, labelNames ...string) {
+	r.families[name] = &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+	r.names = append(r.names, name)
+}
+
+// 获取指标序列，不存在时创建，调用方需持有锁
+func (r *Registry) series(name string, labels ...string) *series {
+	f := r.families[name]
+	key := strings.Join(labels, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if f.kind == histogram {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (r *Registry) add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	r.series(name, labels...).value += v
+	r.mu.Unlock()
+}
+
+func (r *Registry) observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	s := r.series(name, labels...)
+	for i, le := range latencyBuckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	r.mu.Unlock()
+}
+
+// Value 获取counter或gauge的当前值，用于测试和调试
+func (r *Registry) Value(name string, labels ...string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		return 0
+	}
+	if s, ok := f.series[strings.Join(labels, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// WriteText 以Prometheus文本格式输出所有指标
+func (r *Registry) WriteText(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.names {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			labels := formatLabels(f.labelNames, s.labels)
+			if f.kind != histogram {
+				fmt.Fprintf(w, "%s%s %s\n", f.name, wrap(labels), formatFloat(s.value))
+				continue
+			}
+			for i, le := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, wrap(join(labels, `le="`+formatFloat(le)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, wrap(join(labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, wrap(labels), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, wrap(labels), s.count)
+		}
+	}
+	return w.Flush()
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + escape(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func join(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrap(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (s *serverRecorder) ConnAccepted() {
+	s.r.add("iot_connections_accepted_total", 1, s.server)
+	s.r.add("iot_connections_active", 1, s.server)
+}
+
+func (s *serverRecorder) ConnClosed(reason string) {
+	s.r.add("iot_connections_closed_total", 1, s.server, reason)
+	s.r.add("iot_connections_active", -1, s.server)
+}
+
+func (s *serverRecorder) BytesIn(n int) {
+	s.r.add("iot_received_bytes_total", float64(n), s.server)
+}
+
+func (s *serverRecorder) BytesOut(n int) {
+	s.r.add("iot_sent_bytes_total", float64(n), s.server)
+}
+
+func (s *serverRecorder) FrameIn() {
+	s.r.add("iot_received_frames_total", 1, s.server)
+}
+
+func (s *serverRecorder) FrameOut() {
+	s.r.add("iot_sent_frames_total", 1, s.server)
+}
+
+func (s *serverRecorder) CRCFailure() {
+	s.r.add("iot_crc_failures_total", 1, s.server)
+}
+
+func (s *serverRecorder) Exception(function uint8, code uint8) {
+	s.r.add("iot_exceptions_total", 1, s.server, fmt.Sprintf("0x%02x", function), strconv.Itoa(int(code)))
+}
+
+func (s *serverRecorder) Timeout(op string) {
+	s.r.add("iot_timeouts_total", 1, s.server, op)
+}
+
+func (s *serverRecorder) WriteLatency(d time.Duration) {
+	s.r.observe("iot_write_latency_seconds", d.Seconds(), s.server)
+}
+
+func (s *serverRecorder) QueueWait(priority string, d time.Duration) {
+	s.r.observe("iot_queue_wait_seconds", d.Seconds(), s.server, priority)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	m := r.For("modbus")
+	m.ConnAccepted()
+	m.ConnAccepted()
+	m.ConnClosed("eof")
+	m.BytesIn(12)
+	m.Exception(0x03, 2)
+	m.WriteLatency(30 * time.Millisecond)
+	m.QueueWait("high", 2*time.Millisecond)
+
+	if v := r.Value("iot_connections_active", "modbus"); v != 1 {
+		t.Fatalf("active = %v, want 1", v)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE iot_connections_active gauge\n",
+		`iot_connections_active{server="modbus"} 1` + "\n",
+		`iot_connections_closed_total{server="modbus",reason="eof"} 1` + "\n",
+		`iot_received_bytes_total{server="modbus"} 12` + "\n",
+		`iot_exceptions_total{server="modbus",function="0x03",code="2"} 1` + "\n",
+		`iot_write_latency_seconds_bucket{server="modbus",le="0.01"} 0` + "\n",
+		`iot_write_latency_seconds_bucket{server="modbus",le="0.05"} 1` + "\n",
+		`iot_write_latency_seconds_bucket{server="modbus",le="+Inf"} 1` + "\n",
+		`iot_write_latency_seconds_count{server="modbus"} 1` + "\n",
+		`iot_queue_wait_seconds_bucket{server="modbus",priority="high",le="0.005"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("output missing %q\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "iot_crc_failures_total") {
+		t.Error("metrics without samples should not be written")
+	}
+}
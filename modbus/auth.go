@@ -0,0 +1,68 @@
+package modbus
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/budget"
+)
+
+// 该设备编号已被通过认证的连接使用，未认证的连接不能替换它
+var AlreadyRegistered = errors.New("device already registered by authenticated connection")
+
+// Register 以Server.Authenticator校验注册报文中的凭据，通过之后以id注册连接。
+// 未设置Authenticator时等同于SetID。校验失败时返回错误，由调用方决定是否关闭连接；
+// 同一IP的失败次数超出Server.AuthFailures时，在AuthFailures.Ban时间内拒绝其连接和认证
+func (c *Conn) Register(id string, payload []byte) error {
+	srv := c.server
+	host := budget.Host(c.rwc.RemoteAddr())
+	if srv.banned.Banned(host, time.Now()) {
+		return Banned
+	}
+	if a := srv.Authenticator; a != nil {
+		if err := a.Authenticate(id, payload); err != nil {
+			log.Printf("failed to authenticate %v from %v,reason: %v\n", id, c.RemoteAddr(), err)
+			srv.onError(c, err)
+			if b := srv.AuthFailures; b != nil && srv.authFailures.Add(host, time.Now(), b.Max, b.Window) {
+				log.Printf("%v exceeded authentication failure limit\n", host)
+				if b.Ban > 0 {
+					srv.banned.Ban(host, time.Now().Add(b.Ban))
+				}
+			}
+			return err
+		}
+		srv.authFailures.Reset(host)
+		c.authID.Store(id)
+	}
+	return c.setID(id)
+}
+
+// Authenticated 判断连接是否通过了认证
+func (c *Conn) Authenticated() bool {
+	return c.AuthenticatedID() != ""
+}
+
+// AuthenticatedID 连接通过认证的设备编号，未认证时返回空
+func (c *Conn) AuthenticatedID() string {
+	id, _ := c.authID.Load().(string)
+	return id
+}
+
+// 只有以id通过认证的连接才能替换以id通过认证的连接，
+// 以其他编号通过认证的连接调用SetID(id)时与未认证的连接相同
+func (c *Conn) checkEvict(id string) error {
+	if c.AuthenticatedID() == id {
+		return nil
+	}
+	var err error
+	c.server.activeConn.Range(func(key, value interface{}) bool {
+		prev := key.(*Conn)
+		if prev != c && prev.id == id && prev.AuthenticatedID() == id {
+			err = AlreadyRegistered
+			return false
+		}
+		return true
+	})
+	return err
+}
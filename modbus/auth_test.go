@@ -0,0 +1,66 @@
+package modbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/auth"
+)
+
+func TestConn_Register(t *testing.T) {
+	s := NewServer()
+	s.Authenticator = &auth.Token{Store: auth.MapStore{"dev1": "token", "dev2": "token2"}}
+	s.AuthFailures = &ErrorBudget{Max: 1, Window: time.Minute, Ban: time.Minute}
+	reasons := make(map[*Conn]CloseReason)
+	s.OnClose = func(c *Conn, r CloseReason) {
+		reasons[c] = r
+	}
+	newConn := func() *Conn {
+		rwc, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		c := s.newConn(rwc)
+		s.activeConn.Store(c, true)
+		return c
+	}
+
+	real := newConn()
+	if err := real.Register("dev1", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	if !real.Authenticated() {
+		t.Fatal("connection should be authenticated")
+	}
+
+	// 未认证的连接不能替换已认证的连接
+	fake := newConn()
+	fake.SetID("dev1")
+	if reasons[fake] != CloseUnauthorized {
+		t.Fatalf("fake reason = %v, want %v", reasons[fake], CloseUnauthorized)
+	}
+	if _, ok := reasons[real]; ok {
+		t.Fatal("authenticated connection should not be evicted")
+	}
+
+	// 以其他编号通过认证的连接同样不能替换
+	other := newConn()
+	if err := other.Register("dev2", []byte("token2")); err != nil {
+		t.Fatal(err)
+	}
+	other.SetID("dev1")
+	if reasons[other] != CloseUnauthorized {
+		t.Fatalf("other reason = %v, want %v", reasons[other], CloseUnauthorized)
+	}
+	if _, ok := reasons[real]; ok {
+		t.Fatal("connection authenticated as dev1 should not be evicted by dev2")
+	}
+
+	if err := newConn().Register("dev1", []byte("wrong")); err != auth.Unauthorized {
+		t.Fatalf("err = %v, want %v", err, auth.Unauthorized)
+	}
+	// 第二次失败超出限制之后，该地址被拒绝
+	newConn().Register("dev1", []byte("wrong"))
+	if err := newConn().Register("dev1", []byte("token")); err != Banned {
+		t.Fatalf("err = %v, want %v", err, Banned)
+	}
+}
@@ -13,7 +13,18 @@ type RTUFrame struct {
 	CRC      uint16
 }
 
+// CRCError RTU帧的CRC校验失败
+type CRCError struct {
+	Expect uint16
+	Calc   uint16
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("rtu frame error: CRC (expected 0x%x, got 0x%x)", e.Expect, e.Calc)
+}
+
 // NewRTUFrame converts a packet to a Modbus RTU frame.
+// 不记录CRC校验失败等指标，需要记录时使用Conn.NewRTUFrame或者ValidateCRC、Metrics中间件
 func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	// Check the that the packet length.
 	if len(packet) < 5 {
@@ -25,7 +36,7 @@ func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	crcExpect := binary.LittleEndian.Uint16(packet[pLen-2 : pLen])
 	crcCalc := CRCModbus(packet[0 : pLen-2])
 	if crcCalc != crcExpect {
-		return nil, fmt.Errorf("rtu frame error: CRC (expected 0x%x, got 0x%x)", crcExpect, crcCalc)
+		return nil, &CRCError{Expect: crcExpect, Calc: crcCalc}
 	}
 
 	frame := &RTUFrame{
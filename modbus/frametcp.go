@@ -0,0 +1,92 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TCPFrame is the Modbus TCP frame.
+type TCPFrame struct {
+	TransactionIdentifier uint16
+	ProtocolIdentifier    uint16
+	Length                uint16
+	Device                uint8
+	Function              uint8
+	Data                  []byte
+}
+
+// MBAP报文头的长度
+const mbapHeaderLength = 7
+
+// NewTCPFrame converts a packet to a Modbus TCP frame.
+func NewTCPFrame(packet []byte) (*TCPFrame, error) {
+	// Check the that the packet length.
+	if len(packet) < mbapHeaderLength+1 {
+		return nil, fmt.Errorf("tcp frame error: packet less than 8 bytes: %v", packet)
+	}
+
+	pLen := len(packet)
+	length := binary.BigEndian.Uint16(packet[4:6])
+	if int(length) != pLen-6 {
+		return nil, fmt.Errorf("tcp frame error: length (expected %v, got %v)", length, pLen-6)
+	}
+
+	// Modbus协议的协议标识固定为0
+	if protocol := binary.BigEndian.Uint16(packet[2:4]); protocol != 0 {
+		return nil, fmt.Errorf("tcp frame error: protocol identifier %v", protocol)
+	}
+
+	frame := &TCPFrame{
+		TransactionIdentifier: binary.BigEndian.Uint16(packet[0:2]),
+		ProtocolIdentifier:    binary.BigEndian.Uint16(packet[2:4]),
+		Length:                length,
+		Device:                uint8(packet[6]),
+		Function:              uint8(packet[7]),
+		Data:                  packet[8:],
+	}
+
+	return frame, nil
+}
+
+// Copy the TCPFrame.
+func (frame *TCPFrame) Copy() Framer {
+	f := *frame
+	return &f
+}
+
+// Bytes returns the Modbus byte stream based on the TCPFrame fields
+func (frame *TCPFrame) Bytes() []byte {
+	bytes := make([]byte, mbapHeaderLength+1)
+
+	frame.Length = uint16(len(frame.Data) + 2)
+	binary.BigEndian.PutUint16(bytes[0:2], frame.TransactionIdentifier)
+	binary.BigEndian.PutUint16(bytes[2:4], frame.ProtocolIdentifier)
+	binary.BigEndian.PutUint16(bytes[4:6], frame.Length)
+	bytes[6] = frame.Device
+	bytes[7] = frame.Function
+
+	return append(bytes, frame.Data...)
+}
+
+// GetFunction returns the Modbus function code.
+func (frame *TCPFrame) GetFunction() uint8 {
+	return frame.Function
+}
+
+// GetData returns the TCPFrame Data byte field.
+func (frame *TCPFrame) GetData() []byte {
+	return frame.Data
+}
+
+// SetData sets the TCPFrame Data byte field and updates the frame length
+// accordingly.
+func (frame *TCPFrame) SetData(data []byte) {
+	frame.Data = data
+	frame.Length = uint16(len(data) + 2)
+}
+
+// SetException sets the Modbus exception code in the frame.
+func (frame *TCPFrame) SetException(exception *Exception) {
+	frame.Function = frame.Function | 0x80
+	frame.SetData([]byte{byte(*exception)})
+}
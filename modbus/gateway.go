@@ -0,0 +1,228 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultGatewayTimeout = 5 * time.Second
+
+type (
+	// Route Modbus TCP单元标识对应的DTU连接和RTU从站地址
+	Route struct {
+		// DTU连接的设备编号，即Conn.ID
+		DeviceID string
+		// RTU从站地址，为0时使用请求中的单元标识
+		Slave uint8
+	}
+
+	// Gateway 接受Modbus TCP客户端（如SCADA）的请求，转换为RTU帧之后经DTU连接发往现场设备，
+	// 再将设备的响应转换为Modbus TCP帧返回，事务标识与请求保持一致。
+	// 找不到路径时返回GatewayPathUnavailable，设备未响应时返回GatewayTargetDeviceFailedtoRespond
+	Gateway struct {
+		server *Server
+
+		// 单元标识到DTU的映射
+		Routes map[uint8]Route
+
+		// Routes中没有该单元标识时调用，返回false表示没有可用的路径
+		Resolve func(unit uint8) (Route, bool)
+
+		// 等待设备响应的超时，默认5秒
+		Timeout time.Duration
+
+		// 正在等待响应的DTU连接，key为*Conn，value为*pendingRequest
+		pending sync.Map
+	}
+
+	// 网关正在等待的设备响应
+	pendingRequest struct {
+		slave    uint8
+		function uint8
+		ch       chan []byte
+	}
+)
+
+// NewGateway 创建Modbus TCP网关，会为Server添加截获设备响应的中间件，必须在StartServer之前调用
+func (srv *Server) NewGateway() *Gateway {
+	g := &Gateway{
+		server:  srv,
+		Routes:  make(map[uint8]Route),
+		Timeout: defaultGatewayTimeout,
+	}
+	srv.Use(g.intercept)
+	return g
+}
+
+// ListenAndServe 监听Modbus TCP端口，一般为502
+func (g *Gateway) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	return g.Serve(l)
+}
+
+// Serve 在调用方提供的Listener上接受Modbus TCP客户端，返回时关闭l
+func (g *Gateway) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go g.serve(rwc)
+	}
+}
+
+// 依次处理同一客户端的请求，保证响应的顺序与请求一致
+func (g *Gateway) serve(rwc net.Conn) {
+	defer rwc.Close()
+	for {
+		rwc.SetReadDeadline(time.Now().Add(g.server.Timeout))
+		packet, err := readTCPFrame(rwc)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read from modbus tcp client %v,reason: %v\n", rwc.RemoteAddr(), err)
+			}
+			return
+		}
+		req, err := NewTCPFrame(packet)
+		if err != nil {
+			log.Printf("invalid modbus tcp frame from %v,reason: %v\n", rwc.RemoteAddr(), err)
+			return
+		}
+		resp := g.forward(req)
+		rwc.SetWriteDeadline(time.Now().Add(g.server.Timeout))
+		if _, err := rwc.Write(resp.Bytes()); err != nil {
+			log.Printf("failed to write to modbus tcp client %v,reason: %v\n", rwc.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// 按MBAP报文头中的长度读取一个完整的Modbus TCP帧
+func readTCPFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, mbapHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if protocol := binary.BigEndian.Uint16(header[2:4]); protocol != 0 {
+		return nil, fmt.Errorf("invalid mbap protocol identifier %v", protocol)
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("invalid mbap length %v", length)
+	}
+	packet := make([]byte, 6+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[mbapHeaderLength:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (g *Gateway) route(unit uint8) (Route, bool) {
+	if r, ok := g.Routes[unit]; ok {
+		return r, true
+	}
+	if g.Resolve != nil {
+		return g.Resolve(unit)
+	}
+	return Route{}, false
+}
+
+// 将请求转发给DTU并等待响应
+func (g *Gateway) forward(req *TCPFrame) *TCPFrame {
+	resp := req.Copy().(*TCPFrame)
+	route, ok := g.route(req.Device)
+	if !ok {
+		resp.SetException(&GatewayPathUnavailable)
+		return resp
+	}
+	c, err := g.server.FindConn(route.DeviceID)
+	if err != nil {
+		resp.SetException(&GatewayPathUnavailable)
+		return resp
+	}
+	slave := route.Slave
+	if slave == 0 {
+		slave = req.Device
+	}
+
+	out, err := g.exchange(c, &RTUFrame{Address: slave, Function: req.Function, Data: req.Data})
+	if err != nil {
+		log.Printf("gateway failed to reach unit %v via %v,reason: %v\n", req.Device, route.DeviceID, err)
+		resp.SetException(&GatewayTargetDeviceFailedtoRespond)
+		return resp
+	}
+	frame, err := c.NewRTUFrame(out)
+	if err != nil || frame.Address != slave || frame.Function&0x7f != req.Function {
+		resp.SetException(&GatewayTargetDeviceFailedtoRespond)
+		return resp
+	}
+	resp.Function = frame.Function
+	resp.SetData(frame.Data)
+	return resp
+}
+
+// 以连接的交互锁保证同一DTU上同时只有一个请求在等待响应，等待锁的时间计入Timeout
+func (g *Gateway) exchange(c *Conn, frame *RTUFrame) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.Timeout)
+	defer cancel()
+	if err := c.LockExchange(ctx); err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, WaitMessageTimeout
+		}
+		return nil, err
+	}
+	defer c.UnlockExchange()
+
+	p := &pendingRequest{slave: frame.Address, function: frame.Function, ch: make(chan []byte, 1)}
+	g.pending.Store(c, p)
+	defer g.pending.Delete(c)
+
+	if _, err := c.Write(frame.Bytes()); err != nil {
+		return nil, err
+	}
+	select {
+	case out := <-p.ch:
+		return out, nil
+	case <-c.CloseNotifier:
+		return nil, DeviceOffline
+	case <-ctx.Done():
+		return nil, WaitMessageTimeout
+	}
+}
+
+// 判断报文是否是该请求的响应：CRC正确，从站地址和功能码（包括异常响应）与请求一致
+func (p *pendingRequest) match(out []byte) bool {
+	frame, err := NewRTUFrame(out)
+	return err == nil && frame.Address == p.slave && frame.Function&0x7f == p.function
+}
+
+// 截获网关正在等待的设备响应，心跳包、注册包、不完整的报文等其余报文交给下一个Handler
+func (g *Gateway) intercept(next HandlerFunc) HandlerFunc {
+	return func(c *Conn, out []byte) {
+		if v, ok := g.pending.Load(c); ok {
+			if p := v.(*pendingRequest); p.match(out) {
+				select {
+				case p.ch <- out:
+					return
+				default:
+				}
+			}
+		}
+		next(c, out)
+	}
+}
@@ -0,0 +1,135 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	s := NewServer()
+	heartbeats := make(chan []byte, 4)
+	s.Handler = func(c *Conn, out []byte) {
+		if c.ID() == "" {
+			c.SetID(string(out))
+			return
+		}
+		heartbeats <- out
+	}
+	registered := make(chan struct{}, 1)
+	s.OnRegister = func(c *Conn) {
+		registered <- struct{}{}
+	}
+	g := s.NewGateway()
+	g.Routes[1] = Route{DeviceID: "dtu1", Slave: 3}
+	g.Routes[2] = Route{DeviceID: "dtu2"}
+	g.Routes[4] = Route{DeviceID: "dtu1", Slave: 4}
+	g.Timeout = 300 * time.Millisecond
+	go s.StartServer("127.0.0.1:6570")
+	time.Sleep(100 * time.Millisecond)
+
+	// 模拟DTU，从站3应答读请求，从站4不应答
+	dtu, err := net.Dial("tcp", "127.0.0.1:6570")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dtu.Close()
+	dtu.Write([]byte("dtu1"))
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := dtu.Read(buf)
+			if err != nil {
+				return
+			}
+			req, err := NewRTUFrame(buf[:n])
+			if err != nil || req.Address != 3 {
+				continue
+			}
+			// 响应之前的心跳包和其他从站的报文不能被当作响应
+			dtu.Write([]byte("heartbeat"))
+			time.Sleep(20 * time.Millisecond)
+			other := &RTUFrame{Address: 5, Function: req.Function, Data: []byte{0x02, 0x00, 0x00}}
+			dtu.Write(other.Bytes())
+			time.Sleep(20 * time.Millisecond)
+			resp := &RTUFrame{Address: 3, Function: req.Function, Data: []byte{0x02, 0x12, 0x34}}
+			dtu.Write(resp.Bytes())
+		}
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("dtu not registered")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(l)
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	request := func(tid uint16, unit uint8) *TCPFrame {
+		req := &TCPFrame{TransactionIdentifier: tid, Device: unit, Function: Read, Data: []byte{0x00, 0x00, 0x00, 0x01}}
+		if _, err := client.Write(req.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		packet, err := readTCPFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := NewTCPFrame(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TransactionIdentifier != tid || resp.Device != unit {
+			t.Fatalf("response header = %+v, want tid %v unit %v", resp, tid, unit)
+		}
+		return resp
+	}
+
+	// 调用方持有连接的锁时网关仍可使用该连接
+	conn, err := s.FindConn("dtu1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+
+	if resp := request(7, 1); resp.Function != Read || !bytes.Equal(resp.Data, []byte{0x02, 0x12, 0x34}) {
+		t.Fatalf("response = %+v", resp)
+	}
+	if resp := request(8, 9); resp.Function != Read|0x80 || resp.Data[0] != byte(GatewayPathUnavailable) {
+		t.Fatalf("unknown unit response = %+v", resp)
+	}
+	if resp := request(9, 2); resp.Function != Read|0x80 || resp.Data[0] != byte(GatewayPathUnavailable) {
+		t.Fatalf("offline dtu response = %+v", resp)
+	}
+	if resp := request(10, 4); resp.Function != Read|0x80 || resp.Data[0] != byte(GatewayTargetDeviceFailedtoRespond) {
+		t.Fatalf("silent slave response = %+v", resp)
+	}
+	select {
+	case out := <-heartbeats:
+		if string(out) != "heartbeat" {
+			t.Fatalf("handler got %q, want heartbeat", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat not passed to handler")
+	}
+}
+
+func TestNewTCPFrame_ProtocolIdentifier(t *testing.T) {
+	frame := &TCPFrame{TransactionIdentifier: 1, ProtocolIdentifier: 1, Device: 1, Function: Read, Data: []byte{0x00, 0x00, 0x00, 0x01}}
+	if _, err := NewTCPFrame(frame.Bytes()); err == nil {
+		t.Fatal("frame with non-zero protocol identifier should be rejected")
+	}
+	if _, err := readTCPFrame(bytes.NewReader(frame.Bytes())); err == nil {
+		t.Fatal("readTCPFrame should reject non-zero protocol identifier")
+	}
+}
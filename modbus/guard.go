@@ -0,0 +1,72 @@
+package modbus
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/budget"
+)
+
+// 来自该地址的连接因超出ErrorBudget暂时被拒绝
+var Banned = errors.New("remote address banned")
+
+// ErrorBudget 每个连接允许的错误报文数量
+type ErrorBudget struct {
+	// Window时间内最多允许Max个错误报文
+	Max    int
+	Window time.Duration
+	// 超出之后拒绝来自同一IP的连接的时长，为0时只关闭连接
+	Ban time.Duration
+}
+
+// Malformed 报告一个无法处理的报文，CRC校验失败、解析失败以及Handler发生panic时会自动调用。
+// 超出Server.ErrorBudget时关闭连接，并在ErrorBudget.Ban内拒绝来自同一IP的连接
+func (c *Conn) Malformed(err error) {
+	b := c.server.ErrorBudget
+	if b == nil {
+		return
+	}
+	if !c.malformed.Add(time.Now(), b.Max, b.Window) {
+		return
+	}
+	log.Printf("connection %v exceeded error budget,last error: %v\n", c.RemoteAddr(), err)
+	if b.Ban > 0 {
+		c.server.banned.Ban(budget.Host(c.rwc.RemoteAddr()), time.Now().Add(b.Ban))
+	}
+	c.close(CloseErrorBudget)
+}
+
+// 判断是否接受来自remote的连接，接受时返回的release需要在连接关闭时调用
+func (srv *Server) admit(remote net.Addr) (release func(), err error) {
+	if srv.banned.Banned(budget.Host(remote), time.Now()) {
+		return nil, Banned
+	}
+	release = func() {}
+	if p := srv.Admission; p != nil {
+		if release, err = p.Admit(remote); err != nil {
+			return nil, err
+		}
+	}
+	if err := srv.onAccept(remote); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// 新连接必须在Admission.RegisterTimeout内调用SetID，否则会被关闭
+func (c *Conn) watchRegister() {
+	p := c.server.Admission
+	if p == nil || p.RegisterTimeout <= 0 {
+		return
+	}
+	c.registerTimer = time.AfterFunc(p.RegisterTimeout, func() {
+		if atomic.LoadInt32(&c.registered) == 0 {
+			log.Printf("connection %v did not register in %v\n", c.RemoteAddr(), p.RegisterTimeout)
+			c.close(CloseRegisterTimeout)
+		}
+	})
+}
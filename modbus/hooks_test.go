@@ -0,0 +1,78 @@
+package modbus
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Hooks(t *testing.T) {
+	s := NewServer()
+	s.Pacing = nil
+	started := make(chan net.Addr, 1)
+	s.OnStart = func(addr net.Addr) {
+		started <- addr
+	}
+	accepted := 0
+	s.OnAccept = func(remote net.Addr) error {
+		accepted++
+		if accepted == 1 {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	registered := make(chan string, 2)
+	s.OnRegister = func(c *Conn) {
+		registered <- c.ID()
+	}
+	frames := make(chan Direction, 4)
+	s.OnFrame = func(c *Conn, dir Direction, frame []byte) {
+		frames <- dir
+	}
+	reasons := make(chan CloseReason, 2)
+	s.OnClose = func(c *Conn, reason CloseReason) {
+		reasons <- reason
+	}
+	s.Handler = func(c *Conn, out []byte) {
+		c.SetID(string(out))
+		c.Write(out)
+	}
+	go s.StartServer("127.0.0.1:6530")
+	<-started
+
+	// 第一个连接被OnAccept拒绝
+	rejected, err := net.Dial("tcp", "127.0.0.1:6530")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("rejected connection should be closed")
+	}
+
+	first, _ := net.Dial("tcp", "127.0.0.1:6530")
+	defer first.Close()
+	first.Write([]byte("dev1"))
+	if id := <-registered; id != "dev1" {
+		t.Fatalf("registered = %v, want dev1", id)
+	}
+	if d := <-frames; d != Inbound {
+		t.Fatalf("direction = %v, want %v", d, Inbound)
+	}
+	if d := <-frames; d != Outbound {
+		t.Fatalf("direction = %v, want %v", d, Outbound)
+	}
+
+	// 同一设备的新连接替换旧连接
+	second, _ := net.Dial("tcp", "127.0.0.1:6530")
+	second.Write([]byte("dev1"))
+	if r := <-reasons; r != CloseReplaced {
+		t.Fatalf("reason = %v, want %v", r, CloseReplaced)
+	}
+	second.Read(make([]byte, 4))
+	second.Close()
+	if r := <-reasons; r != CloseEOF {
+		t.Fatalf("reason = %v, want %v", r, CloseEOF)
+	}
+}
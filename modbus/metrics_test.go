@@ -0,0 +1,91 @@
+package modbus
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/metrics"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	r := metrics.NewRegistry()
+	s := NewServer()
+	s.Metrics = r.For("modbus")
+	closed := make(chan string, 1)
+	s.AfterConnClose = func(id string) {
+		closed <- id
+	}
+	s.Handler = func(c *Conn, out []byte) {
+		c.SetID("dev1")
+		c.NewRTUFrame(out)
+		c.Write([]byte{0x01})
+	}
+	go s.StartServer("127.0.0.1:6520")
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := net.Dial("tcp", "127.0.0.1:6520")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 从站1返回功能码0x03的异常码2
+	frame := &RTUFrame{Address: 1, Function: 0x83, Data: []byte{0x02}}
+	client.Write(frame.Bytes())
+	// 读取下行报文，避免关闭时未读的数据导致连接被重置
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	client.Read(make([]byte, 8))
+	client.Close()
+	<-closed
+
+	for _, c := range []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"iot_connections_accepted_total", []string{"modbus"}, 1},
+		{"iot_connections_active", []string{"modbus"}, 0},
+		{"iot_connections_closed_total", []string{"modbus", string(CloseEOF)}, 1},
+		{"iot_received_bytes_total", []string{"modbus"}, 5},
+		{"iot_exceptions_total", []string{"modbus", "0x03", "2"}, 1},
+	} {
+		if got := r.Value(c.name, c.labels...); got != c.want {
+			t.Errorf("%v%v = %v, want %v", c.name, c.labels, got, c.want)
+		}
+	}
+	// 排队时长在连接关闭之后仍然可以获取
+	var b strings.Builder
+	r.WriteText(&b)
+	if want := `iot_queue_wait_seconds_count{server="modbus",priority="normal"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("output missing %q\n%s", want, b.String())
+	}
+}
+
+func TestConn_ReceiveContextTimeout(t *testing.T) {
+	r := metrics.NewRegistry()
+	s := NewServer()
+	s.Metrics = r.For("modbus")
+	server, client := net.Pipe()
+	defer client.Close()
+	c := s.newConn(server)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.ReceiveContext(ctx); err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if v := r.Value("iot_timeouts_total", "modbus", "receive"); v != 0 {
+		t.Fatalf("timeouts after cancel = %v, want 0", v)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReceiveContext(ctx); err != WaitMessageTimeout {
+		t.Fatalf("err = %v, want %v", err, WaitMessageTimeout)
+	}
+	if v := r.Value("iot_timeouts_total", "modbus", "receive"); v != 1 {
+		t.Fatalf("timeouts = %v, want 1", v)
+	}
+}
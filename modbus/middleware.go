@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+type (
+	// HandlerFunc 处理从连接读取出的数据，与Server.Handler相同
+	HandlerFunc func(c *Conn, out []byte)
+
+	// Middleware 包装HandlerFunc，不调用next即可丢弃报文
+	Middleware func(next HandlerFunc) HandlerFunc
+
+	// FrameHandler 处理解析之后的RTU帧
+	FrameHandler func(c *Conn, frame *RTUFrame)
+
+	// PanicError Handler发生panic时传给OnError的错误
+	PanicError struct {
+		Value interface{}
+		Stack []byte
+	}
+)
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// Use 添加中间件，先添加的先执行，必须在StartServer之前调用
+func (srv *Server) Use(mw ...Middleware) {
+	srv.middlewares = append(srv.middlewares, mw...)
+}
+
+// 以中间件包装Handler，并且始终恢复Handler中的panic，避免影响其他连接
+func (srv *Server) handle(c *Conn, out []byte) {
+	h := HandlerFunc(srv.Handler)
+	for i := len(srv.middlewares) - 1; i >= 0; i-- {
+		h = srv.middlewares[i](h)
+	}
+	Recover()(h)(c, out)
+}
+
+// Recover 恢复Handler中的panic，打印堆栈并通过OnError上报
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Conn, out []byte) {
+			defer func() {
+				if v := recover(); v != nil {
+					err := &PanicError{Value: v, Stack: debug.Stack()}
+					log.Printf("handler panic on connection %v,reason: %v\n%s", c.RemoteAddr(), v, err.Stack)
+					c.server.onError(c, err)
+					c.Malformed(err)
+				}
+			}()
+			next(c, out)
+		}
+	}
+}
+
+// ValidateCRC 丢弃长度不足或者CRC校验失败的报文。
+// 注册包、心跳包等非RTU报文需要在此之前处理
+func ValidateCRC() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Conn, out []byte) {
+			l := len(out)
+			if l < 5 || CRCModbus(out[:l-2]) != binary.LittleEndian.Uint16(out[l-2:]) {
+				c.server.metrics().CRCFailure()
+				if c.server.debug {
+					log.Printf("drop invalid rtu frame from %v:0x% x\n", c.RemoteAddr(), out)
+				}
+				c.Malformed(fmt.Errorf("invalid rtu frame:0x% x", out))
+				return
+			}
+			next(c, out)
+		}
+	}
+}
+
+// Metrics 将报文解析为RTU帧，并将CRC校验失败和设备返回的异常码记录到Server的指标中，
+// 报文本身原样交给下一个Handler
+func Metrics() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Conn, out []byte) {
+			c.NewRTUFrame(out)
+			next(c, out)
+		}
+	}
+}
+
+// Logging 打印每个报文及其处理耗时，logger为nil时使用log的默认输出
+func Logging(logger *log.Logger) Middleware {
+	printf := log.Printf
+	if logger != nil {
+		printf = logger.Printf
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Conn, out []byte) {
+			start := time.Now()
+			next(c, out)
+			printf("%v(%v) 0x% x handled in %v\n", c.ID(), c.RemoteAddr(), out, time.Since(start))
+		}
+	}
+}
+
+// Tracing 在处理报文之前调用start，处理完成之后调用其返回的函数，用于对接链路追踪
+func Tracing(start func(c *Conn, out []byte) (finish func())) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Conn, out []byte) {
+			finish := start(c, out)
+			defer finish()
+			next(c, out)
+		}
+	}
+}
+
+// HandleFrame 将报文解析为RTU帧之后交给h处理，解析失败的报文直接丢弃，
+// 可以作为Server.Handler或者中间件链的末端使用
+func HandleFrame(h FrameHandler) HandlerFunc {
+	return func(c *Conn, out []byte) {
+		frame, err := c.NewRTUFrame(out)
+		if err != nil {
+			if c.server.debug {
+				log.Printf("drop invalid rtu frame from %v,reason: %v\n", c.RemoteAddr(), err)
+			}
+			c.Malformed(err)
+			return
+		}
+		h(c, frame)
+	}
+}
@@ -0,0 +1,111 @@
+package modbus
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Use(t *testing.T) {
+	rwc, peer := net.Pipe()
+	defer peer.Close()
+	s := NewServer()
+	c := s.newConn(rwc)
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Conn, out []byte) {
+				calls = append(calls, name)
+				next(c, out)
+			}
+		}
+	}
+	var frames []*RTUFrame
+	s.Use(trace("first"), ValidateCRC(), trace("second"))
+	s.Handler = HandleFrame(func(c *Conn, frame *RTUFrame) {
+		frames = append(frames, frame)
+	})
+
+	valid := (&RTUFrame{Address: 1, Function: Read, Data: []byte{0x02, 0x00, 0x01}}).Bytes()
+	s.handle(c, valid)
+	invalid := append([]byte{}, valid...)
+	invalid[2] ^= 0xff
+	s.handle(c, invalid)
+
+	if len(frames) != 1 || frames[0].Address != 1 || frames[0].Function != Read {
+		t.Fatalf("frames = %+v, want one valid frame", frames)
+	}
+	want := []string{"first", "second", "first"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("calls = %v, want %v", calls, want)
+		}
+	}
+}
+
+func TestServer_HandlePanic(t *testing.T) {
+	rwc, peer := net.Pipe()
+	defer peer.Close()
+	s := NewServer()
+	c := s.newConn(rwc)
+	var reported error
+	s.OnError = func(c *Conn, err error) {
+		reported = err
+	}
+	s.Handler = func(c *Conn, out []byte) {
+		BytesDecodeTime(out)
+	}
+
+	s.handle(c, []byte{0x20})
+	if _, ok := reported.(*PanicError); !ok {
+		t.Fatalf("reported = %v, want *PanicError", reported)
+	}
+}
+
+func TestServer_ErrorBudget(t *testing.T) {
+	s := NewServer()
+	s.ErrorBudget = &ErrorBudget{Max: 2, Window: time.Minute, Ban: time.Minute}
+	s.Use(ValidateCRC())
+	s.Handler = func(c *Conn, out []byte) {}
+	reasons := make(chan CloseReason, 1)
+	s.OnClose = func(c *Conn, reason CloseReason) {
+		reasons <- reason
+	}
+	go s.StartServer("127.0.0.1:6540")
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := net.Dial("tcp", "127.0.0.1:6540")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		client.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05})
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case r := <-reasons:
+		if r != CloseErrorBudget {
+			t.Fatalf("reason = %v, want %v", r, CloseErrorBudget)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after exceeding error budget")
+	}
+
+	// 同一IP在Ban时间内被拒绝
+	banned, _ := net.Dial("tcp", "127.0.0.1:6540")
+	defer banned.Close()
+	banned.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := banned.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("banned connection should be closed by server, err = %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -1,24 +1,65 @@
 package modbus
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/ricnsmart/iot-protocol/admission"
+	"github.com/ricnsmart/iot-protocol/auth"
+	"github.com/ricnsmart/iot-protocol/internal/budget"
+	"github.com/ricnsmart/iot-protocol/metrics"
+	"github.com/ricnsmart/iot-protocol/outbox"
+	"github.com/ricnsmart/iot-protocol/pacing"
+	"github.com/ricnsmart/iot-protocol/presence"
 )
 
 const (
 	defaultMaxBytes = 500
 	defaultTimeout  = 3 * time.Minute
+	// 默认两帧之间的最小间隔，防止粘包
+	defaultWriteGap = 1 * time.Second
 )
 
 var (
 	DeviceOffline      = errors.New("device offline")
 	SendMessageTimeout = errors.New("send message timeout")
 	WaitMessageTimeout = errors.New("wait message timeout")
+	// 排队等待写入的报文数量已达到MaxQueueDepth
+	WriteQueueFull = outbox.Full
+)
+
+// CloseReason 连接关闭的原因
+type CloseReason string
+
+const (
+	// 调用方主动关闭
+	CloseByCaller CloseReason = "closed"
+	// 读取超时
+	CloseReadTimeout CloseReason = "read_timeout"
+	// 设备断开了连接
+	CloseEOF CloseReason = "eof"
+	// 其他读取错误
+	CloseReadError CloseReason = "read_error"
+	// 同一设备建立了新的连接
+	CloseReplaced CloseReason = "replaced"
+	// 服务关闭
+	CloseShutdown CloseReason = "shutdown"
+	// TLS握手失败
+	CloseHandshake CloseReason = "handshake"
+	// 未在Admission.RegisterTimeout内完成注册
+	CloseRegisterTimeout CloseReason = "register_timeout"
+	// 未认证的连接试图替换已认证的连接
+	CloseUnauthorized CloseReason = "unauthorized"
+	// 错误报文超出ErrorBudget
+	CloseErrorBudget CloseReason = "error_budget"
 )
 
 type (
@@ -38,6 +79,9 @@ type (
 		// 处理从连接读取出的数据
 		Handler func(c *Conn, out []byte)
 
+		// 包装Handler的中间件，通过Use添加
+		middlewares []Middleware
+
 		// 保存所有活动连接
 		activeConn sync.Map
 
@@ -46,6 +90,57 @@ type (
 
 		// 是否打印报文
 		debug bool
+
+		// 记录设备的在线状态，为nil时不记录
+		Presence *presence.Tracker
+
+		// 控制每个连接的写入节奏，默认两帧之间至少间隔1秒，为nil时不限制
+		Pacing pacing.Policy
+
+		// 每个连接排队等待写入的最大数量，为0时不限制
+		MaxQueueDepth int
+
+		// 记录运行指标，为nil时不记录
+		Metrics metrics.Recorder
+
+		// 开始监听时调用
+		OnStart func(addr net.Addr)
+
+		// 接受新连接时调用，返回error时拒绝该连接
+		OnAccept func(remote net.Addr) error
+
+		// 连接通过SetID注册设备编号之后调用
+		OnRegister func(c *Conn)
+
+		// 读取或写入报文时调用
+		OnFrame func(c *Conn, dir Direction, frame []byte)
+
+		// 连接读写失败时调用，c为nil时表示监听失败
+		OnError func(c *Conn, err error)
+
+		// 连接关闭时调用，在AfterConnClose之前
+		OnClose func(c *Conn, reason CloseReason)
+
+		// 每个连接允许的错误报文数量，为nil时不限制
+		ErrorBudget *ErrorBudget
+
+		// 连接的准入策略，为nil时接受所有连接
+		Admission *admission.Policy
+
+		// 校验Conn.Register中的凭据，为nil时不校验
+		Authenticator auth.Authenticator
+
+		// 同一IP允许的认证失败次数，为nil时不限制
+		AuthFailures *ErrorBudget
+
+		// 认证失败计数，key为IP
+		authFailures budget.Counter
+
+		// 因超出ErrorBudget被拒绝的地址
+		banned budget.BanList
+
+		// TLS连接根据客户端证书获取设备编号，返回非空时自动调用SetID，为nil时不使用证书识别设备
+		CertID func(cert *x509.Certificate) string
 	}
 
 	// A conn represents the server side of an tcp connection.
@@ -72,14 +167,42 @@ type (
 		// 资源读写锁，仅限调用方使用
 		sync.Mutex
 
+		// 库内部（Gateway、rest等）的交互锁，容量为1，与调用方使用的sync.Mutex相互独立
+		exchangeMu chan struct{}
+
 		// 可供调用方存储一些键值
 		sync.Map
 
 		// 可供调用方执行一次性操作
 		sync.Once
 
-		// 用于控制写入的频率
-		writeSignal chan struct{}
+		// 同一时间只允许一个协程写入，其余按优先级排队
+		queue *outbox.Queue
+
+		// 控制写入节奏
+		pacer   pacing.Pacer
+		pacerMu sync.RWMutex
+
+		// 最近一次读取失败对应的关闭原因
+		readErr atomic.Value
+
+		// 错误报文计数
+		malformed budget.Window
+
+		// TLS连接的客户端证书
+		cert *x509.Certificate
+
+		// 连接关闭时归还Admission的名额
+		release func()
+
+		// 是否已调用SetID，未在规定时间内注册的连接会被关闭
+		registered    int32
+		registerTimer *time.Timer
+
+		// 通过Authenticator或者TLS客户端证书认证的设备编号，类型为string
+		authID atomic.Value
+		// Modbus/TCP Security客户端证书中的角色
+		role string
 	}
 )
 
@@ -87,6 +210,7 @@ func NewServer() *Server {
 	return &Server{
 		MaxBytes: defaultMaxBytes,
 		Timeout:  defaultTimeout,
+		Pacing:   pacing.MinGap(defaultWriteGap),
 	}
 }
 
@@ -99,7 +223,13 @@ func (srv *Server) StartServer(address string) error {
 	if err != nil {
 		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
 	}
+	return srv.Serve(l)
+}
+
+// Serve 在调用方提供的Listener上接受连接，返回时关闭l
+func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	srv.onStart(l.Addr())
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rwc, err := l.Accept()
@@ -116,10 +246,19 @@ func (srv *Server) StartServer(address string) error {
 				time.Sleep(tempDelay)
 				continue
 			}
+			srv.onError(nil, err)
 			return err
 		}
 		tempDelay = 0
+		release, err := srv.admit(rwc.RemoteAddr())
+		if err != nil {
+			log.Printf("reject connection from %v,reason: %v\n", rwc.RemoteAddr(), err)
+			rwc.Close()
+			continue
+		}
 		c := srv.newConn(rwc)
+		c.release = release
+		c.watchRegister()
 		srv.activeConn.Store(c, true)
 		go c.serve()
 	}
@@ -127,18 +266,35 @@ func (srv *Server) StartServer(address string) error {
 
 // Create new connection from rwc.
 func (srv *Server) newConn(rwc net.Conn) *Conn {
-	return &Conn{
+	c := &Conn{
 		server:        srv,
 		rwc:           rwc,
 		CloseNotifier: make(chan struct{}),
 		bridgeCh:      make(chan []byte, 1),
-		writeSignal:   make(chan struct{}, 1), // 必须要指定size，否则无法写入
+		exchangeMu:    make(chan struct{}, 1),
+		queue:         outbox.New(srv.MaxQueueDepth),
+	}
+	// 排队时长在连接关闭之后仍保留在Server的指标中
+	c.queue.Observe = func(p outbox.Priority, wait time.Duration) {
+		srv.metrics().QueueWait(p.String(), wait)
+	}
+	if srv.Pacing != nil {
+		c.pacer = srv.Pacing()
+	}
+	srv.metrics().ConnAccepted()
+	return c
+}
+
+func (srv *Server) metrics() metrics.Recorder {
+	if srv.Metrics == nil {
+		return metrics.Nop
 	}
+	return srv.Metrics
 }
 
 func (srv *Server) Shutdown() {
 	srv.activeConn.Range(func(key, value interface{}) bool {
-		key.(*Conn).Close()
+		key.(*Conn).close(CloseShutdown)
 		return true
 	})
 }
@@ -159,7 +315,26 @@ func (srv *Server) FindConn(id string) (*Conn, error) {
 	return c1, nil
 }
 
+// Conns 返回所有已注册设备编号的活动连接
+func (srv *Server) Conns() []*Conn {
+	var conns []*Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if atomic.LoadInt32(&c.registered) == 1 {
+			conns = append(conns, c)
+		}
+		return true
+	})
+	return conns
+}
+
 func (c *Conn) serve() {
+	if err := c.handshake(); err != nil {
+		log.Printf("failed to handshake with %v,reason: %v\n", c.RemoteAddr(), err)
+		c.server.onError(c, err)
+		c.close(CloseHandshake)
+		return
+	}
 	for {
 		select {
 		case <-c.CloseNotifier:
@@ -173,7 +348,7 @@ func (c *Conn) serve() {
 			}
 			// 必须用协程，否则设备的响应会无法及时处理，导致请求超时
 			// 另外调用房可能会误用，导致阻塞，从而使接下来的读取失败，导致超时
-			go c.server.Handler(c, buf)
+			go c.server.handle(c, buf)
 		}
 	}
 }
@@ -183,14 +358,35 @@ func (c *Conn) ID() string {
 }
 
 func (c *Conn) SetID(id string) {
+	if err := c.setID(id); err != nil {
+		log.Printf("failed to register %v from %v,reason: %v\n", id, c.RemoteAddr(), err)
+		c.server.onError(c, err)
+		c.close(CloseUnauthorized)
+	}
+}
+
+func (c *Conn) setID(id string) error {
+	if err := c.checkEvict(id); err != nil {
+		return err
+	}
+	if p := c.server.Presence; p != nil && c.id != id {
+		// 先登记新连接再关闭之前的连接，避免设备状态在离线和在线之间跳变
+		p.Connect(id, c.RemoteAddr())
+		if c.id != "" {
+			p.Disconnect(c.id)
+		}
+	}
 	c.server.activeConn.Range(func(key, value interface{}) bool {
 		prev := key.(*Conn)
-		if prev.id == id {
-			prev.Close()
+		if prev != c && prev.id == id {
+			prev.close(CloseReplaced)
 		}
-		return false
+		return true
 	})
 	c.id = id
+	atomic.StoreInt32(&c.registered, 1)
+	c.server.onRegister(c)
+	return nil
 }
 
 func (c *Conn) Send(data []byte) error {
@@ -202,6 +398,7 @@ func (c *Conn) Send(data []byte) error {
 	case c.bridgeCh <- data:
 		return nil
 	case <-ticker.C:
+		c.server.metrics().Timeout("send")
 		return SendMessageTimeout
 	}
 }
@@ -215,10 +412,61 @@ func (c *Conn) Receive() ([]byte, error) {
 	case buf := <-c.bridgeCh:
 		return buf, nil
 	case <-ticker.C:
+		c.server.metrics().Timeout("receive")
 		return nil, WaitMessageTimeout
 	}
 }
 
+// ReceiveContext 与Receive相同，但以ctx控制等待时间，ctx超时时返回WaitMessageTimeout。
+// 只有ctx超时才计入Timeout指标，调用方主动取消时返回ctx.Err()且不计入
+func (c *Conn) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case <-c.CloseNotifier:
+		return nil, DeviceOffline
+	case buf := <-c.bridgeCh:
+		return buf, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			c.server.metrics().Timeout("receive")
+			return nil, WaitMessageTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// DiscardReceived 丢弃已经通过Send交给调用方但尚未被读取的报文，例如之前的请求超时之后才到达的响应，
+// 返回丢弃的数量。在发送新的请求之前调用，避免读到上一个请求的响应
+func (c *Conn) DiscardReceived() int {
+	n := 0
+	for {
+		select {
+		case <-c.bridgeCh:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+// LockExchange 获取连接的交互锁，保证Gateway、rest等库内部的请求在同一连接上依次等待响应。
+// 该锁与嵌入的sync.Mutex相互独立，不会与调用方争用。ctx结束时返回ctx.Err()，连接关闭时返回DeviceOffline，
+// 成功时必须调用UnlockExchange
+func (c *Conn) LockExchange(ctx context.Context) error {
+	select {
+	case c.exchangeMu <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.CloseNotifier:
+		return DeviceOffline
+	}
+}
+
+// UnlockExchange 释放LockExchange获取的交互锁
+func (c *Conn) UnlockExchange() {
+	<-c.exchangeMu
+}
+
 func (c *Conn) read() ([]byte, error) {
 	buf := make([]byte, c.server.MaxBytes)
 	defer func() {
@@ -229,38 +477,160 @@ func (c *Conn) read() ([]byte, error) {
 	c.rwc.SetReadDeadline(time.Now().Add(c.server.Timeout))
 	readLen, err := c.rwc.Read(buf)
 	if err != nil {
+		reason := readErrReason(err)
+		c.readErr.Store(reason)
+		if reason != CloseEOF {
+			c.server.onError(c, err)
+		}
 		return nil, err
 	}
 	buf = buf[:readLen]
+	c.server.onFrame(c, Inbound, buf)
+	m := c.server.metrics()
+	m.BytesIn(readLen)
+	m.FrameIn()
+	if p := c.Pacer(); p != nil {
+		p.Received()
+	}
+	if p := c.server.Presence; p != nil && c.id != "" {
+		p.Uplink(c.id, readLen)
+	}
 	return buf, nil
 }
 
+// NewRTUFrame 与NewRTUFrame相同，同时将CRC校验失败和设备返回的异常码记录到Server的指标中。
+// 包级别的NewRTUFrame不属于任何Server，不记录指标
+func (c *Conn) NewRTUFrame(packet []byte) (*RTUFrame, error) {
+	frame, err := NewRTUFrame(packet)
+	if err != nil {
+		if _, ok := err.(*CRCError); ok {
+			c.server.metrics().CRCFailure()
+		}
+		return nil, err
+	}
+	if e := GetException(frame); e != Success {
+		c.server.metrics().Exception(frame.Function&0x7f, uint8(e))
+	}
+	return frame, nil
+}
+
 func (c *Conn) Write(buf []byte) (n int, err error) {
-	// 控制写入频率，防止粘包
-	c.writeSignal <- struct{}{}
+	return c.WritePriority(context.Background(), priorityOf(buf), buf)
+}
 
-	defer func() {
-		if c.server.debug {
-			log.Printf(fmt.Sprintf("write:0x% x\n", buf))
+// WritePriority 以指定的优先级排队写入，ctx取消时放弃排队
+func (c *Conn) WritePriority(ctx context.Context, priority outbox.Priority, buf []byte) (n int, err error) {
+	start := time.Now()
+	if err := c.queue.Acquire(ctx, priority); err != nil {
+		if err == outbox.Closed {
+			return 0, DeviceOffline
 		}
-		// 等待1秒之后才允许其他协程使用Write方法
-		// 功能和c.Lock相仿，但是c.Lock仅用于调用方使用
-		time.Sleep(1 * time.Second)
-		<-c.writeSignal
-	}()
+		return 0, err
+	}
+	defer c.queue.Release()
+
+	// 控制写入节奏，防止粘包
+	p := c.Pacer()
+	if p != nil {
+		if err := p.Wait(c.CloseNotifier); err != nil {
+			return 0, DeviceOffline
+		}
+	}
 
+	if c.server.debug {
+		log.Printf(fmt.Sprintf("write:0x% x\n", buf))
+	}
 	c.rwc.SetWriteDeadline(time.Now().Add(c.server.Timeout))
-	return c.rwc.Write(buf)
+	n, err = c.rwc.Write(buf)
+	if p != nil {
+		p.Sent(n)
+	}
+	m := c.server.metrics()
+	m.BytesOut(n)
+	if err == nil {
+		m.FrameOut()
+		c.server.onFrame(c, Outbound, buf)
+	} else {
+		c.server.onError(c, err)
+	}
+	m.WriteLatency(time.Since(start))
+	if p := c.server.Presence; p != nil && c.id != "" {
+		p.Downlink(c.id, n)
+	}
+	return
+}
+
+// 遥控命令优先于轮询等其他报文写入
+func priorityOf(frame []byte) outbox.Priority {
+	if len(frame) > 1 && frame[1] == Control {
+		return outbox.High
+	}
+	return outbox.Normal
+}
+
+// Pacer 获取连接的写入节奏
+func (c *Conn) Pacer() pacing.Pacer {
+	c.pacerMu.RLock()
+	defer c.pacerMu.RUnlock()
+	return c.pacer
+}
+
+// SetPacer 单独设置连接的写入节奏，为nil时不限制
+func (c *Conn) SetPacer(p pacing.Pacer) {
+	// 等待正在进行的写入完成
+	if err := c.queue.Acquire(context.Background(), outbox.High); err == nil {
+		defer c.queue.Release()
+	}
+	c.pacerMu.Lock()
+	c.pacer = p
+	c.pacerMu.Unlock()
+}
+
+// QueueStats 获取写入队列的统计信息
+func (c *Conn) QueueStats() outbox.Stats {
+	return c.queue.Stats()
 }
 
 func (c *Conn) Close() {
-	if !c.ShuttingDown() {
-		atomic.StoreInt32(&c.inShutdown, 1)
+	c.close("")
+}
+
+// 以指定的原因关闭连接，reason为空时根据最近一次读取失败的原因判断
+func (c *Conn) close(reason CloseReason) {
+	if atomic.CompareAndSwapInt32(&c.inShutdown, 0, 1) {
+		if reason == "" {
+			reason = CloseByCaller
+			if r, ok := c.readErr.Load().(CloseReason); ok {
+				reason = r
+			}
+		}
 		c.server.activeConn.Delete(c)
+		if c.registerTimer != nil {
+			c.registerTimer.Stop()
+		}
+		if c.release != nil {
+			c.release()
+		}
 		close(c.CloseNotifier)
+		c.queue.Close()
 		c.rwc.Close()
-		c.server.AfterConnClose(c.id)
+		if p := c.server.Presence; p != nil && c.id != "" {
+			p.Disconnect(c.id)
+		}
+		c.server.metrics().ConnClosed(string(reason))
+		c.server.onClose(c, reason)
+	}
+}
+
+// 根据读取错误判断连接关闭的原因
+func readErrReason(err error) CloseReason {
+	if err == io.EOF {
+		return CloseEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseReadTimeout
 	}
+	return CloseReadError
 }
 
 func (c *Conn) ShuttingDown() bool {
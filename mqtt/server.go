@@ -0,0 +1,813 @@
+// Package mqtt 为以MQTT接入的设备提供最小的MQTT 3.1.1/5 broker，
+// 连接的注册、Send/Receive、AfterConnClose等与modbus和nb的Server一致
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	codec "github.com/ricnsmart/iot-protocol/internal/mqtt"
+	"github.com/ricnsmart/iot-protocol/presence"
+)
+
+const (
+	defaultTimeout       = 3 * time.Minute
+	defaultDownlinkTopic = "devices/{id}/down"
+
+	// 每个连接等待转发的消息数量，已满时丢弃新的消息
+	outboundBuffer = 64
+)
+
+var (
+	DeviceOffline      = errors.New("device offline")
+	SendMessageTimeout = errors.New("send message timeout")
+	WaitMessageTimeout = errors.New("wait message timeout")
+	// 设备没有订阅该主题
+	NotSubscribed = errors.New("topic not subscribed by device")
+	// 设备的报文不符合协议，例如第一个报文不是CONNECT或者使用了未知的主题别名
+	ProtocolError = errors.New("mqtt protocol error")
+)
+
+// CloseReason 连接关闭的原因
+type CloseReason string
+
+const (
+	// 调用方主动关闭
+	CloseByCaller CloseReason = "closed"
+	// 超过1.5倍心跳间隔没有收到报文
+	CloseReadTimeout CloseReason = "read_timeout"
+	// 设备断开了连接
+	CloseEOF CloseReason = "eof"
+	// 其他读取错误
+	CloseReadError CloseReason = "read_error"
+	// 设备发送了DISCONNECT
+	CloseDisconnect CloseReason = "disconnect"
+	// 同一设备建立了新的连接
+	CloseReplaced CloseReason = "replaced"
+	// 服务关闭
+	CloseShutdown CloseReason = "shutdown"
+	// CONNECT认证失败
+	CloseUnauthorized CloseReason = "unauthorized"
+	// 报文不符合协议
+	CloseProtocolError CloseReason = "protocol_error"
+)
+
+// MQTT 5的原因码
+const (
+	reasonUnsupportedVersion = byte(0x84)
+	reasonInvalidClientID    = byte(0x85)
+	reasonBadCredentials     = byte(0x86)
+	reasonSessionTakenOver   = byte(0x8E)
+	reasonNoSubscription     = byte(0x11)
+	reasonNotAuthorized      = byte(0x87)
+)
+
+type (
+	Server struct {
+		// 等待CONNECT、没有心跳间隔的连接的读取超时以及写入超时，默认3分钟
+		Timeout time.Duration
+
+		// 报文的最大长度，默认1MB
+		MaxPacketSize int
+
+		// 处理设备发布的消息
+		Handler func(c *Conn, msg *Message)
+
+		// 校验CONNECT中的凭据，为nil时接受所有连接，返回error时以用户名或密码错误拒绝
+		Authenticate func(clientID, username string, password []byte) error
+
+		// 将ClientID映射为设备编号，为nil时以ClientID作为设备编号
+		DeviceID func(clientID, username string) string
+
+		// Conn.Write发布的主题，{id}替换为设备编号，默认devices/{id}/down
+		DownlinkTopic string
+
+		// 检查连接能否发布到topic（subscribe为false）或者订阅过滤器topic（subscribe为true），
+		// 为nil时使用OwnTopic，每个设备只能使用自己的主题
+		Authorize func(c *Conn, topic string, subscribe bool) bool
+
+		// 保存所有活动连接
+		activeConn sync.Map
+
+		// 保留消息，key为主题
+		retained   map[string]*Message
+		retainedMu sync.RWMutex
+
+		// 用于调用方执行收尾工作
+		AfterConnClose func(id string)
+
+		// 是否打印报文
+		debug bool
+
+		// 记录设备的在线状态，为nil时不记录
+		Presence *presence.Tracker
+
+		// 开始监听时调用
+		OnStart func(addr net.Addr)
+
+		// 接受新连接时调用，返回error时拒绝该连接
+		OnAccept func(remote net.Addr) error
+
+		// 连接完成CONNECT并注册设备编号之后调用
+		OnRegister func(c *Conn)
+
+		// 连接关闭时调用，在AfterConnClose之前
+		OnClose func(c *Conn, reason CloseReason)
+	}
+
+	// Message 发布的消息
+	Message struct {
+		Topic   string
+		Payload []byte
+		QoS     byte
+		Retain  bool
+	}
+
+	// A conn represents the server side of an mqtt connection.
+	Conn struct {
+		// 设备编号，由idMu保护
+		id       string
+		idMu     sync.RWMutex
+		clientID string
+		username string
+
+		server *Server
+
+		rwc net.Conn
+		r   *bufio.Reader
+
+		// CONNECT中的协议级别
+		version byte
+
+		// CONNECT中的心跳间隔
+		keepAlive time.Duration
+
+		// 未正常断开时发布的遗嘱消息
+		will *Message
+
+		CloseNotifier chan struct{}
+
+		inShutdown int32 // accessed atomically (non-zero means we're in Shutdown)
+
+		// 用于和外界交换数据
+		bridgeCh chan []byte
+
+		// 等待转发给该连接的消息
+		outbound chan *Message
+
+		// 资源读写锁，仅限调用方使用
+		sync.Mutex
+
+		// 可供调用方存储一些键值
+		sync.Map
+
+		// 同一时间只允许一个协程写入
+		writeMu sync.Mutex
+
+		// 以下字段由subsMu保护
+		subsMu sync.Mutex
+		subs   map[string]byte
+		nextID uint16
+
+		// MQTT 5的主题别名，只在读取协程中使用
+		aliases map[uint16]string
+
+		// 最近一次读取失败对应的关闭原因
+		readErr atomic.Value
+	}
+)
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (srv *Server) Debug(debug bool) {
+	srv.debug = debug
+}
+
+func (srv *Server) timeout() time.Duration {
+	if srv.Timeout > 0 {
+		return srv.Timeout
+	}
+	return defaultTimeout
+}
+
+func (srv *Server) StartServer(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	return srv.Serve(l)
+}
+
+// Serve 在调用方提供的Listener上接受连接，返回时关闭l
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if srv.OnStart != nil {
+		srv.OnStart(l.Addr())
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if srv.OnAccept != nil {
+			if err := srv.OnAccept(rwc.RemoteAddr()); err != nil {
+				log.Printf("reject connection from %v,reason: %v\n", rwc.RemoteAddr(), err)
+				rwc.Close()
+				continue
+			}
+		}
+		c := &Conn{
+			server:        srv,
+			rwc:           rwc,
+			r:             bufio.NewReader(rwc),
+			version:       codec.Version311,
+			CloseNotifier: make(chan struct{}),
+			bridgeCh:      make(chan []byte),
+			outbound:      make(chan *Message, outboundBuffer),
+			subs:          make(map[string]byte),
+		}
+		srv.activeConn.Store(c, true)
+		go c.serve()
+	}
+}
+
+func (srv *Server) Shutdown() {
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		key.(*Conn).close(CloseShutdown)
+		return true
+	})
+}
+
+func (srv *Server) FindConn(id string) (*Conn, error) {
+	var c1 *Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if c.ID() == id {
+			c1 = c
+			return false
+		}
+		return true
+	})
+	if c1 == nil {
+		return nil, DeviceOffline
+	}
+	return c1, nil
+}
+
+// Conns 返回所有已注册设备编号的活动连接
+func (srv *Server) Conns() []*Conn {
+	var conns []*Conn
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if c.ID() != "" {
+			conns = append(conns, c)
+		}
+		return true
+	})
+	return conns
+}
+
+// Publish 向所有订阅了topic的设备发布消息，retain为true时保存为保留消息，payload为空时删除保留消息。
+// 消息进入各个订阅者的发送队列后即返回，队列已满的订阅者丢弃该消息
+func (srv *Server) Publish(topic string, payload []byte, qos byte, retain bool) {
+	msg := &Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+	if retain {
+		srv.retain(msg)
+	}
+	srv.forward(msg)
+}
+
+func (srv *Server) retain(msg *Message) {
+	srv.retainedMu.Lock()
+	defer srv.retainedMu.Unlock()
+	if len(msg.Payload) == 0 {
+		delete(srv.retained, msg.Topic)
+		return
+	}
+	if srv.retained == nil {
+		srv.retained = make(map[string]*Message)
+	}
+	srv.retained[msg.Topic] = msg
+}
+
+// Retained 返回主题为topic的保留消息
+func (srv *Server) Retained(topic string) (*Message, bool) {
+	srv.retainedMu.RLock()
+	defer srv.retainedMu.RUnlock()
+	msg, ok := srv.retained[topic]
+	return msg, ok
+}
+
+// 转发给订阅者，转发的消息不带保留标志。
+// 只放入订阅者的发送队列，慢速的订阅者不会阻塞发布者的读取
+func (srv *Server) forward(msg *Message) {
+	srv.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*Conn)
+		if c.ID() == "" {
+			return true
+		}
+		if _, ok := c.granted(msg.Topic); !ok {
+			return true
+		}
+		select {
+		case c.outbound <- msg:
+		default:
+			log.Printf("drop message to %v,reason: outbound queue full for %v\n", c.RemoteAddr(), msg.Topic)
+		}
+		return true
+	})
+}
+
+func (srv *Server) authorize(c *Conn, topic string, subscribe bool) bool {
+	if srv.Authorize != nil {
+		return srv.Authorize(c, topic, subscribe)
+	}
+	return OwnTopic(c, topic, subscribe)
+}
+
+// OwnTopic 只允许设备使用自己的主题，即DownlinkTopic中{id}及之前的部分所在的子树，
+// 默认为devices/{id}和devices/{id}/...，订阅的过滤器在该子树之前不能包含通配符。可以作为Server.Authorize
+func OwnTopic(c *Conn, topic string, subscribe bool) bool {
+	id := c.ID()
+	// 包含通配符或者层级分隔符的编号可能覆盖其他设备的主题
+	if id == "" || strings.ContainsAny(id, "+#/") {
+		return false
+	}
+	root := c.server.DownlinkTopic
+	if root == "" {
+		root = defaultDownlinkTopic
+	}
+	i := strings.Index(root, "{id}")
+	if i < 0 {
+		root = defaultDownlinkTopic
+		i = strings.Index(root, "{id}")
+	}
+	root = strings.Replace(root[:i+len("{id}")], "{id}", id, -1)
+	return topic == root || strings.HasPrefix(topic, root+"/")
+}
+
+func (srv *Server) handle(c *Conn, msg *Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("handler panic on connection %v,reason: %v\n%s", c.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	if srv.Handler != nil {
+		srv.Handler(c, msg)
+	}
+}
+
+func (c *Conn) serve() {
+	if reason, err := c.handshake(); err != nil {
+		log.Printf("failed to handshake with %v,reason: %v\n", c.RemoteAddr(), err)
+		c.close(reason)
+		return
+	}
+	go c.forwardLoop()
+	for {
+		p, err := c.read()
+		if err != nil {
+			if !c.ShuttingDown() {
+				log.Printf("failed to read from connection %v,reason: %v\n", c.RemoteAddr(), err)
+			}
+			c.close("")
+			return
+		}
+		if reason, err := c.dispatch(p); err != nil {
+			if reason != CloseDisconnect {
+				log.Printf("failed to handle packet from %v,reason: %v\n", c.RemoteAddr(), err)
+			}
+			c.close(reason)
+			return
+		}
+	}
+}
+
+// 读取CONNECT，认证并注册设备编号
+func (c *Conn) handshake() (CloseReason, error) {
+	c.rwc.SetReadDeadline(time.Now().Add(c.server.timeout()))
+	p, err := codec.ReadPacketVersion(c.r, c.server.MaxPacketSize, codec.Version311)
+	if err != nil {
+		return readErrReason(err), err
+	}
+	connect, ok := p.(*codec.Connect)
+	if !ok {
+		return CloseProtocolError, fmt.Errorf("%w: expect connect", ProtocolError)
+	}
+	if connect.ProtocolLevel != codec.Version311 && connect.ProtocolLevel != codec.Version5 {
+		c.writePacket(&codec.ConnAck{ReturnCode: c.connAckCode(codec.UnacceptableVersion)})
+		return CloseProtocolError, fmt.Errorf("%w: protocol level %d", ProtocolError, connect.ProtocolLevel)
+	}
+	c.version = connect.ProtocolLevel
+	c.clientID = connect.ClientID
+	if connect.Username != nil {
+		c.username = *connect.Username
+	}
+	if c.clientID == "" {
+		c.writePacket(&codec.ConnAck{ReturnCode: c.connAckCode(codec.IdentifierRejected)})
+		return CloseProtocolError, fmt.Errorf("%w: empty client id", ProtocolError)
+	}
+	if auth := c.server.Authenticate; auth != nil {
+		if err := auth(c.clientID, c.username, connect.Password); err != nil {
+			c.writePacket(&codec.ConnAck{ReturnCode: c.connAckCode(codec.BadUsernameOrPassword)})
+			return CloseUnauthorized, err
+		}
+	}
+	c.keepAlive = time.Duration(connect.KeepAlive) * time.Second
+	if connect.WillTopic != "" {
+		c.will = &Message{Topic: connect.WillTopic, Payload: connect.WillMessage, QoS: connect.WillQoS, Retain: connect.WillRetain}
+		if c.will.QoS > 1 {
+			c.will.QoS = 1
+		}
+	}
+	id := c.clientID
+	if c.server.DeviceID != nil {
+		id = c.server.DeviceID(c.clientID, c.username)
+	}
+	if err := c.writePacket(&codec.ConnAck{ReturnCode: codec.Accepted}); err != nil {
+		return CloseReadError, err
+	}
+	c.SetID(id)
+	if c.will != nil && !c.server.authorize(c, c.will.Topic, false) {
+		log.Printf("drop will from %v,reason: topic %v not authorized\n", c.RemoteAddr(), c.will.Topic)
+		c.will = nil
+	}
+	return "", nil
+}
+
+// 依次发送转发给该连接的消息，直到连接关闭
+func (c *Conn) forwardLoop() {
+	for {
+		select {
+		case <-c.CloseNotifier:
+			return
+		case msg := <-c.outbound:
+			c.Publish(msg.Topic, msg.Payload, msg.QoS)
+		}
+	}
+}
+
+// MQTT 5的CONNACK使用原因码
+func (c *Conn) connAckCode(code byte) byte {
+	if c.version != codec.Version5 {
+		return code
+	}
+	switch code {
+	case codec.UnacceptableVersion:
+		return reasonUnsupportedVersion
+	case codec.IdentifierRejected:
+		return reasonInvalidClientID
+	case codec.BadUsernameOrPassword:
+		return reasonBadCredentials
+	}
+	return code
+}
+
+func (c *Conn) read() (codec.Packet, error) {
+	timeout := c.server.timeout()
+	if c.keepAlive > 0 {
+		timeout = c.keepAlive * 3 / 2
+	}
+	c.rwc.SetReadDeadline(time.Now().Add(timeout))
+	p, err := codec.ReadPacketVersion(c.r, c.server.MaxPacketSize, c.version)
+	if err != nil {
+		c.readErr.Store(readErrReason(err))
+		return nil, err
+	}
+	if c.server.debug {
+		log.Printf("read:%+v\n", p)
+	}
+	return p, nil
+}
+
+func (c *Conn) dispatch(p codec.Packet) (CloseReason, error) {
+	switch p := p.(type) {
+	case *codec.Publish:
+		topic := p.Topic
+		if p.TopicAlias != 0 {
+			if c.aliases == nil {
+				c.aliases = make(map[uint16]string)
+			}
+			if topic != "" {
+				c.aliases[p.TopicAlias] = topic
+			} else if topic = c.aliases[p.TopicAlias]; topic == "" {
+				return CloseProtocolError, fmt.Errorf("%w: unknown topic alias %d", ProtocolError, p.TopicAlias)
+			}
+		}
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return CloseProtocolError, fmt.Errorf("%w: invalid topic %q", ProtocolError, topic)
+		}
+		if t := c.server.Presence; t != nil {
+			t.Uplink(c.ID(), len(p.Payload))
+		}
+		if p.QoS > 0 {
+			c.writePacket(&codec.PubAck{ID: p.ID})
+		}
+		// 没有权限的消息确认后丢弃，不转发也不交给Handler
+		if !c.server.authorize(c, topic, false) {
+			log.Printf("drop message from %v,reason: topic %v not authorized\n", c.RemoteAddr(), topic)
+			return "", nil
+		}
+		msg := &Message{Topic: topic, Payload: p.Payload, QoS: p.QoS, Retain: p.Retain}
+		if msg.Retain {
+			c.server.retain(msg)
+		}
+		c.server.forward(msg)
+		// 必须用协程，否则Handler中的Receive会因为无法读取应答而超时
+		go c.server.handle(c, msg)
+	case *codec.Subscribe:
+		c.subscribe(p)
+	case *codec.Unsubscribe:
+		ack := &codec.UnsubAck{ID: p.ID}
+		c.subsMu.Lock()
+		for _, f := range p.Filters {
+			code := byte(0)
+			if _, ok := c.subs[f]; !ok {
+				code = reasonNoSubscription
+			}
+			delete(c.subs, f)
+			ack.Codes = append(ack.Codes, code)
+		}
+		c.subsMu.Unlock()
+		c.writePacket(ack)
+	case *codec.PubAck:
+		// QoS 1的下行消息不重发，收到确认即可
+	case *codec.PingReq:
+		c.writePacket(&codec.PingResp{})
+	case *codec.Disconnect:
+		// 正常断开，close中不会发布遗嘱消息
+		return CloseDisconnect, io.EOF
+	default:
+		return CloseProtocolError, fmt.Errorf("%w: unexpected packet type %d", ProtocolError, p.Type())
+	}
+	return "", nil
+}
+
+// 登记订阅，最高授予QoS 1，之后发送匹配的保留消息
+func (c *Conn) subscribe(p *codec.Subscribe) {
+	ack := &codec.SubAck{ID: p.ID}
+	var filters []string
+	c.subsMu.Lock()
+	for _, s := range p.Subscriptions {
+		if !codec.ValidFilter(s.Filter) {
+			ack.Codes = append(ack.Codes, codec.SubscribeFailure)
+			continue
+		}
+		if !c.server.authorize(c, s.Filter, true) {
+			code := codec.SubscribeFailure
+			if c.version == codec.Version5 {
+				code = reasonNotAuthorized
+			}
+			ack.Codes = append(ack.Codes, code)
+			continue
+		}
+		qos := s.QoS
+		if qos > 1 {
+			qos = 1
+		}
+		c.subs[s.Filter] = qos
+		filters = append(filters, s.Filter)
+		ack.Codes = append(ack.Codes, qos)
+	}
+	c.subsMu.Unlock()
+	c.writePacket(ack)
+
+	c.server.retainedMu.RLock()
+	var retained []*Message
+	for topic, msg := range c.server.retained {
+		for _, f := range filters {
+			if codec.Match(f, topic) {
+				retained = append(retained, msg)
+				break
+			}
+		}
+	}
+	c.server.retainedMu.RUnlock()
+	for _, msg := range retained {
+		c.publish(msg.Topic, msg.Payload, msg.QoS, true)
+	}
+}
+
+// 订阅中与topic匹配的最高QoS，没有匹配时返回false
+func (c *Conn) granted(topic string) (byte, bool) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	qos, ok := byte(0), false
+	for f, q := range c.subs {
+		if codec.Match(f, topic) {
+			ok = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, ok
+}
+
+// Publish 向设备发布消息，设备必须订阅了topic，QoS取qos与订阅授予的QoS中较小的
+func (c *Conn) Publish(topic string, payload []byte, qos byte) error {
+	return c.publish(topic, payload, qos, false)
+}
+
+func (c *Conn) publish(topic string, payload []byte, qos byte, retain bool) error {
+	granted, ok := c.granted(topic)
+	if !ok {
+		return NotSubscribed
+	}
+	if qos > granted {
+		qos = granted
+	}
+	p := &codec.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload}
+	if qos > 0 {
+		c.subsMu.Lock()
+		if c.nextID++; c.nextID == 0 {
+			c.nextID++
+		}
+		p.ID = c.nextID
+		c.subsMu.Unlock()
+	}
+	if err := c.writePacket(p); err != nil {
+		return err
+	}
+	if t := c.server.Presence; t != nil && c.ID() != "" {
+		t.Downlink(c.ID(), len(payload))
+	}
+	return nil
+}
+
+// Write 以QoS 1发布到DownlinkTopic，使Conn可以作为dlt645等协议的Transport
+func (c *Conn) Write(buf []byte) (n int, err error) {
+	topic := c.server.DownlinkTopic
+	if topic == "" {
+		topic = defaultDownlinkTopic
+	}
+	if err := c.Publish(strings.Replace(topic, "{id}", c.ID(), -1), buf, 1); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *Conn) writePacket(p codec.Packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.ShuttingDown() {
+		return DeviceOffline
+	}
+	if c.server.debug {
+		log.Printf("write:%+v\n", p)
+	}
+	c.rwc.SetWriteDeadline(time.Now().Add(c.server.timeout()))
+	_, err := c.rwc.Write(codec.EncodeVersion(p, c.version))
+	return err
+}
+
+func (c *Conn) ID() string {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
+	return c.id
+}
+
+// ClientID CONNECT中的ClientID
+func (c *Conn) ClientID() string {
+	return c.clientID
+}
+
+// Username CONNECT中的用户名
+func (c *Conn) Username() string {
+	return c.username
+}
+
+// SetID 注册设备编号，关闭同一设备之前的连接
+func (c *Conn) SetID(id string) {
+	c.idMu.Lock()
+	prevID := c.id
+	c.id = id
+	c.idMu.Unlock()
+	if p := c.server.Presence; p != nil && prevID != id {
+		// 先登记新连接再关闭之前的连接，避免设备状态在离线和在线之间跳变
+		p.Connect(id, c.RemoteAddr())
+		if prevID != "" {
+			p.Disconnect(prevID)
+		}
+	}
+	c.server.activeConn.Range(func(key, value interface{}) bool {
+		prev := key.(*Conn)
+		if prev != c && prev.ID() == id {
+			prev.close(CloseReplaced)
+		}
+		return true
+	})
+	if c.server.OnRegister != nil {
+		c.server.OnRegister(c)
+	}
+}
+
+func (c *Conn) Send(data []byte) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	select {
+	case <-c.CloseNotifier:
+		return DeviceOffline
+	case c.bridgeCh <- data:
+		return nil
+	case <-ticker.C:
+		return SendMessageTimeout
+	}
+}
+
+func (c *Conn) Receive() ([]byte, error) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	select {
+	case <-c.CloseNotifier:
+		return nil, DeviceOffline
+	case buf := <-c.bridgeCh:
+		return buf, nil
+	case <-ticker.C:
+		return nil, WaitMessageTimeout
+	}
+}
+
+func (c *Conn) Close() {
+	c.close("")
+}
+
+// 以指定的原因关闭连接，reason为空时根据最近一次读取失败的原因判断
+func (c *Conn) close(reason CloseReason) {
+	if reason == CloseReplaced && c.version == codec.Version5 {
+		c.writePacket(&codec.Disconnect{ReasonCode: reasonSessionTakenOver})
+	}
+	if atomic.CompareAndSwapInt32(&c.inShutdown, 0, 1) {
+		if reason == "" {
+			reason = CloseByCaller
+			if r, ok := c.readErr.Load().(CloseReason); ok {
+				reason = r
+			}
+		}
+		c.server.activeConn.Delete(c)
+		close(c.CloseNotifier)
+		c.rwc.Close()
+		// 未发送DISCONNECT时发布遗嘱消息
+		if c.will != nil && reason != CloseDisconnect {
+			c.server.Publish(c.will.Topic, c.will.Payload, c.will.QoS, c.will.Retain)
+		}
+		id := c.ID()
+		if p := c.server.Presence; p != nil && id != "" {
+			p.Disconnect(id)
+		}
+		if c.server.OnClose != nil {
+			c.server.OnClose(c, reason)
+		}
+		if c.server.AfterConnClose != nil {
+			c.server.AfterConnClose(id)
+		}
+	}
+}
+
+// 根据读取错误判断连接关闭的原因
+func readErrReason(err error) CloseReason {
+	if err == io.EOF {
+		return CloseEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseReadTimeout
+	}
+	if errors.Is(err, codec.MalformedPacket) || errors.Is(err, codec.PacketTooLarge) {
+		return CloseProtocolError
+	}
+	return CloseReadError
+}
+
+func (c *Conn) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.inShutdown) != 0
+}
+
+// 获取客户端地址
+func (c *Conn) RemoteAddr() string {
+	return c.rwc.RemoteAddr().String()
+}
@@ -0,0 +1,329 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	codec "github.com/ricnsmart/iot-protocol/internal/mqtt"
+)
+
+type client struct {
+	t       *testing.T
+	conn    net.Conn
+	r       *bufio.Reader
+	version byte
+}
+
+func dial(t *testing.T, addr string, connect *codec.Connect) (*client, *codec.ConnAck) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if connect.ProtocolLevel == 0 {
+		connect.ProtocolLevel = codec.Version311
+	}
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn), version: connect.ProtocolLevel}
+	c.write(connect)
+	ack, ok := c.read().(*codec.ConnAck)
+	if !ok {
+		t.Fatal("expect connack")
+	}
+	return c, ack
+}
+
+func (c *client) write(p codec.Packet) {
+	c.t.Helper()
+	if _, err := c.conn.Write(codec.EncodeVersion(p, c.version)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read() codec.Packet {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := codec.ReadPacketVersion(c.r, 0, c.version)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+func (c *client) subscribe(filter string) {
+	c.t.Helper()
+	c.write(&codec.Subscribe{ID: 1, Subscriptions: []codec.Subscription{{Filter: filter, QoS: 1}}})
+	if ack, ok := c.read().(*codec.SubAck); !ok || len(ack.Codes) != 1 || ack.Codes[0] != 1 {
+		c.t.Fatalf("suback = %+v", ack)
+	}
+}
+
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		srv.Shutdown()
+	})
+	return l.Addr().String()
+}
+
+func TestServer_Authenticate(t *testing.T) {
+	srv := NewServer()
+	srv.Authenticate = func(clientID, username string, password []byte) error {
+		if username != "gw" || string(password) != "secret" {
+			return errors.New("bad credentials")
+		}
+		return nil
+	}
+	addr := startServer(t, srv)
+
+	user := "gw"
+	_, ack := dial(t, addr, &codec.Connect{ClientID: "1", Username: &user, Password: []byte("wrong")})
+	if ack.ReturnCode != codec.BadUsernameOrPassword {
+		t.Fatalf("v3.1.1 return code = %d", ack.ReturnCode)
+	}
+	_, ack = dial(t, addr, &codec.Connect{ProtocolLevel: codec.Version5, ClientID: "1", Username: &user, Password: []byte("wrong")})
+	if ack.ReturnCode != reasonBadCredentials {
+		t.Fatalf("v5 reason code = 0x%02x", ack.ReturnCode)
+	}
+	_, ack = dial(t, addr, &codec.Connect{ClientID: "1", Username: &user, Password: []byte("secret")})
+	if ack.ReturnCode != codec.Accepted {
+		t.Fatalf("return code = %d", ack.ReturnCode)
+	}
+	_, ack = dial(t, addr, &codec.Connect{ProtocolLevel: 3, ClientID: "1"})
+	if ack.ReturnCode != codec.UnacceptableVersion {
+		t.Fatalf("return code = %d", ack.ReturnCode)
+	}
+}
+
+func TestServer_PublishAndBridge(t *testing.T) {
+	srv := NewServer()
+	srv.DeviceID = func(clientID, username string) string {
+		return clientID[len("gw-"):]
+	}
+	registered := make(chan *Conn, 1)
+	srv.OnRegister = func(c *Conn) { registered <- c }
+	srv.Handler = func(c *Conn, msg *Message) {
+		if msg.Topic == "devices/1/up" {
+			if err := c.Send(msg.Payload); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	addr := startServer(t, srv)
+
+	d, ack := dial(t, addr, &codec.Connect{ClientID: "gw-1", KeepAlive: 60})
+	if ack.ReturnCode != codec.Accepted {
+		t.Fatalf("return code = %d", ack.ReturnCode)
+	}
+	c := <-registered
+	if c.ID() != "1" || c.ClientID() != "gw-1" {
+		t.Fatalf("id = %v, client id = %v", c.ID(), c.ClientID())
+	}
+	if found, err := srv.FindConn("1"); err != nil || found != c {
+		t.Fatalf("FindConn() = %v, %v", found, err)
+	}
+	if _, err := c.Write([]byte{0x01}); err != NotSubscribed {
+		t.Fatalf("err = %v, want NotSubscribed", err)
+	}
+	d.subscribe("devices/1/down")
+
+	type result struct {
+		buf []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c.Lock()
+		defer c.Unlock()
+		if _, err := c.Write([]byte{0x01, 0x03}); err != nil {
+			done <- result{err: err}
+			return
+		}
+		buf, err := c.Receive()
+		done <- result{buf, err}
+	}()
+
+	p, ok := d.read().(*codec.Publish)
+	if !ok || p.Topic != "devices/1/down" || p.QoS != 1 || string(p.Payload) != "\x01\x03" {
+		t.Fatalf("downlink = %+v", p)
+	}
+	d.write(&codec.PubAck{ID: p.ID})
+	d.write(&codec.Publish{Topic: "devices/1/up", QoS: 1, ID: 7, Payload: []byte{0x01, 0x03, 0x00}})
+	if ack, ok := d.read().(*codec.PubAck); !ok || ack.ID != 7 {
+		t.Fatalf("puback = %+v", ack)
+	}
+	r := <-done
+	if r.err != nil || string(r.buf) != "\x01\x03\x00" {
+		t.Fatalf("Receive() = % x, %v", r.buf, r.err)
+	}
+
+	d.write(&codec.PingReq{})
+	if _, ok := d.read().(*codec.PingResp); !ok {
+		t.Fatal("expect pingresp")
+	}
+}
+
+func TestServer_Retained(t *testing.T) {
+	srv := NewServer()
+	srv.Handler = func(c *Conn, msg *Message) {}
+	// app可以订阅所有设备的状态
+	srv.Authorize = func(c *Conn, topic string, subscribe bool) bool {
+		return c.ID() == "app" || OwnTopic(c, topic, subscribe)
+	}
+	addr := startServer(t, srv)
+
+	d, _ := dial(t, addr, &codec.Connect{ClientID: "1", WillTopic: "devices/1/status", WillMessage: []byte("offline"), WillRetain: true})
+	d.write(&codec.Publish{Topic: "devices/1/status", Retain: true, Payload: []byte("online")})
+
+	app, _ := dial(t, addr, &codec.Connect{ClientID: "app"})
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, ok := srv.Retained("devices/1/status"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	app.subscribe("devices/+/status")
+	p, ok := app.read().(*codec.Publish)
+	if !ok || !p.Retain || string(p.Payload) != "online" {
+		t.Fatalf("retained = %+v", p)
+	}
+
+	// 未发送DISCONNECT时发布遗嘱
+	d.conn.Close()
+	p, ok = app.read().(*codec.Publish)
+	if !ok || p.Retain || string(p.Payload) != "offline" {
+		t.Fatalf("will = %+v", p)
+	}
+	if msg, _ := srv.Retained("devices/1/status"); string(msg.Payload) != "offline" {
+		t.Fatalf("retained = %+v", msg)
+	}
+}
+
+func TestServer_Authorize(t *testing.T) {
+	srv := NewServer()
+	topics := make(chan string, 4)
+	srv.Handler = func(c *Conn, msg *Message) { topics <- c.ID() + " " + msg.Topic }
+	addr := startServer(t, srv)
+
+	d1, _ := dial(t, addr, &codec.Connect{ClientID: "1"})
+	for _, filter := range []string{"#", "devices/+/down", "devices/2/down", "devices/12/down"} {
+		d1.write(&codec.Subscribe{ID: 1, Subscriptions: []codec.Subscription{{Filter: filter, QoS: 1}}})
+		if ack, ok := d1.read().(*codec.SubAck); !ok || len(ack.Codes) != 1 || ack.Codes[0] != codec.SubscribeFailure {
+			t.Fatalf("subscribe %v: suback = %+v", filter, ack)
+		}
+	}
+	d1.subscribe("devices/1/#")
+
+	// 其他设备不能发布到设备1的主题
+	d2, _ := dial(t, addr, &codec.Connect{ClientID: "2"})
+	d2.write(&codec.Publish{Topic: "devices/1/down", QoS: 1, ID: 3, Payload: []byte("spoofed")})
+	if ack, ok := d2.read().(*codec.PubAck); !ok || ack.ID != 3 {
+		t.Fatalf("puback = %+v", ack)
+	}
+	d2.write(&codec.Publish{Topic: "devices/2/up", Payload: []byte("a")})
+	select {
+	case topic := <-topics:
+		if topic != "2 devices/2/up" {
+			t.Fatalf("handler received %v", topic)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler not called")
+	}
+
+	srv.Publish("devices/1/down", []byte("real"), 0, false)
+	if p, ok := d1.read().(*codec.Publish); !ok || string(p.Payload) != "real" {
+		t.Fatalf("publish = %+v", p)
+	}
+
+	// MQTT 5以没有权限的原因码拒绝订阅
+	v5, _ := dial(t, addr, &codec.Connect{ProtocolLevel: codec.Version5, ClientID: "3"})
+	v5.write(&codec.Subscribe{ID: 1, Subscriptions: []codec.Subscription{{Filter: "devices/1/down", QoS: 1}}})
+	if ack, ok := v5.read().(*codec.SubAck); !ok || len(ack.Codes) != 1 || ack.Codes[0] != reasonNotAuthorized {
+		t.Fatalf("suback = %+v", ack)
+	}
+}
+
+func TestServer_SlowSubscriber(t *testing.T) {
+	srv := NewServer()
+	srv.Authorize = func(c *Conn, topic string, subscribe bool) bool { return true }
+	addr := startServer(t, srv)
+
+	// 订阅之后不再读取
+	slow, _ := dial(t, addr, &codec.Connect{ClientID: "slow"})
+	slow.subscribe("devices/#")
+
+	d, _ := dial(t, addr, &codec.Connect{ClientID: "1"})
+	payload := make([]byte, 64<<10)
+	d.conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < 200; i++ {
+		d.write(&codec.Publish{Topic: "devices/1/up", Payload: payload})
+	}
+	// 发布者的读取不会被订阅者阻塞
+	d.write(&codec.PingReq{})
+	if _, ok := d.read().(*codec.PingResp); !ok {
+		t.Fatal("expect pingresp")
+	}
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	srv := NewServer()
+	reasons := make(chan CloseReason, 2)
+	srv.OnClose = func(c *Conn, reason CloseReason) { reasons <- reason }
+	addr := startServer(t, srv)
+
+	dial(t, addr, &codec.Connect{ClientID: "1", KeepAlive: 1})
+	select {
+	case reason := <-reasons:
+		if reason != CloseReadTimeout {
+			t.Fatalf("reason = %v", reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not closed after keep-alive timeout")
+	}
+}
+
+func TestServer_V5(t *testing.T) {
+	srv := NewServer()
+	topics := make(chan string, 2)
+	srv.Handler = func(c *Conn, msg *Message) { topics <- msg.Topic }
+	reasons := make(chan CloseReason, 1)
+	srv.OnClose = func(c *Conn, reason CloseReason) { reasons <- reason }
+	addr := startServer(t, srv)
+
+	d, ack := dial(t, addr, &codec.Connect{ProtocolLevel: codec.Version5, ClientID: "1"})
+	if ack.ReturnCode != codec.Accepted {
+		t.Fatalf("reason code = 0x%02x", ack.ReturnCode)
+	}
+	d.write(&codec.Publish{Topic: "devices/1/up", TopicAlias: 1, Payload: []byte("a")})
+	d.write(&codec.Publish{TopicAlias: 1, Payload: []byte("b")})
+	for i := 0; i < 2; i++ {
+		select {
+		case topic := <-topics:
+			if topic != "devices/1/up" {
+				t.Fatalf("topic = %v", topic)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("handler not called")
+		}
+	}
+
+	// 同一设备重新连接，之前的连接收到会话被接管的DISCONNECT
+	dial(t, addr, &codec.Connect{ProtocolLevel: codec.Version5, ClientID: "1"})
+	p, ok := d.read().(*codec.Disconnect)
+	if !ok || p.ReasonCode != reasonSessionTakenOver {
+		t.Fatalf("disconnect = %+v", p)
+	}
+	if reason := <-reasons; reason != CloseReplaced {
+		t.Fatalf("reason = %v", reason)
+	}
+}
@@ -0,0 +1,155 @@
+// Package mqttbridge 将设备数据和在线状态发布到MQTT，并将命令主题的消息写入设备的连接
+package mqttbridge
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/modbus"
+	"github.com/ricnsmart/iot-protocol/nb"
+	"github.com/ricnsmart/iot-protocol/presence"
+)
+
+const (
+	defaultTelemetryTopic = "devices/{id}/telemetry"
+	defaultStatusTopic    = "devices/{id}/status"
+	defaultCommandTopic   = "devices/{id}/commands"
+)
+
+type (
+	// Bridge 主题中的{id}替换为设备编号
+	Bridge struct {
+		Client *Client
+
+		// 设备数据的主题，默认devices/{id}/telemetry
+		TelemetryTopic string
+
+		// 在线状态的主题，默认devices/{id}/status，以保留消息发布
+		StatusTopic string
+
+		// 命令的主题，默认devices/{id}/commands，{id}必须占据整级
+		CommandTopic string
+
+		// 发布和订阅的QoS，New默认为1
+		QoS byte
+
+		// 根据设备编号查找写入命令的连接，为nil时不订阅命令主题
+		Find func(id string) (io.Writer, error)
+
+		// 将命令消息转换为写入设备的报文，为nil时直接写入消息内容
+		DecodeCommand func(id string, payload []byte) ([]byte, error)
+	}
+
+	// Status 在线状态消息
+	Status struct {
+		ID          string     `json:"id"`
+		Online      bool       `json:"online"`
+		Remote      string     `json:"remote,omitempty"`
+		ConnectedAt *time.Time `json:"connected_at,omitempty"`
+		OfflineAt   *time.Time `json:"offline_at,omitempty"`
+	}
+)
+
+func New(c *Client) *Bridge {
+	return &Bridge{Client: c, QoS: 1}
+}
+
+func topicOf(template, fallback, id string) string {
+	if template == "" {
+		template = fallback
+	}
+	return strings.Replace(template, "{id}", id, -1)
+}
+
+// Start 订阅命令主题并在后台连接broker
+func (b *Bridge) Start() error {
+	if b.Find != nil {
+		template := b.CommandTopic
+		if template == "" {
+			template = defaultCommandTopic
+		}
+		filter := strings.Replace(template, "{id}", "+", -1)
+		if err := b.Client.Subscribe(filter, b.QoS, func(topic string, payload []byte) {
+			b.command(template, topic, payload)
+		}); err != nil {
+			return err
+		}
+	}
+	b.Client.Start()
+	return nil
+}
+
+// 从主题中取出设备编号，写入设备的连接
+func (b *Bridge) command(template, topic string, payload []byte) {
+	levels := strings.Split(template, "/")
+	parts := strings.Split(topic, "/")
+	var id string
+	for i, l := range levels {
+		if l == "{id}" && i < len(parts) {
+			id = parts[i]
+		}
+	}
+	if id == "" {
+		return
+	}
+	w, err := b.Find(id)
+	if err != nil {
+		log.Printf("failed to find connection for command %v,reason: %v\n", topic, err)
+		return
+	}
+	if b.DecodeCommand != nil {
+		if payload, err = b.DecodeCommand(id, payload); err != nil {
+			log.Printf("failed to decode command %v,reason: %v\n", topic, err)
+			return
+		}
+	}
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("failed to write command to %v,reason: %v\n", id, err)
+	}
+}
+
+// Publish 发布设备数据，v为[]byte时直接发布，否则编码为JSON，例如modbus.Registers.Decode得到的map[string]interface{}
+func (b *Bridge) Publish(id string, v interface{}) error {
+	payload, ok := v.([]byte)
+	if !ok {
+		var err error
+		if payload, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	return b.Client.Publish(topicOf(b.TelemetryTopic, defaultTelemetryTopic, id), b.QoS, false, payload)
+}
+
+// Presence 返回可以作为presence.Tracker.OnChange的函数，以保留消息发布设备的在线状态
+func (b *Bridge) Presence() func(d presence.Device) {
+	return func(d presence.Device) {
+		s := Status{ID: d.ID, Online: d.Online, Remote: d.Remote}
+		if !d.ConnectedAt.IsZero() {
+			s.ConnectedAt = &d.ConnectedAt
+		}
+		if !d.OfflineAt.IsZero() {
+			s.OfflineAt = &d.OfflineAt
+		}
+		payload, _ := json.Marshal(s)
+		if err := b.Client.Publish(topicOf(b.StatusTopic, defaultStatusTopic, d.ID), b.QoS, true, payload); err != nil {
+			log.Printf("failed to publish status of %v,reason: %v\n", d.ID, err)
+		}
+	}
+}
+
+// Modbus 返回以srv.FindConn查找连接的函数，可以作为Bridge.Find
+func Modbus(srv *modbus.Server) func(id string) (io.Writer, error) {
+	return func(id string) (io.Writer, error) {
+		return srv.FindConn(id)
+	}
+}
+
+// NB 返回以srv.FindConn查找连接的函数，可以作为Bridge.Find
+func NB(srv *nb.Server) func(id string) (io.Writer, error) {
+	return func(id string) (io.Writer, error) {
+		return srv.FindConn(id)
+	}
+}
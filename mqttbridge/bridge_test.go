@@ -0,0 +1,141 @@
+package mqttbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/mqttbridge/brokertest"
+	"github.com/ricnsmart/iot-protocol/presence"
+)
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_OfflineBuffer(t *testing.T) {
+	broker, err := brokertest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := broker.Addr()
+	c := NewClient(addr, "bridge")
+	c.MaxReconnectDelay = 50 * time.Millisecond
+	c.Start()
+	defer c.Close()
+	waitUntil(t, c.Connected)
+
+	if err := c.Publish("devices/1/telemetry", 1, false, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if got := broker.Wait("devices/#", 1, time.Second); len(got) != 1 {
+		t.Fatalf("got %d messages", len(got))
+	}
+	waitUntil(t, func() bool { return c.Pending() == 0 })
+
+	broker.Close()
+	waitUntil(t, func() bool { return !c.Connected() })
+	for _, v := range []string{"2", "3", "4"} {
+		if err := c.Publish("devices/1/telemetry", 1, false, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Publish("devices/1/telemetry", 0, false, []byte("lost")); err != NotConnected {
+		t.Fatalf("err = %v, want NotConnected", err)
+	}
+	if c.Pending() != 3 {
+		t.Fatalf("Pending() = %d", c.Pending())
+	}
+
+	broker, err = brokertest.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	got := broker.Wait("devices/#", 3, 3*time.Second)
+	if len(got) != 3 {
+		t.Fatalf("got %d messages after reconnect", len(got))
+	}
+	for i, v := range []string{"2", "3", "4"} {
+		if string(got[i].Payload) != v || got[i].QoS != 1 {
+			t.Errorf("message %d = %+v", i, got[i])
+		}
+	}
+	waitUntil(t, func() bool { return c.Pending() == 0 })
+}
+
+type device struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (d *device) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.buf.Write(b)
+}
+
+func (d *device) written() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byte(nil), d.buf.Bytes()...)
+}
+
+func TestBridge(t *testing.T) {
+	broker, err := brokertest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	dev := &device{}
+	b := New(NewClient(broker.Addr(), "bridge"))
+	b.Find = func(id string) (io.Writer, error) {
+		if id != "meter-1" {
+			t.Errorf("command for %v", id)
+		}
+		return dev, nil
+	}
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Client.Close()
+	if !broker.WaitSubscribed("devices/+/commands", 3*time.Second) {
+		t.Fatal("command topic not subscribed")
+	}
+
+	if err := b.Publish("meter-1", map[string]interface{}{"voltage": 220.5}); err != nil {
+		t.Fatal(err)
+	}
+	got := broker.Wait("devices/meter-1/telemetry", 1, time.Second)
+	if len(got) != 1 {
+		t.Fatal("telemetry not published")
+	}
+	var values map[string]float64
+	if err := json.Unmarshal(got[0].Payload, &values); err != nil || values["voltage"] != 220.5 {
+		t.Errorf("telemetry = %s, %v", got[0].Payload, err)
+	}
+
+	b.Presence()(presence.Device{ID: "meter-1", Online: true, Remote: "10.0.0.1:5000", ConnectedAt: time.Now()})
+	got = broker.Wait("devices/meter-1/status", 1, time.Second)
+	if len(got) != 1 || !got[0].Retain {
+		t.Fatalf("status = %+v", got)
+	}
+	var status Status
+	if err := json.Unmarshal(got[0].Payload, &status); err != nil || !status.Online || status.ConnectedAt == nil {
+		t.Errorf("status = %s, %v", got[0].Payload, err)
+	}
+
+	broker.Publish("devices/meter-1/commands", []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01})
+	waitUntil(t, func() bool { return len(dev.written()) == 6 })
+}
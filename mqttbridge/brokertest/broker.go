@@ -0,0 +1,251 @@
+// Package brokertest 提供测试用的MQTT 3.1.1 broker，支持QoS 0/1的发布和订阅，记录收到的所有消息
+package brokertest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/mqtt"
+)
+
+type (
+	// Message broker收到的消息
+	Message struct {
+		ClientID string
+		Topic    string
+		Payload  []byte
+		QoS      byte
+		Retain   bool
+		Dup      bool
+	}
+
+	Broker struct {
+		l net.Listener
+
+		mu       sync.Mutex
+		cond     *sync.Cond
+		clients  map[*client]bool
+		messages []Message
+		closed   bool
+	}
+
+	client struct {
+		id   string
+		conn net.Conn
+		mu   sync.Mutex
+		subs []mqtt.Subscription
+	}
+)
+
+// New 在127.0.0.1的随机端口上启动broker
+func New() (*Broker, error) {
+	return Listen("127.0.0.1:0")
+}
+
+// Listen 在address上启动broker，可以用于在同一地址上重启broker
+func Listen(address string) (*Broker, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{l: l, clients: make(map[*client]bool)}
+	b.cond = sync.NewCond(&b.mu)
+	go b.serve()
+	return b, nil
+}
+
+func (b *Broker) Addr() string {
+	return b.l.Addr().String()
+}
+
+// Close 关闭监听和所有连接
+func (b *Broker) Close() {
+	b.l.Close()
+	b.mu.Lock()
+	b.closed = true
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := mqtt.ReadPacket(r, 0)
+	if err != nil {
+		return
+	}
+	connect, ok := p.(*mqtt.Connect)
+	if !ok {
+		return
+	}
+	c := &client{id: connect.ClientID, conn: conn}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.clients[c] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}()
+	c.write(&mqtt.ConnAck{ReturnCode: mqtt.Accepted})
+	for {
+		p, err := mqtt.ReadPacket(r, 0)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *mqtt.Publish:
+			if p.QoS > 0 {
+				c.write(&mqtt.PubAck{ID: p.ID})
+			}
+			b.record(Message{ClientID: c.id, Topic: p.Topic, Payload: p.Payload, QoS: p.QoS, Retain: p.Retain, Dup: p.Dup})
+			b.forward(p.Topic, p.Payload, p.QoS)
+		case *mqtt.Subscribe:
+			codes := make([]byte, len(p.Subscriptions))
+			for i, s := range p.Subscriptions {
+				codes[i] = s.QoS
+			}
+			c.mu.Lock()
+			c.subs = append(c.subs, p.Subscriptions...)
+			c.mu.Unlock()
+			c.write(&mqtt.SubAck{ID: p.ID, Codes: codes})
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case *mqtt.PingReq:
+			c.write(&mqtt.PingResp{})
+		case *mqtt.Disconnect:
+			return
+		}
+	}
+}
+
+func (c *client) write(p mqtt.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mqtt.WritePacket(c.conn, p)
+}
+
+func (b *Broker) record(m Message) {
+	b.mu.Lock()
+	b.messages = append(b.messages, m)
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// 转发给订阅者，不等待确认
+func (b *Broker) forward(topic string, payload []byte, qos byte) {
+	b.mu.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		granted := -1
+		for _, s := range c.subs {
+			if mqtt.Match(s.Filter, topic) && int(s.QoS) > granted {
+				granted = int(s.QoS)
+			}
+		}
+		c.mu.Unlock()
+		if granted < 0 {
+			continue
+		}
+		p := &mqtt.Publish{Topic: topic, Payload: payload, QoS: qos}
+		if int(qos) > granted {
+			p.QoS = byte(granted)
+		}
+		if p.QoS > 0 {
+			p.ID = 1
+		}
+		c.write(p)
+	}
+}
+
+// Publish 以broker的身份向订阅者发布消息
+func (b *Broker) Publish(topic string, payload []byte) {
+	b.forward(topic, payload, 1)
+}
+
+// Messages 返回收到的所有消息
+func (b *Broker) Messages() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.messages...)
+}
+
+// Wait 等待收到至少n条匹配filter的消息，超时返回已收到的匹配消息
+func (b *Broker) Wait(filter string, n int, timeout time.Duration) []Message {
+	var matched []Message
+	b.waitFor(timeout, func() bool {
+		matched = matched[:0]
+		for _, m := range b.messages {
+			if mqtt.Match(filter, m.Topic) {
+				matched = append(matched, m)
+			}
+		}
+		return len(matched) >= n
+	})
+	return matched
+}
+
+// WaitSubscribed 等待有客户端订阅filter
+func (b *Broker) WaitSubscribed(filter string, timeout time.Duration) bool {
+	return b.waitFor(timeout, func() bool {
+		for c := range b.clients {
+			c.mu.Lock()
+			subs := c.subs
+			c.mu.Unlock()
+			for _, s := range subs {
+				if s.Filter == filter {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// 在持有b.mu时检查done，直到满足或者超时
+func (b *Broker) waitFor(timeout time.Duration, done func() bool) bool {
+	timer := time.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if done() {
+			return true
+		}
+		if b.closed || !time.Now().Before(deadline) {
+			return false
+		}
+		b.cond.Wait()
+	}
+}
@@ -0,0 +1,437 @@
+package mqttbridge
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/internal/mqtt"
+)
+
+const (
+	defaultKeepAlive         = 60 * time.Second
+	defaultTimeout           = 10 * time.Second
+	defaultBufferSize        = 1000
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+var (
+	// 未连接到broker时发布QoS 0的消息
+	NotConnected = errors.New("mqtt not connected")
+	ClientClosed = errors.New("mqtt client closed")
+	InvalidTopic = errors.New("invalid mqtt topic filter")
+)
+
+// ConnectRefused broker拒绝连接，值为CONNACK的返回码
+type ConnectRefused byte
+
+func (e ConnectRefused) Error() string {
+	return fmt.Sprintf("mqtt connection refused: return code %d", byte(e))
+}
+
+type (
+	// MessageHandler 处理订阅收到的消息
+	MessageHandler func(topic string, payload []byte)
+
+	// Client MQTT 3.1.1客户端，断开后自动重连，重连后重新订阅并按顺序重发未确认和离线期间缓存的QoS 1消息
+	Client struct {
+		// broker的地址，host:port
+		Addr     string
+		ClientID string
+		// 为空时不发送用户名和密码
+		Username string
+		Password string
+
+		// 心跳间隔，默认60秒
+		KeepAlive time.Duration
+
+		// 连接、等待CONNACK和写入的超时，默认10秒
+		Timeout time.Duration
+
+		// 离线缓存和未确认的QoS 1消息的最大数量，默认1000，已满时丢弃最早的消息
+		BufferSize int
+
+		// 重连间隔从1秒开始加倍，最大为MaxReconnectDelay，默认30秒
+		MaxReconnectDelay time.Duration
+
+		// 连接成功时调用
+		OnConnect func()
+
+		// 连接断开时调用
+		OnConnectionLost func(err error)
+
+		// 保护以下字段，写入也在锁内进行，保证消息的顺序
+		mu   sync.Mutex
+		conn net.Conn
+		// 已发送未确认的QoS 1消息，按发送顺序
+		inflight []*mqtt.Publish
+		// 离线期间缓存的QoS 1消息
+		queue  []*mqtt.Publish
+		nextID uint16
+		subs   map[string]subscription
+
+		dropped uint64
+
+		closed    chan struct{}
+		closeOnce sync.Once
+		startOnce sync.Once
+	}
+
+	subscription struct {
+		qos     byte
+		handler MessageHandler
+	}
+)
+
+func NewClient(addr, clientID string) *Client {
+	return &Client{Addr: addr, ClientID: clientID}
+}
+
+func (c *Client) keepAlive() time.Duration {
+	if c.KeepAlive > 0 {
+		return c.KeepAlive
+	}
+	return defaultKeepAlive
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+func (c *Client) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+	return defaultBufferSize
+}
+
+// Start 在后台连接broker，连接失败时按间隔重试
+func (c *Client) Start() {
+	c.startOnce.Do(func() {
+		go c.run()
+	})
+}
+
+func (c *Client) closedCh() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
+}
+
+func (c *Client) run() {
+	closed := c.closedCh()
+	delay := time.Second
+	for {
+		select {
+		case <-closed:
+			return
+		default:
+		}
+		conn, err := c.connect()
+		if err != nil {
+			log.Printf("failed to connect to mqtt broker %v,reason: %v\n", c.Addr, err)
+			select {
+			case <-closed:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > c.maxReconnectDelay() {
+				delay = c.maxReconnectDelay()
+			}
+			continue
+		}
+		delay = time.Second
+		c.online(conn)
+		err = c.serve(conn)
+		c.offline(conn, err)
+	}
+}
+
+func (c *Client) maxReconnectDelay() time.Duration {
+	if c.MaxReconnectDelay > 0 {
+		return c.MaxReconnectDelay
+	}
+	return defaultMaxReconnectDelay
+}
+
+func (c *Client) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+	p := &mqtt.Connect{
+		CleanSession: true,
+		KeepAlive:    uint16(c.keepAlive() / time.Second),
+		ClientID:     c.ClientID,
+	}
+	if c.Username != "" {
+		p.Username = &c.Username
+		p.Password = []byte(c.Password)
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout()))
+	if err := mqtt.WritePacket(conn, p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := mqtt.ReadPacket(bufio.NewReader(conn), 0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, ok := resp.(*mqtt.ConnAck)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%w: expect connack", mqtt.MalformedPacket)
+	}
+	if ack.ReturnCode != mqtt.Accepted {
+		conn.Close()
+		return nil, ConnectRefused(ack.ReturnCode)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// 重新订阅，重发未确认的消息和离线缓存
+func (c *Client) online(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	if len(c.subs) > 0 {
+		sub := &mqtt.Subscribe{ID: c.newID()}
+		for filter, s := range c.subs {
+			sub.Subscriptions = append(sub.Subscriptions, mqtt.Subscription{Filter: filter, QoS: s.qos})
+		}
+		c.write(sub)
+	}
+	for _, p := range c.inflight {
+		p.Dup = true
+		c.write(p)
+	}
+	for _, p := range c.queue {
+		c.write(p)
+		c.inflight = append(c.inflight, p)
+	}
+	c.queue = nil
+	c.mu.Unlock()
+	if c.OnConnect != nil {
+		c.OnConnect()
+	}
+}
+
+func (c *Client) offline(conn net.Conn, err error) {
+	conn.Close()
+	c.mu.Lock()
+	c.conn = nil
+	c.mu.Unlock()
+	select {
+	case <-c.closedCh():
+		return
+	default:
+	}
+	log.Printf("mqtt connection to %v lost,reason: %v\n", c.Addr, err)
+	if c.OnConnectionLost != nil {
+		c.OnConnectionLost(err)
+	}
+}
+
+// 读取broker的报文，并定时发送PINGREQ，超过1.5倍心跳间隔没有收到报文时断开
+func (c *Client) serve(conn net.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.keepAlive())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.mu.Lock()
+				if c.conn == conn {
+					c.write(&mqtt.PingReq{})
+				}
+				c.mu.Unlock()
+			}
+		}
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.keepAlive() * 3 / 2))
+		p, err := mqtt.ReadPacket(r, 0)
+		if err != nil {
+			return err
+		}
+		switch p := p.(type) {
+		case *mqtt.PubAck:
+			c.ack(p.ID)
+		case *mqtt.Publish:
+			if p.QoS > 0 {
+				c.mu.Lock()
+				c.write(&mqtt.PubAck{ID: p.ID})
+				c.mu.Unlock()
+			}
+			c.dispatch(p)
+		case *mqtt.SubAck:
+			for _, code := range p.Codes {
+				if code == mqtt.SubscribeFailure {
+					log.Printf("failed to subscribe on %v,reason: rejected by broker\n", c.Addr)
+				}
+			}
+		}
+	}
+}
+
+// 调用方需持有c.mu，写入失败时关闭连接，由serve返回后重连
+func (c *Client) write(p mqtt.Packet) {
+	if c.conn == nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout()))
+	if err := mqtt.WritePacket(c.conn, p); err != nil {
+		c.conn.Close()
+	}
+}
+
+// 分配报文标识符，跳过0和未确认消息使用的标识符，调用方需持有c.mu
+func (c *Client) newID() uint16 {
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		used := false
+		for _, p := range c.inflight {
+			if p.ID == c.nextID {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return c.nextID
+		}
+	}
+}
+
+func (c *Client) ack(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.inflight {
+		if p.ID == id {
+			c.inflight = append(c.inflight[:i], c.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Client) dispatch(p *mqtt.Publish) {
+	c.mu.Lock()
+	var handlers []MessageHandler
+	for filter, s := range c.subs {
+		if mqtt.Match(filter, p.Topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range handlers {
+		// 处理可能写入设备而阻塞，不能影响心跳和确认的读取
+		go h(p.Topic, p.Payload)
+	}
+}
+
+// Publish 发布消息，qos为0或1。QoS 1的消息在离线时缓存，重连后按顺序发送，直到收到PUBACK；
+// QoS 0的消息在离线时返回NotConnected
+func (c *Client) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if qos > 1 {
+		qos = 1
+	}
+	select {
+	case <-c.closedCh():
+		return ClientClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := &mqtt.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload}
+	if qos == 0 {
+		if c.conn == nil {
+			return NotConnected
+		}
+		c.write(p)
+		return nil
+	}
+	p.ID = c.newID()
+	if len(c.inflight)+len(c.queue) >= c.bufferSize() {
+		// 丢弃最早的消息
+		atomic.AddUint64(&c.dropped, 1)
+		if len(c.queue) > 0 {
+			c.queue = c.queue[1:]
+		} else {
+			c.inflight = c.inflight[1:]
+		}
+	}
+	if c.conn == nil {
+		c.queue = append(c.queue, p)
+		return nil
+	}
+	c.write(p)
+	c.inflight = append(c.inflight, p)
+	return nil
+}
+
+// Subscribe 订阅filter，重连后自动重新订阅
+func (c *Client) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	if !mqtt.ValidFilter(filter) {
+		return fmt.Errorf("%w: %q", InvalidTopic, filter)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[string]subscription)
+	}
+	c.subs[filter] = subscription{qos: qos, handler: handler}
+	c.write(&mqtt.Subscribe{ID: c.newID(), Subscriptions: []mqtt.Subscription{{Filter: filter, QoS: qos}}})
+	return nil
+}
+
+// Connected 是否已连接到broker
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Pending 未确认和离线缓存的QoS 1消息数量
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.inflight) + len(c.queue)
+}
+
+// Dropped 因缓存已满丢弃的消息数量
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Close 断开连接并停止重连
+func (c *Client) Close() {
+	closed := c.closedCh()
+	c.closeOnce.Do(func() {
+		close(closed)
+		c.mu.Lock()
+		c.write(&mqtt.Disconnect{})
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+}
@@ -0,0 +1,89 @@
+package nb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/admission"
+)
+
+func TestServer_ServePanic(t *testing.T) {
+	rwc, peer := net.Pipe()
+	defer peer.Close()
+	s := NewServer()
+	var reported error
+	s.OnError = func(c *Conn, err error) {
+		reported = err
+	}
+	var reason CloseReason
+	s.OnClose = func(c *Conn, r CloseReason) {
+		reason = r
+	}
+	s.Handler = func(c *Conn) {
+		var b []byte
+		_ = b[1]
+	}
+
+	s.serve(s.newConn(rwc))
+	if _, ok := reported.(*PanicError); !ok {
+		t.Fatalf("reported = %v, want *PanicError", reported)
+	}
+	if reason != ClosePanic {
+		t.Fatalf("reason = %v, want %v", reason, ClosePanic)
+	}
+}
+
+func TestServer_Admission(t *testing.T) {
+	s := NewServer()
+	s.Admission = &admission.Policy{
+		MaxConnsPerIP:   1,
+		RegisterTimeout: 200 * time.Millisecond,
+	}
+	s.Handler = func(c *Conn) {
+		for {
+			if _, err := c.Read(); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+	reasons := make(chan CloseReason, 1)
+	s.OnClose = func(c *Conn, r CloseReason) {
+		reasons <- r
+	}
+	go s.StartServer("127.0.0.1:6560")
+	time.Sleep(100 * time.Millisecond)
+
+	first, err := net.Dial("tcp", "127.0.0.1:6560")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// 同一IP的第二个连接超出限制
+	second, _ := net.Dial("tcp", "127.0.0.1:6560")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("second connection should be rejected, err = %v", err)
+	}
+
+	// 第一个连接没有注册
+	select {
+	case r := <-reasons:
+		if r != CloseRegisterTimeout {
+			t.Fatalf("reason = %v, want %v", r, CloseRegisterTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unregistered connection not closed")
+	}
+	if total, _ := s.Admission.Conns("127.0.0.1"); total != 0 {
+		t.Fatalf("conns = %v after close, want 0", total)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,54 @@
+package nb
+
+import "net"
+
+// Direction 报文的方向
+type Direction string
+
+const (
+	// 设备上行
+	Inbound Direction = "in"
+	// 向设备下行
+	Outbound Direction = "out"
+)
+
+func (srv *Server) onStart(addr net.Addr) {
+	if srv.OnStart != nil {
+		srv.OnStart(addr)
+	}
+}
+
+// 返回error时拒绝该连接
+func (srv *Server) onAccept(remote net.Addr) error {
+	if srv.OnAccept != nil {
+		return srv.OnAccept(remote)
+	}
+	return nil
+}
+
+func (srv *Server) onRegister(c *Conn) {
+	if srv.OnRegister != nil {
+		srv.OnRegister(c)
+	}
+}
+
+func (srv *Server) onFrame(c *Conn, dir Direction, frame []byte) {
+	if srv.OnFrame != nil {
+		srv.OnFrame(c, dir, frame)
+	}
+}
+
+func (srv *Server) onError(c *Conn, err error) {
+	if srv.OnError != nil {
+		srv.OnError(c, err)
+	}
+}
+
+func (srv *Server) onClose(c *Conn, reason CloseReason) {
+	if srv.OnClose != nil {
+		srv.OnClose(c, reason)
+	}
+	if srv.AfterConnClose != nil {
+		srv.AfterConnClose(c.id)
+	}
+}
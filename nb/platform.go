@@ -0,0 +1,414 @@
+package nb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 平台推送消息的类型
+type PushType int
+
+const (
+	// 设备数据上报
+	PushDataReport PushType = iota + 1
+	// 设备上线
+	PushOnline
+	// 设备下线
+	PushOffline
+	// 指令下发结果
+	PushCommandResponse
+)
+
+var (
+	NoCommander = errors.New("platform commander not set")
+	// 推送消息的签名或令牌校验失败
+	InvalidSignature = errors.New("invalid push signature")
+)
+
+type (
+	// PushMessage 是物联网平台推送的一条消息
+	PushMessage struct {
+		Type     PushType
+		DeviceID string
+		// 平台记录的消息时间
+		Timestamp time.Time
+		// 设备上报的原始报文，仅PushDataReport有效
+		Payload []byte
+		// 指令编号和执行结果，仅PushCommandResponse有效
+		CommandID string
+		Result    string
+	}
+
+	// PushDecoder 将平台推送的HTTP请求体解析为消息，一次推送可能包含多条消息
+	PushDecoder func(body []byte) ([]*PushMessage, error)
+
+	// Commander 通过平台向设备下发指令
+	Commander interface {
+		SendCommand(deviceID string, payload []byte) error
+	}
+
+	// Platform 接收物联网平台（CTWing、OneNET等）以HTTP推送的消息，
+	// 并按设备编号转换为Server的会话：数据上报由Handler通过Conn.Read读取，
+	// 设备下线时Conn.Read返回io.EOF，Conn.Write则通过Commander下发指令
+	Platform struct {
+		server *Server
+
+		// 解析推送消息，默认为DecodeCTWing
+		Decode PushDecoder
+
+		// 下发指令
+		Commander Commander
+
+		// 处理指令下发结果
+		OnCommandResponse func(m *PushMessage)
+
+		// 校验推送的签名或令牌，返回error时以401拒绝。为nil时不校验，
+		// 任何能访问该地址的人都可以伪造设备数据或者以下线事件关闭会话。
+		// 验证推送地址的GET请求同样经过Verify，body为nil，为nil时拒绝GET请求
+		Verify func(r *http.Request, body []byte) error
+	}
+
+	// HTTPCommander 以JSON的形式调用平台的指令下发接口：
+	// {"deviceId":"...","payload":"base64"}
+	HTTPCommander struct {
+		URL    string
+		Header http.Header
+		Client *http.Client
+	}
+
+	// 平台会话的地址
+	platformAddr string
+)
+
+func (a platformAddr) Network() string { return "http" }
+func (a platformAddr) String() string  { return string(a) }
+
+// NewPlatform 创建接收平台推送的http.Handler
+func (srv *Server) NewPlatform(commander Commander) *Platform {
+	return &Platform{
+		server:    srv,
+		Decode:    DecodeCTWing,
+		Commander: commander,
+	}
+}
+
+func (p *Platform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// OneNET在配置推送地址时以GET请求验证，校验通过后以纯文本原样返回msg参数。
+	// 未设置Verify时拒绝，避免任意内容被原样返回
+	if r.Method == http.MethodGet {
+		if p.Verify == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := p.Verify(r, nil); err != nil {
+			log.Printf("failed to verify url from %v,reason: %v\n", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.WriteString(w, r.URL.Query().Get("msg"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if p.server.debug {
+		log.Printf("push:%s\n", body)
+	}
+	if p.Verify != nil {
+		if err := p.Verify(r, body); err != nil {
+			log.Printf("failed to verify push from %v,reason: %v\n", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	msgs, err := p.Decode(body)
+	if err != nil {
+		log.Printf("failed to decode push from %v,reason: %v\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dropped := false
+	for _, m := range msgs {
+		if !p.dispatch(m, r.RemoteAddr) {
+			dropped = true
+		}
+	}
+	if dropped {
+		// 让平台稍后重试，同一次推送中已投递的消息可能会重复
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// 分发一条消息，数据上报因会话缓存已满或者会话被拒绝而丢弃时返回false
+func (p *Platform) dispatch(m *PushMessage, remote string) bool {
+	if m.DeviceID == "" {
+		return true
+	}
+	switch m.Type {
+	case PushDataReport:
+		s := p.session(m.DeviceID)
+		if s == nil {
+			return false
+		}
+		if !s.deliver(m.Payload, s.RemoteAddr()) {
+			log.Printf("session %v is busy, drop push from %v\n", m.DeviceID, remote)
+			return false
+		}
+	case PushOnline:
+		p.session(m.DeviceID)
+	case PushOffline:
+		if s, ok := p.server.findSession(m.DeviceID); ok {
+			s.Close()
+		}
+	case PushCommandResponse:
+		if p.OnCommandResponse != nil {
+			p.OnCommandResponse(m)
+		}
+	}
+	return true
+}
+
+// VerifyToken 校验请求头header中的令牌与token一致，适用于在推送地址上配置了固定令牌的平台
+func VerifyToken(header, token string) func(r *http.Request, body []byte) error {
+	return func(r *http.Request, body []byte) error {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(header)), []byte(token)) != 1 {
+			return InvalidSignature
+		}
+		return nil
+	}
+}
+
+// VerifyOneNET 按OneNET的规则校验推送的签名：msg_signature = Base64(MD5(token + nonce + msg))，
+// 其中msg为请求体中msg字段的原始JSON。
+// 验证推送地址的GET请求以查询参数msg、nonce和signature按同样的规则校验
+func VerifyOneNET(token string) func(r *http.Request, body []byte) error {
+	return func(r *http.Request, body []byte) error {
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			return verifyOneNET(token, q.Get("nonce"), []byte(q.Get("msg")), q.Get("signature"))
+		}
+		var v struct {
+			Msg       json.RawMessage `json:"msg"`
+			Nonce     string          `json:"nonce"`
+			Signature string          `json:"msg_signature"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return err
+		}
+		return verifyOneNET(token, v.Nonce, v.Msg, v.Signature)
+	}
+}
+
+func verifyOneNET(token, nonce string, msg []byte, signature string) error {
+	sum := md5.Sum(append([]byte(token+nonce), msg...))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(want)) != 1 {
+		return InvalidSignature
+	}
+	return nil
+}
+
+// 获取设备的平台会话，不存在时创建。
+// 同一平台的推送都来自相同的IP，因此会话的地址为platform/设备编号，
+// Admission的单IP连接数限制和ErrorBudget的封禁都只作用于该设备
+func (p *Platform) session(id string) *session {
+	return p.server.loadSession(id, func() *session {
+		s := newSession(platformAddr("platform"), platformAddr("platform/"+id))
+		s.write = func(s *session, b []byte) (int, error) {
+			if p.Commander == nil {
+				return 0, NoCommander
+			}
+			if err := p.Commander.SendCommand(id, b); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		return s
+	})
+}
+
+func (c *HTTPCommander) SendCommand(deviceID string, payload []byte) error {
+	body, err := json.Marshal(map[string]string{
+		"deviceId": deviceID,
+		"payload":  base64.StdEncoding.EncodeToString(payload),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to send command to %v, status: %v, body: %s", deviceID, resp.Status, b)
+	}
+	return nil
+}
+
+// DecodeCTWing 解析CTWing（天翼物联）风格的推送消息
+func DecodeCTWing(body []byte) ([]*PushMessage, error) {
+	var v struct {
+		MessageType string          `json:"messageType"`
+		DeviceID    string          `json:"deviceId"`
+		Timestamp   int64           `json:"timestamp"`
+		EventType   int             `json:"eventType"`
+		TaskID      json.RawMessage `json:"taskId"`
+		Payload     struct {
+			APPdata string `json:"APPdata"`
+		} `json:"payload"`
+		Result struct {
+			ResultCode string `json:"resultCode"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	m := &PushMessage{
+		DeviceID:  v.DeviceID,
+		Timestamp: msToTime(v.Timestamp),
+	}
+	switch v.MessageType {
+	case "dataReport":
+		payload, err := base64.StdEncoding.DecodeString(v.Payload.APPdata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid APPdata: %v", err)
+		}
+		m.Type = PushDataReport
+		m.Payload = payload
+	case "deviceOnlineOfflineReport":
+		if v.EventType == 1 {
+			m.Type = PushOnline
+		} else {
+			m.Type = PushOffline
+		}
+	case "commandResponse":
+		m.Type = PushCommandResponse
+		m.CommandID = rawString(v.TaskID)
+		m.Result = v.Result.ResultCode
+	default:
+		// 其他类型的消息直接忽略
+		return nil, nil
+	}
+	return []*PushMessage{m}, nil
+}
+
+// DecodeOneNET 解析OneNET风格的推送消息，msg可能是单条消息或者消息数组
+func DecodeOneNET(body []byte) ([]*PushMessage, error) {
+	var v struct {
+		Msg json.RawMessage `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	type item struct {
+		Type   int             `json:"type"`
+		DevID  json.RawMessage `json:"dev_id"`
+		At     int64           `json:"at"`
+		Value  json.RawMessage `json:"value"`
+		Status int             `json:"status"`
+		CmdID  string          `json:"cmd_id"`
+		Result json.RawMessage `json:"send_status"`
+	}
+	var items []item
+	if len(v.Msg) > 0 && v.Msg[0] == '[' {
+		if err := json.Unmarshal(v.Msg, &items); err != nil {
+			return nil, err
+		}
+	} else {
+		var it item
+		if err := json.Unmarshal(v.Msg, &it); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+
+	msgs := make([]*PushMessage, 0, len(items))
+	for _, it := range items {
+		m := &PushMessage{
+			DeviceID:  rawString(it.DevID),
+			Timestamp: msToTime(it.At),
+		}
+		switch it.Type {
+		case 1:
+			m.Type = PushDataReport
+			m.Payload = oneNETValue(rawString(it.Value))
+		case 2:
+			if it.Status == 1 {
+				m.Type = PushOnline
+			} else {
+				m.Type = PushOffline
+			}
+		case 7:
+			m.Type = PushCommandResponse
+			m.CommandID = it.CmdID
+			m.Result = rawString(it.Result)
+		default:
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// OneNET透传的数据一般为十六进制字符串，无法按十六进制解析时原样返回
+func oneNETValue(v string) []byte {
+	if b, err := hex.DecodeString(v); err == nil {
+		return b
+	}
+	return []byte(v)
+}
+
+// 平台的编号可能是数字也可能是字符串
+func rawString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return string(raw)
+}
+
+func msToTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,226 @@
+package nb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/admission"
+)
+
+func TestPlatform_ServeHTTP(t *testing.T) {
+	// 模拟平台的指令下发接口
+	commands := make(chan map[string]string, 1)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		m := make(map[string]string)
+		json.Unmarshal(b, &m)
+		commands <- m
+	}))
+	defer stub.Close()
+
+	s := NewServer()
+	reports := make(chan []byte, 1)
+	s.Handler = func(c *Conn) {
+		for {
+			buf, err := c.Read()
+			if err != nil {
+				c.Close()
+				return
+			}
+			reports <- buf
+			c.Write([]byte{0x01})
+		}
+	}
+	closed := make(chan string, 1)
+	s.AfterConnClose = func(id string) {
+		closed <- id
+	}
+	p := s.NewPlatform(&HTTPCommander{URL: stub.URL})
+	responses := make(chan *PushMessage, 1)
+	p.OnCommandResponse = func(m *PushMessage) {
+		responses <- m
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	push := func(body string) {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("push status = %v", resp.Status)
+		}
+	}
+
+	// 未设置Verify时不回显验证请求
+	if resp, err := http.Get(srv.URL + "?msg=check"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("url verification without Verify = %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	payload := []byte{0x68, 0x01, 0x02}
+	push(`{"messageType":"dataReport","deviceId":"imei1","timestamp":1600000000000,"payload":{"APPdata":"` +
+		base64.StdEncoding.EncodeToString(payload) + `"}}`)
+
+	select {
+	case got := <-reports:
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("report = % x, want % x", got, payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("report not received")
+	}
+	select {
+	case m := <-commands:
+		if m["deviceId"] != "imei1" || m["payload"] != "AQ==" {
+			t.Fatalf("command = %v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("command not sent")
+	}
+	if _, err := s.FindConn("imei1"); err != nil {
+		t.Fatal(err)
+	}
+
+	push(`{"messageType":"commandResponse","deviceId":"imei1","taskId":7,"result":{"resultCode":"SUCCESSFUL"}}`)
+	if m := <-responses; m.CommandID != "7" || m.Result != "SUCCESSFUL" {
+		t.Fatalf("command response = %+v", m)
+	}
+
+	push(`{"messageType":"deviceOnlineOfflineReport","deviceId":"imei1","eventType":0}`)
+	select {
+	case id := <-closed:
+		if id != "imei1" {
+			t.Fatalf("closed id = %v, want imei1", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("conn not closed")
+	}
+}
+
+func TestDecodeOneNET(t *testing.T) {
+	msgs, err := DecodeOneNET([]byte(`{"msg":[{"type":1,"dev_id":1001,"at":1600000000000,"value":"6801"},{"type":2,"dev_id":1001,"status":0}],"nonce":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("len = %v, want 2", len(msgs))
+	}
+	if msgs[0].Type != PushDataReport || msgs[0].DeviceID != "1001" || !bytes.Equal(msgs[0].Payload, []byte{0x68, 0x01}) {
+		t.Fatalf("data report = %+v", msgs[0])
+	}
+	if msgs[1].Type != PushOffline {
+		t.Fatalf("type = %v, want PushOffline", msgs[1].Type)
+	}
+}
+
+func TestPlatform_VerifyAndBacklog(t *testing.T) {
+	s := NewServer()
+	block := make(chan struct{})
+	defer close(block)
+	s.Handler = func(c *Conn) {
+		<-block
+	}
+	p := s.NewPlatform(nil)
+	p.Decode = DecodeOneNET
+	p.Verify = VerifyOneNET("token")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	push := func(msg, signature string) int {
+		body := `{"msg":` + msg + `,"nonce":"abc","msg_signature":"` + signature + `"}`
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	sign := func(msg string) string {
+		sum := md5.Sum([]byte("token" + "abc" + msg))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	// 验证推送地址：签名正确时以纯文本返回msg
+	get := func(msg, signature string) (int, string, http.Header) {
+		q := url.Values{"msg": {msg}, "nonce": {"abc"}, "signature": {signature}}
+		resp, err := http.Get(srv.URL + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), resp.Header
+	}
+	xss := "<script>alert(1)</script>"
+	if code, body, _ := get(xss, "forged"); code != http.StatusUnauthorized || body != "" {
+		t.Fatalf("forged url verification = %v %q", code, body)
+	}
+	code, body, header := get("check", sign("check"))
+	if code != http.StatusOK || body != "check" ||
+		header.Get("Content-Type") != "text/plain; charset=utf-8" || header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("url verification = %v %q %v", code, body, header)
+	}
+
+	msg := `{"type":1,"dev_id":1001,"value":"6801"}`
+	if code := push(msg, "forged"); code != http.StatusUnauthorized {
+		t.Fatalf("forged push status = %v", code)
+	}
+	if _, err := s.FindConn("1001"); err != DeviceOffline {
+		t.Fatalf("forged push created session, err = %v", err)
+	}
+	// Handler不读取，缓存满之后平台需要重试
+	for i := 0; i < sessionBacklog; i++ {
+		if code := push(msg, sign(msg)); code != http.StatusOK {
+			t.Fatalf("push %d status = %v", i, code)
+		}
+	}
+	if code := push(msg, sign(msg)); code != http.StatusServiceUnavailable {
+		t.Fatalf("push with full backlog status = %v", code)
+	}
+}
+
+func TestPlatform_SessionPerDevice(t *testing.T) {
+	s := NewServer()
+	s.Admission = &admission.Policy{MaxConnsPerIP: 1}
+	block := make(chan struct{})
+	defer close(block)
+	s.Handler = func(c *Conn) {
+		<-block
+	}
+	p := s.NewPlatform(nil)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// 同一平台推送的多个设备不受单IP连接数的限制
+	for _, id := range []string{"imei1", "imei2"} {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(
+			`{"messageType":"dataReport","deviceId":"`+id+`","payload":{"APPdata":"AQ=="}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("push %v status = %v", id, resp.Status)
+		}
+		c, err := s.FindConn(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.RemoteAddr() != "platform/"+id {
+			t.Fatalf("remote = %v", c.RemoteAddr())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package nb
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// session 是以设备编号而非socket区分的虚拟连接，实现了net.Conn，
+// 使UDP等无连接的传输方式可以复用Conn的读写逻辑
+type session struct {
+	// 上行报文
+	in chan []byte
+
+	done chan struct{}
+	once sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	local        net.Addr
+	// 设备最后一次上行的地址
+	remote net.Addr
+	// 设备最后一次上行的时间
+	lastSeen time.Time
+
+	// 下行报文的实际发送方式
+	write func(s *session, b []byte) (int, error)
+
+	// 会话关闭时调用
+	onClose func()
+}
+
+// 获取设备的会话，不存在时以create创建新的会话，并以设备编号为ID启动Handler。
+// 新会话被拒绝时返回nil。
+// 会话不经过Authenticator，UDP报文和平台推送分别由Server.VerifyPacket和Platform.Verify校验，
+// 未设置时这两种传输方式没有任何认证；未认证的会话同样不能替换已认证的TCP连接
+func (srv *Server) loadSession(id string, create func() *session) *session {
+	srv.sessionsMu.Lock()
+	if s, ok := srv.sessions[id]; ok {
+		srv.sessionsMu.Unlock()
+		return s
+	}
+	s := create()
+	release, err := srv.admit(s.RemoteAddr())
+	if err != nil {
+		srv.sessionsMu.Unlock()
+		log.Printf("reject session %v from %v,reason: %v\n", id, s.RemoteAddr(), err)
+		return nil
+	}
+	s.onClose = func() {
+		srv.sessionsMu.Lock()
+		if srv.sessions[id] == s {
+			delete(srv.sessions, id)
+		}
+		srv.sessionsMu.Unlock()
+	}
+	if srv.sessions == nil {
+		srv.sessions = make(map[string]*session)
+	}
+	srv.sessions[id] = s
+	srv.sessionsMu.Unlock()
+
+	c := srv.newConn(s)
+	c.release = release
+	// 先设置编号再加入activeConn，避免与FindConn产生竞争
+	c.SetID(id)
+	if c.ShuttingDown() {
+		// 该编号已被通过认证的连接使用
+		return nil
+	}
+	srv.activeConn.Store(c, true)
+	go srv.serve(c)
+	return s
+}
+
+// 查找设备的会话
+func (srv *Server) findSession(id string) (*session, bool) {
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+	s, ok := srv.sessions[id]
+	return s, ok
+}
+
+// 每个会话最多缓存的上行报文数量
+const sessionBacklog = 16
+
+func newSession(local, remote net.Addr) *session {
+	return &session{
+		in:       make(chan []byte, sessionBacklog),
+		done:     make(chan struct{}),
+		local:    local,
+		remote:   remote,
+		lastSeen: time.Now(),
+	}
+}
+
+// 投递一个上行报文，会话已关闭或者缓存已满时返回false。
+// 只有报文进入缓存之后才更新设备的地址，被丢弃的报文不会改变下行的目的地址
+func (s *session) deliver(packet []byte, from net.Addr) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.in <- packet:
+		s.remote = from
+		s.lastSeen = time.Now()
+		return true
+	default:
+		return false
+	}
+}
+
+// 获取设备最后一次上行的地址和时间
+func (s *session) peer() (net.Addr, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote, s.lastSeen
+}
+
+func (s *session) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	deadline := s.readDeadline
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p := <-s.in:
+		return copy(b, p), nil
+	case <-s.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (s *session) Write(b []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return s.write(s, b)
+}
+
+func (s *session) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return nil
+}
+
+func (s *session) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	addr, _ := s.peer()
+	return addr
+}
+
+func (s *session) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *session) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+// 下行报文由具体的传输方式负责超时，这里无需处理
+func (s *session) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// timeoutError 实现了net.Error，使调用方可以和TCP一样判断读取超时
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,74 @@
+package nb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// StartTLS 监听TCP端口并以TLS加密，
+// config.ClientAuth为tls.RequireAndVerifyClientCert时即为双向认证
+func (srv *Server) StartTLS(address string, config *tls.Config) error {
+	l, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	return srv.Serve(l)
+}
+
+// TLS连接在读取之前完成握手，并根据客户端证书设置设备编号
+func (c *Conn) handshake() error {
+	tc, ok := c.rwc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(c.server.Timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	c.cert = certs[0]
+	if c.server.CertID != nil {
+		if id := c.server.CertID(c.cert); id != "" {
+			// 证书经过了校验即视为以证书中的编号通过认证
+			if len(tc.ConnectionState().VerifiedChains) > 0 {
+				c.authID.Store(id)
+			}
+			c.SetID(id)
+		}
+	}
+	return nil
+}
+
+// PeerCertificate 获取TLS连接的客户端证书，非TLS连接或者客户端未提供证书时返回nil
+func (c *Conn) PeerCertificate() *x509.Certificate {
+	return c.cert
+}
+
+// CertCommonName 以证书的CN作为设备编号，可用作Server.CertID
+func CertCommonName(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// CertIdentity 优先以证书的CN作为设备编号，CN为空时依次使用SAN中的DNS名称、URI和邮箱，可用作Server.CertID
+func CertIdentity(cert *x509.Certificate) string {
+	if cn := cert.Subject.CommonName; cn != "" {
+		return cn
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package nb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// StartUDPServer 监听UDP端口，以PacketID从报文中解析出的设备编号区分会话。
+// 每个设备对应一个Conn，Handler、SetID、FindConn以及AfterConnClose的用法与TCP一致，
+// 下行报文发往设备最后一次上行的地址，并且只能在上行之后的ResponseWindow内发送
+func (srv *Server) StartUDPServer(address string) error {
+	if srv.PacketID == nil {
+		return errors.New("PacketID is required by udp server")
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf(`failed to listen port %v , reason: %v`, address, err)
+	}
+	defer pc.Close()
+	srv.onStart(pc.LocalAddr())
+	var tempDelay time.Duration // how long to sleep on read failure
+	for {
+		buf := make([]byte, srv.MaxBytes)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			srv.onError(nil, err)
+			return err
+		}
+		tempDelay = 0
+		packet := buf[:n]
+		id, err := srv.PacketID(packet)
+		if err != nil || id == "" {
+			log.Printf("failed to parse device id from %v,reason: %v\n", addr, err)
+			continue
+		}
+		if srv.VerifyPacket != nil {
+			if err := srv.VerifyPacket(id, packet); err != nil {
+				log.Printf("failed to verify packet of %v from %v,reason: %v\n", id, addr, err)
+				continue
+			}
+		}
+		s := srv.udpSession(pc, id, addr)
+		if s == nil {
+			continue
+		}
+		if !s.deliver(packet, addr) {
+			log.Printf("session %v is busy, drop packet from %v\n", id, addr)
+		}
+	}
+}
+
+// 获取设备的UDP会话，不存在时创建新的会话
+func (srv *Server) udpSession(pc net.PacketConn, id string, addr net.Addr) *session {
+	return srv.loadSession(id, func() *session {
+		s := newSession(pc.LocalAddr(), addr)
+		s.write = func(s *session, b []byte) (int, error) {
+			remote, lastSeen := s.peer()
+			if time.Since(lastSeen) > srv.ResponseWindow {
+				return 0, ResponseWindowClosed
+			}
+			return pc.WriteTo(b, remote)
+		}
+		return s
+	})
+}
@@ -0,0 +1,142 @@
+package nb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_StartUDPServer(t *testing.T) {
+	s := NewServer()
+	s.ResponseWindow = 2 * time.Second
+	s.PacketID = func(packet []byte) (string, error) {
+		return string(packet[:4]), nil
+	}
+	closed := make(chan string, 1)
+	s.AfterConnClose = func(id string) {
+		closed <- id
+	}
+	s.Handler = func(c *Conn) {
+		for {
+			buf, err := c.Read()
+			if err != nil {
+				c.Close()
+				return
+			}
+			c.Write(buf)
+		}
+	}
+
+	go s.StartUDPServer("127.0.0.1:6510")
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := net.Dial("udp", "127.0.0.1:6510")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := []byte("dev1hello")
+	if _, err := client.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], packet) {
+		t.Fatalf("echo = %q, want %q", buf[:n], packet)
+	}
+
+	c, err := s.FindConn("dev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr() != client.LocalAddr().String() {
+		t.Fatalf("remote addr = %v, want %v", c.RemoteAddr(), client.LocalAddr())
+	}
+
+	// 超出下行窗口之后无法再下行
+	time.Sleep(s.ResponseWindow)
+	if _, err := c.Write([]byte("late")); err != ResponseWindowClosed {
+		t.Fatalf("write after window err = %v, want %v", err, ResponseWindowClosed)
+	}
+
+	c.Close()
+	if id := <-closed; id != "dev1" {
+		t.Fatalf("closed id = %v, want dev1", id)
+	}
+	if _, err := s.FindConn("dev1"); err != DeviceOffline {
+		t.Fatalf("FindConn after close err = %v, want %v", err, DeviceOffline)
+	}
+}
+
+func TestServer_VerifyPacket(t *testing.T) {
+	s := NewServer()
+	s.PacketID = func(packet []byte) (string, error) {
+		return string(packet[:4]), nil
+	}
+	s.VerifyPacket = func(id string, packet []byte) error {
+		if !bytes.HasSuffix(packet, []byte("#ok")) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	received := make(chan []byte, 4)
+	s.Handler = func(c *Conn) {
+		for {
+			buf, err := c.Read()
+			if err != nil {
+				c.Close()
+				return
+			}
+			received <- buf
+		}
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	go s.StartUDPServer(addr)
+	time.Sleep(100 * time.Millisecond)
+
+	device, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	attacker, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	device.Write([]byte("dev2data#ok"))
+	select {
+	case <-received:
+	case <-time.After(3 * time.Second):
+		t.Fatal("packet not delivered")
+	}
+	// 伪造的报文被丢弃，下行地址不变
+	attacker.Write([]byte("dev2spoof"))
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case buf := <-received:
+		t.Fatalf("spoofed packet delivered: %q", buf)
+	default:
+	}
+	c, err := s.FindConn("dev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr() != device.LocalAddr().String() {
+		t.Fatalf("remote addr = %v, want %v", c.RemoteAddr(), device.LocalAddr())
+	}
+	c.Close()
+}
@@ -0,0 +1,218 @@
+// Package outbox 为每个连接提供带优先级的写入队列，使遥控等操作命令可以越过定时轮询优先写入
+package outbox
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Priority 写入的优先级，数值越大越优先
+type Priority int
+
+const (
+	Low Priority = iota
+	Normal
+	High
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	}
+	return strconv.Itoa(int(p))
+}
+
+var (
+	// 排队数量已达到MaxDepth
+	Full = errors.New("outbox full")
+	// 队列已关闭
+	Closed = errors.New("outbox closed")
+)
+
+type (
+	// Queue 同一时间只允许一个写入方持有，其余写入方按优先级排队，同一优先级先到先得
+	Queue struct {
+		// 最大排队数量，为0时不限制
+		MaxDepth int
+
+		// 每次获得写入机会时调用，wait为排队时长，不能在其中调用Queue的方法
+		Observe func(p Priority, wait time.Duration)
+
+		mu      sync.Mutex
+		busy    bool
+		waiting tickets
+		seq     uint64
+		done    chan struct{}
+		closed  bool
+		stats   Stats
+	}
+
+	// Stats 队列的统计信息
+	Stats struct {
+		// 当前排队数量
+		Depth int
+		// 累计获得写入机会的次数
+		Acquired uint64
+		// 因队列已满被拒绝的次数
+		Rejected uint64
+		// 排队过程中被取消的次数
+		Canceled uint64
+		// 累计和最大的排队时长
+		TotalWait time.Duration
+		MaxWait   time.Duration
+	}
+
+	ticket struct {
+		priority Priority
+		seq      uint64
+		enqueued time.Time
+		ready    chan struct{}
+		// 在堆中的位置，出队之后为-1
+		index int
+	}
+
+	tickets []*ticket
+)
+
+func New(maxDepth int) *Queue {
+	return &Queue{
+		MaxDepth: maxDepth,
+		done:     make(chan struct{}),
+	}
+}
+
+// Acquire 排队等待写入机会，成功之后必须调用Release归还。
+// ctx取消时从队列中移除并返回ctx.Err()
+func (q *Queue) Acquire(ctx context.Context, p Priority) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return Closed
+	}
+	if !q.busy {
+		q.busy = true
+		q.record(p, 0)
+		q.mu.Unlock()
+		return nil
+	}
+	if q.MaxDepth > 0 && len(q.waiting) >= q.MaxDepth {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return Full
+	}
+	t := &ticket{
+		priority: p,
+		seq:      q.seq,
+		enqueued: time.Now(),
+		ready:    make(chan struct{}),
+	}
+	q.seq++
+	heap.Push(&q.waiting, t)
+	q.mu.Unlock()
+
+	var err error
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-q.done:
+		err = Closed
+	}
+
+	q.mu.Lock()
+	if t.index >= 0 {
+		heap.Remove(&q.waiting, t.index)
+		q.stats.Canceled++
+		q.mu.Unlock()
+		return err
+	}
+	q.mu.Unlock()
+	// 取消的同时已经获得了写入机会，需要交给下一个
+	q.Release()
+	return err
+}
+
+// Release 归还写入机会，交给优先级最高的排队者
+func (q *Queue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.busy = false
+		return
+	}
+	t := heap.Pop(&q.waiting).(*ticket)
+	q.record(t.priority, time.Since(t.enqueued))
+	close(t.ready)
+}
+
+// Close 关闭队列，所有排队者返回Closed
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+// Stats 获取队列的统计信息
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.Depth = len(q.waiting)
+	return s
+}
+
+// 记录排队时长，调用方需持有锁
+func (q *Queue) record(p Priority, wait time.Duration) {
+	q.stats.Acquired++
+	q.stats.TotalWait += wait
+	if wait > q.stats.MaxWait {
+		q.stats.MaxWait = wait
+	}
+	if q.Observe != nil {
+		q.Observe(p, wait)
+	}
+}
+
+func (ts tickets) Len() int { return len(ts) }
+
+func (ts tickets) Less(i, j int) bool {
+	if ts[i].priority != ts[j].priority {
+		return ts[i].priority > ts[j].priority
+	}
+	return ts[i].seq < ts[j].seq
+}
+
+func (ts tickets) Swap(i, j int) {
+	ts[i], ts[j] = ts[j], ts[i]
+	ts[i].index = i
+	ts[j].index = j
+}
+
+func (ts *tickets) Push(x interface{}) {
+	t := x.(*ticket)
+	t.index = len(*ts)
+	*ts = append(*ts, t)
+}
+
+func (ts *tickets) Pop() interface{} {
+	old := *ts
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*ts = old[:n-1]
+	return t
+}
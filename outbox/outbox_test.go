@@ -0,0 +1,71 @@
+package outbox
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueue_Priority(t *testing.T) {
+	q := New(0)
+	if err := q.Acquire(context.Background(), Normal); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan Priority, 3)
+	for _, p := range []Priority{Low, Normal, High} {
+		go func(p Priority) {
+			if err := q.Acquire(context.Background(), p); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- p
+			q.Release()
+		}(p)
+		// 保证按顺序入队
+		time.Sleep(20 * time.Millisecond)
+	}
+	q.Release()
+
+	for _, want := range []Priority{High, Normal, Low} {
+		if got := <-order; got != want {
+			t.Fatalf("priority = %v, want %v", got, want)
+		}
+	}
+	if s := q.Stats(); s.Acquired != 4 || s.Depth != 0 || s.MaxWait == 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestQueue_FullAndCancel(t *testing.T) {
+	q := New(1)
+	q.Acquire(context.Background(), Normal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.Acquire(ctx, Normal)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := q.Acquire(context.Background(), High); err != Full {
+		t.Fatalf("err = %v, want %v", err, Full)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if s := q.Stats(); s.Rejected != 1 || s.Canceled != 1 || s.Depth != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+
+	go func() {
+		errc <- q.Acquire(context.Background(), Normal)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Close()
+	if err := <-errc; err != Closed {
+		t.Fatalf("err = %v, want %v", err, Closed)
+	}
+}
@@ -0,0 +1,235 @@
+// Package pacing 控制向单个设备写入报文的节奏，防止设备或DTU因报文粘连而无法解析
+package pacing
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var Canceled = errors.New("pacing canceled")
+
+type (
+	// Pacer 控制单个连接的写入节奏。
+	// Wait和Sent由写入方串行调用，Received可能与它们并发调用
+	Pacer interface {
+		// Wait 在写入之前调用，阻塞直到允许写入，cancel关闭时返回Canceled
+		Wait(cancel <-chan struct{}) error
+		// Sent 在写入n个字节之后调用
+		Sent(n int)
+		// Received 在收到设备上行数据之后调用
+		Received()
+	}
+
+	// Policy 为每个连接创建独立的Pacer
+	Policy func() Pacer
+)
+
+// MinGap 两帧之间至少间隔gap，从上一帧写入完成开始计算
+func MinGap(gap time.Duration) Policy {
+	return func() Pacer {
+		return &deadlinePacer{next: func(n int) time.Duration { return gap }}
+	}
+}
+
+// RTU 按照Modbus RTU的要求，在上一帧经DTU以baud波特率发送完毕之后，
+// 再间隔3.5个字符的静默时间才允许写入下一帧。
+// 每个字符按11位（起始位、8个数据位、校验位或第二个停止位、停止位）计算，
+// 波特率大于19200时静默时间固定为1.75ms。baud不大于0时panic
+func RTU(baud int) Policy {
+	if baud <= 0 {
+		panic(fmt.Sprintf("pacing: non-positive baud rate %d", baud))
+	}
+	char := time.Duration(11 * float64(time.Second) / float64(baud))
+	silent := char * 7 / 2
+	if baud > 19200 {
+		silent = 1750 * time.Microsecond
+	}
+	return func() Pacer {
+		return &deadlinePacer{next: func(n int) time.Duration {
+			return time.Duration(n)*char + silent
+		}}
+	}
+}
+
+// TokenBucket 以令牌桶限制写入速率，rate为每秒允许的帧数，burst为允许的突发帧数。
+// rate不大于0或者为NaN时panic
+func TokenBucket(rate float64, burst int) Policy {
+	if !(rate > 0) {
+		panic(fmt.Sprintf("pacing: non-positive token rate %v", rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return func() Pacer {
+		return &bucketPacer{
+			rate:   rate,
+			burst:  float64(burst),
+			tokens: float64(burst),
+			last:   time.Now(),
+		}
+	}
+}
+
+// WaitResponse 写入之后等待设备响应，直到收到上行数据或者超过timeout才允许写入下一帧
+func WaitResponse(timeout time.Duration) Policy {
+	return func() Pacer {
+		return &responsePacer{
+			timeout:  timeout,
+			response: make(chan struct{}, 1),
+		}
+	}
+}
+
+// Chain 依次满足多个策略之后才允许写入
+func Chain(policies ...Policy) Policy {
+	return func() Pacer {
+		c := make(chain, len(policies))
+		for i, p := range policies {
+			c[i] = p()
+		}
+		return c
+	}
+}
+
+// 阻塞d时长，cancel关闭时返回Canceled
+func sleep(d time.Duration, cancel <-chan struct{}) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-cancel:
+		return Canceled
+	}
+}
+
+// deadlinePacer 在上一帧写入完成之后，间隔next计算的时长才允许写入
+type deadlinePacer struct {
+	next  func(n int) time.Duration
+	ready time.Time
+}
+
+func (p *deadlinePacer) Wait(cancel <-chan struct{}) error {
+	return sleep(time.Until(p.ready), cancel)
+}
+
+func (p *deadlinePacer) Sent(n int) {
+	p.ready = time.Now().Add(p.next(n))
+}
+
+func (p *deadlinePacer) Received() {}
+
+type bucketPacer struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (p *bucketPacer) Wait(cancel <-chan struct{}) error {
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	if p.tokens >= 1 {
+		return nil
+	}
+	wait := time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+	if err := sleep(wait, cancel); err != nil {
+		return err
+	}
+	p.tokens = 1
+	p.last = time.Now()
+	return nil
+}
+
+func (p *bucketPacer) Sent(n int) {
+	p.tokens--
+}
+
+func (p *bucketPacer) Received() {}
+
+type responsePacer struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	waiting  bool
+	deadline time.Time
+	response chan struct{}
+}
+
+func (p *responsePacer) Wait(cancel <-chan struct{}) error {
+	p.mu.Lock()
+	waiting, deadline := p.waiting, p.deadline
+	p.mu.Unlock()
+	if !waiting {
+		return nil
+	}
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-p.response:
+	case <-t.C:
+	case <-cancel:
+		return Canceled
+	}
+	p.mu.Lock()
+	p.waiting = false
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *responsePacer) Sent(n int) {
+	p.mu.Lock()
+	p.waiting = true
+	p.deadline = time.Now().Add(p.timeout)
+	// 丢弃写入之前收到的上行数据
+	select {
+	case <-p.response:
+	default:
+	}
+	p.mu.Unlock()
+}
+
+func (p *responsePacer) Received() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.waiting {
+		return
+	}
+	select {
+	case p.response <- struct{}{}:
+	default:
+	}
+}
+
+type chain []Pacer
+
+func (c chain) Wait(cancel <-chan struct{}) error {
+	for _, p := range c {
+		if err := p.Wait(cancel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c chain) Sent(n int) {
+	for _, p := range c {
+		p.Sent(n)
+	}
+}
+
+func (c chain) Received() {
+	for _, p := range c {
+		p.Received()
+	}
+}
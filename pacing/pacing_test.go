@@ -0,0 +1,88 @@
+package pacing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinGap(t *testing.T) {
+	p := MinGap(100 * time.Millisecond)()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.Wait(nil); err != nil {
+			t.Fatal(err)
+		}
+		p.Sent(8)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("3 writes took %v, want >= 200ms", d)
+	}
+}
+
+func TestRTU(t *testing.T) {
+	p := RTU(9600)().(*deadlinePacer)
+	// 8字节的帧在9600波特率下需要约9.17ms，静默时间约4.01ms
+	if d := p.next(8); d < 13*time.Millisecond || d > 14*time.Millisecond {
+		t.Fatalf("gap = %v, want about 13.2ms", d)
+	}
+	p = RTU(115200)().(*deadlinePacer)
+	if d := p.next(0); d != 1750*time.Microsecond {
+		t.Fatalf("silent interval = %v, want 1.75ms", d)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	p := TokenBucket(10, 2)()
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := p.Wait(nil); err != nil {
+			t.Fatal(err)
+		}
+		p.Sent(8)
+	}
+	// 前两帧可以突发，之后每帧间隔100ms
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("4 writes took %v, want about 200ms", d)
+	}
+}
+
+func TestWaitResponse(t *testing.T) {
+	p := WaitResponse(time.Second)()
+	p.Wait(nil)
+	p.Sent(8)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Received()
+	}()
+	start := time.Now()
+	if err := p.Wait(nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("wait took %v, want released by response", d)
+	}
+
+	p.Sent(8)
+	cancel := make(chan struct{})
+	close(cancel)
+	if err := p.Wait(cancel); err != Canceled {
+		t.Fatalf("err = %v, want %v", err, Canceled)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	for name, f := range map[string]func(){
+		"RTU(0)":             func() { RTU(0) },
+		"TokenBucket(0, 1)":  func() { TokenBucket(0, 1) },
+		"TokenBucket(-1, 1)": func() { TokenBucket(-1, 1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,232 @@
+// Package presence 记录设备的在线状态，供modbus和nb的Server共用
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Device 是设备在线状态的快照
+	Device struct {
+		ID     string
+		Remote string
+		Online bool
+		// 最近一次建立连接的时间
+		ConnectedAt time.Time
+		// 最近一次断开连接或者被判定为离线的时间
+		OfflineAt time.Time
+		// 最近一次上行的时间
+		LastSeen time.Time
+		// 累计的上下行字节数
+		BytesIn  uint64
+		BytesOut uint64
+		// 重连次数，首次连接不计入
+		Reconnects int
+	}
+
+	// Tracker 由Server在连接注册、收发数据和关闭时更新，
+	// 设置了心跳间隔时，超过心跳间隔没有上行的设备即使连接未关闭也会被判定为离线
+	Tracker struct {
+		heartbeat time.Duration
+
+		// 设备上线或离线时调用
+		OnChange func(d Device)
+
+		mu      sync.RWMutex
+		devices map[string]*device
+
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+
+	device struct {
+		Device
+		// 同一设备的活动连接数，新连接替换旧连接时会短暂存在两个
+		conns int
+	}
+)
+
+// NewTracker 创建在线状态记录，heartbeat为0时仅以连接关闭判断离线
+func NewTracker(heartbeat time.Duration) *Tracker {
+	t := &Tracker{
+		heartbeat: heartbeat,
+		devices:   make(map[string]*device),
+		stop:      make(chan struct{}),
+	}
+	if heartbeat > 0 {
+		go t.check()
+	}
+	return t
+}
+
+// Stop 停止心跳检查
+func (t *Tracker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+// Connect 在设备注册连接时调用
+func (t *Tracker) Connect(id, remote string) {
+	now := time.Now()
+	t.mu.Lock()
+	d, ok := t.devices[id]
+	if !ok {
+		d = &device{Device: Device{ID: id}}
+		t.devices[id] = d
+	} else {
+		d.Reconnects++
+	}
+	d.conns++
+	d.Remote = remote
+	d.ConnectedAt = now
+	d.LastSeen = now
+	changed := t.setOnline(d, true, now)
+	snapshot := d.Device
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(snapshot)
+	}
+}
+
+// Disconnect 在设备的连接关闭时调用
+func (t *Tracker) Disconnect(id string) {
+	t.mu.Lock()
+	d, ok := t.devices[id]
+	if !ok || d.conns == 0 {
+		t.mu.Unlock()
+		return
+	}
+	d.conns--
+	changed := false
+	if d.conns == 0 {
+		changed = t.setOnline(d, false, time.Now())
+	}
+	snapshot := d.Device
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(snapshot)
+	}
+}
+
+// Uplink 在收到设备上行数据时调用
+func (t *Tracker) Uplink(id string, n int) {
+	now := time.Now()
+	t.mu.Lock()
+	d, ok := t.devices[id]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	d.BytesIn += uint64(n)
+	d.LastSeen = now
+	// 因心跳超时被判定离线的设备重新上行
+	changed := d.conns > 0 && t.setOnline(d, true, now)
+	snapshot := d.Device
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(snapshot)
+	}
+}
+
+// Downlink 在向设备下行数据时调用
+func (t *Tracker) Downlink(id string, n int) {
+	t.mu.Lock()
+	if d, ok := t.devices[id]; ok {
+		d.BytesOut += uint64(n)
+	}
+	t.mu.Unlock()
+}
+
+// Get 获取单个设备的状态
+func (t *Tracker) Get(id string) (Device, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	d, ok := t.devices[id]
+	if !ok {
+		return Device{}, false
+	}
+	return d.Device, true
+}
+
+// IsOnline 判断设备是否在线
+func (t *Tracker) IsOnline(id string) bool {
+	d, ok := t.Get(id)
+	return ok && d.Online
+}
+
+// Snapshot 获取所有设备的状态，按ID排序
+func (t *Tracker) Snapshot() []Device {
+	return t.Query(nil)
+}
+
+// Query 获取满足条件的设备状态，按ID排序，filter为nil时返回全部
+func (t *Tracker) Query(filter func(d Device) bool) []Device {
+	t.mu.RLock()
+	list := make([]Device, 0, len(t.devices))
+	for _, d := range t.devices {
+		if filter == nil || filter(d.Device) {
+			list = append(list, d.Device)
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Forget 删除设备的记录
+func (t *Tracker) Forget(id string) {
+	t.mu.Lock()
+	delete(t.devices, id)
+	t.mu.Unlock()
+}
+
+// 修改在线状态，返回状态是否发生变化，调用方需持有锁
+func (t *Tracker) setOnline(d *device, online bool, now time.Time) bool {
+	if d.Online == online {
+		return false
+	}
+	d.Online = online
+	if !online {
+		d.OfflineAt = now
+	}
+	return true
+}
+
+func (t *Tracker) notify(d Device) {
+	if t.OnChange != nil {
+		t.OnChange(d)
+	}
+}
+
+// 定期检查超过心跳间隔没有上行的设备
+func (t *Tracker) check() {
+	ticker := time.NewTicker(t.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			var expired []Device
+			t.mu.Lock()
+			for _, d := range t.devices {
+				if d.Online && now.Sub(d.LastSeen) > t.heartbeat {
+					t.setOnline(d, false, now)
+					expired = append(expired, d.Device)
+				}
+			}
+			t.mu.Unlock()
+			for _, d := range expired {
+				t.notify(d)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker(0)
+	changes := make(chan Device, 4)
+	tr.OnChange = func(d Device) {
+		changes <- d
+	}
+
+	tr.Connect("dev1", "127.0.0.1:1000")
+	if d := <-changes; d.ID != "dev1" || !d.Online {
+		t.Fatalf("change = %+v, want dev1 online", d)
+	}
+	tr.Uplink("dev1", 10)
+	tr.Downlink("dev1", 8)
+
+	// 新连接替换旧连接，设备不应离线
+	tr.Connect("dev1", "127.0.0.1:1001")
+	tr.Disconnect("dev1")
+	d, ok := tr.Get("dev1")
+	if !ok || !d.Online {
+		t.Fatalf("device = %+v, want online", d)
+	}
+	if d.BytesIn != 10 || d.BytesOut != 8 || d.Reconnects != 1 || d.Remote != "127.0.0.1:1001" {
+		t.Fatalf("device = %+v", d)
+	}
+
+	tr.Disconnect("dev1")
+	if d := <-changes; d.Online {
+		t.Fatalf("change = %+v, want offline", d)
+	}
+	if len(tr.Query(func(d Device) bool { return d.Online })) != 0 {
+		t.Fatal("query online devices should be empty")
+	}
+	if len(tr.Snapshot()) != 1 {
+		t.Fatal("snapshot should contain dev1")
+	}
+}
+
+func TestTracker_Heartbeat(t *testing.T) {
+	tr := NewTracker(100 * time.Millisecond)
+	defer tr.Stop()
+	changes := make(chan Device, 4)
+	tr.OnChange = func(d Device) {
+		changes <- d
+	}
+
+	tr.Connect("dev1", "127.0.0.1:1000")
+	<-changes
+	select {
+	case d := <-changes:
+		if d.Online {
+			t.Fatalf("change = %+v, want offline", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat timeout not detected")
+	}
+
+	// 重新上行之后恢复在线
+	tr.Uplink("dev1", 1)
+	if d := <-changes; !d.Online {
+		t.Fatalf("change = %+v, want online", d)
+	}
+}
@@ -0,0 +1,524 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/modbus"
+	"github.com/ricnsmart/iot-protocol/outbox"
+)
+
+const defaultTimeout = 10 * time.Second
+
+var (
+	NoProfile       = errors.New("no profile for device")
+	UnknownRegister = errors.New("unknown register")
+	NotReadable     = errors.New("register not readable")
+	NotWritable     = errors.New("register not writable")
+	NotControllable = errors.New("register not controllable")
+	// 写入的值无法由寄存器编码
+	InvalidValue = errors.New("invalid register value")
+	// 设备的响应与请求的从站地址或功能码不一致
+	UnexpectedResponse = errors.New("unexpected response")
+)
+
+type (
+	// API 以HTTP接口查询设备、按寄存器名称读写以及遥控操作，实现了http.Handler：
+	//  GET  /devices
+	//  GET  /devices/{id}
+	//  POST /devices/{id}/read     {"registers":["voltage"]}，为空时读取所有寄存器
+	//  POST /devices/{id}/write    {"values":{"setpoint":12.5}}，值以字符串交给modbus.Encoder
+	//  POST /devices/{id}/control  {"register":"switch","value":65280}
+	// 与设备的交互遵循Conn的约定：Server.Handler需要将设备的响应通过Conn.Send交给调用方
+	API struct {
+		server *modbus.Server
+
+		// 返回设备对应的型号名称，为nil时只注册了一个型号则使用该型号
+		ProfileOf func(c *modbus.Conn) string
+
+		// 每个请求从排队写入到收到设备响应的超时，默认10秒
+		Timeout time.Duration
+
+		mu       sync.RWMutex
+		profiles map[string]*Profile
+	}
+
+	// Device 设备信息
+	Device struct {
+		ID          string     `json:"id"`
+		Remote      string     `json:"remote,omitempty"`
+		Online      bool       `json:"online"`
+		Profile     string     `json:"profile,omitempty"`
+		ConnectedAt *time.Time `json:"connected_at,omitempty"`
+		LastSeen    *time.Time `json:"last_seen,omitempty"`
+	}
+
+	// ExceptionDetail 设备返回的Modbus异常
+	ExceptionDetail struct {
+		Code    uint8  `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// ErrorResponse 请求失败时的响应
+	ErrorResponse struct {
+		Error     string           `json:"error"`
+		Exception *ExceptionDetail `json:"exception,omitempty"`
+		// 写入中途失败时已经写入成功的寄存器
+		Written []string `json:"written,omitempty"`
+	}
+
+	// WriteError 写入中途失败，Written为失败之前已经写入成功的寄存器
+	WriteError struct {
+		Written []string
+		Err     error
+	}
+
+	readRequest struct {
+		Registers []string `json:"registers"`
+	}
+
+	writeRequest struct {
+		Values map[string]interface{} `json:"values"`
+	}
+
+	controlRequest struct {
+		Register string `json:"register"`
+		Value    uint16 `json:"value"`
+	}
+)
+
+// New 创建srv的HTTP接口
+func New(srv *modbus.Server) *API {
+	return &API{
+		server:   srv,
+		Timeout:  defaultTimeout,
+		profiles: make(map[string]*Profile),
+	}
+}
+
+// AddProfile 按名称注册设备型号，同名的型号会被替换
+func (a *API) AddProfile(p *Profile) {
+	a.mu.Lock()
+	a.profiles[p.Name] = p
+	a.mu.Unlock()
+}
+
+func (a *API) profile(c *modbus.Conn) (*Profile, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.ProfileOf == nil {
+		if len(a.profiles) == 1 {
+			for _, p := range a.profiles {
+				return p, nil
+			}
+		}
+		return nil, NoProfile
+	}
+	p, ok := a.profiles[a.ProfileOf(c)]
+	if !ok {
+		return nil, NoProfile
+	}
+	return p, nil
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "devices" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.devices())
+	case len(parts) == 2:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		d, ok := a.device(parts[1])
+		if !ok {
+			writeError(w, modbus.DeviceOffline)
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	default:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		a.operate(w, r, parts[1], parts[2])
+	}
+}
+
+func (a *API) devices() []Device {
+	var devices []Device
+	if p := a.server.Presence; p != nil {
+		for _, d := range p.Snapshot() {
+			devices = append(devices, a.fromPresence(d.ID))
+		}
+	} else {
+		for _, c := range a.server.Conns() {
+			devices = append(devices, a.fromConn(c))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	if devices == nil {
+		devices = []Device{}
+	}
+	return devices
+}
+
+func (a *API) device(id string) (Device, bool) {
+	if p := a.server.Presence; p != nil {
+		if _, ok := p.Get(id); ok {
+			return a.fromPresence(id), true
+		}
+	}
+	c, err := a.server.FindConn(id)
+	if err != nil {
+		return Device{}, false
+	}
+	return a.fromConn(c), true
+}
+
+func (a *API) fromConn(c *modbus.Conn) Device {
+	d := Device{ID: c.ID(), Remote: c.RemoteAddr(), Online: true}
+	if p, err := a.profile(c); err == nil {
+		d.Profile = p.Name
+	}
+	return d
+}
+
+// 设备在线时以连接补充型号
+func (a *API) fromPresence(id string) Device {
+	pd, _ := a.server.Presence.Get(id)
+	d := Device{ID: pd.ID, Remote: pd.Remote, Online: pd.Online}
+	if !pd.ConnectedAt.IsZero() {
+		d.ConnectedAt = &pd.ConnectedAt
+	}
+	if !pd.LastSeen.IsZero() {
+		d.LastSeen = &pd.LastSeen
+	}
+	if c, err := a.server.FindConn(id); err == nil {
+		d.Online = true
+		if p, err := a.profile(c); err == nil {
+			d.Profile = p.Name
+		}
+	}
+	return d
+}
+
+func (a *API) operate(w http.ResponseWriter, r *http.Request, id, op string) {
+	if op != "read" && op != "write" && op != "control" {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := a.server.FindConn(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := a.profile(c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	switch op {
+	case "read":
+		var req readRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		values, err := a.read(ctx, c, p, req.Registers)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "values": values})
+	case "write":
+		var req writeRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		written, err := a.write(ctx, c, p, req.Values)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "written": written})
+	case "control":
+		var req controlRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		if err := a.control(ctx, c, p, req.Register, req.Value); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "register": req.Register, "value": req.Value})
+	}
+}
+
+func (a *API) read(ctx context.Context, c *modbus.Conn, p *Profile, names []string) (map[string]interface{}, error) {
+	var regs modbus.Registers
+	if len(names) == 0 {
+		// 读取所有可以读取的寄存器
+		for _, r := range p.Registers {
+			if _, ok := r.(modbus.Decoder); ok {
+				regs = append(regs, r)
+			}
+		}
+	}
+	for _, name := range names {
+		r, ok := p.Find(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", UnknownRegister, name)
+		}
+		if _, ok := r.(modbus.Decoder); !ok {
+			return nil, fmt.Errorf("%w: %v", NotReadable, name)
+		}
+		regs = append(regs, r)
+	}
+
+	if err := c.LockExchange(ctx); err != nil {
+		return nil, err
+	}
+	defer c.UnlockExchange()
+	values := make(map[string]interface{}, len(regs))
+	for _, g := range readGroups(regs) {
+		frame := &modbus.RTUFrame{Address: p.Slave, Function: modbus.Read}
+		modbus.SetDataWithRegisterAndNumber(frame, g.GetStart(), g.GetNum())
+		resp, err := exchange(ctx, c, frame)
+		if err != nil {
+			return nil, err
+		}
+		// 读取响应的第一个字节为字节数
+		data := resp.GetData()
+		if len(data) < 1 || int(data[0]) != len(data)-1 || int(data[0]) != int(g.GetNum())*2 {
+			return nil, UnexpectedResponse
+		}
+		if err := g.Decode(data[1:], values); err != nil {
+			return nil, fmt.Errorf("%w: %v", UnexpectedResponse, err)
+		}
+	}
+	return values, nil
+}
+
+func (a *API) write(ctx context.Context, c *modbus.Conn, p *Profile, values map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// 先全部校验，避免只写入一部分
+	frames := make([]*modbus.RTUFrame, 0, len(names))
+	for _, name := range names {
+		r, ok := p.Find(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", UnknownRegister, name)
+		}
+		enc, ok := r.(modbus.Encoder)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", NotWritable, name)
+		}
+		var v string
+		switch value := values[name].(type) {
+		case string:
+			v = value
+		case json.Number:
+			v = value.String()
+		case bool:
+			v = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("%w: %v", InvalidValue, name)
+		}
+		b, err := enc.Encode(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v: %v", InvalidValue, name, err)
+		}
+		if len(b) != int(r.GetNum())*2 {
+			return nil, fmt.Errorf("%w: %v: want %v bytes, got %v", InvalidValue, name, r.GetNum()*2, len(b))
+		}
+		frame := &modbus.RTUFrame{Address: p.Slave, Function: modbus.Write}
+		modbus.SetDataWithRegisterAndNumberAndBytes(frame, r.GetStart(), r.GetNum(), b)
+		frames = append(frames, frame)
+	}
+
+	if err := c.LockExchange(ctx); err != nil {
+		return nil, err
+	}
+	defer c.UnlockExchange()
+	for i, frame := range frames {
+		if _, err := exchange(ctx, c, frame); err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return names[:i], &WriteError{Written: names[:i], Err: err}
+		}
+	}
+	return names, nil
+}
+
+func (a *API) control(ctx context.Context, c *modbus.Conn, p *Profile, name string, value uint16) error {
+	r, ok := p.Find(name)
+	if !ok {
+		return fmt.Errorf("%w: %v", UnknownRegister, name)
+	}
+	if !p.controllable(name) {
+		return fmt.Errorf("%w: %v", NotControllable, name)
+	}
+	frame := &modbus.RTUFrame{Address: p.Slave, Function: modbus.Control}
+	modbus.SetDateForControl(frame, r.GetStart(), value)
+	if err := c.LockExchange(ctx); err != nil {
+		return err
+	}
+	defer c.UnlockExchange()
+	_, err := exchange(ctx, c, frame)
+	return err
+}
+
+// 发送请求并等待设备响应，调用方需持有连接的交互锁。
+// 发送之前丢弃之前的请求超时之后才到达的响应，与请求不匹配的响应同样丢弃并继续等待
+func exchange(ctx context.Context, c *modbus.Conn, frame *modbus.RTUFrame) (*modbus.RTUFrame, error) {
+	priority := outbox.Normal
+	if frame.Function == modbus.Control {
+		priority = outbox.High
+	}
+	if n := c.DiscardReceived(); n > 0 {
+		log.Printf("discard %v stale responses from %v\n", n, c.ID())
+	}
+	if _, err := c.WritePriority(ctx, priority, frame.Bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		out, err := c.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.NewRTUFrame(out)
+		if err != nil {
+			return nil, err
+		}
+		if !matches(frame, resp) {
+			log.Printf("discard unexpected response from %v: 0x% x\n", c.ID(), out)
+			continue
+		}
+		if e := modbus.GetException(resp); e != modbus.Success {
+			return nil, e
+		}
+		return resp, nil
+	}
+}
+
+// 判断resp是否是req的响应：从站地址和功能码一致，读取响应的字节数与请求的数量一致，
+// 写入和遥控的响应原样返回请求的地址和数量（或者值）
+func matches(req, resp *modbus.RTUFrame) bool {
+	if resp.Address != req.Address || resp.Function&0x7f != req.Function {
+		return false
+	}
+	if modbus.GetException(resp) != modbus.Success {
+		return true
+	}
+	data := resp.GetData()
+	switch req.Function {
+	case modbus.Read:
+		return len(data) >= 1 && int(data[0]) == len(data)-1 && int(data[0]) == int(binary.BigEndian.Uint16(req.Data[2:4]))*2
+	default:
+		return len(data) >= 4 && bytes.Equal(data[:4], req.Data[:4])
+	}
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("written %v before failure: %v", e.Written, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// 将错误映射为HTTP状态码
+func statusOf(err error) int {
+	var e modbus.Exception
+	var crc *modbus.CRCError
+	switch {
+	case errors.Is(err, modbus.DeviceOffline), errors.Is(err, NoProfile):
+		return http.StatusNotFound
+	case errors.Is(err, UnknownRegister), errors.Is(err, NotReadable), errors.Is(err, NotWritable),
+		errors.Is(err, NotControllable), errors.Is(err, InvalidValue):
+		return http.StatusBadRequest
+	case errors.Is(err, modbus.WaitMessageTimeout), errors.Is(err, modbus.SendMessageTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, outbox.Full):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &e), errors.As(err, &crc), errors.Is(err, UnexpectedResponse):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	resp := ErrorResponse{Error: err.Error()}
+	var e modbus.Exception
+	if errors.As(err, &e) {
+		resp.Error = "modbus exception"
+		resp.Exception = &ExceptionDetail{Code: uint8(e), Message: e.String()}
+	}
+	var we *WriteError
+	if errors.As(err, &we) {
+		resp.Written = we.Written
+	}
+	writeJSON(w, statusOf(err), resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+}
+
+// 请求体为空时保持零值
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Body == nil {
+		return true
+	}
+	d := json.NewDecoder(r.Body)
+	// 写入的数值以原始文本交给modbus.Encoder
+	d.UseNumber()
+	if err := d.Decode(v); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package rest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/modbus"
+)
+
+// 只读的单个寄存器，实际值=原始值*scale
+type word struct {
+	name  string
+	start uint16
+	scale float64
+}
+
+func (w word) GetName() string  { return w.name }
+func (w word) GetStart() uint16 { return w.start }
+func (w word) GetNum() uint16   { return 1 }
+
+func (w word) Decode(data []byte, m map[string]interface{}) {
+	m[w.name] = float64(binary.BigEndian.Uint16(data)) * w.scale
+}
+
+// 可写的单个寄存器
+type setting struct {
+	word
+}
+
+func (s setting) Encode(value string) ([]byte, error) {
+	v, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b, nil
+}
+
+// 遥控的线圈，不能读写
+type coil struct {
+	name  string
+	start uint16
+}
+
+func (c coil) GetName() string  { return c.name }
+func (c coil) GetStart() uint16 { return c.start }
+func (c coil) GetNum() uint16   { return 1 }
+
+func TestAPI(t *testing.T) {
+	s := modbus.NewServer()
+	s.Pacing = nil
+	registered := make(chan *modbus.Conn, 1)
+	s.OnRegister = func(c *modbus.Conn) {
+		registered <- c
+	}
+	s.Handler = func(c *modbus.Conn, out []byte) {
+		if c.ID() == "" {
+			c.SetID(string(out))
+			return
+		}
+		c.Send(out)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown()
+
+	// 模拟DTU下的电表：读取时每个寄存器的值为其地址，0x0010不存在，0x0020不应答，
+	// 0x0060的值为读取次数且第一次在超时之后才应答，写入0x0050返回异常，其余写入和遥控原样返回
+	var reads, lateReads int32
+	dtu, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dtu.Close()
+	dtu.Write([]byte("meter1"))
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := dtu.Read(buf)
+			if err != nil {
+				return
+			}
+			req, err := modbus.NewRTUFrame(buf[:n])
+			if err != nil {
+				continue
+			}
+			start := modbus.GetRegister(req)
+			resp := &modbus.RTUFrame{Address: req.Address, Function: req.Function}
+			switch {
+			case req.Function != modbus.Read && start == 0x0050:
+				resp.SetException(&modbus.IllegalDataValue)
+			case req.Function != modbus.Read:
+				resp.Data = req.Data[:4]
+			case start == 0x0010:
+				resp.SetException(&modbus.IllegalDataAddress)
+			case start == 0x0020:
+				continue
+			case start == 0x0060:
+				n := atomic.AddInt32(&lateReads, 1)
+				resp.Data = []byte{2, 0, byte(n)}
+				if n == 1 {
+					go func(b []byte) {
+						time.Sleep(400 * time.Millisecond)
+						dtu.Write(b)
+					}(resp.Bytes())
+					continue
+				}
+			default:
+				atomic.AddInt32(&reads, 1)
+				num := binary.BigEndian.Uint16(req.Data[2:4])
+				resp.Data = []byte{byte(num * 2)}
+				for i := uint16(0); i < num; i++ {
+					resp.Data = append(resp.Data, byte((start+i)>>8), byte(start+i))
+				}
+			}
+			dtu.Write(resp.Bytes())
+		}
+	}()
+	conn := <-registered
+
+	p := &Profile{Name: "meter", Slave: 1, Registers: modbus.Registers{
+		word{name: "voltage", start: 0x0100, scale: 0.1},
+		word{name: "missing", start: 0x0010},
+		word{name: "silent", start: 0x0020},
+		word{name: "late", start: 0x0060, scale: 1},
+		setting{word{name: "ratio", start: 0x0030}},
+		setting{word{name: "tariff", start: 0x0050}},
+		coil{name: "switch", start: 0x0040},
+	}, Controls: []string{"switch"}}
+	// 20个连续的寄存器以一次读取完成
+	var bulk []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("r%d", i)
+		p.Registers = append(p.Registers, word{name: name, start: 0x0101 + uint16(i), scale: 1})
+		bulk = append(bulk, `"`+name+`"`)
+	}
+	a := New(s)
+	a.Timeout = 300 * time.Millisecond
+	a.AddProfile(p)
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	do := func(method, path, body string, status int, v interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%v %v status = %v, want %v", method, path, resp.StatusCode, status)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var devices []Device
+	do(http.MethodGet, "/devices", "", http.StatusOK, &devices)
+	if len(devices) != 1 || devices[0].ID != "meter1" || devices[0].Profile != "meter" {
+		t.Fatalf("devices = %+v", devices)
+	}
+	do(http.MethodGet, "/devices/meter2", "", http.StatusNotFound, nil)
+
+	var read struct {
+		Values map[string]float64
+	}
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["voltage",`+strings.Join(bulk, ",")+`]}`, http.StatusOK, &read)
+	if v := read.Values["voltage"]; v < 25.5 || v > 25.7 {
+		t.Fatalf("voltage = %v", v)
+	}
+	if len(read.Values) != 21 || read.Values["r19"] != 0x0114 {
+		t.Fatalf("values = %+v", read.Values)
+	}
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Fatalf("reads = %v, want 1", n)
+	}
+
+	var failed ErrorResponse
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["missing"]}`, http.StatusBadGateway, &failed)
+	if failed.Exception == nil || failed.Exception.Code != uint8(modbus.IllegalDataAddress) {
+		t.Fatalf("exception = %+v", failed)
+	}
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["silent"]}`, http.StatusGatewayTimeout, nil)
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["unknown"]}`, http.StatusBadRequest, nil)
+
+	// 超时之后才到达的响应不能作为下一次相同读取的结果
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["late"]}`, http.StatusGatewayTimeout, nil)
+	time.Sleep(200 * time.Millisecond)
+	read.Values = nil
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["late"]}`, http.StatusOK, &read)
+	if v := read.Values["late"]; v != 2 {
+		t.Fatalf("late = %v, want 2", v)
+	}
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["switch"]}`, http.StatusBadRequest, nil)
+	do(http.MethodPost, "/devices/meter2/read", `{}`, http.StatusNotFound, nil)
+
+	do(http.MethodPost, "/devices/meter1/write", `{"values":{"voltage":1}}`, http.StatusBadRequest, nil)
+	do(http.MethodPost, "/devices/meter1/write", `{"values":{"ratio":-1}}`, http.StatusBadRequest, nil)
+	var written struct {
+		Written []string
+	}
+	do(http.MethodPost, "/devices/meter1/write", `{"values":{"ratio":40}}`, http.StatusOK, &written)
+	if len(written.Written) != 1 || written.Written[0] != "ratio" {
+		t.Fatalf("written = %+v", written)
+	}
+	// 中途失败时返回已经写入的寄存器
+	failed = ErrorResponse{}
+	do(http.MethodPost, "/devices/meter1/write", `{"values":{"ratio":"41","tariff":2}}`, http.StatusBadGateway, &failed)
+	if len(failed.Written) != 1 || failed.Written[0] != "ratio" || failed.Exception == nil {
+		t.Fatalf("partial write = %+v", failed)
+	}
+
+	do(http.MethodPost, "/devices/meter1/control", `{"register":"switch","value":65280}`, http.StatusOK, nil)
+	do(http.MethodPost, "/devices/meter1/control", `{"register":"ratio","value":65280}`, http.StatusBadRequest, nil)
+
+	// 调用方持有连接的锁时不影响API
+	conn.Lock()
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["voltage"]}`, http.StatusOK, nil)
+	conn.Unlock()
+	// 交互锁被网关等占用时，等待锁同样受超时限制
+	if err := conn.LockExchange(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["voltage"]}`, http.StatusGatewayTimeout, nil)
+	conn.UnlockExchange()
+	do(http.MethodPost, "/devices/meter1/read", `{"registers":["voltage"]}`, http.StatusOK, nil)
+}
+
+func TestReadGroups(t *testing.T) {
+	rs := modbus.Registers{
+		word{name: "c", start: 260},
+		word{name: "a", start: 0},
+		word{name: "b", start: 124},
+		word{name: "d", start: 125},
+	}
+	groups := readGroups(rs)
+	if len(groups) != 3 {
+		t.Fatalf("groups = %v", groups)
+	}
+	if groups[0].GetStart() != 0 || groups[0].GetNum() != 125 || groups[1].GetStart() != 125 || groups[2].GetStart() != 260 {
+		t.Fatalf("groups = %v", groups)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	read := &modbus.RTUFrame{Address: 1, Function: modbus.Read}
+	modbus.SetDataWithRegisterAndNumber(read, 0x0100, 2)
+	write := &modbus.RTUFrame{Address: 1, Function: modbus.Write}
+	modbus.SetDataWithRegisterAndNumberAndBytes(write, 0x0030, 1, []byte{0x00, 0x28})
+	exception := &modbus.RTUFrame{Address: 1, Function: modbus.Read}
+	exception.SetException(&modbus.IllegalDataAddress)
+
+	cases := []struct {
+		req, resp *modbus.RTUFrame
+		want      bool
+	}{
+		{read, &modbus.RTUFrame{Address: 1, Function: modbus.Read, Data: []byte{4, 0, 1, 0, 2}}, true},
+		// 字节数与请求的数量不一致
+		{read, &modbus.RTUFrame{Address: 1, Function: modbus.Read, Data: []byte{2, 0, 1}}, false},
+		{read, &modbus.RTUFrame{Address: 2, Function: modbus.Read, Data: []byte{4, 0, 1, 0, 2}}, false},
+		{read, exception, true},
+		{write, &modbus.RTUFrame{Address: 1, Function: modbus.Write, Data: []byte{0x00, 0x30, 0x00, 0x01}}, true},
+		// 其他地址的写入响应
+		{write, &modbus.RTUFrame{Address: 1, Function: modbus.Write, Data: []byte{0x00, 0x31, 0x00, 0x01}}, false},
+	}
+	for i, c := range cases {
+		if got := matches(c.req, c.resp); got != c.want {
+			t.Errorf("case %d: matches() = %v, want %v", i, got, c.want)
+		}
+	}
+}
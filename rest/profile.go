@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"sort"
+
+	"github.com/ricnsmart/iot-protocol/modbus"
+)
+
+// 单次读取的最大寄存器数量
+const maxReadQuantity = 125
+
+// Profile 设备型号
+type Profile struct {
+	Name string `json:"name"`
+	// RTU从站地址
+	Slave uint8 `json:"slave"`
+	// 寄存器表，实现了modbus.Decoder的寄存器可以读取，实现了modbus.Encoder的寄存器可以写入
+	Registers modbus.Registers `json:"-"`
+	// 允许遥控操作（功能码0x05）的寄存器名称，以寄存器的起始地址作为线圈地址
+	Controls []string `json:"controls,omitempty"`
+}
+
+// Find 按名称查找寄存器
+func (p *Profile) Find(name string) (modbus.Register, bool) {
+	for _, r := range p.Registers {
+		if r.GetName() == name {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Profile) controllable(name string) bool {
+	for _, n := range p.Controls {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 按地址将寄存器分组，每组的地址范围不超过maxReadQuantity，以一次读取完成
+func readGroups(rs modbus.Registers) []modbus.Registers {
+	sorted := make(modbus.Registers, len(rs))
+	copy(sorted, rs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetStart() < sorted[j].GetStart()
+	})
+	var groups []modbus.Registers
+	var g modbus.Registers
+	for _, r := range sorted {
+		if len(g) > 0 && int(r.GetStart())+int(r.GetNum())-int(g.GetStart()) > maxReadQuantity {
+			groups = append(groups, g)
+			g = nil
+		}
+		g = append(g, r)
+	}
+	if len(g) > 0 {
+		groups = append(groups, g)
+	}
+	return groups
+}
@@ -0,0 +1,157 @@
+package sl651
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultAssembleTimeout = 5 * time.Minute
+
+type (
+	// Assembler 将多包发送（M3）的报文按序列号合并为一帧，可以在多个连接之间共用
+	Assembler struct {
+		// 未收齐的报文保留的时间，默认5分钟
+		Timeout time.Duration
+
+		mu       sync.Mutex
+		partials map[partialKey]*partial
+	}
+
+	partialKey struct {
+		remote   string
+		function uint8
+		total    int
+	}
+
+	partial struct {
+		first   *Frame
+		packets map[int][]byte
+		last    byte
+		updated time.Time
+	}
+)
+
+func NewAssembler() *Assembler {
+	return &Assembler{}
+}
+
+// Add 添加一帧报文，收齐全部分包时返回合并后的报文，否则返回nil。
+// 单包报文直接返回
+func (a *Assembler) Add(f *Frame) *Frame {
+	if f.Start != SYN {
+		return f
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.expire(now)
+	if a.partials == nil {
+		a.partials = make(map[partialKey]*partial)
+	}
+	key := partialKey{remote: f.Remote, function: f.Function, total: f.Total}
+	p, ok := a.partials[key]
+	if !ok {
+		p = &partial{packets: make(map[int][]byte)}
+		a.partials[key] = p
+	}
+	p.updated = now
+	p.packets[f.Seq] = f.Body
+	if f.Seq == 1 {
+		p.first = f
+	}
+	if f.Seq == f.Total {
+		p.last = f.End
+	}
+	if len(p.packets) < f.Total || p.first == nil {
+		return nil
+	}
+	var body bytes.Buffer
+	for seq := 1; seq <= f.Total; seq++ {
+		b, ok := p.packets[seq]
+		if !ok {
+			return nil
+		}
+		body.Write(b)
+	}
+	delete(a.partials, key)
+	merged := *p.first
+	merged.Start = STX
+	merged.Total, merged.Seq = 0, 0
+	merged.Body = body.Bytes()
+	merged.End = p.last
+	return &merged
+}
+
+// Missing 返回遥测站remote的功能码为function的多包报文中尚未收到的序列号，用于NAK要求重发
+func (a *Assembler) Missing(remote string, function uint8) []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var missing []int
+	for key, p := range a.partials {
+		if key.remote != remote || key.function != function {
+			continue
+		}
+		for seq := 1; seq <= key.total; seq++ {
+			if _, ok := p.packets[seq]; !ok {
+				missing = append(missing, seq)
+			}
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+func (a *Assembler) expire(now time.Time) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultAssembleTimeout
+	}
+	for key, p := range a.partials {
+		if now.Sub(p.updated) > timeout {
+			delete(a.partials, key)
+		}
+	}
+}
+
+// Decoder 从nb或modbus的Server读取的字节流中切分出完整的报文，
+// 一次读取可能包含多帧或者半帧，每个连接使用一个Decoder
+type Decoder struct {
+	buf []byte
+}
+
+// Feed 追加读取到的字节，返回其中完整的报文，无法识别的字节会被丢弃
+func (d *Decoder) Feed(b []byte) ([]*Frame, error) {
+	d.buf = append(d.buf, b...)
+	var frames []*Frame
+	var lastErr error
+	for len(d.buf) > 0 {
+		n, err := frameLength(d.buf)
+		if err != nil {
+			// 丢弃到下一个可能的帧起始符
+			d.buf = d.buf[1:]
+			if i := bytes.IndexAny(d.buf, string([]byte{hexStart, SOH})); i >= 0 {
+				d.buf = d.buf[i:]
+			} else {
+				d.buf = d.buf[:0]
+			}
+			lastErr = err
+			continue
+		}
+		if n == 0 || len(d.buf) < n {
+			break
+		}
+		f, err := NewFrame(d.buf[:n])
+		d.buf = d.buf[n:]
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		frames = append(frames, f)
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return frames, lastErr
+}
@@ -0,0 +1,17 @@
+package sl651
+
+// CRC16 多项式0xA001、初值0xFFFF，与CRCModbus相同，但在报文中高字节在前
+func CRC16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,396 @@
+package sl651
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// 要素标识符
+const (
+	// 时间步长码DRxnn，均匀时段报中其后的要素为一组等间隔的数据
+	TimeStep = uint16(0x04)
+	// 瞬时气温
+	AirTemperature = uint16(0x03)
+	// 1小时时段降水量
+	Rainfall1h = uint16(0x1A)
+	// 日降水量
+	DailyRainfall = uint16(0x1F)
+	// 当前降水量
+	CurrentRainfall = uint16(0x20)
+	// 降水量累计值
+	TotalRainfall = uint16(0x26)
+	// 瞬时流量
+	Flow = uint16(0x27)
+	// 电源电压
+	Voltage = uint16(0x38)
+	// 瞬时河道水位
+	WaterLevel = uint16(0x39)
+	// 遥测站状态及报警信息，4字节按位表示
+	Status = uint16(0x45)
+	// 观测时间，标识符和数据定义均为0xF0
+	ObserveTime = uint16(0xF0)
+	// 测站编码，标识符和数据定义均为0xF1
+	StationAddress = uint16(0xF1)
+	// 人工置数，标识符和数据定义均为0xF2，其后至正文结束为人工置数的内容
+	ManualData = uint16(0xF2)
+	// 图片信息，标识符和数据定义均为0xF3，其后至正文结束为图片
+	Picture = uint16(0xF3)
+	// 1小时内每5分钟时段雨量，12个1字节的HEX，单位0.1毫米
+	Rainfall5m = uint16(0xF4)
+	// 1小时内5分钟间隔相对水位1~8，12个2字节的HEX，单位0.01米
+	RelativeLevel5m1 = uint16(0xF5)
+	RelativeLevel5m8 = uint16(0xFC)
+)
+
+// 遥测站分类码
+const (
+	Rainfall     = byte('P')
+	River        = byte('H')
+	Reservoir    = byte('K')
+	Gate         = byte('Z')
+	Pump         = byte('D')
+	Tide         = byte('T')
+	Moisture     = byte('M')
+	Groundwater  = byte('G')
+	WaterQuality = byte('Q')
+	Intake       = byte('I')
+	Outfall      = byte('O')
+)
+
+var (
+	// ASCII编码时不在Elements中的要素
+	UnknownElement = errors.New("unknown sl651 element")
+	InvalidBCD     = errors.New("invalid bcd")
+)
+
+type (
+	// ElementInfo 要素的编码和标准的数据格式
+	ElementInfo struct {
+		// ASCII编码时的标识符
+		Code string
+		Name string
+		Unit string
+		// 字节数和小数位数
+		Length   int
+		Decimals int
+	}
+
+	// Element 一个要素及其数据
+	Element struct {
+		// 单字节标识符，扩展标识符为0xFF00加上第二个字节
+		ID uint16
+		// 数据的字节数，均匀时段报中为每个值的字节数
+		Length   int
+		Decimals int
+		// 数据缺失时为NaN
+		Value float64
+		// 5分钟时段数据和均匀时段报的一组数据
+		Values []float64
+		// 观测时间
+		Time time.Time
+		// 状态及报警信息、人工置数和图片等原始数据
+		Raw []byte
+	}
+)
+
+// Elements 常用要素
+var Elements = map[uint16]ElementInfo{
+	AirTemperature:  {Code: "AI", Name: "瞬时气温", Unit: "℃", Length: 2, Decimals: 1},
+	Rainfall1h:      {Code: "P1", Name: "1小时时段降水量", Unit: "mm", Length: 3, Decimals: 1},
+	DailyRainfall:   {Code: "PD", Name: "日降水量", Unit: "mm", Length: 3, Decimals: 1},
+	CurrentRainfall: {Code: "PJ", Name: "当前降水量", Unit: "mm", Length: 3, Decimals: 1},
+	TotalRainfall:   {Code: "PT", Name: "降水量累计值", Unit: "mm", Length: 3, Decimals: 1},
+	Flow:            {Code: "Q", Name: "瞬时流量", Unit: "m³/s", Length: 5, Decimals: 3},
+	Voltage:         {Code: "VT", Name: "电源电压", Unit: "V", Length: 2, Decimals: 2},
+	WaterLevel:      {Code: "Z", Name: "瞬时河道水位", Unit: "m", Length: 4, Decimals: 3},
+	Status:          {Code: "ZT", Name: "遥测站状态及报警信息", Length: 4},
+	TimeStep:        {Code: "DR", Name: "时间步长码", Length: 3},
+	ObserveTime:     {Code: "TT", Name: "观测时间", Length: 5},
+	StationAddress:  {Code: "ST", Name: "测站编码", Length: 5},
+	Rainfall5m:      {Code: "DRP", Name: "1小时内每5分钟时段雨量", Unit: "mm", Length: 12, Decimals: 1},
+}
+
+func init() {
+	for id := RelativeLevel5m1; id <= RelativeLevel5m8; id++ {
+		n := id - RelativeLevel5m1 + 1
+		Elements[id] = ElementInfo{Code: fmt.Sprintf("DRZ%d", n), Name: fmt.Sprintf("1小时内5分钟间隔相对水位%d", n), Unit: "m", Length: 24, Decimals: 2}
+	}
+}
+
+// 按ASCII标识符查找要素
+func elementByCode(code string) (uint16, ElementInfo, bool) {
+	for id, info := range Elements {
+		if info.Code == code {
+			return id, info, true
+		}
+	}
+	return 0, ElementInfo{}, false
+}
+
+// Info 要素的名称和单位
+func (e Element) Info() ElementInfo {
+	return Elements[e.ID]
+}
+
+// Step 时间步长码对应的时间间隔
+func (e Element) Step() time.Duration {
+	v := int(e.Value)
+	return time.Duration(v/10000)*24*time.Hour + time.Duration(v/100%100)*time.Hour + time.Duration(v%100)*time.Minute
+}
+
+func isSeries(id uint16) bool {
+	return id >= Rainfall5m && id <= RelativeLevel5m8
+}
+
+func fromBCD(b byte) (int, bool) {
+	hi, lo := int(b>>4), int(b&0x0F)
+	return hi*10 + lo, hi <= 9 && lo <= 9
+}
+
+func bcdByte(v int) byte {
+	return byte(v/10<<4 | v%10)
+}
+
+// DecodeBCD 解析BCD数据，首字节为0xFF时为负数，全部为0xFF时表示数据缺失，返回NaN
+func DecodeBCD(b []byte, decimals int) (float64, error) {
+	missing := true
+	for _, v := range b {
+		if v != 0xFF {
+			missing = false
+		}
+	}
+	if missing {
+		return math.NaN(), nil
+	}
+	negative := b[0] == 0xFF
+	if negative {
+		b = b[1:]
+	}
+	var v float64
+	for _, d := range b {
+		n, ok := fromBCD(d)
+		if !ok {
+			return 0, fmt.Errorf("%w: 0x% x", InvalidBCD, b)
+		}
+		v = v*100 + float64(n)
+	}
+	v /= math.Pow10(decimals)
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// EncodeBCD 编码为n字节的BCD，负数首字节为0xFF，NaN编码为全部0xFF
+func EncodeBCD(v float64, n, decimals int) []byte {
+	b := make([]byte, n)
+	if math.IsNaN(v) {
+		for i := range b {
+			b[i] = 0xFF
+		}
+		return b
+	}
+	digits := b
+	if v < 0 {
+		b[0] = 0xFF
+		digits = b[1:]
+		v = -v
+	}
+	x := uint64(math.Round(v * math.Pow10(decimals)))
+	for i := len(digits) - 1; i >= 0; i-- {
+		digits[i] = bcdByte(int(x % 100))
+		x /= 100
+	}
+	return b
+}
+
+// 解析yyMMddHHmm或yyMMddHHmmss
+func decodeTime(b []byte, loc *time.Location) (time.Time, error) {
+	var v [6]int
+	for i, d := range b {
+		n, ok := fromBCD(d)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w: time 0x% x", InvalidBCD, b)
+		}
+		v[i] = n
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return time.Date(2000+v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, loc), nil
+}
+
+func encodeTime(t time.Time, n int) []byte {
+	v := []int{t.Year() % 100, int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second()}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = bcdByte(v[i])
+	}
+	return b
+}
+
+// 解析HEX编码的一组要素
+func decodeElements(b []byte, loc *time.Location) ([]Element, error) {
+	var elements []Element
+	uniform := false
+	for len(b) > 0 {
+		id := uint16(b[0])
+		b = b[1:]
+		if id == 0xFF {
+			if len(b) == 0 {
+				return nil, fmt.Errorf("%w: truncated element", InvalidFrame)
+			}
+			id = 0xFF00 | uint16(b[0])
+			b = b[1:]
+		}
+		if len(b) == 0 {
+			return nil, fmt.Errorf("%w: element 0x%02x without data definition", InvalidFrame, id)
+		}
+		def := b[0]
+		b = b[1:]
+		e := Element{ID: id}
+		switch {
+		case id == ObserveTime && def == 0xF0, id == StationAddress && def == 0xF1:
+			e.Length = 5
+		case id == ManualData && def == 0xF2, id == Picture && def == 0xF3:
+			e.Raw = append([]byte(nil), b...)
+			e.Length = len(b)
+			return append(elements, e), nil
+		default:
+			e.Length, e.Decimals = int(def>>3), int(def&0x07)
+		}
+		if e.Length == 0 || len(b) < e.Length {
+			return nil, fmt.Errorf("%w: element 0x%02x length %d", InvalidFrame, id, e.Length)
+		}
+		data := b[:e.Length]
+		var err error
+		switch {
+		case id == ObserveTime:
+			e.Time, err = decodeTime(data, loc)
+		case id == StationAddress, id == Status:
+			e.Raw = append([]byte(nil), data...)
+		case uniform:
+			// 均匀时段报：时间步长码之后的要素为一组等长的数据，直到正文结束
+			for len(b) >= e.Length {
+				v, err := DecodeBCD(b[:e.Length], e.Decimals)
+				if err != nil {
+					return nil, err
+				}
+				e.Values = append(e.Values, v)
+				b = b[e.Length:]
+			}
+			return append(elements, e), nil
+		case isSeries(id):
+			e.Values = decodeSeries(id, data)
+		default:
+			e.Value, err = DecodeBCD(data, e.Decimals)
+		}
+		if err != nil {
+			return nil, err
+		}
+		uniform = id == TimeStep
+		elements = append(elements, e)
+		b = b[e.Length:]
+	}
+	return elements, nil
+}
+
+// 5分钟时段雨量和相对水位为HEX，全部为0xFF时表示数据缺失
+func decodeSeries(id uint16, data []byte) []float64 {
+	var values []float64
+	if id == Rainfall5m {
+		for _, v := range data {
+			if v == 0xFF {
+				values = append(values, math.NaN())
+			} else {
+				values = append(values, float64(v)/10)
+			}
+		}
+		return values
+	}
+	for i := 0; i+1 < len(data); i += 2 {
+		v := uint16(data[i])<<8 | uint16(data[i+1])
+		if v == 0xFFFF {
+			values = append(values, math.NaN())
+		} else {
+			values = append(values, float64(v)/100)
+		}
+	}
+	return values
+}
+
+func encodeSeries(e Element) []byte {
+	var b []byte
+	for _, v := range e.Values {
+		if e.ID == Rainfall5m {
+			if math.IsNaN(v) {
+				b = append(b, 0xFF)
+			} else {
+				b = append(b, byte(math.Round(v*10)))
+			}
+			continue
+		}
+		x := uint16(0xFFFF)
+		if !math.IsNaN(v) {
+			x = uint16(math.Round(v * 100))
+		}
+		b = append(b, byte(x>>8), byte(x))
+	}
+	return b
+}
+
+// 编码HEX的要素，Length为0时使用Elements中的格式
+func (e Element) hexBytes() ([]byte, error) {
+	var b []byte
+	if e.ID > 0xFF {
+		b = append(b, 0xFF, byte(e.ID))
+	} else {
+		b = append(b, byte(e.ID))
+	}
+	switch {
+	case e.ID == ObserveTime:
+		return append(append(b, 0xF0), encodeTime(e.Time, 5)...), nil
+	case e.ID == StationAddress || e.ID == ManualData || e.ID == Picture:
+		return append(append(b, byte(e.ID)), e.Raw...), nil
+	}
+	length, decimals := e.Length, e.Decimals
+	if length == 0 {
+		info, ok := Elements[e.ID]
+		if !ok {
+			return nil, fmt.Errorf("%w: 0x%02x", UnknownElement, e.ID)
+		}
+		length, decimals = info.Length, info.Decimals
+	}
+	var data []byte
+	switch {
+	case e.ID == Status:
+		data = e.Raw
+		length = len(data)
+	case isSeries(e.ID):
+		data = encodeSeries(e)
+		length = len(data)
+	case len(e.Values) > 0:
+		for _, v := range e.Values {
+			data = append(data, EncodeBCD(v, length, decimals)...)
+		}
+	default:
+		data = EncodeBCD(e.Value, length, decimals)
+	}
+	b = append(b, byte(length<<3|decimals&0x07))
+	return append(b, data...), nil
+}
+
+// 编码ASCII的要素值
+func (e Element) asciiValue() string {
+	if math.IsNaN(e.Value) {
+		return ""
+	}
+	decimals := e.Decimals
+	if e.Length == 0 {
+		decimals = Elements[e.ID].Decimals
+	}
+	return strconv.FormatFloat(e.Value, 'f', decimals, 64)
+}
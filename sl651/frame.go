@@ -0,0 +1,385 @@
+package sl651
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Encoding 报文的编码
+type Encoding uint8
+
+const (
+	// HEX/BCD编码，帧起始符0x7E7E
+	HEX Encoding = iota
+	// ASCII编码，帧起始符SOH
+	ASCII
+)
+
+// 帧起始符、报文起始符和报文结束符
+const (
+	SOH = byte(0x01)
+	STX = byte(0x02)
+	// 多包发送（M3）的报文起始符，其后为包总数及序列号
+	SYN = byte(0x16)
+	// 报文结束，后续无报文
+	ETX = byte(0x03)
+	// 报文结束，后续有报文
+	ETB = byte(0x17)
+	// 询问
+	ENQ = byte(0x05)
+	// 传输结束，退出通信
+	EOT = byte(0x04)
+	// 肯定确认，继续发送
+	ACK = byte(0x06)
+	// 否定应答，反馈重发
+	NAK = byte(0x15)
+	// 传输结束，终端保持在线
+	ESC = byte(0x1B)
+
+	hexStart = byte(0x7E)
+)
+
+// 功能码
+const (
+	KeepAlive          = uint8(0x2F)
+	TestReport         = uint8(0x30)
+	UniformReport      = uint8(0x31)
+	TimedReport        = uint8(0x32)
+	AddedReport        = uint8(0x33)
+	HourlyReport       = uint8(0x34)
+	ManualReport       = uint8(0x35)
+	PictureReport      = uint8(0x36)
+	QueryRealtime      = uint8(0x37)
+	QueryPeriod        = uint8(0x38)
+	QueryManual        = uint8(0x39)
+	QueryElements      = uint8(0x3A)
+	WriteConfig        = uint8(0x40)
+	ReadConfig         = uint8(0x41)
+	WriteParams        = uint8(0x42)
+	ReadParams         = uint8(0x43)
+	QueryPump          = uint8(0x44)
+	QueryVersion       = uint8(0x45)
+	QueryStatus        = uint8(0x46)
+	InitStorage        = uint8(0x47)
+	FactoryReset       = uint8(0x48)
+	ChangePassword     = uint8(0x49)
+	SetClock           = uint8(0x4A)
+	SetICCard          = uint8(0x4B)
+	ControlPump        = uint8(0x4C)
+	ControlValve       = uint8(0x4D)
+	ControlGate        = uint8(0x4E)
+	ControlWaterAmount = uint8(0x4F)
+	QueryEvents        = uint8(0x50)
+	QueryClock         = uint8(0x51)
+)
+
+// Functions 功能码的名称
+var Functions = map[uint8]string{
+	KeepAlive:          "链路维持报",
+	TestReport:         "测试报",
+	UniformReport:      "均匀时段水文信息报",
+	TimedReport:        "遥测站定时报",
+	AddedReport:        "遥测站加报报",
+	HourlyReport:       "遥测站小时报",
+	ManualReport:       "遥测站人工置数报",
+	PictureReport:      "遥测站图片报",
+	QueryRealtime:      "查询遥测站实时数据",
+	QueryPeriod:        "查询遥测站时段数据",
+	QueryManual:        "查询遥测站人工置数",
+	QueryElements:      "查询遥测站指定要素数据",
+	WriteConfig:        "修改遥测站基本配置表",
+	ReadConfig:         "读取遥测站基本配置表",
+	WriteParams:        "修改遥测站运行参数配置表",
+	ReadParams:         "读取遥测站运行参数配置表",
+	QueryPump:          "查询水泵电机实时工作数据",
+	QueryVersion:       "查询遥测终端软件版本",
+	QueryStatus:        "查询遥测站状态和报警信息",
+	InitStorage:        "初始化固态存储数据",
+	FactoryReset:       "恢复终端出厂设置",
+	ChangePassword:     "修改密码",
+	SetClock:           "设置遥测站时钟",
+	SetICCard:          "设置遥测终端IC卡状态",
+	ControlPump:        "控制水泵开关命令",
+	ControlValve:       "控制阀门开关命令",
+	ControlGate:        "控制闸门开关命令",
+	ControlWaterAmount: "水量定值控制命令",
+	QueryEvents:        "查询遥测站事件记录",
+	QueryClock:         "查询遥测站时钟",
+}
+
+// IsReport 是否为遥测站主动上报的报文
+func IsReport(function uint8) bool {
+	return function >= KeepAlive && function <= PictureReport
+}
+
+var (
+	InvalidFrame = errors.New("invalid sl651 frame")
+	CRCError     = errors.New("sl651 crc error")
+)
+
+const (
+	// HEX：帧起始符2、地址6、密码2、功能码1、上下行标识及长度2、报文起始符1
+	hexHeaderLength = 14
+	// ASCII：帧起始符1、地址12、密码4、功能码2、上下行标识及长度4、报文起始符1
+	asciiHeaderLength = 24
+	// 正文长度为12位
+	maxBodyLength = 0x0FFF
+)
+
+// Frame 一帧报文，上行时中心站地址在前，下行时遥测站地址在前
+type Frame struct {
+	Encoding Encoding
+	// 中心站地址
+	Center uint8
+	// 遥测站地址，5字节的十六进制字符串，例如0012345678
+	Remote   string
+	Password uint16
+	Function uint8
+	// 下行报文（中心站发往遥测站）
+	Downlink bool
+	// STX或SYN
+	Start byte
+	// 多包发送的包总数和序列号（从1开始），Start为SYN时有效
+	Total int
+	Seq   int
+	// 报文正文，ASCII编码时为ASCII字符
+	Body []byte
+	// 报文结束符
+	End byte
+}
+
+func (f *Frame) remoteBytes() ([]byte, error) {
+	if len(f.Remote) != 10 {
+		return nil, fmt.Errorf("%w: remote address %q", InvalidFrame, f.Remote)
+	}
+	b := make([]byte, 5)
+	for i := range b {
+		v, err := strconv.ParseUint(f.Remote[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%w: remote address %q", InvalidFrame, f.Remote)
+		}
+		b[i] = byte(v)
+	}
+	return b, nil
+}
+
+// 正文长度，多包发送时包含包总数及序列号
+func (f *Frame) bodyLength() int {
+	n := len(f.Body)
+	if f.Start == SYN {
+		if f.Encoding == ASCII {
+			n += 6
+		} else {
+			n += 3
+		}
+	}
+	return n
+}
+
+func (f *Frame) Bytes() ([]byte, error) {
+	remote, err := f.remoteBytes()
+	if err != nil {
+		return nil, err
+	}
+	n := f.bodyLength()
+	if n > maxBodyLength {
+		return nil, fmt.Errorf("%w: body length %d", InvalidFrame, n)
+	}
+	start := f.Start
+	if start == 0 {
+		start = STX
+	}
+	dirLen := uint16(n)
+	if f.Downlink {
+		dirLen |= 0x8000
+	}
+	if f.Encoding == ASCII {
+		return f.asciiBytes(remote, start, dirLen), nil
+	}
+	b := []byte{hexStart, hexStart}
+	if f.Downlink {
+		b = append(b, remote...)
+		b = append(b, f.Center)
+	} else {
+		b = append(b, f.Center)
+		b = append(b, remote...)
+	}
+	b = append(b, byte(f.Password>>8), byte(f.Password), f.Function, byte(dirLen>>8), byte(dirLen), start)
+	if start == SYN {
+		pkt := uint32(f.Total)<<12 | uint32(f.Seq)&0x0FFF
+		b = append(b, byte(pkt>>16), byte(pkt>>8), byte(pkt))
+	}
+	b = append(b, f.Body...)
+	b = append(b, f.End)
+	crc := CRC16(b)
+	return append(b, byte(crc>>8), byte(crc)), nil
+}
+
+func (f *Frame) asciiBytes(remote []byte, start byte, dirLen uint16) []byte {
+	b := []byte{SOH}
+	center := fmt.Sprintf("%02X", f.Center)
+	if f.Downlink {
+		b = append(b, fmt.Sprintf("%X", remote)+center...)
+	} else {
+		b = append(b, center+fmt.Sprintf("%X", remote)...)
+	}
+	b = append(b, fmt.Sprintf("%04X%02X%04X", f.Password, f.Function, dirLen)...)
+	b = append(b, start)
+	if start == SYN {
+		b = append(b, fmt.Sprintf("%03X%03X", f.Total, f.Seq)...)
+	}
+	b = append(b, f.Body...)
+	b = append(b, f.End)
+	return append(b, fmt.Sprintf("%04X", CRC16(b))...)
+}
+
+// IsFrame 是否为SL 651的报文，用于在Handler中区分不同协议的报文
+func IsFrame(packet []byte) bool {
+	return len(packet) >= 2 && packet[0] == hexStart && packet[1] == hexStart ||
+		len(packet) >= asciiHeaderLength && packet[0] == SOH
+}
+
+// frameLength 根据报文头计算整帧的长度，报文头不完整时返回0
+func frameLength(packet []byte) (int, error) {
+	switch {
+	case len(packet) >= 1 && packet[0] == SOH:
+		if len(packet) < asciiHeaderLength {
+			return 0, nil
+		}
+		v, err := strconv.ParseUint(string(packet[19:23]), 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("%w: length %q", InvalidFrame, packet[19:23])
+		}
+		return asciiHeaderLength + int(v&0x0FFF) + 1 + 4, nil
+	case len(packet) >= 1 && packet[0] == hexStart:
+		if len(packet) < hexHeaderLength {
+			return 0, nil
+		}
+		if packet[1] != hexStart {
+			return 0, InvalidFrame
+		}
+		return hexHeaderLength + int(binary.BigEndian.Uint16(packet[11:])&0x0FFF) + 1 + 2, nil
+	}
+	return 0, InvalidFrame
+}
+
+// NewFrame 解析一帧完整的报文
+func NewFrame(packet []byte) (*Frame, error) {
+	n, err := frameLength(packet)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(packet) != n {
+		return nil, fmt.Errorf("%w: length %d", InvalidFrame, len(packet))
+	}
+	if packet[0] == SOH {
+		return newASCIIFrame(packet)
+	}
+	if crc := binary.BigEndian.Uint16(packet[n-2:]); crc != CRC16(packet[:n-2]) {
+		return nil, fmt.Errorf("%w: got %04X, want %04X", CRCError, crc, CRC16(packet[:n-2]))
+	}
+	f := &Frame{
+		Encoding: HEX,
+		Password: binary.BigEndian.Uint16(packet[8:]),
+		Function: packet[10],
+		Downlink: packet[11]&0x80 != 0,
+		Start:    packet[13],
+		End:      packet[n-3],
+	}
+	if f.Downlink {
+		f.Remote = fmt.Sprintf("%X", packet[2:7])
+		f.Center = packet[7]
+	} else {
+		f.Center = packet[2]
+		f.Remote = fmt.Sprintf("%X", packet[3:8])
+	}
+	body := packet[hexHeaderLength : n-3]
+	if err := f.setBody(body, 3); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func newASCIIFrame(packet []byte) (*Frame, error) {
+	n := len(packet)
+	crc, err := strconv.ParseUint(string(packet[n-4:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: crc %q", InvalidFrame, packet[n-4:])
+	}
+	if uint16(crc) != CRC16(packet[:n-4]) {
+		return nil, fmt.Errorf("%w: got %04X, want %04X", CRCError, crc, CRC16(packet[:n-4]))
+	}
+	fields, err := parseHex(string(packet[13:23]), 4, 2, 4)
+	if err != nil {
+		return nil, err
+	}
+	f := &Frame{
+		Encoding: ASCII,
+		Password: uint16(fields[0]),
+		Function: uint8(fields[1]),
+		Downlink: fields[2]&0x8000 != 0,
+		Start:    packet[23],
+		End:      packet[n-5],
+	}
+	addr := string(packet[1:13])
+	if f.Downlink {
+		addr = addr[10:] + addr[:10]
+	}
+	center, err := parseHex(addr[:2], 2)
+	if err != nil {
+		return nil, err
+	}
+	f.Center = uint8(center[0])
+	f.Remote = addr[2:]
+	if err := f.setBody(packet[asciiHeaderLength:n-5], 6); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 多包发送时从正文中分离包总数及序列号
+func (f *Frame) setBody(body []byte, pktLength int) error {
+	if f.Start != SYN {
+		if f.Start != STX {
+			return fmt.Errorf("%w: start 0x%02x", InvalidFrame, f.Start)
+		}
+		f.Body = append([]byte(nil), body...)
+		return nil
+	}
+	if len(body) < pktLength {
+		return fmt.Errorf("%w: missing packet sequence", InvalidFrame)
+	}
+	var pkt uint32
+	if f.Encoding == ASCII {
+		v, err := parseHex(string(body[:pktLength]), 3, 3)
+		if err != nil {
+			return err
+		}
+		pkt = uint32(v[0])<<12 | uint32(v[1])
+	} else {
+		pkt = uint32(body[0])<<16 | uint32(body[1])<<8 | uint32(body[2])
+	}
+	f.Total = int(pkt >> 12)
+	f.Seq = int(pkt & 0x0FFF)
+	f.Body = append([]byte(nil), body[pktLength:]...)
+	return nil
+}
+
+// 按宽度依次解析十六进制字符
+func parseHex(s string, widths ...int) ([]uint64, error) {
+	values := make([]uint64, 0, len(widths))
+	for _, w := range widths {
+		if len(s) < w {
+			return nil, InvalidFrame
+		}
+		v, err := strconv.ParseUint(s[:w], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", InvalidFrame, s[:w])
+		}
+		values = append(values, v)
+		s = s[w:]
+	}
+	return values, nil
+}
@@ -0,0 +1,230 @@
+package sl651
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report 上行报文的正文：流水号、发报时间、测站编码、分类码、观测时间和要素
+type Report struct {
+	Serial   uint16
+	SendTime time.Time
+	// 遥测站地址，5字节的十六进制字符串
+	Station string
+	// 遥测站分类码，例如Rainfall、River
+	Category    byte
+	ObserveTime time.Time
+	Elements    []Element
+}
+
+// Get 返回第一个标识符为id的要素
+func (r *Report) Get(id uint16) (Element, bool) {
+	for _, e := range r.Elements {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Element{}, false
+}
+
+// ParseReport 解析遥测站上报或者应答查询的正文，链路维持报的正文为空，loc为nil时使用time.Local
+func ParseReport(f *Frame, loc *time.Location) (*Report, error) {
+	if f.Start == SYN && f.Total > 1 {
+		return nil, fmt.Errorf("%w: packet %d/%d not reassembled", InvalidFrame, f.Seq, f.Total)
+	}
+	if len(f.Body) == 0 {
+		return &Report{}, nil
+	}
+	if f.Encoding == ASCII {
+		return parseASCIIReport(string(f.Body), loc)
+	}
+	b := f.Body
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: body length %d", InvalidFrame, len(b))
+	}
+	r := &Report{Serial: uint16(b[0])<<8 | uint16(b[1])}
+	var err error
+	if r.SendTime, err = decodeTime(b[2:8], loc); err != nil {
+		return nil, err
+	}
+	b = b[8:]
+	if len(b) >= 8 && b[0] == 0xF1 && b[1] == 0xF1 {
+		r.Station = fmt.Sprintf("%X", b[2:7])
+		r.Category = b[7]
+		b = b[8:]
+	}
+	if r.Elements, err = decodeElements(b, loc); err != nil {
+		return nil, err
+	}
+	if len(r.Elements) > 0 && r.Elements[0].ID == ObserveTime {
+		r.ObserveTime = r.Elements[0].Time
+		r.Elements = r.Elements[1:]
+	}
+	return r, nil
+}
+
+// ASCII正文以空格分隔：流水号 发报时间 ST 测站编码 分类码 TT 观测时间 标识符 数据 ...
+func parseASCIIReport(body string, loc *time.Location) (*Report, error) {
+	tokens := strings.Fields(body)
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("%w: body %q", InvalidFrame, body)
+	}
+	serial, err := strconv.ParseUint(tokens[0], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: serial %q", InvalidFrame, tokens[0])
+	}
+	r := &Report{Serial: uint16(serial)}
+	if r.SendTime, err = parseASCIITime(tokens[1], loc); err != nil {
+		return nil, err
+	}
+	tokens = tokens[2:]
+	for len(tokens) > 0 {
+		code := tokens[0]
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("%w: element %v without data", InvalidFrame, code)
+		}
+		switch code {
+		case "ST":
+			if len(tokens) < 3 || len(tokens[2]) != 1 {
+				return nil, fmt.Errorf("%w: station", InvalidFrame)
+			}
+			r.Station, r.Category = tokens[1], tokens[2][0]
+			tokens = tokens[3:]
+			continue
+		case "TT":
+			t, err := parseASCIITime(tokens[1], loc)
+			if err != nil {
+				return nil, err
+			}
+			if r.ObserveTime.IsZero() {
+				r.ObserveTime = t
+			} else {
+				r.Elements = append(r.Elements, Element{ID: ObserveTime, Time: t})
+			}
+			tokens = tokens[2:]
+			continue
+		}
+		id, info, ok := elementByCode(code)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", UnknownElement, code)
+		}
+		v, err := strconv.ParseFloat(tokens[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v=%q", InvalidFrame, code, tokens[1])
+		}
+		decimals := 0
+		if i := strings.IndexByte(tokens[1], '.'); i >= 0 {
+			decimals = len(tokens[1]) - i - 1
+		}
+		r.Elements = append(r.Elements, Element{ID: id, Length: info.Length, Decimals: decimals, Value: v})
+		tokens = tokens[2:]
+	}
+	return r, nil
+}
+
+// 解析yyMMddHHmm或yyMMddHHmmss
+func parseASCIITime(s string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	layout := "0601021504"
+	if len(s) == 12 {
+		layout = "060102150405"
+	}
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: time %q", InvalidFrame, s)
+	}
+	return t, nil
+}
+
+// Body 编码为报文正文
+func (r *Report) Body(enc Encoding) ([]byte, error) {
+	if enc == ASCII {
+		return r.asciiBody()
+	}
+	b := []byte{byte(r.Serial >> 8), byte(r.Serial)}
+	b = append(b, encodeTime(r.SendTime, 6)...)
+	if r.Station != "" {
+		station, err := (&Frame{Remote: r.Station}).remoteBytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xF1, 0xF1)
+		b = append(b, station...)
+		b = append(b, r.Category)
+	}
+	if !r.ObserveTime.IsZero() {
+		b = append(b, 0xF0, 0xF0)
+		b = append(b, encodeTime(r.ObserveTime, 5)...)
+	}
+	for _, e := range r.Elements {
+		eb, err := e.hexBytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, eb...)
+	}
+	return b, nil
+}
+
+func (r *Report) asciiBody() ([]byte, error) {
+	tokens := []string{fmt.Sprintf("%04X", r.Serial), r.SendTime.Format("060102150405")}
+	if r.Station != "" {
+		tokens = append(tokens, "ST", r.Station, string(r.Category))
+	}
+	if !r.ObserveTime.IsZero() {
+		tokens = append(tokens, "TT", r.ObserveTime.Format("0601021504"))
+	}
+	for _, e := range r.Elements {
+		if e.ID == ObserveTime {
+			tokens = append(tokens, "TT", e.Time.Format("0601021504"))
+			continue
+		}
+		info, ok := Elements[e.ID]
+		if !ok || isSeries(e.ID) || len(e.Values) > 0 || e.Raw != nil {
+			return nil, fmt.Errorf("%w: 0x%02x in ascii", UnknownElement, e.ID)
+		}
+		tokens = append(tokens, info.Code, e.asciiValue())
+	}
+	return []byte(strings.Join(tokens, " ")), nil
+}
+
+// Serial 正文中的流水号，正文为空时返回0
+func (f *Frame) Serial() uint16 {
+	if f.Encoding == ASCII {
+		if len(f.Body) < 4 {
+			return 0
+		}
+		v, _ := strconv.ParseUint(string(f.Body[:4]), 16, 16)
+		return uint16(v)
+	}
+	if len(f.Body) < 2 {
+		return 0
+	}
+	return uint16(f.Body[0])<<8 | uint16(f.Body[1])
+}
+
+// Confirm 中心站对上行报文的确认，功能码与f相同，正文为f的流水号和发报时间，
+// end通常为EOT（退出通信）、ESC（保持在线），多包发送缺包时为NAK
+func Confirm(f *Frame, end byte, now time.Time) *Frame {
+	r := &Frame{
+		Encoding: f.Encoding,
+		Center:   f.Center,
+		Remote:   f.Remote,
+		Password: f.Password,
+		Function: f.Function,
+		Downlink: true,
+		Start:    STX,
+		End:      end,
+	}
+	serial := f.Serial()
+	if f.Encoding == ASCII {
+		r.Body = []byte(fmt.Sprintf("%04X %s", serial, now.Format("060102150405")))
+	} else {
+		r.Body = append([]byte{byte(serial >> 8), byte(serial)}, encodeTime(now, 6)...)
+	}
+	return r
+}
@@ -0,0 +1,216 @@
+package sl651
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0x4B37 {
+		t.Fatalf("CRC16 = %04X", crc)
+	}
+}
+
+func testReport() *Report {
+	return &Report{
+		Serial:      0x0102,
+		SendTime:    time.Date(2024, 6, 1, 8, 0, 5, 0, time.UTC),
+		Station:     "0012345678",
+		Category:    River,
+		ObserveTime: time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC),
+		Elements: []Element{
+			{ID: WaterLevel, Value: 12.345},
+			{ID: CurrentRainfall, Value: 0.5},
+			{ID: AirTemperature, Value: -3.5},
+			{ID: Voltage, Value: 12.6},
+		},
+	}
+}
+
+func checkReport(t *testing.T, r *Report) {
+	t.Helper()
+	want := testReport()
+	if r.Serial != want.Serial || !r.SendTime.Equal(want.SendTime) || r.Station != want.Station ||
+		r.Category != want.Category || !r.ObserveTime.Equal(want.ObserveTime) || len(r.Elements) != len(want.Elements) {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	for i, e := range want.Elements {
+		if r.Elements[i].ID != e.ID || math.Abs(r.Elements[i].Value-e.Value) > 1e-9 {
+			t.Errorf("element %d = %+v, want %+v", i, r.Elements[i], e)
+		}
+	}
+}
+
+func TestHEXReport(t *testing.T) {
+	body, err := testReport().Body(HEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Frame{Center: 0x01, Remote: "0012345678", Password: 0x1234, Function: TimedReport, Body: body, End: ETX}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsFrame(b) || b[2] != 0x01 || !bytes.Equal(b[3:8], []byte{0x00, 0x12, 0x34, 0x56, 0x78}) {
+		t.Fatalf("unexpected header % x", b[:14])
+	}
+	parsed, err := NewFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Function != TimedReport || parsed.Downlink || parsed.Password != 0x1234 || parsed.End != ETX {
+		t.Fatalf("unexpected frame %+v", parsed)
+	}
+	r, err := ParseReport(parsed, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReport(t, r)
+
+	b[20] ^= 0xFF
+	if _, err := NewFrame(b); err == nil {
+		t.Error("corrupted frame accepted")
+	}
+
+	// 确认报文为下行，遥测站地址在前
+	c, err := Confirm(parsed, EOT, time.Date(2024, 6, 1, 8, 0, 6, 0, time.UTC)).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c[2:8], []byte{0x00, 0x12, 0x34, 0x56, 0x78, 0x01}) || c[11]&0x80 == 0 {
+		t.Fatalf("unexpected confirm % x", c)
+	}
+	cf, err := NewFrame(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.Downlink || cf.Remote != "0012345678" || cf.Center != 0x01 || cf.Serial() != 0x0102 || cf.End != EOT {
+		t.Fatalf("unexpected confirm %+v", cf)
+	}
+}
+
+func TestASCIIReport(t *testing.T) {
+	body, err := testReport().Body(ASCII)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Frame{Encoding: ASCII, Center: 0x01, Remote: "0012345678", Password: 0x1234, Function: TimedReport, Body: body, End: ETX}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("\x01010012345678123432")) {
+		t.Fatalf("unexpected frame %q", b)
+	}
+	parsed, err := NewFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseReport(parsed, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReport(t, r)
+}
+
+func TestUniformReport(t *testing.T) {
+	r := &Report{
+		Serial:      1,
+		SendTime:    time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC),
+		Station:     "0012345678",
+		Category:    Rainfall,
+		ObserveTime: time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC),
+		Elements: []Element{
+			{ID: TimeStep, Value: 100},
+			{ID: WaterLevel, Values: []float64{1.1, 1.2, math.NaN()}},
+		},
+	}
+	body, err := r.Body(HEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseReport(&Frame{Start: STX, Body: body}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, _ := got.Get(TimeStep)
+	if step.Step() != time.Hour {
+		t.Errorf("Step() = %v", step.Step())
+	}
+	level, _ := got.Get(WaterLevel)
+	if len(level.Values) != 3 || level.Values[1] != 1.2 || !math.IsNaN(level.Values[2]) {
+		t.Errorf("Values = %v", level.Values)
+	}
+
+	series := &Report{SendTime: r.SendTime, Elements: []Element{{ID: Rainfall5m, Values: []float64{0, 0.5, 1.2, math.NaN(), 0, 0, 0, 0, 0, 0, 0, 0}}}}
+	body, err = series.Body(HEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ParseReport(&Frame{Start: STX, Body: body}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Elements[0].Values; len(v) != 12 || v[2] != 1.2 || !math.IsNaN(v[3]) {
+		t.Errorf("Rainfall5m = %v", v)
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	body, err := (&Report{
+		Serial:   7,
+		SendTime: time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC),
+		Station:  "0012345678",
+		Category: River,
+		Elements: []Element{{ID: Picture, Raw: bytes.Repeat([]byte{0xAB}, 100)}},
+	}).Body(HEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]byte{body[:40], body[40:80], body[80:]}
+	var stream []byte
+	for i, chunk := range chunks {
+		end := ETB
+		if i == len(chunks)-1 {
+			end = ETX
+		}
+		f := &Frame{Center: 1, Remote: "0012345678", Function: PictureReport, Start: SYN, Total: 3, Seq: i + 1, Body: chunk, End: end}
+		b, err := f.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, b...)
+	}
+
+	// 字节流被任意切分，并且夹杂无效字节
+	var d Decoder
+	var frames []*Frame
+	for _, part := range [][]byte{{0x00, 0x11}, stream[:5], stream[5:60], stream[60:]} {
+		fs, _ := d.Feed(part)
+		frames = append(frames, fs...)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("decoded %d frames", len(frames))
+	}
+
+	a := NewAssembler()
+	if a.Add(frames[2]) != nil || a.Add(frames[0]) != nil {
+		t.Fatal("assembled before all packets received")
+	}
+	if missing := a.Missing("0012345678", PictureReport); len(missing) != 1 || missing[0] != 2 {
+		t.Fatalf("Missing = %v", missing)
+	}
+	merged := a.Add(frames[1])
+	if merged == nil || merged.End != ETX || !bytes.Equal(merged.Body, body) {
+		t.Fatalf("unexpected merged frame %+v", merged)
+	}
+	r, err := ParseReport(merged, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic, ok := r.Get(Picture); !ok || len(pic.Raw) != 100 {
+		t.Errorf("picture = %+v", pic)
+	}
+}
@@ -0,0 +1,274 @@
+package tap
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+
+	// 没有报文时定期发送，用于发现已断开的查看者
+	keepAlive = 30 * time.Second
+)
+
+// ServeHTTP 以WebSocket或者SSE推送报文，请求头包含Upgrade: websocket时使用WebSocket，否则使用SSE。
+// 查询参数：id（可以有多个）、prefix为设备编号的前缀、dir为in或者out
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var filters []Filter
+	if ids := q["id"]; len(ids) > 0 {
+		filters = append(filters, Devices(ids...))
+	}
+	if prefix := q.Get("prefix"); prefix != "" {
+		filters = append(filters, Prefix(prefix))
+	}
+	if dir := q.Get("dir"); dir != "" {
+		filters = append(filters, Direction(dir))
+	}
+	filter := All(filters...)
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.serveWebSocket(w, r, filter)
+		return
+	}
+	h.serveSSE(w, r, filter)
+}
+
+func (h *Hub) serveSSE(w http.ResponseWriter, r *http.Request, filter Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s := h.Subscribe(filter)
+	defer s.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case f := <-s.C:
+			b, err := s.encode(f)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: frame\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *Hub) serveWebSocket(w http.ResponseWriter, r *http.Request, filter Filter) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		return
+	}
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	rwc, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer rwc.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	s := h.Subscribe(filter)
+	defer s.Close()
+
+	// 只处理查看者的关闭和ping，其余消息丢弃
+	closed := make(chan struct{})
+	pings := make(chan []byte, 1)
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := readWSFrame(brw.Reader)
+			if err != nil || op == opClose {
+				return
+			}
+			if op == opPing {
+				select {
+				case pings <- payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			writeWSFrame(brw.Writer, opClose, nil)
+			brw.Flush()
+			return
+		case p := <-pings:
+			err = writeWSFrame(brw.Writer, opPong, p)
+		case <-ticker.C:
+			err = writeWSFrame(brw.Writer, opPing, nil)
+		case f := <-s.C:
+			b, e := s.encode(f)
+			if e != nil {
+				continue
+			}
+			err = writeWSFrame(brw.Writer, opText, b)
+		}
+		if err == nil {
+			err = brw.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 解码并附上该订阅者累计丢弃的报文数量
+func (s *Subscription) encode(f *Frame) ([]byte, error) {
+	out := *f
+	if decode := s.hub.Decode; decode != nil && out.Decoded == nil {
+		out.Decoded = decode(&out)
+	}
+	out.Dropped = s.Dropped()
+	return json.Marshal(&out)
+}
+
+// SameOrigin 允许不带Origin（非浏览器的客户端）或者Origin的主机与请求的Host相同的请求，Hub.CheckOrigin为nil时使用
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Origins 只允许不带Origin或者Origin在列表中的请求，例如Origins("https://ops.example.com")，可以作为Hub.CheckOrigin
+func Origins(origins ...string) func(r *http.Request) bool {
+	set := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		set[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || set[strings.ToLower(origin)]
+	}
+}
+
+// 服务端发送的帧不加掩码
+func writeWSFrame(w *bufio.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch l := len(payload); {
+	case l < 126:
+		header = append(header, byte(l))
+	case l <= 0xffff:
+		header = append(header, 126, byte(l>>8), byte(l))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// 读取查看者发送的一帧，控制帧返回去掉掩码之后的内容，数据帧的内容被丢弃
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	// 控制帧的内容不超过125个字节
+	if op < opClose {
+		_, err := io.CopyN(ioutil.Discard, r, int64(length))
+		return op, nil, err
+	}
+	if length > 125 {
+		return 0, nil, fmt.Errorf("websocket control frame too long: %v", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
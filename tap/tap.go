@@ -0,0 +1,203 @@
+package tap
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ricnsmart/iot-protocol/modbus"
+	"github.com/ricnsmart/iot-protocol/nb"
+)
+
+// 每个订阅者默认缓存的报文数量
+const defaultBuffer = 64
+
+type (
+	// Frame 截获的一个报文
+	Frame struct {
+		Time   time.Time `json:"time"`
+		ID     string    `json:"id"`
+		Remote string    `json:"remote,omitempty"`
+		// 报文的方向，in为设备上行，out为向设备下行
+		Direction string `json:"dir"`
+		Hex       string `json:"hex"`
+		// Hub.Decode解码之后的内容，在推送给查看者时才解码
+		Decoded interface{} `json:"decoded,omitempty"`
+		// 推送该报文时，该订阅者累计丢弃的报文数量
+		Dropped uint64 `json:"dropped,omitempty"`
+
+		Raw []byte `json:"-"`
+	}
+
+	// Filter 返回true的报文才会推送给订阅者
+	Filter func(f *Frame) bool
+
+	// Hub 将Server的报文分发给订阅者，用于调试设备。
+	// 订阅者的缓存已满时丢弃报文并计数，不会阻塞设备的读写
+	Hub struct {
+		// 将报文解码为可读的结构，为nil时只输出十六进制。
+		// 在各个查看者的推送协程中调用，不占用设备读写的时间，可能被并发调用
+		Decode func(f *Frame) interface{}
+
+		// 检查WebSocket握手请求的Origin，返回false时拒绝。
+		// 为nil时只允许不带Origin或者Origin与Host相同的请求，防止其他网页以操作员的身份查看报文
+		CheckOrigin func(r *http.Request) bool
+
+		// 每个订阅者缓存的报文数量，默认64
+		Buffer int
+
+		mu   sync.RWMutex
+		subs map[*Subscription]struct{}
+		// 订阅者数量，为0时Publish直接返回
+		n int32
+	}
+
+	// Subscription 一个订阅者
+	Subscription struct {
+		C <-chan *Frame
+
+		c       chan *Frame
+		filter  Filter
+		dropped uint64
+		hub     *Hub
+		once    sync.Once
+	}
+)
+
+func NewHub() *Hub {
+	return &Hub{
+		Buffer: defaultBuffer,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe 订阅满足filter的报文，filter为nil时订阅所有报文，不再使用时必须调用Close
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	size := h.Buffer
+	if size <= 0 {
+		size = defaultBuffer
+	}
+	c := make(chan *Frame, size)
+	s := &Subscription{C: c, c: c, filter: filter, hub: h}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	atomic.AddInt32(&h.n, 1)
+	return s
+}
+
+// Publish 分发一个报文，不会阻塞
+func (h *Hub) Publish(id, remote, dir string, frame []byte) {
+	if atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+	raw := append([]byte(nil), frame...)
+	f := &Frame{
+		Time:      time.Now(),
+		ID:        id,
+		Remote:    remote,
+		Direction: dir,
+		Hex:       hex.EncodeToString(raw),
+		Raw:       raw,
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if s.filter != nil && !s.filter(f) {
+			continue
+		}
+		select {
+		case s.c <- f:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Modbus 返回可以作为modbus.Server.OnFrame的函数
+func (h *Hub) Modbus() func(c *modbus.Conn, dir modbus.Direction, frame []byte) {
+	return func(c *modbus.Conn, dir modbus.Direction, frame []byte) {
+		h.Publish(c.ID(), c.RemoteAddr(), string(dir), frame)
+	}
+}
+
+// NB 返回可以作为nb.Server.OnFrame的函数
+func (h *Hub) NB() func(c *nb.Conn, dir nb.Direction, frame []byte) {
+	return func(c *nb.Conn, dir nb.Direction, frame []byte) {
+		h.Publish(c.ID(), c.RemoteAddr(), string(dir), frame)
+	}
+}
+
+// Dropped 因缓存已满丢弃的报文数量
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close 取消订阅并关闭C
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		h := s.hub
+		h.mu.Lock()
+		delete(h.subs, s)
+		atomic.AddInt32(&h.n, -1)
+		close(s.c)
+		h.mu.Unlock()
+	})
+}
+
+// Devices 只订阅指定设备的报文
+func Devices(ids ...string) Filter {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return func(f *Frame) bool {
+		return set[f.ID]
+	}
+}
+
+// Direction 只订阅指定方向的报文，dir为in或者out
+func Direction(dir string) Filter {
+	return func(f *Frame) bool {
+		return f.Direction == dir
+	}
+}
+
+// Prefix 只订阅设备编号以prefix开头的报文
+func Prefix(prefix string) Filter {
+	return func(f *Frame) bool {
+		return strings.HasPrefix(f.ID, prefix)
+	}
+}
+
+// All 同时满足所有条件，nil条件会被忽略
+func All(filters ...Filter) Filter {
+	return func(f *Frame) bool {
+		for _, filter := range filters {
+			if filter != nil && !filter(f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DecodeRTU 将报文解码为Modbus RTU帧，可以作为Hub.Decode
+func DecodeRTU(f *Frame) interface{} {
+	frame, err := modbus.NewRTUFrame(f.Raw)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	m := map[string]interface{}{
+		"address":  frame.Address,
+		"function": frame.Function,
+		"data":     hex.EncodeToString(frame.Data),
+	}
+	if e := modbus.GetException(frame); e != modbus.Success {
+		m["exception"] = uint8(e)
+	}
+	return m
+}
@@ -0,0 +1,205 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHub_Publish(t *testing.T) {
+	h := NewHub()
+	h.Buffer = 2
+	// 解码在推送给查看者时进行，不在设备的读写路径上
+	var decoded int32
+	h.Decode = func(f *Frame) interface{} {
+		atomic.AddInt32(&decoded, 1)
+		return nil
+	}
+	s := h.Subscribe(All(Devices("dtu1"), Direction("in")))
+	defer s.Close()
+
+	h.Publish("dtu2", "", "in", []byte{0x01})
+	h.Publish("dtu1", "", "out", []byte{0x02})
+	for i := 0; i < 5; i++ {
+		h.Publish("dtu1", "", "in", []byte{0x03, byte(i)})
+	}
+	if len(s.C) != 2 {
+		t.Fatalf("buffered = %v, want 2", len(s.C))
+	}
+	if s.Dropped() != 3 {
+		t.Fatalf("dropped = %v, want 3", s.Dropped())
+	}
+	if f := <-s.C; f.Hex != "0300" || f.ID != "dtu1" {
+		t.Fatalf("frame = %+v", f)
+	}
+
+	s.Close()
+	if _, ok := <-s.C; !ok {
+		t.Fatal("want buffered frame after close")
+	}
+	// 取消订阅之后不再分发
+	h.Publish("dtu1", "", "in", []byte{0x04})
+	if n := atomic.LoadInt32(&decoded); n != 0 {
+		t.Fatalf("decoded %v frames in Publish", n)
+	}
+}
+
+func TestHub_SSE(t *testing.T) {
+	h := NewHub()
+	h.Decode = DecodeRTU
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?id=dtu1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %v", ct)
+	}
+	waitSubscribed(t, h)
+	h.Publish("dtu2", "", "in", []byte{0x01})
+	h.Publish("dtu1", "127.0.0.1:1", "in", []byte{0x01, 0x83, 0x02, 0xc0, 0xf1})
+
+	r := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	var f struct {
+		ID      string
+		Dir     string
+		Hex     string
+		Decoded map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != "dtu1" || f.Dir != "in" || f.Hex != "018302c0f1" || f.Decoded["exception"] != float64(2) {
+		t.Fatalf("frame = %+v", f)
+	}
+}
+
+func TestHub_WebSocket(t *testing.T) {
+	h := NewHub()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("GET /?dir=out HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake = %v %v", resp.Status, resp.Header)
+	}
+	waitSubscribed(t, h)
+	h.Publish("dtu1", "", "in", []byte{0x01})
+	h.Publish("dtu1", "", "out", []byte{0x02})
+
+	op, payload, err := readServerFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f Frame
+	if op != opText || json.Unmarshal(payload, &f) != nil || f.Direction != "out" || f.Hex != "02" {
+		t.Fatalf("frame = %v %s", op, payload)
+	}
+
+	// 查看者关闭之后取消订阅
+	conn.Write([]byte{0x80 | opClose, 0x80, 0, 0, 0, 0})
+	waitSubscribers(t, h, 0)
+}
+
+func TestHub_WebSocketOrigin(t *testing.T) {
+	h := NewHub()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	handshake := func(origin string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := handshake("https://evil.example.com"); code != http.StatusForbidden {
+		t.Fatalf("cross origin status = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := handshake(srv.URL); code != http.StatusSwitchingProtocols {
+		t.Fatalf("same origin status = %v, want %v", code, http.StatusSwitchingProtocols)
+	}
+
+	h.CheckOrigin = Origins("https://ops.example.com/")
+	if code := handshake("https://ops.example.com"); code != http.StatusSwitchingProtocols {
+		t.Fatalf("allowed origin status = %v, want %v", code, http.StatusSwitchingProtocols)
+	}
+	if code := handshake(srv.URL); code != http.StatusForbidden {
+		t.Fatalf("unlisted origin status = %v, want %v", code, http.StatusForbidden)
+	}
+}
+
+func waitSubscribed(t *testing.T, h *Hub) {
+	waitSubscribers(t, h, 1)
+}
+
+func waitSubscribers(t *testing.T, h *Hub, want int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.mu.RLock()
+		n := len(h.subs)
+		h.mu.RUnlock()
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscribers = %v, want %v", n, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 服务端发送的帧不带掩码，与readWSFrame不同需要保留数据帧的内容
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, header[1]&0x7f)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0f, payload, err
+}